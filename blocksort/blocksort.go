@@ -13,6 +13,7 @@ import (
 	"github.com/jharris2268/osmquadtree/elements"
 
 	"log"
+	"strings"
 	"sync"
 )
 
@@ -68,14 +69,26 @@ type AllocBlockStore interface {
         groups.
  * "tempfileslim": group allocs by groups of 500, (buffered into blocks of 64kb),
         with each written to its own temporary file.
+ * "budget:<mb>" or "budget:<mb>:<tempdir>": hold up to <mb> megabytes of
+        blobs in memory, spilling sorted runs to temporary files in tempdir
+        when this is exceeded (see MakeBudgetAllocBlockStore).
 
 tempfilesplit is the best option for spliting a planet file into blocks,
 tempfileslim is the best option for sorting back to by element id order.
 Temporary files are stored in the current directory, prefixed by
 osmquadtree.blocksort. When spliting/sorting a full planet file (~28gb),
-approximately 40gb of disk space will be used.*/
+approximately 40gb of disk space will be used. The budget store uses a
+predictable amount of memory whatever the size of the input.*/
 func MakeAllocBlockStore(ty string) AllocBlockStore {
 
+	if strings.HasPrefix(ty, "budget:") {
+		mb, td, err := parseBudgetType(ty)
+		if err != nil {
+			panic(err.Error())
+		}
+		return MakeBudgetAllocBlockStore(mb, td)
+	}
+
 	switch ty {
 	case "block":
 		return newMapAllocBlockStore(makeNewSliceBlockStore, nil)
@@ -182,6 +195,54 @@ func SortByTile(
 	return err
 }
 
+/*SortByTileCheckpoint is SortByTile, resumable using cp. If phase has
+been completed the added data is read from the checkpoint, and makeInChans
+is not called (and abs is not used). Otherwise the input channels are
+created with makeInChans, and the data in abs is written to the checkpoint
+before calling ReadData. If cp is nil, this is the same as SortByTile.*/
+func SortByTileCheckpoint(
+	makeInChans func() ([]chan elements.ExtendedBlock, error),
+	addFunc func(elements.ExtendedBlock, chan IdPacked) error,
+	nc int,
+	outputFunc func(int, BlockStoreAllocPair) error,
+	abs AllocBlockStore,
+	cp *Checkpoint, phase string) error {
+
+	if cp.Done(phase) {
+		abs.Finish()
+		var err error
+		abs, err = ReadAllocBlockStore(cp.Path(phase))
+		if err != nil {
+			return err
+		}
+	} else {
+		inChans, err := makeInChans()
+		if err != nil {
+			return err
+		}
+		AddData(abs, inChans, addFunc)
+		if cp != nil {
+			err = WriteAllocBlockStore(abs, cp.Path(phase))
+			if err != nil {
+				return err
+			}
+			err = cp.Complete(phase)
+			if err != nil {
+				return err
+			}
+			// continue from the checkpoint data, freeing abs's temporary files
+			abs.Finish()
+			abs, err = ReadAllocBlockStore(cp.Path(phase))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := ReadData(abs, nc, outputFunc)
+	abs.Finish()
+	return err
+}
+
 type Allocater func(elements.Element) int
 
 func makeByElementId(ipl IdPackedList) elements.ByElementId {
@@ -237,6 +298,33 @@ func SortElementsByAlloc(
 		return SortInMem(inChans, alloc, nc, makeBlock)
 	}
 
+	makeInChans := func() ([]chan elements.ExtendedBlock, error) { return inChans, nil }
+	return SortElementsByAllocCheckpoint(makeInChans, alloc, nc, makeBlock, absType, nil, "")
+}
+
+/*SortElementsByAllocCheckpoint is SortElementsByAlloc, resumable using cp
+(see SortByTileCheckpoint). The input channels are only created (by calling
+makeInChans) if phase has not already been completed. An absType of "inmem"
+cannot be checkpointed: "block" is used instead.*/
+func SortElementsByAllocCheckpoint(
+	makeInChans func() ([]chan elements.ExtendedBlock, error),
+	alloc Allocater,
+	nc int,
+	makeBlock func(int, int, elements.Block) (elements.ExtendedBlock, error),
+	absType string,
+	cp *Checkpoint, phase string) ([]chan elements.ExtendedBlock, error) {
+
+	if absType == "inmem" {
+		if cp == nil {
+			inChans, err := makeInChans()
+			if err != nil {
+				return nil, err
+			}
+			return SortInMem(inChans, alloc, nc, makeBlock)
+		}
+		absType = "block"
+	}
+
 	abs := MakeAllocBlockStore(absType)
 
 	addFunc := func(bl elements.ExtendedBlock, res chan IdPacked) error {
@@ -259,7 +347,7 @@ func SortElementsByAlloc(
 	}
 
 	go func() {
-		err := SortByTile(inChans, addFunc, nc, outputFunc, abs)
+		err := SortByTileCheckpoint(makeInChans, addFunc, nc, outputFunc, abs, cp, phase)
 		if err != nil {
 			log.Println("SortByTile error:", err.Error())
 		}
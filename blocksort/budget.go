@@ -0,0 +1,295 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package blocksort
+
+import (
+	"github.com/jharris2268/osmquadtree/pbffile"
+
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// estimated memory used by each IdPacked, in addition to len(Data)
+const idPackedOverhead = 48
+
+// target size of each (uncompressed) block written to a run file
+const runBlockTarget = 1024 * 1024
+
+//budgetAllocBlockStore: implements AllocBlockStore. Blobs are kept in
+//memory until memBudget is exceeded, when they are sorted by key and
+//spilled to a new temporary file (a "run"). Iter merges the runs.
+
+type budgetAllocBlockStore struct {
+	memBudget int64
+	tempDir   string
+
+	pending   []IdPacked // blobs held in memory
+	pendingSz int64      // estimated size of pending
+
+	runs     []*os.File // sorted runs, each in ascending key order
+	keepRuns bool       // don't remove runs in Finish (see ReadAllocBlockStore)
+
+	keys map[int]int // number of blobs for each key
+	tl   int
+}
+
+/*MakeBudgetAllocBlockStore creates a new AllocBlockStore which holds at
+most (approximately) memBudget bytes of blobs in memory. When this is
+exceeded, the blobs are sorted by key and written to a new temporary file
+in tempDir. Iter merges these sorted runs, so that only one block from each
+run, and the blobs for the current key, are held in memory at once. If
+tempDir is empty, the same location as the other temporary file stores is
+used (the GOPATH environment variable, or the system temporary directory).*/
+func MakeBudgetAllocBlockStore(memBudget int64, tempDir string) AllocBlockStore {
+	if tempDir == "" {
+		tempDir = os.Getenv("GOPATH")
+	}
+	return &budgetAllocBlockStore{memBudget, tempDir, nil, 0, nil, false, map[int]int{}, 0}
+}
+
+/*parseBudgetType parses ty strings of the form "budget:<mb>" or
+"budget:<mb>:<tempdir>"*/
+func parseBudgetType(ty string) (int64, string, error) {
+	pp := strings.SplitN(ty, ":", 3)
+	if len(pp) < 2 || pp[0] != "budget" {
+		return 0, "", fmt.Errorf("expected budget:<mb>[:<tempdir>], not %q", ty)
+	}
+	mb, err := strconv.ParseInt(pp[1], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if mb <= 0 {
+		return 0, "", fmt.Errorf("memory budget must be positive, not %d", mb)
+	}
+	td := ""
+	if len(pp) == 3 {
+		td = pp[2]
+	}
+	return mb * 1024 * 1024, td, nil
+}
+
+func (babs *budgetAllocBlockStore) Add(obj IdPacked) {
+	babs.pending = append(babs.pending, obj)
+	babs.pendingSz += int64(len(obj.Data) + idPackedOverhead)
+	babs.keys[obj.Key]++
+	babs.tl++
+
+	if babs.pendingSz > babs.memBudget {
+		babs.spill()
+	}
+}
+
+func (babs *budgetAllocBlockStore) NumBlocks() int { return len(babs.keys) }
+func (babs *budgetAllocBlockStore) TotalLen() int  { return babs.tl }
+
+/*Flush sorts any blobs still held in memory. They are kept as a final,
+in-memory, run.*/
+func (babs *budgetAllocBlockStore) Flush() {
+	sortIdPackedByKey(babs.pending)
+}
+
+func sortIdPackedByKey(objs []IdPacked) {
+	sort.Stable(sliceIdPackedByKey(objs))
+}
+
+type sliceIdPackedByKey []IdPacked
+
+func (s sliceIdPackedByKey) Len() int           { return len(s) }
+func (s sliceIdPackedByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sliceIdPackedByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+// splitRun groups a sorted slice of blobs into blocks of a single key, of
+// no more than (approximately) runBlockTarget bytes.
+func splitRun(objs []IdPacked) []keyPendingPair {
+	res := make([]keyPendingPair, 0, 16)
+	s, sz := 0, 0
+	for i, o := range objs {
+		if i > s && (o.Key != objs[s].Key || sz > runBlockTarget) {
+			res = append(res, keyPendingPair{objs[s].Key, objs[s:i]})
+			s, sz = i, 0
+		}
+		sz += 10 + len(o.Data)
+	}
+	if s < len(objs) {
+		res = append(res, keyPendingPair{objs[s].Key, objs[s:]})
+	}
+	return res
+}
+
+func (babs *budgetAllocBlockStore) spill() {
+	st := time.Now()
+	sortIdPackedByKey(babs.pending)
+
+	fl, err := ioutil.TempFile(babs.tempDir, "osmquadtree.blocksort.tmp")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// serialize (and compress) blocks in parallel, but write in order
+	bls := splitRun(babs.pending)
+	prepared := make([][]byte, len(bls))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := range next {
+				bb, err := pbffile.PreparePbfFileBlock([]byte("IdPacked"), bls[j].Pack(), true)
+				if err != nil {
+					panic(err.Error())
+				}
+				prepared[j] = bb
+			}
+			wg.Done()
+		}()
+	}
+	for j := range bls {
+		next <- j
+	}
+	close(next)
+	wg.Wait()
+
+	ln := int64(0)
+	for _, p := range prepared {
+		err = pbffile.WriteFileBlock(fl, p)
+		if err != nil {
+			panic(err.Error())
+		}
+		ln += int64(len(p))
+	}
+	fl.Sync()
+	babs.runs = append(babs.runs, fl)
+
+	log.Printf("spilled run %d: %d objs [%d blocks] %8.1fmb in %8.1fs\n",
+		len(babs.runs), len(babs.pending), len(bls), float64(ln)/1024./1024, time.Since(st).Seconds())
+
+	babs.pending = nil
+	babs.pendingSz = 0
+}
+
+// runIter returns each group of blobs from a sorted run
+func runIter(fl *os.File) <-chan keyPendingPair {
+	res := make(chan keyPendingPair)
+	go func() {
+		// open a new handle: ReadPbfFileBlocks closes the file when done
+		rf, err := os.Open(fl.Name())
+		if err != nil {
+			panic(err.Error())
+		}
+		for bl := range pbffile.ReadPbfFileBlocks(rf) {
+			k, oo := unpackObjs(bl.BlockData())
+			res <- keyPendingPair{k, oo}
+		}
+		close(res)
+	}()
+	return res
+}
+
+func memRunIter(objs []IdPacked) <-chan keyPendingPair {
+	res := make(chan keyPendingPair)
+	go func() {
+		for _, b := range splitRun(objs) {
+			res <- b
+		}
+		close(res)
+	}()
+	return res
+}
+
+type runHead struct {
+	curr keyPendingPair
+	iter <-chan keyPendingPair
+	run  int // index of run, to keep blobs with the same key in order
+}
+
+type runHeap []*runHead
+
+func (rh runHeap) Len() int            { return len(rh) }
+func (rh runHeap) Swap(i, j int)       { rh[i], rh[j] = rh[j], rh[i] }
+func (rh runHeap) Less(i, j int) bool {
+	if rh[i].curr.key == rh[j].curr.key {
+		return rh[i].run < rh[j].run
+	}
+	return rh[i].curr.key < rh[j].curr.key
+}
+func (rh *runHeap) Push(x interface{}) { *rh = append(*rh, x.(*runHead)) }
+func (rh *runHeap) Pop() interface{} {
+	o := *rh
+	r := o[len(o)-1]
+	*rh = o[:len(o)-1]
+	return r
+}
+
+/*Iter k-way merges the spilled runs (and any blobs still in memory),
+returning a sliceBlockStore of all the blobs for each key, in ascending key
+order. The blobs for each key are in the order they were added.*/
+func (babs *budgetAllocBlockStore) Iter() <-chan BlockStoreAllocPair {
+
+	iters := make([]<-chan keyPendingPair, 0, len(babs.runs)+1)
+	for _, r := range babs.runs {
+		iters = append(iters, runIter(r))
+	}
+	if len(babs.pending) > 0 {
+		iters = append(iters, memRunIter(babs.pending))
+	}
+
+	hh := make(runHeap, 0, len(iters))
+	for i, it := range iters {
+		if b, ok := <-it; ok {
+			hh = append(hh, &runHead{b, it, i})
+		}
+	}
+	heap.Init(&hh)
+
+	res := make(chan BlockStoreAllocPair)
+	go func() {
+		idx := 0
+		for len(hh) > 0 {
+			key := hh[0].curr.key
+			curr := make([]IdPacked, 0, babs.keys[key])
+			for len(hh) > 0 && hh[0].curr.key == key {
+				// take all blocks with this key from the lowest run
+				h := hh[0]
+				curr = append(curr, h.curr.pending...)
+				b, ok := <-h.iter
+				if ok {
+					h.curr = b
+					heap.Fix(&hh, 0)
+				} else {
+					heap.Pop(&hh)
+				}
+			}
+			res <- BlockStoreAllocPair{key, &sliceBlockStore{curr}, idx}
+			idx++
+		}
+		close(res)
+	}()
+	return res
+}
+
+func (babs *budgetAllocBlockStore) Finish() {
+	for _, r := range babs.runs {
+		r.Close()
+		if babs.keepRuns {
+			continue
+		}
+		err := os.Remove(r.Name())
+		if err != nil {
+			log.Println("os.Remove", r.Name(), "??", err.Error())
+		}
+	}
+	babs.runs = nil
+	babs.pending = nil
+	babs.keys = nil
+}
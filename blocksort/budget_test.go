@@ -0,0 +1,94 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package blocksort
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestParseBudgetType(t *testing.T) {
+	mb, td, err := parseBudgetType("budget:64")
+	if err != nil || mb != 64*1024*1024 || td != "" {
+		t.Errorf("budget:64 => %d %q %v", mb, td, err)
+	}
+	mb, td, err = parseBudgetType("budget:2:/tmp/x")
+	if err != nil || mb != 2*1024*1024 || td != "/tmp/x" {
+		t.Errorf("budget:2:/tmp/x => %d %q %v", mb, td, err)
+	}
+	for _, s := range []string{"budget", "budget:x", "budget:0", "block:5"} {
+		if _, _, err := parseBudgetType(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestBudgetAllocBlockStore(t *testing.T) {
+	dir := t.TempDir()
+	abs := MakeBudgetAllocBlockStore(16*1024, dir)
+
+	// blobs for each key, in the order added
+	expected := map[int][][]byte{}
+	rnd := rand.New(rand.NewSource(17))
+	for i := 0; i < 5000; i++ {
+		k := rnd.Intn(300)
+		d := []byte(fmt.Sprintf("%d:%d", k, i))
+		expected[k] = append(expected[k], d)
+		abs.Add(IdPacked{k, d})
+	}
+	abs.Flush()
+
+	babs := abs.(*budgetAllocBlockStore)
+	if len(babs.runs) < 2 {
+		t.Fatalf("expected data to be spilled to more than one run, have %d", len(babs.runs))
+	}
+	if abs.NumBlocks() != len(expected) || abs.TotalLen() != 5000 {
+		t.Errorf("NumBlocks() = %d, TotalLen() = %d, expected %d, 5000", abs.NumBlocks(), abs.TotalLen(), len(expected))
+	}
+
+	// Iter can be called more than once
+	for pass := 0; pass < 2; pass++ {
+		last, idx, nk := -1, 0, 0
+		for bl := range abs.Iter() {
+			if bl.Alloc <= last {
+				t.Fatalf("pass %d: key %d after %d", pass, bl.Alloc, last)
+			}
+			if bl.Idx != idx {
+				t.Errorf("pass %d: idx %d, expected %d", pass, bl.Idx, idx)
+			}
+			last = bl.Alloc
+			idx++
+			nk++
+
+			all := bl.Block.All()
+			exp := expected[bl.Alloc]
+			if all.Len() != len(exp) {
+				t.Fatalf("pass %d: key %d has %d blobs, expected %d", pass, bl.Alloc, all.Len(), len(exp))
+			}
+			for i := 0; i < all.Len(); i++ {
+				o := all.At(i)
+				if o.Key != bl.Alloc || !bytes.Equal(o.Data, exp[i]) {
+					t.Errorf("pass %d: key %d blob %d: %d %q, expected %q", pass, bl.Alloc, i, o.Key, o.Data, exp[i])
+				}
+			}
+		}
+		if nk != len(expected) {
+			t.Errorf("pass %d: %d keys, expected %d", pass, nk, len(expected))
+		}
+	}
+
+	abs.Finish()
+	ff, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ff) != 0 {
+		t.Errorf("Finish left %d temporary files", len(ff))
+	}
+}
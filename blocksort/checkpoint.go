@@ -0,0 +1,335 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package blocksort
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/pbffile"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*Checkpoint records which phases of a long running job have been
+completed, in the file "state" in a state directory. Each phase can store
+its results in files in the same directory (see Path), which are used to
+resume the job when it is rerun. The key identifies the job (eg. the input
+file name, size and modification time, see FileCheckpointKey): if the
+state directory holds the state of a different job, it is ignored.
+
+A nil *Checkpoint is valid, and does nothing: Done always returns false.*/
+type Checkpoint struct {
+	dir    string
+	key    string
+	done   []string
+	values map[string]int64
+}
+
+/*OpenCheckpoint creates the state directory dir if needed, and reads any
+existing state for the job with the given key.*/
+func OpenCheckpoint(dir string, key string) (*Checkpoint, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{dir, key, nil, map[string]int64{}}
+
+	fl, err := os.Open(cp.statePath())
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+
+	done, values := []string{}, map[string]int64{}
+	sc := bufio.NewScanner(fl)
+	for sc.Scan() {
+		ff := strings.Fields(sc.Text())
+		if len(ff) < 2 {
+			continue
+		}
+		switch ff[0] {
+		case "key":
+			if strings.Join(ff[1:], " ") != key {
+				log.Printf("checkpoint %s: state is for a different job, ignoring\n", dir)
+				return cp, nil
+			}
+		case "done":
+			done = append(done, ff[1])
+		case "value":
+			if len(ff) != 3 {
+				return nil, fmt.Errorf("checkpoint %s: bad line %q", dir, sc.Text())
+			}
+			v, err := strconv.ParseInt(ff[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			values[ff[1]] = v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	cp.done, cp.values = done, values
+	if len(done) > 0 {
+		log.Printf("checkpoint %s: resuming after %s\n", dir, strings.Join(done, ", "))
+	}
+	return cp, nil
+}
+
+/*FileCheckpointKey returns a key identifying the given input files by
+their name, size and modification time*/
+func FileCheckpointKey(fns ...string) (string, error) {
+	pp := make([]string, len(fns))
+	for i, fn := range fns {
+		st, err := os.Stat(fn)
+		if err != nil {
+			return "", err
+		}
+		pp[i] = fmt.Sprintf("%s:%d:%d", fn, st.Size(), st.ModTime().Unix())
+	}
+	return strings.Join(pp, " "), nil
+}
+
+func (cp *Checkpoint) statePath() string {
+	return filepath.Join(cp.dir, "state")
+}
+
+/*Done returns true if phase has been completed*/
+func (cp *Checkpoint) Done(phase string) bool {
+	if cp == nil {
+		return false
+	}
+	for _, d := range cp.done {
+		if d == phase {
+			return true
+		}
+	}
+	return false
+}
+
+/*Path returns the location in the state directory of the file name*/
+func (cp *Checkpoint) Path(name string) string {
+	return filepath.Join(cp.dir, "osmquadtree.checkpoint."+name)
+}
+
+/*SetValue stores a value, which will be written with the next call to
+Complete.*/
+func (cp *Checkpoint) SetValue(name string, v int64) {
+	if cp == nil {
+		return
+	}
+	cp.values[name] = v
+}
+
+func (cp *Checkpoint) Value(name string) (int64, bool) {
+	if cp == nil {
+		return 0, false
+	}
+	v, ok := cp.values[name]
+	return v, ok
+}
+
+/*Complete records that phase has been completed. Any files for the phase
+must have been closed before calling Complete.*/
+func (cp *Checkpoint) Complete(phase string) error {
+	if cp == nil || cp.Done(phase) {
+		return nil
+	}
+	cp.done = append(cp.done, phase)
+
+	lines := []string{"key " + cp.key}
+	for _, d := range cp.done {
+		lines = append(lines, "done "+d)
+	}
+	kk := make([]string, 0, len(cp.values))
+	for k, _ := range cp.values {
+		kk = append(kk, k)
+	}
+	sort.Strings(kk)
+	for _, k := range kk {
+		lines = append(lines, fmt.Sprintf("value %s %d", k, cp.values[k]))
+	}
+
+	// write to temporary file and rename, so state is never left half written
+	tfn := cp.statePath() + ".tmp"
+	err := ioutil.WriteFile(tfn, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("checkpoint %s: completed %s\n", cp.dir, phase)
+	return os.Rename(tfn, cp.statePath())
+}
+
+/*Remove deletes the state and all checkpoint files. Call this when the
+whole job has finished.*/
+func (cp *Checkpoint) Remove() error {
+	if cp == nil {
+		return nil
+	}
+	fns, err := filepath.Glob(filepath.Join(cp.dir, "osmquadtree.checkpoint.*"))
+	if err != nil {
+		return err
+	}
+	fns = append(fns, cp.statePath())
+	for _, fn := range fns {
+		err = os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	cp.done = nil
+	cp.values = map[string]int64{}
+	return nil
+}
+
+/*WriteAllocBlockStore writes all the data in abs to the file fn, in
+ascending key order, with the number of blobs for each key written to
+fn+".keys". Use ReadAllocBlockStore to retrieve the data.*/
+func WriteAllocBlockStore(abs AllocBlockStore, fn string) error {
+	fl, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	keys := make([]uint64, 0, 2*abs.NumBlocks())
+	for bl := range abs.Iter() {
+		all := bl.Block.All()
+		objs := make([]IdPacked, all.Len())
+		for i, _ := range objs {
+			objs[i] = all.At(i)
+			objs[i].Key = bl.Alloc
+		}
+		for _, kp := range splitRun(objs) {
+			bb, err := pbffile.PreparePbfFileBlock([]byte("IdPacked"), kp.Pack(), true)
+			if err != nil {
+				fl.Close()
+				return err
+			}
+			err = pbffile.WriteFileBlock(fl, bb)
+			if err != nil {
+				fl.Close()
+				return err
+			}
+		}
+		keys = append(keys, utils.Zigzag(int64(bl.Alloc)), uint64(len(objs)))
+	}
+	fl.Sync()
+	fl.Close()
+
+	kk, err := utils.PackPackedList(keys)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fn+".keys", kk, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+/*ReadAllocBlockStore returns an AllocBlockStore for the data written by
+WriteAllocBlockStore. The file fn is not removed by Finish.*/
+func ReadAllocBlockStore(fn string) (AllocBlockStore, error) {
+	kk, err := ioutil.ReadFile(fn + ".keys")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := utils.ReadPackedList(kk)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys)%2 != 0 {
+		return nil, errors.New(fn + ".keys: odd number of values")
+	}
+
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	babs := MakeBudgetAllocBlockStore(math.MaxInt64, "").(*budgetAllocBlockStore)
+	babs.runs = []*os.File{fl}
+	babs.keepRuns = true
+	for i := 0; i < len(keys); i += 2 {
+		n := int(keys[i+1])
+		babs.keys[int(utils.UnZigzag(keys[i]))] = n
+		babs.tl += n
+	}
+	return babs, nil
+}
+
+/*BlockFileWriter writes blocks of elements to a checkpoint file.*/
+type BlockFileWriter struct {
+	fn string
+	fl *os.File
+	nb int
+}
+
+/*MakeBlockFileWriter creates a new BlockFileWriter. Data is written to a
+temporary file, which is renamed to fn when Close is called.*/
+func MakeBlockFileWriter(fn string) (*BlockFileWriter, error) {
+	fl, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &BlockFileWriter{fn, fl, 0}, nil
+}
+
+func (bfw *BlockFileWriter) Write(bl elements.Block) error {
+	objs := make([]IdPacked, bl.Len())
+	for i, _ := range objs {
+		objs[i] = IdPacked{bfw.nb, bl.Element(i).Pack()}
+	}
+	bb, err := pbffile.PreparePbfFileBlock([]byte("IdPacked"), packObjs(bfw.nb, objs), true)
+	if err != nil {
+		return err
+	}
+	bfw.nb++
+	return pbffile.WriteFileBlock(bfw.fl, bb)
+}
+
+func (bfw *BlockFileWriter) Close() error {
+	bfw.fl.Sync()
+	err := bfw.fl.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(bfw.fn+".tmp", bfw.fn)
+}
+
+/*ReadBlockFile returns the blocks written by a BlockFileWriter*/
+func ReadBlockFile(fn string) (<-chan elements.ExtendedBlock, error) {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		for bl := range pbffile.ReadPbfFileBlocks(fl) {
+			k, oo := unpackObjs(bl.BlockData())
+			ee := make(elements.ByElementId, len(oo))
+			for i, o := range oo {
+				ee[i] = elements.UnpackElement(o.Data)
+			}
+			res <- elements.MakeExtendedBlock(k, ee, quadtree.Null, 0, 0, nil)
+		}
+		close(res)
+	}()
+	return res, nil
+}
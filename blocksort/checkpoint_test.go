@@ -0,0 +1,259 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package blocksort
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckpointState(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	cp, err := OpenCheckpoint(dir, "job a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Done("one") {
+		t.Errorf("new checkpoint has phase one done")
+	}
+	cp.SetValue("x", -17)
+	if err := cp.Complete("one"); err != nil {
+		t.Fatal(err)
+	}
+
+	cp2, err := OpenCheckpoint(dir, "job a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp2.Done("one") || cp2.Done("two") {
+		t.Errorf("reopened checkpoint: Done(one)=%v Done(two)=%v", cp2.Done("one"), cp2.Done("two"))
+	}
+	if v, ok := cp2.Value("x"); !ok || v != -17 {
+		t.Errorf("reopened checkpoint: Value(x) = %d, %v", v, ok)
+	}
+
+	other, err := OpenCheckpoint(dir, "job b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Done("one") {
+		t.Errorf("checkpoint for a different job has phase one done")
+	}
+
+	if err := os.WriteFile(cp2.Path("one"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp2.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cp2.Path("one")); !os.IsNotExist(err) {
+		t.Errorf("Remove left %s", cp2.Path("one"))
+	}
+	cp3, err := OpenCheckpoint(dir, "job a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp3.Done("one") {
+		t.Errorf("removed checkpoint has phase one done")
+	}
+}
+
+func TestNilCheckpoint(t *testing.T) {
+	var cp *Checkpoint
+	cp.SetValue("x", 1)
+	if cp.Done("one") {
+		t.Errorf("nil checkpoint has phase done")
+	}
+	if _, ok := cp.Value("x"); ok {
+		t.Errorf("nil checkpoint has value")
+	}
+	if cp.Complete("one") != nil || cp.Remove() != nil {
+		t.Errorf("nil checkpoint returned error")
+	}
+}
+
+func TestWriteReadAllocBlockStore(t *testing.T) {
+	dir := t.TempDir()
+	abs := MakeAllocBlockStore("block")
+	for i := 0; i < 1000; i++ {
+		abs.Add(IdPacked{(i * 7) % 31, []byte(fmt.Sprintf("blob %d", i))})
+	}
+	abs.Flush()
+
+	fn := filepath.Join(dir, "abs")
+	if err := WriteAllocBlockStore(abs, fn); err != nil {
+		t.Fatal(err)
+	}
+	rabs, err := ReadAllocBlockStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rabs.NumBlocks() != abs.NumBlocks() || rabs.TotalLen() != abs.TotalLen() {
+		t.Errorf("read %d blocks, %d blobs: expected %d, %d", rabs.NumBlocks(), rabs.TotalLen(), abs.NumBlocks(), abs.TotalLen())
+	}
+
+	expected := map[int]map[string]bool{}
+	for bl := range abs.Iter() {
+		expected[bl.Alloc] = map[string]bool{}
+		all := bl.Block.All()
+		for i := 0; i < all.Len(); i++ {
+			expected[bl.Alloc][string(all.At(i).Data)] = true
+		}
+	}
+	n := 0
+	for bl := range rabs.Iter() {
+		all := bl.Block.All()
+		if all.Len() != len(expected[bl.Alloc]) {
+			t.Errorf("key %d: %d blobs, expected %d", bl.Alloc, all.Len(), len(expected[bl.Alloc]))
+		}
+		for i := 0; i < all.Len(); i++ {
+			if !expected[bl.Alloc][string(all.At(i).Data)] {
+				t.Errorf("key %d: unexpected blob %q", bl.Alloc, all.At(i).Data)
+			}
+			n++
+		}
+	}
+	if n != 1000 {
+		t.Errorf("read %d blobs, expected 1000", n)
+	}
+	rabs.Finish()
+	abs.Finish()
+	if _, err := os.Stat(fn); err != nil {
+		t.Errorf("ReadAllocBlockStore Finish removed %s", fn)
+	}
+}
+
+func TestBlockFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "blocks")
+	bfw, err := MakeBlockFileWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := 0; b < 3; b++ {
+		bl := elements.ByElementId{}
+		for i := 0; i < 10; i++ {
+			id := elements.Ref(b*10 + i + 1)
+			bl = append(bl, elements.MakeNode(id, nil, nil, int64(id)*100, -int64(id)*100, quadtree.Quadtree(id<<5|5), elements.Normal))
+		}
+		if err := bfw.Write(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("%s exists before Close", fn)
+	}
+	if err := bfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blcks, err := ReadBlockFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, id := 0, elements.Ref(1)
+	for bl := range blcks {
+		if bl.Idx() != nb {
+			t.Errorf("block %d has idx %d", nb, bl.Idx())
+		}
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i).(elements.FullNode)
+			if e.Id() != id || e.Lon() != int64(id)*100 || e.Lat() != -int64(id)*100 || e.Quadtree() != quadtree.Quadtree(id<<5|5) {
+				t.Errorf("unexpected element %s", e)
+			}
+			id++
+		}
+		nb++
+	}
+	if nb != 3 || id != 31 {
+		t.Errorf("read %d blocks, %d elements", nb, id-1)
+	}
+}
+
+// testSortByTile runs SortByTileCheckpoint, returning the number of
+// elements for each alloc
+func testSortByTile(cp *Checkpoint, makeInChans func() ([]chan elements.ExtendedBlock, error)) (map[int]int, error) {
+	addFunc := func(bl elements.ExtendedBlock, res chan IdPacked) error {
+		return addToPackedPairBlock(bl, func(e elements.Element) int { return int(e.Id() % 13) }, res)
+	}
+	mu := sync.Mutex{}
+	res := map[int]int{}
+	outputFunc := func(i int, bl BlockStoreAllocPair) error {
+		mu.Lock()
+		defer mu.Unlock()
+		res[bl.Alloc] += bl.Block.Len()
+		return nil
+	}
+	err := SortByTileCheckpoint(makeInChans, addFunc, 2, outputFunc, MakeAllocBlockStore("block"), cp, "sort")
+	return res, err
+}
+
+func TestSortByTileCheckpoint(t *testing.T) {
+	makeInChans := func() ([]chan elements.ExtendedBlock, error) {
+		cc := make([]chan elements.ExtendedBlock, 2)
+		for i := range cc {
+			cc[i] = make(chan elements.ExtendedBlock)
+			go func(i int) {
+				for b := i; b < 10; b += 2 {
+					bl := elements.ByElementId{}
+					for j := 0; j < 100; j++ {
+						bl = append(bl, elements.MakeNode(elements.Ref(b*100+j+1), nil, nil, 0, 0, 0, elements.Normal))
+					}
+					cc[i] <- elements.MakeExtendedBlock(b, bl, quadtree.Null, 0, 0, nil)
+				}
+				close(cc[i])
+			}(i)
+		}
+		return cc, nil
+	}
+
+	expected, err := testSortByTile(nil, makeInChans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cp, err := OpenCheckpoint(dir, "sort test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := testSortByTile(cp, makeInChans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume: the input must not be read again
+	cp, err = OpenCheckpoint(dir, "sort test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done("sort") {
+		t.Fatalf("phase sort not completed")
+	}
+	resumed, err := testSortByTile(cp, func() ([]chan elements.ExtendedBlock, error) {
+		return nil, errors.New("input read when resuming")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, got := range []map[int]int{first, resumed} {
+		if len(got) != len(expected) {
+			t.Errorf("%d allocs, expected %d", len(got), len(expected))
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Errorf("alloc %d: %d elements, expected %d", k, got[k], v)
+			}
+		}
+	}
+}
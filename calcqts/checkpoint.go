@@ -0,0 +1,159 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/blocksort"
+	"github.com/jharris2268/osmquadtree/elements"
+
+	"errors"
+	"log"
+)
+
+// phases of CalcObjectQtsCheckpoint
+const (
+	phaseWayNodes = "calcqts.waynodes"
+	phaseWayQts   = "calcqts.wayqts"
+	phaseNodeQts  = "calcqts.nodeqts"
+	phaseRelQts   = "calcqts.relqts"
+)
+
+func saveQuadtreeStore(qts quadtreeStore, objT elements.ElementType, fn string) error {
+	bfw, err := blocksort.MakeBlockFileWriter(fn)
+	if err != nil {
+		return err
+	}
+	for bl := range qts.ObjsIter(objT, 8000) {
+		err = bfw.Write(bl)
+		if err != nil {
+			return err
+		}
+	}
+	return bfw.Close()
+}
+
+func loadQuadtreeStore(qts quadtreeStore, fn string) (quadtreeStore, error) {
+	blcks, err := blocksort.ReadBlockFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	for bl := range blcks {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i).(elements.FullElement)
+			qts.Set(e.Id(), e.Quadtree())
+		}
+	}
+	return qts, nil
+}
+
+func saveBlock(bl elements.Block, fn string) error {
+	bfw, err := blocksort.MakeBlockFileWriter(fn)
+	if err != nil {
+		return err
+	}
+	err = bfw.Write(bl)
+	if err != nil {
+		return err
+	}
+	return bfw.Close()
+}
+
+func loadBlock(fn string) (elements.Block, error) {
+	blcks, err := blocksort.ReadBlockFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	res := elements.ByElementId{}
+	for bl := range blcks {
+		res = append(res, elements.Elements(bl)...)
+	}
+	return res, nil
+}
+
+// replayBlocks sends blocks stored in a checkpoint file to res, starting at
+// index k. It returns the next index.
+func replayBlocks(fn string, k int, res chan elements.ExtendedBlock) (int, error) {
+	blcks, err := blocksort.ReadBlockFile(fn)
+	if err != nil {
+		return k, err
+	}
+	nb := 0
+	for bl := range blcks {
+		bl.SetIdx(k)
+		res <- bl
+		k++
+		nb++
+	}
+	log.Printf("replayed %d blocks from %s\n", nb, fn)
+	return k, nil
+}
+
+// teeBlocks returns a channel which passes each block to res, and also
+// writes it to a checkpoint file. Call the returned function once the
+// channel has been closed.
+func teeBlocks(fn string, res chan elements.ExtendedBlock) (chan elements.ExtendedBlock, func() error, error) {
+	bfw, err := blocksort.MakeBlockFileWriter(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	tee := make(chan elements.ExtendedBlock)
+	done := make(chan error)
+	go func() {
+		var werr error
+		for bl := range tee {
+			if werr == nil {
+				werr = bfw.Write(bl)
+			}
+			res <- bl
+		}
+		if werr == nil {
+			werr = bfw.Close()
+		}
+		done <- werr
+	}()
+	wait := func() error { return <-done }
+	return tee, wait, nil
+}
+
+// loadWayNodes returns the data saved by the phaseWayNodes checkpoint
+func loadWayNodes(cp *blocksort.Checkpoint) (blocksort.AllocBlockStore, int, elements.Ref, elements.Block, error) {
+	nw, ok := cp.Value("numWays")
+	mw, ok2 := cp.Value("maxWay")
+	if !ok || !ok2 {
+		return nil, 0, 0, nil, errors.New("checkpoint missing numWays or maxWay")
+	}
+	abs, err := blocksort.ReadAllocBlockStore(cp.Path(phaseWayNodes))
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	rels, err := loadBlock(cp.Path(phaseWayNodes + ".rels"))
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	return abs, int(nw), elements.Ref(mw), rels, nil
+}
+
+// saveWayNodes writes the way nodes in abs, and the relations, to the
+// checkpoint. The returned AllocBlockStore reads from the checkpoint file:
+// abs is finished.
+func saveWayNodes(cp *blocksort.Checkpoint, abs blocksort.AllocBlockStore, numWays int, maxWay elements.Ref, rels elements.Block) (blocksort.AllocBlockStore, error) {
+	err := blocksort.WriteAllocBlockStore(abs, cp.Path(phaseWayNodes))
+	if err != nil {
+		return nil, err
+	}
+	err = saveBlock(rels, cp.Path(phaseWayNodes+".rels"))
+	if err != nil {
+		return nil, err
+	}
+	cp.SetValue("numWays", int64(numWays))
+	cp.SetValue("maxWay", int64(maxWay))
+	err = cp.Complete(phaseWayNodes)
+	if err != nil {
+		return nil, err
+	}
+	abs.Finish()
+	return blocksort.ReadAllocBlockStore(cp.Path(phaseWayNodes))
+}
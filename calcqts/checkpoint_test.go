@@ -0,0 +1,178 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/blocksort"
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
+	"github.com/jharris2268/osmquadtree/writefile"
+
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// objKey identifies an element of any type
+type objKey struct {
+	ty elements.ElementType
+	id elements.Ref
+}
+
+// testData returns a grid of 40x40 nodes, 0.05 degrees apart, ways along
+// each row, column and diagonal, and relations of ways, nodes and other
+// relations
+func testData() elements.ByElementId {
+	res := elements.ByElementId{}
+	tags := elements.MakeTags(nil, nil)
+	nid := func(x, y int) elements.Ref { return elements.Ref(y*40 + x + 1) }
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			res = append(res, elements.MakeNode(nid(x, y), nil, tags, int64(x)*500000, 510000000+int64(y)*500000, quadtree.Null, elements.Normal))
+		}
+	}
+	wid := elements.Ref(1)
+	addWay := func(refs []elements.Ref) {
+		res = append(res, elements.MakeWay(wid, nil, tags, refs, quadtree.Null, elements.Normal))
+		wid++
+	}
+	for y := 0; y < 40; y += 3 {
+		for x := 0; x < 36; x += 4 {
+			addWay([]elements.Ref{nid(x, y), nid(x+1, y), nid(x+2, y), nid(x+3, y), nid(x+4, y)})
+		}
+	}
+	for x := 0; x < 40; x += 7 {
+		rr := []elements.Ref{}
+		for y := 0; y < 40; y++ {
+			rr = append(rr, nid(x, y))
+		}
+		addWay(rr)
+	}
+	addWay([]elements.Ref{nid(0, 0), nid(39, 39)})
+
+	rel := func(id elements.Ref, tys []elements.ElementType, refs []elements.Ref) {
+		res = append(res, elements.MakeRelation(id, nil, tags, tys, refs, nil, quadtree.Null, elements.Normal))
+	}
+	rel(1, []elements.ElementType{elements.Way, elements.Way}, []elements.Ref{1, 50})
+	rel(2, []elements.ElementType{elements.Node, elements.Node}, []elements.Ref{nid(3, 3), nid(4, 3)})
+	rel(3, []elements.ElementType{elements.Relation, elements.Node}, []elements.Ref{2, nid(30, 30)})
+	return res
+}
+
+// writeTestFile writes ee to fn, in blocks of 500 elements
+func writeTestFile(t *testing.T, fn string, ee elements.ByElementId) {
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		for i := 0; i*500 < len(ee); i++ {
+			j := (i + 1) * 500
+			if j > len(ee) {
+				j = len(ee)
+			}
+			inc <- elements.MakeExtendedBlock(i, ee[i*500:j], quadtree.Null, 0, 0, nil)
+		}
+		close(inc)
+	}()
+	_, err := writefile.WritePbfFile(readfile.SplitExtendedBlockChans(inc, 4), fn, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func collectQts(inc <-chan elements.ExtendedBlock) map[objKey]quadtree.Quadtree {
+	res := map[objKey]quadtree.Quadtree{}
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			res[objKey{e.Type(), e.Id()}] = e.(elements.Quadtreer).Quadtree()
+		}
+	}
+	return res
+}
+
+func compareQts(t *testing.T, name string, got, expected map[objKey]quadtree.Quadtree) {
+	if len(got) != len(expected) {
+		t.Errorf("%s: %d objects, expected %d", name, len(got), len(expected))
+	}
+	for k, v := range expected {
+		if g, ok := got[k]; !ok || g != v {
+			t.Errorf("%s: %s %d: quadtree %s, expected %s", name, k.ty, k.id, g, v)
+		}
+	}
+}
+
+func TestCalcObjectQtsCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	infn := filepath.Join(dir, "test.pbf")
+	ee := testData()
+	writeTestFile(t, infn, ee)
+
+	calc := func(cp *blocksort.Checkpoint) map[objKey]quadtree.Quadtree {
+		res, err := CalcObjectQtsCheckpoint(infn, 0, "block", 4, false, quadtree.DefaultParams, cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return collectQts(res)
+	}
+
+	expected := calc(nil)
+	if len(expected) != len(ee) {
+		t.Fatalf("calculated %d quadtrees, expected %d", len(expected), len(ee))
+	}
+	// relation 3 contains relation 2
+	r2, r3 := expected[objKey{elements.Relation, 2}], expected[objKey{elements.Relation, 3}]
+	if r3.Common(r2) != r3 {
+		t.Errorf("relation 3 quadtree %s does not contain relation 2 %s", r3, r2)
+	}
+
+	statedir := filepath.Join(dir, "state")
+	cp, err := blocksort.OpenCheckpoint(statedir, "calcqts test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareQts(t, "first run", calc(cp), expected)
+
+	cp, err = blocksort.OpenCheckpoint(statedir, "calcqts test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{phaseWayNodes, phaseWayQts, phaseNodeQts, phaseRelQts} {
+		if !cp.Done(p) {
+			t.Errorf("phase %s not completed", p)
+		}
+	}
+	compareQts(t, "resume all", calc(cp), expected)
+
+	// resume after only the first two phases: remove the others from the
+	// state file, as if the job had been interrupted
+	sfn := filepath.Join(statedir, "state")
+	state, err := ioutil.ReadFile(sfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(state)), "\n") {
+		if l != "done "+phaseNodeQts && l != "done "+phaseRelQts {
+			lines = append(lines, l)
+		}
+	}
+	if err := ioutil.WriteFile(sfn, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cp, err = blocksort.OpenCheckpoint(statedir, "calcqts test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done(phaseWayQts) || cp.Done(phaseNodeQts) {
+		t.Fatalf("unexpected checkpoint state")
+	}
+	compareQts(t, "resume partial", calc(cp), expected)
+
+	if err := cp.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
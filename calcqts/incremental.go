@@ -0,0 +1,619 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/read"
+	"github.com/jharris2268/osmquadtree/readfile"
+
+	"log"
+	"sync"
+	"time"
+)
+
+// objects are identified by type and id packed together, as in the
+// update package
+func incKey(ty elements.ElementType, id elements.Ref) elements.Ref {
+	return (elements.Ref(ty) << 59) | id
+}
+
+func incKeyType(k elements.Ref) elements.ElementType { return elements.ElementType(k >> 59) }
+func incKeyId(k elements.Ref) elements.Ref           { return k & ((1 << 59) - 1) }
+
+// incObj is the version of an object present in the existing file
+type incObj struct {
+	qt       quadtree.Quadtree
+	lon, lat int64
+	refs     []elements.Ref // way node refs, or relation member keys
+}
+
+// a request for blocks of the existing file: if full is false, only blocks
+// with a quadtree which is an ancestor of one of anc, or an ancestor or
+// descendant of one of rel, are read.
+type incScan struct {
+	full     bool
+	anc, rel map[quadtree.Quadtree]bool
+}
+
+func newIncScan() *incScan {
+	return &incScan{false, map[quadtree.Quadtree]bool{}, map[quadtree.Quadtree]bool{}}
+}
+
+func (sc *incScan) empty() bool {
+	return !sc.full && len(sc.anc) == 0 && len(sc.rel) == 0
+}
+
+func (sc *incScan) passQt() func(quadtree.Quadtree) bool {
+	if sc.full {
+		return func(quadtree.Quadtree) bool { return true }
+	}
+	ancs := map[quadtree.Quadtree]bool{}
+	for q, _ := range sc.anc {
+		addAncestors(ancs, q)
+	}
+	for q, _ := range sc.rel {
+		addAncestors(ancs, q)
+	}
+	return func(q quadtree.Quadtree) bool {
+		if ancs[q] {
+			return true
+		}
+		for l := uint(0); l <= uint(q&31); l++ {
+			if sc.rel[q.Round(l)] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func addAncestors(ancs map[quadtree.Quadtree]bool, q quadtree.Quadtree) {
+	if q < 0 {
+		return
+	}
+	for l := uint(0); l <= uint(q&31); l++ {
+		ancs[q.Round(l)] = true
+	}
+}
+
+type incState struct {
+	infn   string
+	nc     int
+	params quadtree.Params
+
+	changes map[elements.Ref]elements.Element
+	file    map[elements.Ref]*incObj
+
+	// requested objects, and objects for which the parents are requested
+	reqObj, reqParents map[elements.Ref]bool
+	// for each node (or member), the file ways (or relations) containing it
+	parents map[elements.Ref][]elements.Ref
+
+	mu sync.Mutex
+}
+
+// CalcObjectQtsIncremental calculates the quadtree values which change
+// when the elements in changes are applied to the existing quadtree
+// annotated file infn. Only the objects affected by the changes are
+// considered: the changed nodes, ways and relations, the ways containing
+// changed nodes, the nodes of these ways, and the relations containing any
+// of these (and so on up to the parent relations). Rather than rereading
+// the whole of infn, after a first pass to find the existing versions of
+// the changed objects, only the blocks which may contain the other
+// affected objects are read. The result has the same form as
+// CalcObjectQts: blocks of elements with only type, id and quadtree, but
+// only includes the changed objects and those with a different quadtree.
+// Deleted objects are not included. The quadtree.Params recorded in the
+// header of infn are used.
+func CalcObjectQtsIncremental(infn string, changes elements.Block, nc int) (<-chan elements.ExtendedBlock, error) {
+	st := time.Now()
+	params, err := readfile.GetQuadtreeParams(infn)
+	if err != nil {
+		return nil, err
+	}
+	is := &incState{infn, nc, params,
+		map[elements.Ref]elements.Element{}, map[elements.Ref]*incObj{},
+		map[elements.Ref]bool{}, map[elements.Ref]bool{},
+		map[elements.Ref][]elements.Ref{}, sync.Mutex{}}
+
+	for i := 0; i < changes.Len(); i++ {
+		e := changes.Element(i)
+		// keep last version of each object
+		is.changes[incKey(e.Type(), e.Id())] = e
+	}
+
+	np := 0
+	for {
+		sc := is.resolve()
+		if sc.empty() {
+			break
+		}
+		np++
+		err = is.scan(sc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("CalcObjectQtsIncremental: %d changes, read %d objects in %d passes: %8.1fs\n",
+		len(is.changes), len(is.file), np, time.Since(st).Seconds())
+
+	qts := is.calculate()
+
+	kk := make(refSlice, 0, len(qts))
+	for k, _ := range qts {
+		kk = append(kk, k)
+	}
+	kk.Sort()
+
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		k := 0
+		bl := make(elements.ByElementId, 0, 8000)
+		for _, o := range kk {
+			bl = append(bl, read.MakeObjQt(incKeyType(o), incKeyId(o), qts[o]))
+			if len(bl) == 8000 {
+				res <- elements.MakeExtendedBlock(k, bl, quadtree.Null, 0, 0, nil)
+				k++
+				bl = make(elements.ByElementId, 0, 8000)
+			}
+		}
+		if len(bl) > 0 {
+			res <- elements.MakeExtendedBlock(k, bl, quadtree.Null, 0, 0, nil)
+		}
+		close(res)
+	}()
+	return res, nil
+}
+
+func (is *incState) isDeleted(k elements.Ref) bool {
+	c, ok := is.changes[k]
+	return ok && c.ChangeType() == elements.Delete
+}
+
+// exists returns true if the object is present after the changes are applied
+func (is *incState) exists(k elements.Ref) bool {
+	if c, ok := is.changes[k]; ok {
+		return c.ChangeType() != elements.Delete
+	}
+	_, ok := is.file[k]
+	return ok
+}
+
+func (is *incState) oldQt(k elements.Ref) quadtree.Quadtree {
+	if f, ok := is.file[k]; ok {
+		return f.qt
+	}
+	return quadtree.Null
+}
+
+// refs returns the current node refs of a way, or member keys of a relation
+func (is *incState) refs(k elements.Ref) []elements.Ref {
+	if c, ok := is.changes[k]; ok {
+		if c.ChangeType() == elements.Delete {
+			return nil
+		}
+		switch incKeyType(k) {
+		case elements.Way:
+			rf := c.(elements.Refs)
+			res := make([]elements.Ref, rf.Len())
+			for i, _ := range res {
+				res[i] = incKey(elements.Node, rf.Ref(i))
+			}
+			return res
+		case elements.Relation:
+			mm := c.(elements.Members)
+			res := make([]elements.Ref, mm.Len())
+			for i, _ := range res {
+				res[i] = incKey(mm.MemberType(i), mm.Ref(i))
+			}
+			return res
+		}
+		return nil
+	}
+	if f, ok := is.file[k]; ok {
+		return f.refs
+	}
+	return nil
+}
+
+func (is *incState) nodeLoc(k elements.Ref) (int64, int64, bool) {
+	if c, ok := is.changes[k]; ok {
+		if c.ChangeType() == elements.Delete {
+			return 0, 0, false
+		}
+		ll := c.(elements.LonLat)
+		return ll.Lon(), ll.Lat(), true
+	}
+	if f, ok := is.file[k]; ok {
+		return f.lon, f.lat, true
+	}
+	return 0, 0, false
+}
+
+// changedWays maps each node to the changed ways which contain it
+func (is *incState) changedWays() map[elements.Ref][]elements.Ref {
+	res := map[elements.Ref][]elements.Ref{}
+	for ck, c := range is.changes {
+		if incKeyType(ck) != elements.Way || c.ChangeType() == elements.Delete {
+			continue
+		}
+		for _, r := range is.refs(ck) {
+			if !containsRef(res[r], ck) {
+				res[r] = append(res[r], ck)
+			}
+		}
+	}
+	return res
+}
+
+// parentsOfType returns the parents of k found in the existing file
+// which have type ty
+func (is *incState) parentsOfType(k elements.Ref, ty elements.ElementType) []elements.Ref {
+	res := make([]elements.Ref, 0, len(is.parents[k]))
+	for _, p := range is.parents[k] {
+		if incKeyType(p) == ty {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// currentWays returns the ways containing node k after the changes are
+// applied
+func (is *incState) currentWays(k elements.Ref, changed map[elements.Ref][]elements.Ref) []elements.Ref {
+	res := make([]elements.Ref, 0, len(is.parents[k])+len(changed[k]))
+	for _, p := range is.parentsOfType(k, elements.Way) {
+		if _, ok := is.changes[p]; !ok {
+			res = append(res, p)
+		}
+	}
+	return append(res, changed[k]...)
+}
+
+// affected finds the ways which need a new bbox, the nodes which need a
+// new quadtree, and the relations which need to be recalculated.
+func (is *incState) affected() (map[elements.Ref]bool, map[elements.Ref]bool, map[elements.Ref]bool) {
+	bboxWays := map[elements.Ref]bool{}
+	qtNodes := map[elements.Ref]bool{}
+	rels := map[elements.Ref]bool{}
+
+	for k, c := range is.changes {
+		switch incKeyType(k) {
+		case elements.Node:
+			if c.ChangeType() != elements.Delete {
+				qtNodes[k] = true
+			}
+			for _, w := range is.parentsOfType(k, elements.Way) {
+				if !is.isDeleted(w) {
+					bboxWays[w] = true
+				}
+			}
+		case elements.Way:
+			if c.ChangeType() != elements.Delete {
+				bboxWays[k] = true
+			}
+			// nodes removed from (or of a deleted) way may have a new qt
+			if f, ok := is.file[k]; ok {
+				for _, n := range f.refs {
+					if !is.isDeleted(n) {
+						qtNodes[n] = true
+					}
+				}
+			}
+		case elements.Relation:
+			if c.ChangeType() != elements.Delete {
+				rels[k] = true
+			}
+		}
+	}
+	for w, _ := range bboxWays {
+		for _, n := range is.refs(w) {
+			if !is.isDeleted(n) {
+				qtNodes[n] = true
+			}
+		}
+	}
+
+	// relation closure: the parents of anything which may have changed
+	// (repeating, like writeRelQts, for nested relations)
+	addParents := func(k elements.Ref) {
+		for _, r := range is.parentsOfType(k, elements.Relation) {
+			if !is.isDeleted(r) {
+				rels[r] = true
+			}
+		}
+	}
+	for k, _ := range is.changes {
+		addParents(k)
+	}
+	for k, _ := range bboxWays {
+		addParents(k)
+	}
+	for k, _ := range qtNodes {
+		addParents(k)
+	}
+	for i := 0; i < 5; i++ {
+		for k, _ := range rels {
+			addParents(k)
+		}
+	}
+	return bboxWays, qtNodes, rels
+}
+
+// resolve finds which information is still needed from the existing file
+func (is *incState) resolve() *incScan {
+	sc := newIncScan()
+
+	thisRound := map[elements.Ref]bool{}
+	reqObj := func(k elements.Ref, loc quadtree.Quadtree, anc bool) {
+		if is.reqObj[k] {
+			return
+		}
+		is.reqObj[k] = true
+		thisRound[k] = true
+		switch {
+		case loc < 0:
+			sc.full = true
+		case anc:
+			sc.anc[loc] = true
+		default:
+			sc.rel[loc] = true
+		}
+	}
+	reqParents := func(k elements.Ref) {
+		if is.reqParents[k] {
+			return
+		}
+		f, ok := is.file[k]
+		switch {
+		case ok:
+			is.reqParents[k] = true
+			if incKeyType(k) == elements.Node {
+				// parent way quadtrees are all within the node quadtree
+				sc.rel[f.qt] = true
+			} else {
+				// parent relation quadtrees all contain the member quadtree
+				sc.anc[f.qt] = true
+			}
+		case is.reqObj[k] && !thisRound[k]:
+			// new (or missing) object: no parents in the existing file
+			is.reqParents[k] = true
+		case !is.reqObj[k]:
+			reqObj(k, quadtree.Null, false)
+			is.reqParents[k] = true
+		case sc.full:
+			// object and parents will be found in this pass
+			is.reqParents[k] = true
+		}
+		// otherwise wait until the object itself has been read
+	}
+
+	// first pass: changed objects, and the objects they refer to
+	for k, _ := range is.changes {
+		reqObj(k, quadtree.Null, false)
+		reqParents(k)
+		for _, r := range is.refs(k) {
+			reqObj(r, quadtree.Null, false)
+		}
+	}
+	if sc.full {
+		return sc
+	}
+
+	// nodes removed from changed ways are in blocks containing the old way
+	for k, _ := range is.changes {
+		if f, ok := is.file[k]; ok && incKeyType(k) == elements.Way {
+			for _, n := range f.refs {
+				reqObj(n, f.qt, true)
+			}
+		}
+	}
+
+	bboxWays, qtNodes, rels := is.affected()
+	for w, _ := range bboxWays {
+		// nodes are all in blocks which contain the way quadtree
+		wq := is.oldQt(w)
+		for _, n := range is.refs(w) {
+			reqObj(n, wq, true)
+		}
+		reqParents(w)
+	}
+	for n, _ := range qtNodes {
+		reqParents(n)
+	}
+	for r, _ := range rels {
+		rq := is.oldQt(r)
+		for _, m := range is.refs(r) {
+			reqObj(m, rq, false)
+		}
+		reqParents(r)
+	}
+	return sc
+}
+
+func (is *incState) scan(sc *incScan) error {
+	st := time.Now()
+	inChans, err := readfile.ReadExtendedBlockMultiMergeQtsSingleFile(is.infn, is.nc, sc.passQt())
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(inChans))
+	nb := 0
+	for _, c := range inChans {
+		go func(c chan elements.ExtendedBlock) {
+			for bl := range c {
+				is.scanBlock(bl)
+				is.mu.Lock()
+				nb++
+				is.mu.Unlock()
+			}
+			wg.Done()
+		}(c)
+	}
+	wg.Wait()
+	log.Printf("CalcObjectQtsIncremental: full=%t [%d, %d], read %d blocks in %8.1fs\n",
+		sc.full, len(sc.anc), len(sc.rel), nb, time.Since(st).Seconds())
+	return nil
+}
+
+func (is *incState) scanBlock(bl elements.ExtendedBlock) {
+	for i := 0; i < bl.Len(); i++ {
+		e := bl.Element(i)
+		if e.ChangeType() == elements.Delete || e.ChangeType() == elements.Remove {
+			continue
+		}
+		k := incKey(e.Type(), e.Id())
+		fe, ok := e.(elements.FullElement)
+		if !ok {
+			continue
+		}
+
+		var refs []elements.Ref
+		switch e.Type() {
+		case elements.Way:
+			rf := e.(elements.Refs)
+			refs = make([]elements.Ref, rf.Len())
+			for j, _ := range refs {
+				refs[j] = incKey(elements.Node, rf.Ref(j))
+			}
+		case elements.Relation:
+			mm := e.(elements.Members)
+			refs = make([]elements.Ref, mm.Len())
+			for j, _ := range refs {
+				refs[j] = incKey(mm.MemberType(j), mm.Ref(j))
+			}
+		}
+
+		is.mu.Lock()
+		keep := is.reqObj[k]
+		for _, r := range refs {
+			if is.reqParents[r] {
+				keep = true
+				if !containsRef(is.parents[r], k) {
+					is.parents[r] = append(is.parents[r], k)
+				}
+			}
+		}
+		if keep {
+			if _, ok := is.file[k]; !ok {
+				o := &incObj{fe.Quadtree(), 0, 0, refs}
+				if ll, ok := e.(elements.LonLat); ok {
+					o.lon, o.lat = ll.Lon(), ll.Lat()
+				}
+				is.file[k] = o
+			}
+		}
+		is.mu.Unlock()
+	}
+}
+
+func containsRef(rr []elements.Ref, r elements.Ref) bool {
+	for _, a := range rr {
+		if a == r {
+			return true
+		}
+	}
+	return false
+}
+
+// calculate finds the new quadtree values of the affected objects,
+// returning those which are new or have changed
+func (is *incState) calculate() map[elements.Ref]quadtree.Quadtree {
+	bboxWays, qtNodes, rels := is.affected()
+
+	newQts := map[elements.Ref]quadtree.Quadtree{}
+	currQt := func(k elements.Ref) quadtree.Quadtree {
+		if q, ok := newQts[k]; ok {
+			return q
+		}
+		return is.oldQt(k)
+	}
+
+	changed := is.changedWays()
+	missing := 0
+	for w, _ := range bboxWays {
+		bx := quadtree.NullBbox()
+		for _, n := range is.refs(w) {
+			ln, lt, ok := is.nodeLoc(n)
+			if !ok {
+				if missing < 10 {
+					log.Printf("missing node %d in way %d\n", incKeyId(n), incKeyId(w))
+				}
+				missing++
+				continue
+			}
+			bx.ExpandXY(ln, lt)
+		}
+		q, _ := is.params.Calculate(*bx)
+		if q < 0 {
+			q = 0
+		}
+		newQts[w] = q
+	}
+
+	for n, _ := range qtNodes {
+		q := quadtree.Null
+		for _, w := range is.currentWays(n, changed) {
+			q = q.Common(currQt(w))
+		}
+		if q < 0 {
+			ln, lt, ok := is.nodeLoc(n)
+			if !ok {
+				missing++
+				continue
+			}
+			q, _ = is.params.CalculatePoint(ln, lt)
+		}
+		newQts[n] = q
+	}
+
+	// as writeRelQts: empty relations have quadtree 0, and repeating five
+	// times gives nested relations a value
+	relMems := map[elements.Ref][]elements.Ref{}
+	for r, _ := range rels {
+		relMems[r] = is.refs(r)
+	}
+	for i := 0; i < 5; i++ {
+		for r, mm := range relMems {
+			q := quadtree.Null
+			for _, m := range mm {
+				if incKeyType(m) == elements.Relation {
+					if _, ok := relMems[m]; ok && i == 0 {
+						continue
+					}
+				}
+				if is.exists(m) {
+					q = q.Common(currQt(m))
+				}
+			}
+			if len(mm) == 0 || q < 0 {
+				q = 0
+			}
+			newQts[r] = q
+		}
+	}
+	if missing > 0 {
+		log.Printf("have %d missing nodes\n", missing)
+	}
+
+	res := map[elements.Ref]quadtree.Quadtree{}
+	for k, q := range newQts {
+		if !is.exists(k) {
+			continue
+		}
+		if f, ok := is.file[k]; ok && f.qt == q {
+			if _, ch := is.changes[k]; !ch {
+				continue
+			}
+		}
+		res[k] = q
+	}
+	return res
+}
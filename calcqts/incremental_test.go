@@ -0,0 +1,168 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
+	"github.com/jharris2268/osmquadtree/writefile"
+
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// withQt returns a copy of e with quadtree qt and change type ct
+func withQt(e elements.Element, qt quadtree.Quadtree, ct elements.ChangeType) elements.Element {
+	switch e.Type() {
+	case elements.Node:
+		n := e.(elements.FullNode)
+		return elements.MakeNode(n.Id(), nil, elements.MakeTags(nil, nil), n.Lon(), n.Lat(), qt, ct)
+	case elements.Way:
+		w := e.(elements.FullWay)
+		refs := make([]elements.Ref, w.Len())
+		for i := range refs {
+			refs[i] = w.Ref(i)
+		}
+		return elements.MakeWay(w.Id(), nil, elements.MakeTags(nil, nil), refs, qt, ct)
+	case elements.Relation:
+		r := e.(elements.FullRelation)
+		return elements.MakeRelationCopy(r.Id(), nil, elements.MakeTags(nil, nil), r, qt, ct)
+	}
+	return nil
+}
+
+// writeQtFile writes ee, with the quadtrees qts, as a quadtree sorted
+// file: elements are grouped into blocks by their quadtree at level 12
+func writeQtFile(t *testing.T, fn string, ee elements.ByElementId, qts map[objKey]quadtree.Quadtree) {
+	tiles := map[quadtree.Quadtree]elements.ByElementId{}
+	for _, e := range ee {
+		q := qts[objKey{e.Type(), e.Id()}]
+		k := q.Round(12)
+		tiles[k] = append(tiles[k], withQt(e, q, elements.Normal))
+	}
+	keys := make(quadtree.QuadtreeSlice, 0, len(tiles))
+	for k, _ := range tiles {
+		keys = append(keys, k)
+	}
+	keys.Sort()
+
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		for i, k := range keys {
+			bl := tiles[k]
+			bl.Sort()
+			inc <- elements.MakeExtendedBlock(i, bl, k, 0, 0, nil)
+		}
+		close(inc)
+	}()
+	_, err := writefile.WritePbfFile(readfile.SplitExtendedBlockChans(inc, 4), fn, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// applyChanges returns the elements of ee, replaced, deleted or added as
+// given by changes
+func applyChanges(ee elements.ByElementId, changes elements.ByElementId) elements.ByElementId {
+	cc := map[objKey]elements.Element{}
+	for _, c := range changes {
+		cc[objKey{c.Type(), c.Id()}] = c
+	}
+	res := elements.ByElementId{}
+	for _, e := range ee {
+		k := objKey{e.Type(), e.Id()}
+		if c, ok := cc[k]; ok {
+			delete(cc, k)
+			if c.ChangeType() != elements.Delete {
+				res = append(res, withQt(c, quadtree.Null, elements.Normal))
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	for _, c := range cc {
+		res = append(res, withQt(c, quadtree.Null, elements.Normal))
+	}
+	sort.Sort(res)
+	return res
+}
+
+func TestCalcObjectQtsIncremental(t *testing.T) {
+	dir := t.TempDir()
+	ee := testData()
+
+	origfn := filepath.Join(dir, "orig.pbf")
+	writeTestFile(t, origfn, ee)
+	res, err := CalcObjectQts(origfn, 0, "block", 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldQts := collectQts(res)
+
+	qtfn := filepath.Join(dir, "orig-qts.pbf")
+	writeQtFile(t, qtfn, ee, oldQts)
+
+	nid := func(x, y int) elements.Ref { return elements.Ref(y*40 + x + 1) }
+	changes := elements.ByElementId{
+		// move a node (in ways 1 and 2, and relation 2) a long way east
+		elements.MakeNode(nid(4, 0), nil, nil, 5*10000000, 510000000, quadtree.Null, elements.Modify),
+		// new node, far to the north
+		elements.MakeNode(5000, nil, nil, 500000, 530000000, quadtree.Null, elements.Create),
+		// delete a way: its nodes are no longer in a way
+		elements.MakeWay(13, nil, nil, nil, quadtree.Null, elements.Delete),
+		// shorten a way
+		elements.MakeWay(20, nil, nil, []elements.Ref{nid(4, 6), nid(5, 6)}, quadtree.Null, elements.Modify),
+		// new way, with the new node
+		elements.MakeWay(500, nil, nil, []elements.Ref{nid(10, 10), 5000}, quadtree.Null, elements.Create),
+		// new relation containing the new way
+		elements.MakeRelation(10, nil, nil, []elements.ElementType{elements.Way, elements.Relation},
+			[]elements.Ref{500, 1}, []string{"", ""}, quadtree.Null, elements.Create),
+	}
+
+	newfn := filepath.Join(dir, "new.pbf")
+	newEE := applyChanges(ee, changes)
+	writeTestFile(t, newfn, newEE)
+	res, err = CalcObjectQts(newfn, 0, "block", 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newQts := collectQts(res)
+
+	res, err = CalcObjectQtsIncremental(qtfn, changes, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incQts := collectQts(res)
+
+	for k, q := range incQts {
+		if nq, ok := newQts[k]; !ok {
+			t.Errorf("%s %d: unexpected object", k.ty, k.id)
+		} else if q != nq {
+			t.Errorf("%s %d: quadtree %s, expected %s", k.ty, k.id, q, nq)
+		}
+	}
+	nc := 0
+	for k, nq := range newQts {
+		if oq, ok := oldQts[k]; ok && oq == nq {
+			continue
+		}
+		nc++
+		if _, ok := incQts[k]; !ok {
+			t.Errorf("%s %d: changed quadtree %s => %s missing", k.ty, k.id, oldQts[k], nq)
+		}
+	}
+	if nc == 0 {
+		t.Errorf("expected changes to alter some quadtrees")
+	}
+	for _, c := range changes {
+		_, ok := incQts[objKey{c.Type(), c.Id()}]
+		if ok != (c.ChangeType() != elements.Delete) {
+			t.Errorf("%s %d [%s]: present in result %v", c.Type(), c.Id(), elements.ChangeTypeString(c.ChangeType()), ok)
+		}
+	}
+}
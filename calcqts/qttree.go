@@ -488,7 +488,7 @@ func findClosestToTarget(qtt *qtTree, i uint32, absmin int64, mn int64, mx int64
         return mm
     }
     if len(mm)!=1 {
-        panic(fmt.Sprintf("?? findClosestToTarget %s",mm))
+        panic(fmt.Sprintf("?? findClosestToTarget %v",mm))
     }
     qtt.Remove(mm[0])
     return mm
@@ -620,7 +620,7 @@ func FindQtGroups(qttin QtTree, target int64, minimum int64) QtTree {
 
 	}
     if nqtt.Get(0).total != origtotal {
-        panic(fmt.Sprintf("?? %s",nqtt))
+        panic(fmt.Sprintf("?? %v",nqtt))
     }
     
 	return nqtt
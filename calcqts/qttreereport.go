@@ -0,0 +1,242 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// QtTreeReportEntry is a leaf of the QtTree found by FindQtTree, with the
+// group (the leaf of the QtTree returned by FindQtGroups) containing it.
+type QtTreeReportEntry struct {
+	QtTreeEntry
+	Group quadtree.Quadtree
+}
+
+// QtTreeHistogramBin counts the groups with a Total of at least Min and
+// less than Max
+type QtTreeHistogramBin struct {
+	Min, Max int64
+	Groups   int
+	Total    int64
+}
+
+// QtTreeReport describes how the leaves of a QtTree are grouped by
+// FindQtGroups. Use this to choose values for target and minimum before
+// sorting a file.
+type QtTreeReport struct {
+	Target, Minimum int64
+	Entries         []QtTreeReportEntry
+	Groups          []QtTreeEntry
+}
+
+// FindQtGroupsReport calls FindQtGroups, also returning a QtTreeReport. As
+// FindQtGroups removes the leaves from qttin, they are copied first.
+func FindQtGroupsReport(qttin QtTree, target int64, minimum int64) (QtTree, *QtTreeReport) {
+	entries := make([]QtTreeEntry, 0, qttin.Len())
+	for e := range qttin.Iter() {
+		entries = append(entries, e)
+	}
+	groups := FindQtGroups(qttin, target, minimum)
+	return groups, MakeQtTreeReport(entries, groups, target, minimum)
+}
+
+// MakeQtTreeReport finds the group in groups for each of entries.
+func MakeQtTreeReport(entries []QtTreeEntry, groups QtTree, target int64, minimum int64) *QtTreeReport {
+	rep := &QtTreeReport{target, minimum, make([]QtTreeReportEntry, len(entries)), nil}
+	for i, e := range entries {
+		rep.Entries[i] = QtTreeReportEntry{e, groups.At(groups.Find(e.Quadtree)).Quadtree}
+	}
+	for g := range groups.Iter() {
+		// Total includes any groups within this one
+		g.Total = g.Count
+		rep.Groups = append(rep.Groups, g)
+	}
+	return rep
+}
+
+// TotalObjects returns the number of objects in all groups
+func (rep *QtTreeReport) TotalObjects() int64 {
+	tl := int64(0)
+	for _, g := range rep.Groups {
+		tl += g.Total
+	}
+	return tl
+}
+
+// Histogram counts the groups by Total, in bins of increasing powers of
+// two.
+func (rep *QtTreeReport) Histogram() []QtTreeHistogramBin {
+	bins := []QtTreeHistogramBin{}
+	for _, g := range rep.Groups {
+		b := 0
+		for v := g.Total; v > 0; v >>= 1 {
+			b++
+		}
+		for len(bins) <= b {
+			mn := int64(0)
+			if len(bins) > 0 {
+				mn = int64(1) << uint(len(bins)-1)
+			}
+			bins = append(bins, QtTreeHistogramBin{mn, int64(1) << uint(len(bins)), 0, 0})
+		}
+		bins[b].Groups++
+		bins[b].Total += g.Total
+	}
+	return bins
+}
+
+// Oversized returns the groups with a Total greater than limit, largest
+// first.
+func (rep *QtTreeReport) Oversized(limit int64) []QtTreeEntry {
+	res := []QtTreeEntry{}
+	for _, g := range rep.Groups {
+		if g.Total > limit {
+			res = append(res, g)
+		}
+	}
+	sort.Sort(entriesByTotal(res))
+	return res
+}
+
+type entriesByTotal []QtTreeEntry
+
+func (e entriesByTotal) Len() int           { return len(e) }
+func (e entriesByTotal) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesByTotal) Less(i, j int) bool { return e[i].Total > e[j].Total }
+
+func (rep *QtTreeReport) groupTotals() map[quadtree.Quadtree]int64 {
+	res := make(map[quadtree.Quadtree]int64, len(rep.Groups))
+	for _, g := range rep.Groups {
+		res[g.Quadtree] = g.Total
+	}
+	return res
+}
+
+// WriteCSV writes one row for each entry, with the columns quadtree, x, y,
+// z, count, total, group and group_total.
+func (rep *QtTreeReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"quadtree", "x", "y", "z", "count", "total", "group", "group_total"})
+	if err != nil {
+		return err
+	}
+	gt := rep.groupTotals()
+	for _, e := range rep.Entries {
+		x, y, z := e.Quadtree.Tuple()
+		err = cw.Write([]string{
+			e.Quadtree.String(),
+			strconv.FormatInt(x, 10), strconv.FormatInt(y, 10), strconv.FormatInt(z, 10),
+			strconv.FormatInt(e.Count, 10), strconv.FormatInt(e.Total, 10),
+			e.Group.String(), strconv.FormatInt(gt[e.Group], 10)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func tileFeature(q quadtree.Quadtree, props map[string]interface{}) map[string]interface{} {
+	bx := q.Bounds(0)
+	mx, my := quadtree.ToFloat(bx.Minx), quadtree.ToFloat(bx.Miny)
+	Mx, My := quadtree.ToFloat(bx.Maxx), quadtree.ToFloat(bx.Maxy)
+	props["quadtree"] = q.String()
+	return map[string]interface{}{
+		"type":       "Feature",
+		"properties": props,
+		"geometry": map[string]interface{}{
+			"type":        "Polygon",
+			"coordinates": [][][]float64{{{mx, my}, {Mx, my}, {Mx, My}, {mx, My}, {mx, my}}},
+		},
+	}
+}
+
+// WriteGeoJSON writes a GeoJSON FeatureCollection with a polygon for the
+// bounds of each entry, with properties count, total, group and
+// group_total. If groups is true, a feature for each group (with
+// properties total and oversized, i.e. greater than twice the target) is
+// written instead.
+func (rep *QtTreeReport) WriteGeoJSON(w io.Writer, groups bool) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"type": "FeatureCollection","features":[` + "\n")
+
+	write := func(i int, f map[string]interface{}) error {
+		bb, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",\n")
+		}
+		_, err = bw.Write(bb)
+		return err
+	}
+
+	if groups {
+		for i, g := range rep.Groups {
+			err := write(i, tileFeature(g.Quadtree, map[string]interface{}{
+				"total":     g.Total,
+				"oversized": g.Total > 2*rep.Target}))
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		gt := rep.groupTotals()
+		for i, e := range rep.Entries {
+			err := write(i, tileFeature(e.Quadtree, map[string]interface{}{
+				"count":       e.Count,
+				"total":       e.Total,
+				"group":       e.Group.String(),
+				"group_total": gt[e.Group]}))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	bw.WriteString("\n]}\n")
+	return bw.Flush()
+}
+
+// WriteSummary writes the number of groups, a histogram of group sizes, and
+// the groups with a total greater than oversize, as text.
+func (rep *QtTreeReport) WriteSummary(w io.Writer, oversize int64) error {
+	bw := bufio.NewWriter(w)
+	tl := rep.TotalObjects()
+	fmt.Fprintf(bw, "target=%d minimum=%d: %d entries, %d groups, %d objects\n",
+		rep.Target, rep.Minimum, len(rep.Entries), len(rep.Groups), tl)
+	if len(rep.Groups) > 0 {
+		fmt.Fprintf(bw, "mean group size %.1f\n", float64(tl)/float64(len(rep.Groups)))
+	}
+
+	fmt.Fprintf(bw, "%-23s %8s %12s %6s\n", "group size", "groups", "objects", "%")
+	for _, b := range rep.Histogram() {
+		if b.Groups == 0 {
+			continue
+		}
+		pc := 0.0
+		if tl > 0 {
+			pc = float64(b.Total) * 100 / float64(tl)
+		}
+		fmt.Fprintf(bw, "%10d - %10d %8d %12d %6.1f\n", b.Min, b.Max-1, b.Groups, b.Total, pc)
+	}
+
+	ov := rep.Oversized(oversize)
+	fmt.Fprintf(bw, "%d groups with more than %d objects\n", len(ov), oversize)
+	for _, g := range ov {
+		fmt.Fprintf(bw, "%-18s %10d\n", g.Quadtree, g.Total)
+	}
+	return bw.Flush()
+}
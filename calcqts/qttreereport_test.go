@@ -0,0 +1,144 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package calcqts
+
+import (
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQtTreeReport(t *testing.T) {
+	qtt := newQtTree(0, 1)
+	rnd := rand.New(rand.NewSource(5))
+	tl := int64(0)
+	for x := int64(2000); x < 2040; x++ {
+		for y := int64(1300); y < 1340; y++ {
+			q, err := quadtree.FromTuple(x, y, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := int64(rnd.Intn(40))
+			if w > 0 {
+				qtt.AddMulti(q, w)
+				tl += w
+			}
+			// objects spanning more than one tile have quadtrees at
+			// lower levels
+			qtt.AddMulti(q.Round(uint(rnd.Intn(12))), 1)
+			tl++
+		}
+	}
+
+	groups, rep := FindQtGroupsReport(qtt, 1000, 200)
+	if rep.TotalObjects() != tl {
+		t.Errorf("TotalObjects() = %d, expected %d", rep.TotalObjects(), tl)
+	}
+	if len(rep.Groups) != qttCount(groups) || len(rep.Groups) < 2 {
+		t.Errorf("%d groups, expected %d (and more than one)", len(rep.Groups), qttCount(groups))
+	}
+
+	// each entry is within its group, and the entries make up the group's
+	// total
+	gt := rep.groupTotals()
+	sums := map[quadtree.Quadtree]int64{}
+	for _, e := range rep.Entries {
+		if e.Quadtree.Common(e.Group) != e.Group {
+			t.Errorf("entry %s not within group %s", e.Quadtree, e.Group)
+		}
+		if _, ok := gt[e.Group]; !ok {
+			t.Errorf("entry %s: unknown group %s", e.Quadtree, e.Group)
+		}
+		sums[e.Group] += e.Count
+	}
+	for g, v := range gt {
+		if sums[g] != v {
+			t.Errorf("group %s: entries sum to %d, expected %d", g, sums[g], v)
+		}
+	}
+
+	hc, ht := 0, int64(0)
+	for _, b := range rep.Histogram() {
+		hc += b.Groups
+		ht += b.Total
+	}
+	if hc != len(rep.Groups) || ht != tl {
+		t.Errorf("histogram has %d groups, %d objects: expected %d, %d", hc, ht, len(rep.Groups), tl)
+	}
+	ov := rep.Oversized(1000)
+	for i, g := range ov {
+		if g.Total <= 1000 || (i > 0 && g.Total > ov[i-1].Total) {
+			t.Errorf("oversized groups %v", ov)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := rep.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(rep.Entries)+1 || rows[0][0] != "quadtree" || rows[0][7] != "group_total" {
+		t.Fatalf("csv has %d rows, header %v", len(rows), rows[0])
+	}
+	for i, e := range rep.Entries {
+		r := rows[i+1]
+		if r[0] != e.Quadtree.String() || r[4] != strconv.FormatInt(e.Count, 10) || r[6] != e.Group.String() || r[7] != strconv.FormatInt(gt[e.Group], 10) {
+			t.Errorf("csv row %v for entry %s", r, e.Quadtree)
+		}
+	}
+
+	for _, isg := range []bool{false, true} {
+		buf.Reset()
+		if err := rep.WriteGeoJSON(&buf, isg); err != nil {
+			t.Fatal(err)
+		}
+		var fc struct {
+			Type     string
+			Features []struct {
+				Properties map[string]interface{}
+				Geometry   struct {
+					Type        string
+					Coordinates [][][]float64
+				}
+			}
+		}
+		if err := json.Unmarshal(buf.Bytes(), &fc); err != nil {
+			t.Fatal(err)
+		}
+		exp := len(rep.Entries)
+		if isg {
+			exp = len(rep.Groups)
+		}
+		if fc.Type != "FeatureCollection" || len(fc.Features) != exp {
+			t.Errorf("geojson %q with %d features, expected %d", fc.Type, len(fc.Features), exp)
+			continue
+		}
+		f := fc.Features[0]
+		if f.Geometry.Type != "Polygon" || len(f.Geometry.Coordinates) != 1 || len(f.Geometry.Coordinates[0]) != 5 {
+			t.Errorf("unexpected geometry %v", f.Geometry)
+		}
+		if _, ok := f.Properties["total"]; !ok {
+			t.Errorf("feature missing total: %v", f.Properties)
+		}
+	}
+
+	buf.Reset()
+	if err := rep.WriteSummary(&buf, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "target=1000 minimum=200:") {
+		t.Errorf("unexpected summary %q", buf.String())
+	}
+}
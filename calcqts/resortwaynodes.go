@@ -607,22 +607,22 @@ func expandWayBoxes(nodeWays nwbs, mw elements.Ref, Mw elements.Ref, storeType i
 	return ans
 }
 
-func calcWayQts(nodeWays nwbs, storeType int, maxWay elements.Ref) (quadtreeStore, error) {
+func calcWayQts(nodeWays nwbs, storeType int, maxWay elements.Ref, params quadtree.Params) (quadtreeStore, error) {
 
 	debug.FreeOSMemory()
 	qts := newQuadtreeStore(storeType > 0)
 	if storeType != 1 {
-		qts = expandWayBoxes(nodeWays /*infn, abs*/, 0, maxWay+1, storeType).Qts(qts, 18, 0.05)
+		qts = expandWayBoxes(nodeWays /*infn, abs*/, 0, maxWay+1, storeType).Qts(qts, params.MaxLevel, params.Buffer)
 
 	} else {
 		//split into three parts: memory use gets too high overwise
 		mp := elements.Ref(500 * tileLen)
 
-		qts = expandWayBoxes(nodeWays /*infn, abs*/, 0, mp, storeType).Qts(qts, 18, 0.05)
+		qts = expandWayBoxes(nodeWays /*infn, abs*/, 0, mp, storeType).Qts(qts, params.MaxLevel, params.Buffer)
 		debug.FreeOSMemory()
-		qts = expandWayBoxes(nodeWays /*infn, abs*/, mp, 2*mp, storeType).Qts(qts, 18, 0.05)
+		qts = expandWayBoxes(nodeWays /*infn, abs*/, mp, 2*mp, storeType).Qts(qts, params.MaxLevel, params.Buffer)
 		debug.FreeOSMemory()
-		qts = expandWayBoxes(nodeWays /*infn, abs*/, mp*2, maxWay+1, storeType).Qts(qts, 18, 0.05)
+		qts = expandWayBoxes(nodeWays /*infn, abs*/, mp*2, maxWay+1, storeType).Qts(qts, params.MaxLevel, params.Buffer)
 	}
 	debug.FreeOSMemory()
 
@@ -637,6 +637,7 @@ func findNodeQts(
 	rels elements.Block,
 	wayQts quadtreeStore,
 	rls quadtreeStore,
+	params quadtree.Params,
 	res chan elements.ExtendedBlock) (int, error) {
 
 	ndrel := map[elements.Ref][]elements.Ref{}
@@ -702,7 +703,7 @@ func findNodeQts(
 			}
 			if q < 0 {
 
-				q, err = quadtree.Calculate(quadtree.Bbox{nwpb.Lon(i), nwpb.Lat(i), nwpb.Lon(i) + 1, nwpb.Lat(i) + 1}, 0.05, 18)
+				q, err = params.CalculatePoint(nwpb.Lon(i), nwpb.Lat(i))
 				if err != nil {
 					panic(err.Error())
 				}
@@ -825,6 +826,23 @@ func writeRelQts(
 
 // Calculate a quadtree value for each entity in infn.
 func CalcObjectQts(infn string, storeType int, tfs string, sp uint, useAlt bool) (<-chan elements.ExtendedBlock, error) {
+	return CalcObjectQtsCheckpoint(infn, storeType, tfs, sp, useAlt, quadtree.DefaultParams, nil)
+}
+
+// CalcObjectQtsCheckpoint is CalcObjectQts, saving the results of each
+// phase (reading way nodes, calculating way, node and relation qts) to cp.
+// When rerun with the same state directory, the completed phases are
+// skipped, and their results read from cp instead. The caller should call
+// cp.Remove() once the whole job is finished. If cp is nil, no checkpoint
+// is used. The quadtree values are calculated with params, which should be
+// recorded in the output file (see writefile.WritePbfFileParams): as the
+// checkpoint data depends on params, they should be included in the
+// checkpoint key.
+func CalcObjectQtsCheckpoint(infn string, storeType int, tfs string, sp uint, useAlt bool, params quadtree.Params, cp *blocksort.Checkpoint) (<-chan elements.ExtendedBlock, error) {
+	err := params.Check()
+	if err != nil {
+		return nil, err
+	}
 
 	stt := time.Now()
 	st := time.Now()
@@ -833,16 +851,28 @@ func CalcObjectQts(infn string, storeType int, tfs string, sp uint, useAlt bool)
 	var rels elements.Block
 	numWays := 0
 	maxWay := elements.Ref(0)
-	var err error
 
 	var abs blocksort.AllocBlockStore
 	if tfs == "" {
 		tfs = "tempfileslim"
 	}
-    
-    abs, numWays, maxWay, rels, err = readWayNodes(infn, 4, tfs, sp)
-	if err != nil {
-		return nil, err
+
+	if cp.Done(phaseWayNodes) {
+		abs, numWays, maxWay, rels, err = loadWayNodes(cp)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		abs, numWays, maxWay, rels, err = readWayNodes(infn, 4, tfs, sp)
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil {
+			abs, err = saveWayNodes(cp, abs, numWays, maxWay, rels)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	nodeWays = makeNwbs(infn, abs, useAlt)
 
@@ -855,7 +885,18 @@ func CalcObjectQts(infn string, storeType int, tfs string, sp uint, useAlt bool)
 	t1 := time.Since(st)
 	st = time.Now()
 
-	wayQts, err := calcWayQts(nodeWays, storeType, maxWay)
+	var wayQts quadtreeStore
+	if cp.Done(phaseWayQts) {
+		wayQts, err = loadQuadtreeStore(newQuadtreeStore(storeType > 0), cp.Path(phaseWayQts))
+	} else {
+		wayQts, err = calcWayQts(nodeWays, storeType, maxWay, params)
+		if err == nil && cp != nil {
+			err = saveQuadtreeStore(wayQts, elements.Way, cp.Path(phaseWayQts))
+			if err == nil {
+				err = cp.Complete(phaseWayQts)
+			}
+		}
+	}
 
 	if err != nil {
 		return nil, err
@@ -865,8 +906,34 @@ func CalcObjectQts(infn string, storeType int, tfs string, sp uint, useAlt bool)
 	res := make(chan elements.ExtendedBlock)
 	go func() {
 		rls := newQuadtreeStore(false)
-
-		k, err := findNodeQts(nodeWays, rels, wayQts, rls, res)
+		k := 0
+		var err error
+		var tee chan elements.ExtendedBlock
+		var wait func() error
+		if cp.Done(phaseNodeQts) {
+			k, err = replayBlocks(cp.Path(phaseNodeQts), k, res)
+			if err == nil {
+				rls, err = loadQuadtreeStore(rls, cp.Path(phaseNodeQts+".rels"))
+			}
+		} else if cp != nil {
+			tee, wait, err = teeBlocks(cp.Path(phaseNodeQts), res)
+			if err != nil {
+				panic(err.Error())
+			}
+			k, err = findNodeQts(nodeWays, rels, wayQts, rls, params, tee)
+			close(tee)
+			if err == nil {
+				err = wait()
+			}
+			if err == nil {
+				err = saveQuadtreeStore(rls, elements.Relation, cp.Path(phaseNodeQts+".rels"))
+			}
+			if err == nil {
+				err = cp.Complete(phaseNodeQts)
+			}
+		} else {
+			k, err = findNodeQts(nodeWays, rels, wayQts, rls, params, res)
+		}
 		if err != nil {
 			panic(err.Error())
 		}
@@ -881,7 +948,24 @@ func CalcObjectQts(infn string, storeType int, tfs string, sp uint, useAlt bool)
 		}
 		t4 := time.Since(st)
 		st = time.Now()
-		k, err = writeRelQts(rls, rels, k, res)
+		if cp.Done(phaseRelQts) {
+			k, err = replayBlocks(cp.Path(phaseRelQts), k, res)
+		} else if cp != nil {
+			tee, wait, err = teeBlocks(cp.Path(phaseRelQts), res)
+			if err != nil {
+				panic(err.Error())
+			}
+			k, err = writeRelQts(rls, rels, k, tee)
+			close(tee)
+			if err == nil {
+				err = wait()
+			}
+			if err == nil {
+				err = cp.Complete(phaseRelQts)
+			}
+		} else {
+			k, err = writeRelQts(rls, rels, k, res)
+		}
 
 		if err != nil {
 			panic(err.Error())
@@ -0,0 +1,204 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package csvfile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ColumnKind is the value written to a Column
+type ColumnKind int
+
+const (
+	IdColumn ColumnKind = iota
+	TypeColumn
+	VersionColumn
+	TimestampColumn
+	ChangesetColumn
+	UidColumn
+	UserColumn
+	QuadtreeColumn
+	LonColumn
+	LatColumn
+	WktColumn
+	TagsColumn
+	TagColumn
+)
+
+// columnNames are the names of each ColumnKind other than TagColumn
+var columnNames = []string{"id", "type", "version", "timestamp", "changeset",
+	"uid", "user", "quadtree", "lon", "lat", "wkt", "tags"}
+
+// Column is a column of the output. Key is the tag key of a TagColumn.
+type Column struct {
+	Kind ColumnKind
+	Key  string
+}
+
+// Name returns the column header: the tag key for a TagColumn, otherwise
+// the name used by ParseColumns.
+func (c Column) Name() string {
+	if c.Kind == TagColumn {
+		return c.Key
+	}
+	if c.Kind < 0 || int(c.Kind) >= len(columnNames) {
+		return "??"
+	}
+	return columnNames[c.Kind]
+}
+
+// ParseColumns reads a comma separated list of columns: id, type, version,
+// timestamp, changeset, uid, user, quadtree, lon, lat, wkt, tags (all
+// tags as a json object) or tag:key (the value of tag key).
+func ParseColumns(spec string) ([]Column, error) {
+	res := []Column{}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "tag:") && len(s) > 4 {
+			res = append(res, Column{TagColumn, s[4:]})
+			continue
+		}
+		k := -1
+		for i, n := range columnNames {
+			if n == s {
+				k = i
+			}
+		}
+		if k < 0 {
+			return nil, errors.New(fmt.Sprintf("unknown column %q", s))
+		}
+		res = append(res, Column{ColumnKind(k), ""})
+	}
+	return res, nil
+}
+
+// formatCoord returns v (in 10^-7 degrees) in degrees, with no more
+// decimal places than needed
+func formatCoord(v int64) string {
+	return strconv.FormatFloat(float64(v)/1e7, 'f', -1, 64)
+}
+
+// elementType returns the element type, or for Geometry elements the
+// geometry type
+func elementType(e elements.Element, g geometry.Geometry) string {
+	if g != nil {
+		return strings.ToLower(g.GeometryType().String())
+	}
+	return strings.ToLower(e.Type().String())
+}
+
+// location returns the lon, lat and wkt of e: lon and lat are only given
+// for nodes and points, wkt for nodes and all geometries
+func location(e elements.Element, g geometry.Geometry) (string, string, string) {
+	if g != nil {
+		if pt, ok := g.(geometry.PointGeometry); ok {
+			c := pt.Coord()
+			return formatCoord(c.Lon()), formatCoord(c.Lat()), g.AsWkt(false)
+		}
+		return "", "", g.AsWkt(false)
+	}
+	if ll, ok := e.(elements.LonLat); ok && e.Type() == elements.Node {
+		ln, lt := formatCoord(ll.Lon()), formatCoord(ll.Lat())
+		return ln, lt, "POINT(" + ln + " " + lt + ")"
+	}
+	return "", "", ""
+}
+
+func textValue(v interface{}) string {
+	s, _ := geometry.Column{Type: geometry.TextColumn}.Value(v).(string)
+	return s
+}
+
+// row returns the values of columns for e. Geometry elements are
+// extracted as g. Tags are read with geometry.TagValue, so tags of
+// geometries with integer or float values are given without the type
+// prefix.
+func row(e elements.Element, g geometry.Geometry, columns []Column, res []string) []string {
+	res = res[:0]
+	var tags elements.Tags
+	var info elements.Info
+	if fe, ok := e.(elements.FullElement); ok {
+		tags = fe.Tags()
+		info = fe.Info()
+	}
+
+	var tagVals map[string]interface{}
+	lon, lat, wkt := "", "", ""
+	hasLoc := false
+	for _, c := range columns {
+		switch c.Kind {
+		case TagColumn, TagsColumn:
+			if tagVals == nil {
+				tagVals = map[string]interface{}{}
+				for i := 0; tags != nil && i < tags.Len(); i++ {
+					k, v := geometry.TagValue(tags, i)
+					if k != "" {
+						tagVals[k] = v
+					}
+				}
+			}
+		case LonColumn, LatColumn, WktColumn:
+			if !hasLoc {
+				lon, lat, wkt = location(e, g)
+				hasLoc = true
+			}
+		}
+	}
+
+	for _, c := range columns {
+		v := ""
+		switch c.Kind {
+		case IdColumn:
+			v = strconv.FormatInt(int64(e.Id()), 10)
+		case TypeColumn:
+			v = elementType(e, g)
+		case VersionColumn:
+			if info != nil {
+				v = strconv.FormatInt(info.Version(), 10)
+			}
+		case TimestampColumn:
+			if info != nil {
+				v = info.Timestamp().String()
+			}
+		case ChangesetColumn:
+			if info != nil {
+				v = strconv.FormatInt(int64(info.Changeset()), 10)
+			}
+		case UidColumn:
+			if info != nil {
+				v = strconv.FormatInt(info.Uid(), 10)
+			}
+		case UserColumn:
+			if info != nil {
+				v = info.User()
+			}
+		case QuadtreeColumn:
+			if qt, ok := e.(elements.Quadtreer); ok && qt.Quadtree() >= 0 {
+				v = qt.Quadtree().String()
+			}
+		case LonColumn:
+			v = lon
+		case LatColumn:
+			v = lat
+		case WktColumn:
+			v = wkt
+		case TagsColumn:
+			js, _ := json.Marshal(tagVals)
+			v = string(js)
+		case TagColumn:
+			v = textValue(tagVals[c.Key])
+		}
+		res = append(res, v)
+	}
+	return res
+}
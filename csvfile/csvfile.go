@@ -0,0 +1,162 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package csvfile writes elements, or geometries, to CSV or TSV files, with
+// a selectable list of columns.
+package csvfile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Options describe the file written. If Comma is zero, fields are
+// separated by tabs if the filename ends with .tsv (or .tsv.gz), otherwise
+// by commas. If Header is set the first row gives the name of each column.
+type Options struct {
+	Columns []Column
+	Comma   rune
+	Header  bool
+}
+
+func (opts Options) comma(outfn string) rune {
+	if opts.Comma != 0 {
+		return opts.Comma
+	}
+	if strings.HasSuffix(strings.TrimSuffix(outfn, ".gz"), ".tsv") {
+		return '\t'
+	}
+	return ','
+}
+
+// blockRows are the rows for a block
+type blockRows struct {
+	idx  int
+	data []byte
+	num  int
+	err  error
+}
+
+func encodeBlock(bl elements.ExtendedBlock, columns []Column, comma rune) blockRows {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = comma
+	rr := make([]string, 0, len(columns))
+	for i := 0; i < bl.Len(); i++ {
+		e := bl.Element(i)
+		var g geometry.Geometry
+		if e.Type() == elements.Geometry {
+			var err error
+			g, err = geometry.ExtractGeometry(e)
+			if err != nil {
+				return blockRows{bl.Idx(), nil, 0, err}
+			}
+		}
+		rr = row(e, g, columns, rr)
+		w.Write(rr)
+	}
+	w.Flush()
+	return blockRows{bl.Idx(), buf.Bytes(), bl.Len(), w.Error()}
+}
+
+// WriteCsv writes each element of inchans to outfn (compressed if outfn
+// ends with .gz), one row per element, with the values given by
+// opts.Columns. Geometry elements may be mixed with other elements. The
+// blocks of each channel are converted in parallel, and written in the
+// order given by reading from each channel in turn, as for
+// readfile.CollectExtendedBlockChans (so the blocks of a file read with
+// readfile.ReadExtendedBlockMulti are written in order). Returns the
+// number of rows written, not including the header.
+func WriteCsv(inchans []chan elements.ExtendedBlock, outfn string, opts Options) (int, error) {
+	comma := opts.comma(outfn)
+
+	outf, err := os.OpenFile(outfn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return 0, err
+	}
+	defer outf.Close()
+	outb := bufio.NewWriter(outf)
+	var outw io.Writer = outb
+	var outgz *gzip.Writer
+	if strings.HasSuffix(outfn, ".gz") {
+		outgz = gzip.NewWriter(outb)
+		outw = outgz
+	}
+
+	if opts.Header {
+		hw := csv.NewWriter(outw)
+		hw.Comma = comma
+		names := make([]string, len(opts.Columns))
+		for i, c := range opts.Columns {
+			names[i] = c.Name()
+		}
+		hw.Write(names)
+		hw.Flush()
+		if err := hw.Error(); err != nil {
+			return 0, err
+		}
+	}
+
+	rows := make([]chan blockRows, len(inchans))
+	for i := range inchans {
+		rows[i] = make(chan blockRows, 5)
+		go func(i int) {
+			for bl := range inchans[i] {
+				rows[i] <- encodeBlock(bl, opts.Columns, comma)
+			}
+			close(rows[i])
+		}(i)
+	}
+
+	var resErr error
+	nr, tb := 0, 0
+	nc := len(rows)
+	rem := nc
+	closed := make([]bool, nc)
+	for i := 0; rem > 0; i++ {
+		if closed[i%nc] {
+			continue
+		}
+		br, ok := <-rows[i%nc]
+		if !ok {
+			closed[i%nc] = true
+			rem--
+			continue
+		}
+		if resErr != nil {
+			continue
+		}
+		if br.err != nil {
+			resErr = br.err
+			continue
+		}
+		_, resErr = outw.Write(br.data)
+		nr += br.num
+		tb += len(br.data)
+		if (br.idx % 100) == 0 {
+			log.Printf("%-6d: %d rows, %10.1f mb\n", br.idx, nr, float64(tb)/1024.0/1024.0)
+		}
+	}
+	if resErr != nil {
+		return nr, resErr
+	}
+	if outgz != nil {
+		err = outgz.Close()
+		if err != nil {
+			return nr, err
+		}
+	}
+	log.Printf("%s: %d rows, %10.1f mb\n", outfn, nr, float64(tb)/1024.0/1024.0)
+	return nr, outb.Flush()
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package csvfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+func TestParseColumns(t *testing.T) {
+	spec := "id,type,version,timestamp,changeset,uid,user,quadtree,lon,lat,wkt,tags,tag:name"
+	columns, err := ParseColumns(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 13 || columns[3].Kind != TimestampColumn || columns[12] != (Column{TagColumn, "name"}) {
+		t.Errorf("columns %v", columns)
+	}
+	names := []string{}
+	for _, c := range columns {
+		names = append(names, c.Name())
+	}
+	if strings.Join(names, ",") != strings.Replace(spec, "tag:", "", 1) {
+		t.Errorf("names %v", names)
+	}
+
+	if columns, err = ParseColumns(" id , tag:addr:street "); err != nil || len(columns) != 2 || columns[1].Key != "addr:street" {
+		t.Errorf("columns %v %v", columns, err)
+	}
+	for _, s := range []string{"id,name", "tag:", "id,", ""} {
+		if _, err := ParseColumns(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestRow(t *testing.T) {
+	columns, err := ParseColumns("id,type,version,timestamp,changeset,uid,user,quadtree,lon,lat,wkt,tags,tag:name,tag:lanes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt, err := quadtree.FromTuple(1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := elements.MakeInfo(3, elements.Timestamp(1500000000), 42, 7, "someone", true)
+	node := elements.MakeNode(10, info, elements.MakeTags([]string{"name"}, []string{"Some, \"place\""}), 12345678, -4560000, qt, elements.Normal)
+	way := elements.MakeWay(20, nil, nil, []elements.Ref{1, 2}, -1, elements.Normal)
+	point := geometrytest.Element(t, 30, geometry.Point, []string{"name", "pub", "!lanes", "\x04"}, []float64{1.5, 2.25})
+	line := geometrytest.Element(t, 40, geometry.Linestring, nil, []float64{0, 0, 1, 1})
+
+	for i, tc := range []struct {
+		e   elements.Element
+		exp string
+	}{
+		{node, `10|node|3|2017-07-14T02:40:00|42|7|someone|` + qt.String() + `|1.2345678|-0.456|POINT(1.2345678 -0.456)|{"name":"Some, \"place\""}|Some, "place"|`},
+		{way, `20|way||||||||||{}||`},
+		{point, `30|point||||||BCCCCCCBACCBACCBAC|1.5|2.25|POINT(1.500000 2.250000)|{"lanes":2,"name":"pub"}|pub|2`},
+		{line, `40|linestring||||||BCCCCCCC|||LINESTRING(0.000000 0.000000, 1.000000 1.000000)|{}||`},
+	} {
+		var g geometry.Geometry
+		if tc.e.Type() == elements.Geometry {
+			g, err = geometry.ExtractGeometry(tc.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := strings.Join(row(tc.e, g, columns, nil), "|")
+		if got != tc.exp {
+			t.Errorf("%d: row %s, expected %s", i, got, tc.exp)
+		}
+	}
+}
+
+// testChans splits nb blocks, each with one node, between nc channels,
+// as given by readfile.ReadExtendedBlockMulti
+func testChans(nb, nc int, bad int) []chan elements.ExtendedBlock {
+	res := make([]chan elements.ExtendedBlock, nc)
+	for i := range res {
+		res[i] = make(chan elements.ExtendedBlock, nb)
+	}
+	for i := 0; i < nb; i++ {
+		var e elements.Element
+		if i == bad {
+			e = elements.MakeGeometry(elements.Ref(i), nil, nil, []byte{0xff}, -1, elements.Normal)
+		} else {
+			e = elements.MakeNode(elements.Ref(i), nil, nil, int64(i)*10000000, 0, -1, elements.Normal)
+		}
+		res[i%nc] <- elements.MakeExtendedBlock(i, elements.ByElementId{e}, -1, 0, 0, nil)
+	}
+	for _, c := range res {
+		close(c)
+	}
+	return res
+}
+
+func readRows(t *testing.T, fn string, comma rune) [][]string {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasSuffix(fn, ".gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = comma
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteCsv(t *testing.T) {
+	dir := t.TempDir()
+	columns, err := ParseColumns("id,lon,wkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		fn     string
+		nc     int
+		header bool
+		comma  rune
+	}{
+		{"test.csv", 1, true, ','},
+		{"test.tsv", 3, false, '\t'},
+		{"test.tsv.gz", 4, true, '\t'},
+	} {
+		fn := filepath.Join(dir, tc.fn)
+		nr, err := WriteCsv(testChans(10, tc.nc, -1), fn, Options{Columns: columns, Header: tc.header})
+		if err != nil || nr != 10 {
+			t.Fatalf("%s: wrote %d rows: %v", tc.fn, nr, err)
+		}
+		rows := readRows(t, fn, tc.comma)
+		if tc.header {
+			if strings.Join(rows[0], ",") != "id,lon,wkt" {
+				t.Errorf("%s: header %v", tc.fn, rows[0])
+			}
+			rows = rows[1:]
+		}
+		if len(rows) != 10 {
+			t.Fatalf("%s: read %d rows", tc.fn, len(rows))
+		}
+		for i, r := range rows {
+			exp := []string{strconv.Itoa(i), strconv.Itoa(i), "POINT(" + strconv.Itoa(i) + " 0)"}
+			if strings.Join(r, "|") != strings.Join(exp, "|") {
+				t.Errorf("%s: row %d is %v", tc.fn, i, r)
+			}
+		}
+	}
+
+	fn := filepath.Join(dir, "comma.tsv")
+	if _, err := WriteCsv(testChans(2, 1, -1), fn, Options{Columns: columns, Comma: ';'}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := readRows(t, fn, ';'); len(rows) != 2 || len(rows[1]) != 3 {
+		t.Errorf("rows %v", rows)
+	}
+}
+
+func TestWriteCsvError(t *testing.T) {
+	columns, err := ParseColumns("id,wkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the remaining blocks of every channel are read after the error
+	nr, err := WriteCsv(testChans(20, 3, 4), filepath.Join(t.TempDir(), "test.csv"), Options{Columns: columns})
+	if err == nil || nr != 4 {
+		t.Errorf("wrote %d rows: %v", nr, err)
+	}
+}
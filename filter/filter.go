@@ -6,9 +6,9 @@
 package filter
 
 import (
-	//"github.com/jharris2268/osmquadtree/readfile"
 	"github.com/jharris2268/osmquadtree/elements"
 	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
 	"github.com/jharris2268/osmquadtree/utils"
 
 	"log"
@@ -17,12 +17,12 @@ import (
 	//"sync"
 )
 
-func filterByQuadtree(inchan <-chan elements.ExtendedBlock, bbox quadtree.Bbox) (<-chan elements.ExtendedBlock, error) {
+func filterByQuadtree(inchan <-chan elements.ExtendedBlock, bbox quadtree.Bbox, params quadtree.Params) (<-chan elements.ExtendedBlock, error) {
 
 	res := make(chan elements.ExtendedBlock)
 	go func() {
 		for bl := range res {
-			if bbox.Intersects(bl.Quadtree().Bounds(0.05)) {
+			if bbox.Intersects(params.Bounds(bl.Quadtree())) {
 				res <- bl
 			}
 		}
@@ -187,38 +187,39 @@ func (ids *idSetBitMap) CopyInto(other IdSet) {
     }
 }
 
-type locTestBbox quadtree.Bbox
+type locTestBbox struct {
+	bbox   quadtree.Bbox
+	params quadtree.Params
+}
 
 func (bbox locTestBbox) Contains(x, y int64) bool {
-
-	if bbox.Minx <= x && x <= bbox.Maxx {
-		if bbox.Miny <= y && y <= bbox.Maxy {
-			return true
-		}
-	}
-	return false
+	return bbox.bbox.ContainsXY(x, y)
 }
 func (bbox locTestBbox) ContainsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
-	return quadtree.Bbox(bbox).Contains(bx)
+	bx := bbox.params.Bounds(qt)
+	return bbox.bbox.Contains(bx)
 }
 
 func (bbox locTestBbox) Bbox() quadtree.Bbox {
-	return quadtree.Bbox(bbox)
+	return bbox.bbox
 }
 func (bbox locTestBbox) Intersects(other quadtree.Bbox) bool {
-	return bbox.Bbox().Intersects(other)
+	return bbox.bbox.Intersects(other)
 }
 func (bbox locTestBbox) IntersectsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
+	bx := bbox.params.Bounds(qt)
 	return bbox.Intersects(bx)
 }
 
 func (bb locTestBbox) String() string {
-	return "locTestBbox " + bb.Bbox().String()
+	return "locTestBbox " + bb.Bbox().String() + " [" + bb.params.String() + "]"
 }
-func AsLocTest(bbox quadtree.Bbox) LocTest {
-	return locTestBbox(bbox)
+
+//AsLocTest returns a LocTest for bbox. Quadtrees are tested using
+//params, which should be those of the file being filtered (see
+//readfile.GetQuadtreeParams).
+func AsLocTest(bbox quadtree.Bbox, params quadtree.Params) LocTest {
+	return locTestBbox{bbox, params}
 }
 
 func readBbox(f string) *quadtree.Bbox {
@@ -250,9 +251,12 @@ func readBbox(f string) *quadtree.Bbox {
 
 }
 
-func MakeLocTest(f string) LocTest {
+//MakeLocTest returns a LocTest from f: either an osmosis poly file (see
+//ReadPolyFile), a bbox given as minx,miny,maxx,maxy or "planet". Quadtrees
+//are tested using params.
+func MakeLocTest(f string, params quadtree.Params) LocTest {
 	if strings.HasSuffix(f, ".poly") {
-		locTest, err := ReadPolyFile(f)
+		locTest, err := ReadPolyFile(f, params)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -262,10 +266,20 @@ func MakeLocTest(f string) LocTest {
 	if f != "" {
 		fbx := readBbox(f)
 		log.Println(fbx)
-		return AsLocTest(*fbx)
+		return AsLocTest(*fbx, params)
 	}
 	fbx := quadtree.PlanetBbox()
-	return AsLocTest(*fbx)
+	return AsLocTest(*fbx, params)
+}
+
+//MakeLocTestFile is MakeLocTest, for filtering the file infn: quadtrees
+//are tested using the quadtree.Params recorded in the header of infn.
+func MakeLocTestFile(f string, infn string) (LocTest, error) {
+	params, err := readfile.GetQuadtreeParams(infn)
+	if err != nil {
+		return nil, err
+	}
+	return MakeLocTest(f, params), nil
 }
 
 func makeIdSetBitMap() *idSetBitMap {
@@ -280,7 +294,9 @@ func MakeIdSet(bm bool) IdSet {
 }
 
 //FindObjsFilter populates the given IdSet ids with the ids for elements
-//in inblocks which pass the LocTest locTest. These elements are:
+//in inblocks which pass the LocTest locTest (which should be made with
+//the quadtree.Params of inblocks, e.g. by MakeLocTestFile). These
+//elements are:
 //1. Nodes within the the locTest
 //2. Ways with at least one node within the locTest
 //3. Other nodes belonging to Ways which are included (equilivant to osmosis' --complete-ways)
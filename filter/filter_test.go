@@ -0,0 +1,108 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package filter
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
+	"github.com/jharris2268/osmquadtree/writefile"
+
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeParamsFile(t *testing.T, fn string, params quadtree.Params) {
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		bl := elements.ByElementId{elements.MakeNode(1, nil, elements.MakeTags(nil, nil), 0, 0, 0, elements.Normal)}
+		inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+		close(inc)
+	}()
+	if _, err := writefile.WritePbfFileParams(readfile.SplitExtendedBlockChans(inc, 4), fn, false, false, params); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMakeLocTestFile(t *testing.T) {
+	dir := t.TempDir()
+	// a bbox just to the east of tile qt
+	qt, err := quadtree.FromTuple(10, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := qt.Bounds(0)
+	w := tb.Maxx - tb.Minx
+	bbox := quadtree.Bbox{Minx: tb.Maxx + w/15, Miny: tb.Miny, Maxx: tb.Maxx + w/5, Maxy: tb.Maxy}
+
+	if AsLocTest(bbox, quadtree.DefaultParams).IntersectsQuadtree(qt) {
+		t.Errorf("bbox intersects %s with default params", qt)
+	}
+
+	f := fmt.Sprintf("%d,%d,%d,%d", bbox.Minx, bbox.Miny, bbox.Maxx, bbox.Maxy)
+
+	deffn := filepath.Join(dir, "default.pbf")
+	writeParamsFile(t, deffn, quadtree.DefaultParams)
+	lt, err := MakeLocTestFile(f, deffn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt.IntersectsQuadtree(qt) {
+		t.Errorf("%s intersects %s", lt, qt)
+	}
+
+	// with a larger buffer tile qt may hold objects in bbox
+	widefn := filepath.Join(dir, "wide.pbf")
+	writeParamsFile(t, widefn, quadtree.Params{Buffer: 0.1, MaxLevel: 18})
+	lt, err = MakeLocTestFile(f, widefn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lt.IntersectsQuadtree(qt) {
+		t.Errorf("%s doesn't intersect %s", lt, qt)
+	}
+	if lt.Bbox() != bbox {
+		t.Errorf("%s has bbox %s, expected %s", lt, lt.Bbox(), bbox)
+	}
+
+	if MakeLocTest(f, quadtree.DefaultParams).IntersectsQuadtree(qt) {
+		t.Errorf("%s intersects %s with default params", lt, qt)
+	}
+
+	// a poly file covering the same area, with a hole
+	polyfn := filepath.Join(dir, "test.poly")
+	poly := fmt.Sprintf("test\n1\n%d %d\n%d %d\n%d %d\n%d %d\nEND\n!2\n%d %d\n%d %d\n%d %d\nEND\nEND\n",
+		bbox.Minx, bbox.Miny, bbox.Maxx, bbox.Miny, bbox.Maxx, bbox.Maxy, bbox.Minx, bbox.Maxy,
+		bbox.Minx+10, bbox.Miny+10, bbox.Minx+20, bbox.Miny+10, bbox.Minx+20, bbox.Miny+20)
+	if err := ioutil.WriteFile(polyfn, []byte(poly), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lt, err = MakeLocTestFile(polyfn, widefn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lt.IntersectsQuadtree(qt) {
+		t.Errorf("%s doesn't intersect %s", lt, qt)
+	}
+	if lt.Bbox() != bbox {
+		t.Errorf("%s has bbox %s, expected %s", lt, lt.Bbox(), bbox)
+	}
+	lt, err = MakeLocTestFile(polyfn, deffn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt.IntersectsQuadtree(qt) {
+		t.Errorf("%s intersects %s", lt, qt)
+	}
+
+	// a single polygon
+	lt = MakeLocTestPolygon([]int64{bbox.Minx, bbox.Maxx, bbox.Maxx, bbox.Minx}, []int64{bbox.Miny, bbox.Miny, bbox.Maxy, bbox.Maxy}, quadtree.Params{Buffer: 0.1, MaxLevel: 18})
+	if !lt.IntersectsQuadtree(qt) {
+		t.Errorf("%s doesn't intersect %s", lt, qt)
+	}
+}
@@ -27,20 +27,21 @@ func (ll lonLatSlice) Lon(i int) int64 { return ll[i].lon }
 func (ll lonLatSlice) Lat(i int) int64 { return ll[i].lat }
 
 type locTestPolygon struct {
-	verts quadtree.LonLatBlock
-	bb    *quadtree.Bbox
+	verts  quadtree.LonLatBlock
+	bb     *quadtree.Bbox
+	params quadtree.Params
 }
 
 // MakeLocTestPolygon constructs a LocTest which checks if a point is within
 // the specified polygon. Note that the ContainsQuadtree function tests the four corners
-// of the quadtree only.
-func MakeLocTestPolygon(lons, lats []int64) LocTest {
+// of the quadtree only, found using params.
+func MakeLocTestPolygon(lons, lats []int64, params quadtree.Params) LocTest {
 	verts := make(lonLatSlice, len(lons))
 	for i, ln := range lons {
 		verts[i] = lonLat{ln, lats[i]}
 	}
 
-	return locTestPolygon{verts, nil}
+	return locTestPolygon{verts, nil, params}
 }
 
 func (tp locTestPolygon) Bbox() quadtree.Bbox {
@@ -67,14 +68,14 @@ func (tp locTestPolygon) Bbox() quadtree.Bbox {
 
 func (tp locTestPolygon) Contains(x, y int64) bool {
 
-	if !locTestBbox(tp.Bbox()).Contains(x, y) {
+	if !tp.Bbox().ContainsXY(x, y) {
 		return false
 	}
 	return quadtree.PointInPoly(tp.verts, x, y)
 
 }
 func (tp locTestPolygon) ContainsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
+	bx := tp.params.Bounds(qt)
 	if !tp.Bbox().Contains(bx) {
 		return false
 	}
@@ -102,15 +103,16 @@ func (ltp locTestPolygon) Intersects(other quadtree.Bbox) bool {
 }
 
 func (ltp locTestPolygon) IntersectsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
+	bx := ltp.params.Bounds(qt)
 	return ltp.Intersects(bx)
 
 }
 
 type locTestPolygonMulti struct {
-	polys []locTestPolygon
-	holes []locTestPolygon
-	bb    *quadtree.Bbox
+	polys  []locTestPolygon
+	holes  []locTestPolygon
+	bb     *quadtree.Bbox
+	params quadtree.Params
 }
 
 func (tp locTestPolygonMulti) Bbox() quadtree.Bbox {
@@ -140,7 +142,7 @@ func (tp locTestPolygonMulti) Contains(x, y int64) bool {
 }
 
 func (tp locTestPolygonMulti) ContainsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
+	bx := tp.params.Bounds(qt)
 	if !tp.Bbox().Contains(bx) {
 		return false
 	}
@@ -163,7 +165,7 @@ func (tp locTestPolygonMulti) Intersects(other quadtree.Bbox) bool {
 	return tp.Bbox().Intersects(other)
 }
 func (tp locTestPolygonMulti) IntersectsQuadtree(qt quadtree.Quadtree) bool {
-	bx := qt.Bounds(0.05)
+	bx := tp.params.Bounds(qt)
 	return tp.Intersects(bx)
 
 }
@@ -175,8 +177,8 @@ func (tp locTestPolygonMulti) String() string {
 // http://wiki.openstreetmap.org/wiki/Osmosis/Polygon_Filter_File_Format
 // ) and constructs a LocTest which returns true if a point is within the
 // polygon. Note that the ContainsQuadtree function tests the four corners
-// of the quadtree only.
-func ReadPolyFile(fn string) (LocTest, error) {
+// of the quadtree only, found using params.
+func ReadPolyFile(fn string, params quadtree.Params) (LocTest, error) {
 	fl, err := os.Open(fn)
 	if err != nil {
 		return nil, err
@@ -186,9 +188,9 @@ func ReadPolyFile(fn string) (LocTest, error) {
 	//nme:=""
 	i := 0
 	inply, label := false, ""
-	curr := locTestPolygon{}
+	curr := locTestPolygon{params: params}
 	currverts := lonLatSlice{}
-	res := locTestPolygonMulti{}
+	res := locTestPolygonMulti{params: params}
 	for scan.Scan() {
 		ln := strings.TrimSpace(scan.Text())
 		//println(i,ln)
@@ -205,7 +207,7 @@ func ReadPolyFile(fn string) (LocTest, error) {
 				} else {
 					res.polys = append(res.polys, curr)
 				}
-				curr = locTestPolygon{}
+				curr = locTestPolygon{params: params}
 				currverts = lonLatSlice{}
 			} else {
 				xy := strings.Fields(ln)
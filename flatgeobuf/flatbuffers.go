@@ -0,0 +1,219 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// fbBuilder serializes flatbuffer tables. Unlike the flatbuffers library,
+// objects are written front to back: each table is followed by the
+// strings, vectors and tables it refers to (as the offsets are unsigned,
+// these always follow the referring field).
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) uint32(v uint32) {
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-4:], v)
+}
+
+// patch sets the offset at pos to point to to
+func (b *fbBuilder) patch(pos, to int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(to-pos))
+}
+
+type fbObject interface {
+	write(b *fbBuilder) int
+}
+
+type fbString string
+
+func (s fbString) write(b *fbBuilder) int {
+	b.pad(4)
+	p := len(b.buf)
+	b.uint32(uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return p
+}
+
+// fbVector is a vector of scalars, of elemSize bytes each, already
+// encoded as data
+type fbVector struct {
+	elemSize int
+	data     []byte
+}
+
+func (v fbVector) write(b *fbBuilder) int {
+	for (len(b.buf)+4)%v.elemSize != 0 || len(b.buf)%4 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	p := len(b.buf)
+	b.uint32(uint32(len(v.data) / v.elemSize))
+	b.buf = append(b.buf, v.data...)
+	return p
+}
+
+func fbFloat64Vector(vv []float64) fbVector {
+	res := make([]byte, 8*len(vv))
+	for i, v := range vv {
+		binary.LittleEndian.PutUint64(res[8*i:], math.Float64bits(v))
+	}
+	return fbVector{8, res}
+}
+
+func fbUint32Vector(vv []uint32) fbVector {
+	res := make([]byte, 4*len(vv))
+	for i, v := range vv {
+		binary.LittleEndian.PutUint32(res[4*i:], v)
+	}
+	return fbVector{4, res}
+}
+
+// fbTableVector is a vector of tables
+type fbTableVector []*fbTable
+
+func (tv fbTableVector) write(b *fbBuilder) int {
+	b.pad(4)
+	p := len(b.buf)
+	b.uint32(uint32(len(tv)))
+	for range tv {
+		b.uint32(0)
+	}
+	for i, t := range tv {
+		b.patch(p+4+4*i, t.write(b))
+	}
+	return p
+}
+
+// fbField is a table field: either a scalar, encoded as data, or an
+// offset to obj
+type fbField struct {
+	id   int
+	data []byte
+	obj  fbObject
+}
+
+type fbTable struct {
+	fields []fbField
+}
+
+func (t *fbTable) scalar(id int, data []byte) *fbTable {
+	t.fields = append(t.fields, fbField{id, data, nil})
+	return t
+}
+
+func (t *fbTable) uint8(id int, v uint8) *fbTable {
+	return t.scalar(id, []byte{v})
+}
+
+func (t *fbTable) uint16(id int, v uint16) *fbTable {
+	d := make([]byte, 2)
+	binary.LittleEndian.PutUint16(d, v)
+	return t.scalar(id, d)
+}
+
+func (t *fbTable) int32(id int, v int32) *fbTable {
+	d := make([]byte, 4)
+	binary.LittleEndian.PutUint32(d, uint32(v))
+	return t.scalar(id, d)
+}
+
+func (t *fbTable) uint64(id int, v uint64) *fbTable {
+	d := make([]byte, 8)
+	binary.LittleEndian.PutUint64(d, v)
+	return t.scalar(id, d)
+}
+
+func (t *fbTable) object(id int, obj fbObject) *fbTable {
+	t.fields = append(t.fields, fbField{id, nil, obj})
+	return t
+}
+
+func (f fbField) size() int {
+	if f.obj != nil {
+		return 4
+	}
+	return len(f.data)
+}
+
+type fbFieldsBySize []fbField
+
+func (fs fbFieldsBySize) Len() int           { return len(fs) }
+func (fs fbFieldsBySize) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs fbFieldsBySize) Less(i, j int) bool { return fs[i].size() > fs[j].size() }
+
+// write adds the vtable, then the table (with the fields ordered by size,
+// so each is aligned), then the objects referred to.
+func (t *fbTable) write(b *fbBuilder) int {
+	ff := make([]fbField, len(t.fields))
+	copy(ff, t.fields)
+	sort.Stable(fbFieldsBySize(ff))
+
+	nf := 0
+	align := 4
+	for _, f := range ff {
+		if f.id+1 > nf {
+			nf = f.id + 1
+		}
+		if f.size() > align {
+			align = f.size()
+		}
+	}
+
+	b.pad(2)
+	vt := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+2*nf)...)
+
+	// the soffset is 4 bytes, followed by the 8 byte fields
+	for (len(b.buf)+4)%align != 0 || len(b.buf)%4 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	p := len(b.buf)
+	b.uint32(uint32(int32(p - vt)))
+	type ref struct {
+		pos int
+		obj fbObject
+	}
+	refs := []ref{}
+	for _, f := range ff {
+		fp := len(b.buf)
+		binary.LittleEndian.PutUint16(b.buf[vt+4+2*f.id:], uint16(fp-p))
+		if f.obj != nil {
+			refs = append(refs, ref{fp, f.obj})
+			b.uint32(0)
+		} else {
+			b.buf = append(b.buf, f.data...)
+		}
+	}
+	binary.LittleEndian.PutUint16(b.buf[vt:], uint16(4+2*nf))
+	binary.LittleEndian.PutUint16(b.buf[vt+2:], uint16(len(b.buf)-p))
+
+	for _, r := range refs {
+		b.patch(r.pos, r.obj.write(b))
+	}
+	return p
+}
+
+// sizePrefixed returns t as a flatbuffer, preceded by its length.
+func (t *fbTable) sizePrefixed() []byte {
+	b := &fbBuilder{make([]byte, 4, 256)}
+	b.patch(0, t.write(b))
+	res := make([]byte, 4+len(b.buf))
+	binary.LittleEndian.PutUint32(res, uint32(len(b.buf)))
+	copy(res[4:], b.buf)
+	return res
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package flatgeobuf writes geometries to FlatGeobuf (version 3) files.
+package flatgeobuf
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var magic = []byte{0x66, 0x67, 0x62, 0x03, 0x66, 0x67, 0x62, 0x00}
+
+// DefaultNodeSize is the usual number of children of each node of the
+// spatial index.
+const DefaultNodeSize = 16
+
+const (
+	geometryUnknown         = 0
+	geometryPoint           = 1
+	geometryLinestring      = 2
+	geometryPolygon         = 3
+	geometryMultiLinestring = 5
+	geometryMultiPolygon    = 6
+
+	columnLong   = 7
+	columnDouble = 10
+	columnString = 11
+	columnJson   = 12
+)
+
+func columnType(ct geometry.ColumnType) uint8 {
+	switch ct {
+	case geometry.IntegerColumn:
+		return columnLong
+	case geometry.FloatColumn:
+		return columnDouble
+	case geometry.JsonColumn:
+		return columnJson
+	}
+	return columnString
+}
+
+func coordsTable(ty uint8, xy []float64, ends []uint32) *fbTable {
+	t := (&fbTable{}).object(1, fbFloat64Vector(xy)).uint8(6, ty)
+	if len(ends) > 1 {
+		t.object(0, fbUint32Vector(ends))
+	}
+	return t
+}
+
+func appendCoord(xy []float64, c geometry.Coord) []float64 {
+	x, y := c.LonLat()
+	return append(xy, x, y)
+}
+
+func polygonTable(nr int, nc func(int) int, coord func(int, int) geometry.Coord) *fbTable {
+	xy := []float64{}
+	ends := make([]uint32, nr)
+	for i := 0; i < nr; i++ {
+		for j := 0; j < nc(i); j++ {
+			xy = appendCoord(xy, coord(i, j))
+		}
+		ends[i] = uint32(len(xy) / 2)
+	}
+	return coordsTable(geometryPolygon, xy, ends)
+}
+
+// geometryTable returns the Geometry table for g, with coordinates as
+// longitude and latitude.
+func geometryTable(g geometry.Geometry) (*fbTable, error) {
+	switch g.GeometryType() {
+	case geometry.Point:
+		return coordsTable(geometryPoint, appendCoord(nil, g.(geometry.PointGeometry).Coord()), nil), nil
+	case geometry.Linestring:
+		ln := g.(geometry.LinestringGeometry)
+		xy := make([]float64, 0, 2*ln.NumCoords())
+		for i := 0; i < ln.NumCoords(); i++ {
+			xy = appendCoord(xy, ln.Coord(i))
+		}
+		return coordsTable(geometryLinestring, xy, nil), nil
+	case geometry.MultiLinestring:
+		ml := g.(geometry.MultiLinestringGeometry)
+		xy := []float64{}
+		ends := make([]uint32, ml.NumLines())
+		for i := range ends {
+			for j := 0; j < ml.NumCoords(i); j++ {
+				xy = appendCoord(xy, ml.Coord(i, j))
+			}
+			ends[i] = uint32(len(xy) / 2)
+		}
+		return coordsTable(geometryMultiLinestring, xy, ends), nil
+	case geometry.Polygon:
+		py := g.(geometry.PolygonGeometry)
+		return polygonTable(py.NumRings(), py.NumCoords, py.Coord), nil
+	case geometry.Multi:
+		mg := g.(geometry.MultiGeometry)
+		parts := make(fbTableVector, mg.NumGeometries())
+		for i := range parts {
+			ii := i
+			parts[i] = polygonTable(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) geometry.Coord { return mg.Coord(ii, j, k) })
+		}
+		return (&fbTable{}).uint8(6, geometryMultiPolygon).object(7, parts), nil
+	}
+	return nil, errors.New(fmt.Sprintf("can't write %s geometry", g.GeometryType()))
+}
+
+// properties returns the properties of g: the osm_id column, followed by
+// the tags of g given by columns.
+func properties(g geometry.Geometry, columns []geometry.Column) []byte {
+	res := make([]byte, 10, 64)
+	binary.LittleEndian.PutUint16(res, 0)
+	binary.LittleEndian.PutUint64(res[2:], uint64(g.Id()))
+
+	for i, v := range geometry.ColumnValues(g.Tags(), columns) {
+		if v == nil {
+			continue
+		}
+		p := len(res)
+		switch vv := v.(type) {
+		case int64:
+			res = append(res, make([]byte, 10)...)
+			binary.LittleEndian.PutUint64(res[p+2:], uint64(vv))
+		case float64:
+			res = append(res, make([]byte, 10)...)
+			binary.LittleEndian.PutUint64(res[p+2:], math.Float64bits(vv))
+		case string:
+			res = append(res, make([]byte, 6)...)
+			binary.LittleEndian.PutUint32(res[p+2:], uint32(len(vv)))
+			res = append(res, vv...)
+		}
+		binary.LittleEndian.PutUint16(res[p:], uint16(i+1))
+	}
+	return res
+}
+
+// feature returns the size prefixed Feature table for g
+func feature(g geometry.Geometry, columns []geometry.Column) ([]byte, error) {
+	gt, err := geometryTable(g)
+	if err != nil {
+		return nil, err
+	}
+	ft := (&fbTable{}).object(0, gt).object(1, fbVector{1, properties(g, columns)})
+	return ft.sizePrefixed(), nil
+}
+
+func header(name string, columns []geometry.Column, count uint64, nodeSize int, extent nodeItem) []byte {
+	cols := make(fbTableVector, len(columns)+1)
+	cols[0] = (&fbTable{}).object(0, fbString("osm_id")).uint8(1, columnLong)
+	for i, c := range columns {
+		cols[i+1] = (&fbTable{}).object(0, fbString(c.Name)).uint8(1, columnType(c.Type))
+	}
+	crs := (&fbTable{}).object(0, fbString("EPSG")).int32(1, 4326)
+
+	ht := (&fbTable{}).object(0, fbString(name)).uint8(2, geometryUnknown).object(7, cols)
+	ht.uint64(8, count).uint16(9, uint16(nodeSize)).object(10, crs)
+	if count > 0 {
+		ht.object(1, fbFloat64Vector([]float64{extent.minx, extent.miny, extent.maxx, extent.maxy}))
+	}
+	return ht.sizePrefixed()
+}
+
+// featureItem locates a feature in the temporary file
+type featureItem struct {
+	nodeItem
+	pos     int64
+	length  int
+	hilbert uint32
+}
+
+type featuresByHilbert []featureItem
+
+func (fs featuresByHilbert) Len() int           { return len(fs) }
+func (fs featuresByHilbert) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs featuresByHilbert) Less(i, j int) bool { return fs[i].hilbert < fs[j].hilbert }
+
+// WriteFlatGeobuf writes the Geometry elements of inc to outfn as a
+// FlatGeobuf file, with coordinates as longitude and latitude (EPSG:4326).
+// Each feature has an osm_id property, followed by the tags of each of
+// columns (see geometry.StyleColumns). If nodeSize is greater than zero,
+// the features are sorted along a hilbert curve and a packed R-tree index
+// is included. The features are first written to a temporary file, in the
+// same directory as outfn. Returns the number of features written.
+func WriteFlatGeobuf(inc <-chan elements.ExtendedBlock, outfn string, columns []geometry.Column, nodeSize int) (int, error) {
+	if nodeSize == 1 || nodeSize > math.MaxUint16 {
+		return 0, errors.New(fmt.Sprintf("invalid node size %d", nodeSize))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(outfn), "osmquadtree.flatgeobuf.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tmpw := bufio.NewWriter(tmp)
+	items := []featureItem{}
+	extent := emptyNodeItem(0)
+	pos := int64(0)
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if e.Type() != elements.Geometry {
+				continue
+			}
+			g, err := geometry.ExtractGeometry(e)
+			if err != nil {
+				return 0, err
+			}
+			data, err := feature(g, columns)
+			if err != nil {
+				return 0, err
+			}
+			_, err = tmpw.Write(data)
+			if err != nil {
+				return 0, err
+			}
+			bx := g.Bbox()
+			it := featureItem{nodeItem{quadtree.ToFloat(bx.Minx), quadtree.ToFloat(bx.Miny),
+				quadtree.ToFloat(bx.Maxx), quadtree.ToFloat(bx.Maxy), 0}, pos, len(data), 0}
+			extent.expand(it.nodeItem)
+			items = append(items, it)
+			pos += int64(len(data))
+		}
+		if (bl.Idx() % 100) == 0 {
+			log.Printf("%-6d: %d features, %10.1f mb\n", bl.Idx(), len(items), float64(pos)/1024.0/1024.0)
+		}
+	}
+	err = tmpw.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	outf, err := os.OpenFile(outfn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return 0, err
+	}
+	defer outf.Close()
+	outw := bufio.NewWriter(outf)
+
+	if len(items) == 0 {
+		nodeSize = 0
+	}
+	outw.Write(magic)
+	outw.Write(header(strings.TrimSuffix(filepath.Base(outfn), filepath.Ext(outfn)), columns, uint64(len(items)), nodeSize, extent))
+
+	if nodeSize == 0 {
+		_, err = tmp.Seek(0, 0)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(outw, tmp)
+		if err != nil {
+			return 0, err
+		}
+		return len(items), outw.Flush()
+	}
+
+	for i := range items {
+		items[i].hilbert = hilbertValue(items[i].nodeItem, extent)
+	}
+	sort.Sort(featuresByHilbert(items))
+	nodes := make([]nodeItem, len(items))
+	off := uint64(0)
+	for i, it := range items {
+		nodes[i] = it.nodeItem
+		nodes[i].offset = off
+		off += uint64(it.length)
+	}
+	_, err = outw.Write(packedRtree(nodes, nodeSize))
+	if err != nil {
+		return 0, err
+	}
+
+	buf := []byte{}
+	for _, it := range items {
+		if len(buf) < it.length {
+			buf = make([]byte, it.length)
+		}
+		_, err = tmp.ReadAt(buf[:it.length], it.pos)
+		if err != nil {
+			return 0, err
+		}
+		_, err = outw.Write(buf[:it.length])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(items), outw.Flush()
+}
@@ -0,0 +1,383 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package flatgeobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+// fbReader reads the fields of the flatbuffer table at pos
+type fbReader struct {
+	buf []byte
+	pos int
+}
+
+// readSizePrefixed returns the root table of a size prefixed flatbuffer,
+// and the length of the buffer including the prefix
+func readSizePrefixed(t *testing.T, data []byte) (fbReader, int) {
+	n := int(binary.LittleEndian.Uint32(data))
+	if 4+n > len(data) {
+		t.Fatalf("flatbuffer of %d bytes in %d bytes", n, len(data))
+	}
+	buf := data[4 : 4+n]
+	return fbReader{buf, int(binary.LittleEndian.Uint32(buf))}, 4 + n
+}
+
+func (r fbReader) field(id int) int {
+	vt := r.pos - int(int32(binary.LittleEndian.Uint32(r.buf[r.pos:])))
+	if 4+2*id >= int(binary.LittleEndian.Uint16(r.buf[vt:])) {
+		return -1
+	}
+	off := int(binary.LittleEndian.Uint16(r.buf[vt+4+2*id:]))
+	if off == 0 {
+		return -1
+	}
+	return r.pos + off
+}
+
+func (r fbReader) uint8(id int) uint8 {
+	if f := r.field(id); f >= 0 {
+		return r.buf[f]
+	}
+	return 0
+}
+
+func (r fbReader) uint16(id int) uint16 {
+	if f := r.field(id); f >= 0 {
+		return binary.LittleEndian.Uint16(r.buf[f:])
+	}
+	return 0
+}
+
+func (r fbReader) uint64(id int) uint64 {
+	if f := r.field(id); f >= 0 {
+		return binary.LittleEndian.Uint64(r.buf[f:])
+	}
+	return 0
+}
+
+func (r fbReader) deref(id int) int {
+	f := r.field(id)
+	if f < 0 {
+		return -1
+	}
+	return f + int(binary.LittleEndian.Uint32(r.buf[f:]))
+}
+
+// vector returns the data and length of a vector
+func (r fbReader) vector(id int) ([]byte, int) {
+	p := r.deref(id)
+	if p < 0 {
+		return nil, 0
+	}
+	return r.buf[p+4:], int(binary.LittleEndian.Uint32(r.buf[p:]))
+}
+
+func (r fbReader) string(id int) string {
+	data, n := r.vector(id)
+	if n > 0 && data[n] != 0 {
+		return "<unterminated>"
+	}
+	return string(data[:n])
+}
+
+func (r fbReader) float64s(id int) []float64 {
+	data, n := r.vector(id)
+	res := make([]float64, n)
+	for i := range res {
+		res[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	return res
+}
+
+func (r fbReader) uint32s(id int) []uint32 {
+	data, n := r.vector(id)
+	res := make([]uint32, n)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return res
+}
+
+func (r fbReader) table(id int) fbReader {
+	return fbReader{r.buf, r.deref(id)}
+}
+
+func (r fbReader) tables(id int) []fbReader {
+	p := r.deref(id)
+	if p < 0 {
+		return nil
+	}
+	res := make([]fbReader, binary.LittleEndian.Uint32(r.buf[p:]))
+	for i := range res {
+		q := p + 4 + 4*i
+		res[i] = fbReader{r.buf, q + int(binary.LittleEndian.Uint32(r.buf[q:]))}
+	}
+	return res
+}
+
+func sameFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-7 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHeader(t *testing.T) {
+	columns := []geometry.Column{{Name: "highway", Type: geometry.TextColumn}, {Name: "lanes", Type: geometry.IntegerColumn},
+		{Name: "way_area", Type: geometry.FloatColumn}, {Name: "tags", Type: geometry.JsonColumn}}
+	data := header("roads", columns, 12, 16, nodeItem{-1.5, 50, 2.25, 52.125, 0})
+	hd, n := readSizePrefixed(t, data)
+	if n != len(data) {
+		t.Errorf("header of %d bytes, read %d", len(data), n)
+	}
+	if hd.string(0) != "roads" || hd.uint8(2) != geometryUnknown || hd.uint64(8) != 12 || hd.uint16(9) != 16 {
+		t.Errorf("header name %q, type %d, count %d, node size %d", hd.string(0), hd.uint8(2), hd.uint64(8), hd.uint16(9))
+	}
+	if env := hd.float64s(1); !sameFloats(env, []float64{-1.5, 50, 2.25, 52.125}) {
+		t.Errorf("envelope %v", env)
+	}
+	crs := hd.table(10)
+	if crs.string(0) != "EPSG" || binary.LittleEndian.Uint32(crs.buf[crs.field(1):]) != 4326 {
+		t.Errorf("crs %s:%d", crs.string(0), crs.uint16(1))
+	}
+	cols := hd.tables(7)
+	expected := []struct {
+		name string
+		ty   uint8
+	}{{"osm_id", columnLong}, {"highway", columnString}, {"lanes", columnLong}, {"way_area", columnDouble}, {"tags", columnJson}}
+	if len(cols) != len(expected) {
+		t.Fatalf("%d columns", len(cols))
+	}
+	for i, c := range cols {
+		if c.string(0) != expected[i].name || c.uint8(1) != expected[i].ty {
+			t.Errorf("column %d: %s %d, expected %v", i, c.string(0), c.uint8(1), expected[i])
+		}
+	}
+
+	empty, _ := readSizePrefixed(t, header("empty", nil, 0, 0, emptyNodeItem(0)))
+	if empty.field(1) >= 0 || len(empty.tables(7)) != 1 || empty.uint64(8) != 0 {
+		t.Errorf("empty header has envelope or columns")
+	}
+}
+
+func TestFeature(t *testing.T) {
+	g, err := geometry.ExtractGeometry(geometrytest.Element(t, 17, geometry.Polygon, []string{"building", "yes", "!levels", "\x06", "name", "Hall"}, []float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0}, []float64{0.25, 0.25, 0.25, 0.5, 0.5, 0.5, 0.25, 0.25}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []geometry.Column{{Name: "building", Type: geometry.TextColumn}, {Name: "levels", Type: geometry.IntegerColumn}, {Name: "height", Type: geometry.FloatColumn}}
+	data, err := feature(g, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft, n := readSizePrefixed(t, data)
+	if n != len(data) {
+		t.Errorf("feature of %d bytes, read %d", len(data), n)
+	}
+
+	gm := ft.table(0)
+	if gm.uint8(6) != geometryPolygon {
+		t.Errorf("geometry type %d", gm.uint8(6))
+	}
+	ends := gm.uint32s(0)
+	if len(ends) != 2 || ends[0] != 5 || ends[1] != 9 {
+		t.Errorf("ring ends %v", ends)
+	}
+	if xy := gm.float64s(1); len(xy) != 18 || !sameFloats(xy[:4], []float64{0, 0, 0, 1}) || !sameFloats(xy[10:12], []float64{0.25, 0.25}) {
+		t.Errorf("coordinates %v", xy)
+	}
+
+	props, np := ft.vector(1)
+	props = props[:np]
+	expected := []byte{0, 0, 17, 0, 0, 0, 0, 0, 0, 0, 1, 0, 3, 0, 0, 0, 'y', 'e', 's', 2, 0, 3, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(props, expected) {
+		t.Errorf("properties %v, expected %v", props, expected)
+	}
+
+	ml, err := geometry.ExtractGeometry(geometrytest.Element(t, 2, geometry.MultiLinestring, []string{"route", "bus"}, []float64{0, 0, 1, 1}, []float64{2, 2, 3, 3, 4, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = feature(ml, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft, _ = readSizePrefixed(t, data)
+	if gm := ft.table(0); gm.uint8(6) != geometryMultiLinestring || len(gm.uint32s(0)) != 2 || gm.uint32s(0)[1] != 5 {
+		t.Errorf("multilinestring type %d, ends %v", gm.uint8(6), gm.uint32s(0))
+	}
+}
+
+func TestHilbert(t *testing.T) {
+	// the centres of a 16 by 16 grid are visited in turn, each next to the
+	// last
+	cells := make([][2]uint32, 256)
+	seen := map[uint32]bool{}
+	for x := uint32(0); x < 16; x++ {
+		for y := uint32(0); y < 16; y++ {
+			h := hilbert(x<<12|0x800, y<<12|0x800) >> 24
+			if seen[h] {
+				t.Fatalf("%d, %d: repeated hilbert cell %d", x, y, h)
+			}
+			seen[h] = true
+			cells[h] = [2]uint32{x, y}
+		}
+	}
+	for i := 1; i < len(cells); i++ {
+		dx := int(cells[i][0]) - int(cells[i-1][0])
+		dy := int(cells[i][1]) - int(cells[i-1][1])
+		if dx*dx+dy*dy != 1 {
+			t.Errorf("cells %d %v and %d %v not adjacent", i-1, cells[i-1], i, cells[i])
+		}
+	}
+	if hilbert(0, 0) != 0 {
+		t.Errorf("hilbert(0, 0) = %d", hilbert(0, 0))
+	}
+}
+
+func readNodes(data []byte) []nodeItem {
+	res := make([]nodeItem, len(data)/40)
+	for i := range res {
+		vv := make([]float64, 4)
+		for j := range vv {
+			vv[j] = math.Float64frombits(binary.LittleEndian.Uint64(data[40*i+8*j:]))
+		}
+		res[i] = nodeItem{vv[0], vv[1], vv[2], vv[3], binary.LittleEndian.Uint64(data[40*i+32:])}
+	}
+	return res
+}
+
+func contains(n, o nodeItem) bool {
+	return n.minx <= o.minx && n.miny <= o.miny && n.maxx >= o.maxx && n.maxy >= o.maxy
+}
+
+func TestPackedRtree(t *testing.T) {
+	bounds := levelBounds(20, 4)
+	expected := [][2]int{{8, 28}, {3, 8}, {1, 3}, {0, 1}}
+	if len(bounds) != len(expected) {
+		t.Fatalf("level bounds %v, expected %v", bounds, expected)
+	}
+	for i := range bounds {
+		if bounds[i] != expected[i] {
+			t.Errorf("level bounds %v, expected %v", bounds, expected)
+		}
+	}
+
+	items := make([]nodeItem, 20)
+	for i := range items {
+		x := float64(i % 5)
+		y := float64(i / 5)
+		items[i] = nodeItem{x, y, x + 0.5, y + 0.5, uint64(i * 100)}
+	}
+	nodes := readNodes(packedRtree(items, 4))
+	if len(nodes) != 28 {
+		t.Fatalf("%d nodes", len(nodes))
+	}
+	for i, it := range items {
+		if nodes[8+i] != it {
+			t.Errorf("leaf %d: %v, expected %v", i, nodes[8+i], it)
+		}
+	}
+	if nodes[0] != (nodeItem{0, 0, 4.5, 3.5, 1}) {
+		t.Errorf("root %v", nodes[0])
+	}
+	for l := 1; l < len(bounds); l++ {
+		for p := bounds[l][0]; p < bounds[l][1]; p++ {
+			first := int(nodes[p].offset)
+			nc := 0
+			for c := first; c < first+4 && c < bounds[l-1][1]; c++ {
+				if !contains(nodes[p], nodes[c]) {
+					t.Errorf("node %d %v doesn't contain child %d %v", p, nodes[p], c, nodes[c])
+				}
+				nc++
+			}
+			if first != bounds[l-1][0]+4*(p-bounds[l][0]) || nc == 0 {
+				t.Errorf("node %d: children from %d", p, first)
+			}
+		}
+	}
+}
+
+func TestWriteFlatGeobuf(t *testing.T) {
+	bl := elements.ByElementId{
+		geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub"}, []float64{5, 5}),
+		geometrytest.Element(t, 2, geometry.Linestring, []string{"highway", "primary"}, []float64{-1, -1, 0, 0}),
+		geometrytest.Element(t, 3, geometry.Point, []string{"amenity", "cafe"}, []float64{-1, 5}),
+		geometrytest.Element(t, 4, geometry.Polygon, []string{"building", "yes"}, []float64{4, 0, 5, 0, 5, 1, 4, 0}),
+	}
+	columns := []geometry.Column{{Name: "amenity", Type: geometry.TextColumn}}
+	for _, nodeSize := range []int{0, 2} {
+		inc := make(chan elements.ExtendedBlock, 1)
+		inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+		close(inc)
+		fn := filepath.Join(t.TempDir(), "test.fgb")
+		nf, err := WriteFlatGeobuf(inc, fn, columns, nodeSize)
+		if err != nil || nf != 4 {
+			t.Fatalf("node size %d: wrote %d features: %v", nodeSize, nf, err)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[:8], magic) {
+			t.Fatalf("magic %v", data[:8])
+		}
+		hd, hl := readSizePrefixed(t, data[8:])
+		if hd.string(0) != "test" || hd.uint64(8) != 4 || int(hd.uint16(9)) != nodeSize {
+			t.Errorf("header %q, count %d, node size %d", hd.string(0), hd.uint64(8), hd.uint16(9))
+		}
+		if env := hd.float64s(1); !sameFloats(env, []float64{-1, -1, 5, 5}) {
+			t.Errorf("envelope %v", env)
+		}
+		pos := 8 + hl
+
+		ids := map[uint64]uint64{} // offset to osm_id
+		offsets := []uint64{}
+		start := pos
+		if nodeSize > 0 {
+			nn := levelBounds(4, nodeSize)[0][1]
+			nodes := readNodes(data[pos : pos+40*nn])
+			start = pos + 40*nn
+			for _, n := range nodes[nn-4:] {
+				offsets = append(offsets, n.offset)
+			}
+		}
+		for p := start; p < len(data); {
+			ft, n := readSizePrefixed(t, data[p:])
+			props, _ := ft.vector(1)
+			ids[uint64(p-start)] = binary.LittleEndian.Uint64(props[2:])
+			p += n
+		}
+		if len(ids) != 4 {
+			t.Errorf("node size %d: read %d features", nodeSize, len(ids))
+		}
+		if nodeSize > 0 {
+			// features are in hilbert order, as are the index leaves
+			got := []uint64{}
+			for _, o := range offsets {
+				got = append(got, ids[o])
+			}
+			if len(got) != 4 || got[0] == 0 || got[1] == 0 || got[2] == 0 || got[3] == 0 {
+				t.Errorf("index leaves point to features %v", got)
+			}
+		}
+	}
+}
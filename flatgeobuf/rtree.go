@@ -0,0 +1,143 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const hilbertMax = (1 << 16) - 1
+
+// nodeItem is an entry of the packed R-tree: for the leaves offset is the
+// position of the feature in the file (following the index), otherwise
+// the index of the first child node.
+type nodeItem struct {
+	minx, miny, maxx, maxy float64
+	offset                 uint64
+}
+
+func emptyNodeItem(offset uint64) nodeItem {
+	return nodeItem{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1), offset}
+}
+
+func (n *nodeItem) expand(o nodeItem) {
+	n.minx = math.Min(n.minx, o.minx)
+	n.miny = math.Min(n.miny, o.miny)
+	n.maxx = math.Max(n.maxx, o.maxx)
+	n.maxy = math.Max(n.maxy, o.maxy)
+}
+
+// hilbert returns the position of x, y (each from 0 to hilbertMax) along a
+// hilbert curve, as calculated by the flatgeobuf library
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a, b, c, d = A, B, C, D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
+
+// hilbertValue returns the hilbert value of the center of n within extent
+func hilbertValue(n, extent nodeItem) uint32 {
+	x, y := uint32(0), uint32(0)
+	if w := extent.maxx - extent.minx; w > 0 {
+		x = uint32(math.Floor(hilbertMax * ((n.minx+n.maxx)/2 - extent.minx) / w))
+	}
+	if h := extent.maxy - extent.miny; h > 0 {
+		y = uint32(math.Floor(hilbertMax * ((n.miny+n.maxy)/2 - extent.miny) / h))
+	}
+	return hilbert(x, y)
+}
+
+// levelBounds returns the range of nodes in each level of a packed R-tree
+// with numItems leaves, starting with the leaves (which come last).
+func levelBounds(numItems, nodeSize int) [][2]int {
+	n := numItems
+	numNodes := n
+	levelNumNodes := []int{n}
+	for {
+		n = (n + nodeSize - 1) / nodeSize
+		numNodes += n
+		levelNumNodes = append(levelNumNodes, n)
+		if n == 1 {
+			break
+		}
+	}
+	res := make([][2]int, len(levelNumNodes))
+	n = numNodes
+	for i, s := range levelNumNodes {
+		res[i] = [2]int{n - s, n}
+		n -= s
+	}
+	return res
+}
+
+// packedRtree returns the nodes of a packed R-tree for items, which
+// should be sorted by hilbertValue, serialized as stored in the file.
+func packedRtree(items []nodeItem, nodeSize int) []byte {
+	bounds := levelBounds(len(items), nodeSize)
+	nodes := make([]nodeItem, bounds[0][1])
+	copy(nodes[bounds[0][0]:], items)
+	for i := 0; i < len(bounds)-1; i++ {
+		np := bounds[i+1][0]
+		for p := bounds[i][0]; p < bounds[i][1]; p += nodeSize {
+			n := emptyNodeItem(uint64(p))
+			for j := p; j < p+nodeSize && j < bounds[i][1]; j++ {
+				n.expand(nodes[j])
+			}
+			nodes[np] = n
+			np++
+		}
+	}
+
+	res := make([]byte, 40*len(nodes))
+	for i, n := range nodes {
+		for j, v := range []float64{n.minx, n.miny, n.maxx, n.maxy} {
+			binary.LittleEndian.PutUint64(res[40*i+8*j:], math.Float64bits(v))
+		}
+		binary.LittleEndian.PutUint64(res[40*i+32:], n.offset)
+	}
+	return res
+}
@@ -10,7 +10,6 @@ import (
 	"encoding/json"
 	"io"
 	"log"
-	"math"
 	"os"
 	"strings"
 
@@ -20,13 +19,17 @@ import (
 )
 
 type idxData struct {
-	i int
-	d []byte
+	i   int
+	d   []byte
+	err error
 }
 
 func (id idxData) Idx() int { return id.i }
 
-func writeOsmJson(sblc <-chan utils.Idxer, outfn string, header string, footer string) (int, int, error) {
+// writeOsmJson writes the data of each idxData of sblc, in order, between
+// header and footer and separated by sep. If any has an error, the rest of
+// sblc is read and the first error returned.
+func writeOsmJson(sblc <-chan utils.Idxer, outfn string, header string, sep string, footer string) (int, int, error) {
 
 	log.Println("outfn: ", outfn)
 	var outfz io.Writer
@@ -49,10 +52,18 @@ func writeOsmJson(sblc <-chan utils.Idxer, outfn string, header string, footer s
 	tb := 0
 	bc := 0
 	li := 0
+	var resErr error
 	outfz.Write([]byte(header))
 	for s := range utils.SortIdxerChan(sblc) {
+		if resErr != nil {
+			continue
+		}
+		if err := s.(idxData).err; err != nil {
+			resErr = err
+			continue
+		}
 		if bc > 0 {
-			outfz.Write([]byte(",\n"))
+			outfz.Write([]byte(sep))
 		}
 		d := s.(idxData).d
 		bc += 1
@@ -64,6 +75,9 @@ func writeOsmJson(sblc <-chan utils.Idxer, outfn string, header string, footer s
 		outfz.Write(d)
 		li = s.Idx()
 	}
+	if resErr != nil {
+		return tb, bc, resErr
+	}
 	log.Printf("%-6d: %d blocks, %10.1f mb\n", li, bc, float64(tb)/1024.0/1024.0)
 	outfz.Write([]byte(footer))
 	return tb, bc, nil
@@ -82,22 +96,11 @@ func MakeFeature(o geometry.Geometry, asMerc bool) (map[string]interface{}, erro
 	pp := map[string]interface{}{}
 	tt := o.Tags()
 	for j := 0; j < tt.Len(); j++ {
-		k := tt.Key(j)
+		k, v := geometry.TagValue(tt, j)
 		if k == "" {
 			continue
 		}
-		switch k[0] {
-		case '!':
-			ii, _ := utils.ReadVarint([]byte(tt.Value(j)), 0)
-			pp[k[1:]] = ii
-		case '%':
-			ii, _ := utils.ReadUvarint([]byte(tt.Value(j)), 0)
-			pp[k[1:]] = math.Float64frombits(ii)
-		case '$':
-			pp[k[1:]] = nil
-		default:
-			pp[k] = tt.Value(j)
-		}
+		pp[k] = v
 	}
 	om["properties"] = pp
 
@@ -127,8 +130,8 @@ func MakeFeatureCollection(bl elements.ExtendedBlock, asMerc bool) (map[string]i
 		bll["properties"] = ps
 	}
 
-	oo := make([]interface{}, bl.Len())
-	for i, _ := range oo {
+	oo := make([]interface{}, 0, bl.Len())
+	for i := 0; i < bl.Len(); i++ {
         e:=bl.Element(i)
         if e.Type()!=elements.Geometry {
             log.Println("???", i, e)
@@ -147,7 +150,7 @@ func MakeFeatureCollection(bl elements.ExtendedBlock, asMerc bool) (map[string]i
 			return nil, err
 		}
 
-		oo[i] = om
+		oo = append(oo, om)
 	}
 
 	bll["features"] = oo
@@ -163,16 +166,13 @@ func WriteGeoJson(sblc <-chan elements.ExtendedBlock, outfn string) (int, int, e
 
 			bll, err := MakeFeatureCollection(bl, false)
 			if err != nil {
-				panic(err.Error())
+				outc <- idxData{bl.Idx(), nil, err}
+				continue
 			}
 			blc, err := json.Marshal(bll)
-			if err != nil {
-				panic(err.Error())
-			}
-
-			outc <- idxData{bl.Idx(), blc}
+			outc <- idxData{bl.Idx(), blc, err}
 		}
 		close(outc)
 	}()
-	return writeOsmJson(outc, outfn, `{"type": "FeatureCollection","features":[`+"\n", "\n]}")
+	return writeOsmJson(outc, outfn, `{"type": "FeatureCollection","features":[`+"\n", ",\n", "\n]}")
 }
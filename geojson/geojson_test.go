@@ -0,0 +1,219 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geojson
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+// testBlocks returns two blocks, the first with a point and a linestring
+// and the second with a polygon
+func testBlocks(t *testing.T) []elements.ExtendedBlock {
+	return []elements.ExtendedBlock{
+		elements.MakeExtendedBlock(0, elements.ByElementId{
+			geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub", "!lanes", packTagInt(-2)}, []float64{1, 2}),
+			geometrytest.Element(t, 2, geometry.Linestring, []string{"highway", "primary", "%width", packTagFloat(5.5)}, []float64{0, 0, 1, 1}),
+		}, geometrytest.TileQt(t, 0, 0, 1), 0, 0, nil),
+		elements.MakeExtendedBlock(1, elements.ByElementId{
+			geometrytest.Element(t, 3, geometry.Polygon, []string{"building", "yes"}, []float64{0, 0, 1, 0, 1, 1, 0, 0}),
+		}, geometrytest.TileQt(t, 1, 0, 1), 0, 0, nil),
+	}
+}
+
+// nanBlock returns a block with a tag which can't be marshalled
+func nanBlock(t *testing.T, idx int) elements.ExtendedBlock {
+	return elements.MakeExtendedBlock(idx, elements.ByElementId{
+		geometrytest.Element(t, 4, geometry.Point, []string{"%height", packTagFloat(math.NaN())}, []float64{1, 1}),
+	}, geometrytest.TileQt(t, 0, 1, 1), 0, 0, nil)
+}
+
+func blockChan(bls ...elements.ExtendedBlock) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock, len(bls))
+	for _, bl := range bls {
+		res <- bl
+	}
+	close(res)
+	return res
+}
+
+type testFeature struct {
+	Type       string
+	Id         int64
+	Properties map[string]interface{}
+	Geometry   struct {
+		Type        string
+		Coordinates json.RawMessage
+	}
+}
+
+func checkFeatures(t *testing.T, fts []testFeature) {
+	exp := []struct {
+		id    int64
+		gt    string
+		props string
+		cc    string
+	}{
+		{1, "Point", `{"amenity":"pub","lanes":-2}`, `[1,2]`},
+		{2, "LineString", `{"highway":"primary","width":5.5}`, `[[0,0],[1,1]]`},
+		{3, "Polygon", `{"building":"yes"}`, ``},
+	}
+	if len(fts) != len(exp) {
+		t.Fatalf("%d features", len(fts))
+	}
+	for i, e := range exp {
+		ft := fts[i]
+		props, _ := json.Marshal(ft.Properties)
+		if ft.Type != "Feature" || ft.Id != e.id || ft.Geometry.Type != e.gt || string(props) != e.props {
+			t.Errorf("feature %d: %s %d %s %s", i, ft.Type, ft.Id, ft.Geometry.Type, props)
+		}
+		if e.cc != "" && string(ft.Geometry.Coordinates) != e.cc {
+			t.Errorf("feature %d: coordinates %s", i, ft.Geometry.Coordinates)
+		}
+	}
+}
+
+func TestWriteGeoJsonSeq(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{"test.geojsons", "test.geojsons.gz"} {
+		fn = filepath.Join(dir, fn)
+		_, nb, err := WriteGeoJsonSeq(blockChan(testBlocks(t)...), fn)
+		if err != nil || nb != 2 {
+			t.Fatalf("%s: wrote %d blocks: %v", fn, nb, err)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(fn) == ".gz" {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		if len(lines[len(lines)-1]) != 0 {
+			t.Errorf("%s: doesn't end with a newline", fn)
+		}
+		fts := []testFeature{}
+		for _, ln := range lines[:len(lines)-1] {
+			if ln[0] != recordSeparator {
+				t.Fatalf("%s: record %q doesn't start with a record separator", fn, ln)
+			}
+			var ft testFeature
+			if err := json.Unmarshal(ln[1:], &ft); err != nil {
+				t.Fatalf("%s: %q: %s", fn, ln, err)
+			}
+			fts = append(fts, ft)
+		}
+		checkFeatures(t, fts)
+	}
+}
+
+func TestWriteGeoJson(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.geojson")
+	_, nb, err := WriteGeoJson(blockChan(testBlocks(t)...), fn)
+	if err != nil || nb != 2 {
+		t.Fatalf("wrote %d blocks: %v", nb, err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each block is written as a FeatureCollection within the features
+	// of the file
+	var fc struct {
+		Type     string
+		Features []struct {
+			Type       string
+			Properties map[string]string
+			Features   []testFeature
+		}
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("%s with %d blocks", fc.Type, len(fc.Features))
+	}
+	fts := []testFeature{}
+	for i, bl := range fc.Features {
+		if bl.Type != "FeatureCollection" || bl.Properties["quadtree"] != testBlocks(t)[i].Quadtree().String() {
+			t.Errorf("block %d: %s %v", i, bl.Type, bl.Properties)
+		}
+		fts = append(fts, bl.Features...)
+	}
+	checkFeatures(t, fts)
+}
+
+func TestWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	bls := append(testBlocks(t), nanBlock(t, 2))
+	if _, _, err := WriteGeoJsonSeq(blockChan(bls...), filepath.Join(dir, "test.geojsons")); err == nil {
+		t.Errorf("WriteGeoJsonSeq didn't return an error")
+	}
+	if _, _, err := WriteGeoJson(blockChan(bls...), filepath.Join(dir, "test.geojson")); err == nil {
+		t.Errorf("WriteGeoJson didn't return an error")
+	}
+	if _, err := WriteGeoJsonTiles(blockChan(bls...), filepath.Join(dir, "tiles")); err == nil {
+		t.Errorf("WriteGeoJsonTiles didn't return an error")
+	}
+
+	bl := elements.MakeExtendedBlock(0, elements.ByElementId{geometrytest.Element(t, 5, geometry.Point, nil, []float64{0, 0})}, -1, 0, 0, nil)
+	if _, err := WriteGeoJsonTiles(blockChan(bl), filepath.Join(dir, "tiles")); err == nil {
+		t.Errorf("WriteGeoJsonTiles wrote a block without a quadtree")
+	}
+}
+
+func TestWriteGeoJsonTiles(t *testing.T) {
+	dir := t.TempDir()
+	bls := append(testBlocks(t), elements.MakeExtendedBlock(2, elements.ByElementId{}, geometrytest.TileQt(t, 1, 1, 1), 0, 0, nil))
+	nt, err := WriteGeoJsonTiles(blockChan(bls...), dir)
+	if err != nil || nt != 2 {
+		t.Fatalf("wrote %d tiles: %v", nt, err)
+	}
+	if TilePath(dir, 1, 1, 0) != filepath.Join(dir, "1", "1", "0.geojson") {
+		t.Errorf("tile path %s", TilePath(dir, 1, 1, 0))
+	}
+	if _, err := os.Stat(TilePath(dir, 1, 1, 1)); !os.IsNotExist(err) {
+		t.Errorf("empty block written: %v", err)
+	}
+
+	fts := []testFeature{}
+	for i, xy := range [][2]int64{{0, 0}, {1, 0}} {
+		data, err := ioutil.ReadFile(TilePath(dir, 1, xy[0], xy[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fc struct {
+			Type       string
+			Properties map[string]string
+			Features   []testFeature
+		}
+		if err := json.Unmarshal(data, &fc); err != nil {
+			t.Fatal(err)
+		}
+		if fc.Type != "FeatureCollection" || fc.Properties["quadtree"] != bls[i].Quadtree().String() {
+			t.Errorf("tile %v: %s %v", xy, fc.Type, fc.Properties)
+		}
+		fts = append(fts, fc.Features...)
+	}
+	checkFeatures(t, fts)
+}
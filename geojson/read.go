@@ -0,0 +1,437 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geojson
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+)
+
+// readBlockSize is the number of elements in each block returned by
+// ReadGeoJson
+const readBlockSize = 8000
+
+type geoJsonGeometry struct {
+	Type        string
+	Coordinates json.RawMessage
+}
+
+// geoJsonFeature is a Feature, or a FeatureCollection within the features
+// of another FeatureCollection (as written by WriteGeoJson for each block)
+type geoJsonFeature struct {
+	Type       string
+	Id         interface{}
+	OrigType   string `json:"origtype"`
+	Properties map[string]interface{}
+	Geometry   *geoJsonGeometry
+	Features   []geoJsonFeature
+}
+
+func (ft *geoJsonFeature) each(f func(*geoJsonFeature) error) error {
+	if ft.Type != "FeatureCollection" {
+		return f(ft)
+	}
+	for i := range ft.Features {
+		err := ft.Features[i].each(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rsReader replaces the record separators of GeoJSON text sequences with
+// newlines, which json.Decoder treats as whitespace. Record separators
+// can't appear within a json value.
+type rsReader struct {
+	r io.Reader
+}
+
+func (rs rsReader) Read(p []byte) (int, error) {
+	n, err := rs.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == recordSeparator {
+			p[i] = '\n'
+		}
+	}
+	return n, err
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if dd, ok := tok.(json.Delim); !ok || dd != d {
+		return errors.New(fmt.Sprintf("expected %s, not %v", d, tok))
+	}
+	return nil
+}
+
+// readFeatures calls f for each feature read from dec. The input is any
+// number of FeatureCollection or Feature objects: the features of each
+// FeatureCollection are read one at a time.
+func readFeatures(dec *json.Decoder, f func(*geoJsonFeature) error) error {
+	for {
+		err := expectDelim(dec, '{')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		obj := map[string]json.RawMessage{}
+		hasFeatures := false
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := tok.(string)
+			if k != "features" {
+				var v json.RawMessage
+				err = dec.Decode(&v)
+				if err != nil {
+					return err
+				}
+				obj[k] = v
+				continue
+			}
+			hasFeatures = true
+			err = expectDelim(dec, '[')
+			if err != nil {
+				return err
+			}
+			for dec.More() {
+				var ft geoJsonFeature
+				err = dec.Decode(&ft)
+				if err != nil {
+					return err
+				}
+				err = ft.each(f)
+				if err != nil {
+					return err
+				}
+			}
+			err = expectDelim(dec, ']')
+			if err != nil {
+				return err
+			}
+		}
+		err = expectDelim(dec, '}')
+		if err != nil {
+			return err
+		}
+
+		var ty string
+		json.Unmarshal(obj["type"], &ty)
+		switch {
+		case ty == "FeatureCollection" || hasFeatures:
+			continue
+		case ty == "Feature":
+			data, _ := json.Marshal(obj)
+			fd := json.NewDecoder(bytes.NewReader(data))
+			fd.UseNumber()
+			var ft geoJsonFeature
+			err = fd.Decode(&ft)
+			if err != nil {
+				return err
+			}
+			err = ft.each(f)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("expected Feature or FeatureCollection, not %q", ty))
+		}
+	}
+}
+
+func makeCoord(xy []float64) (geometry.Coord, error) {
+	if len(xy) < 2 {
+		return nil, errors.New("coordinate without two values")
+	}
+	return geometry.MakeCoord(0, quadtree.ToInt(xy[0]), quadtree.ToInt(xy[1])), nil
+}
+
+func makeRing(xys [][]float64) ([]geometry.Coord, error) {
+	res := make([]geometry.Coord, len(xys))
+	for i, xy := range xys {
+		c, err := makeCoord(xy)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = c
+	}
+	return res, nil
+}
+
+func makePolygon(rings [][][]float64) ([][]geometry.Coord, error) {
+	res := make([][]geometry.Coord, len(rings))
+	for i, r := range rings {
+		cc, err := makeRing(r)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = cc
+	}
+	return res, nil
+}
+
+// geometryParts converts gj into the form used by geometry.PackGeometryData.
+// Multi geometries with a single part are converted to the single type.
+// MultiPoints with more than one point and GeometryCollections aren't
+// supported.
+func geometryParts(gj *geoJsonGeometry) (geometry.GeometryType, [][][]geometry.Coord, error) {
+	var err error
+	switch gj.Type {
+	case "Point":
+		var xy []float64
+		if err = json.Unmarshal(gj.Coordinates, &xy); err == nil {
+			var c geometry.Coord
+			c, err = makeCoord(xy)
+			return geometry.Point, [][][]geometry.Coord{{{c}}}, err
+		}
+	case "MultiPoint":
+		var xys [][]float64
+		if err = json.Unmarshal(gj.Coordinates, &xys); err == nil {
+			if len(xys) != 1 {
+				return geometry.NullGeometry, nil, errors.New("MultiPoint with more than one point")
+			}
+			var c geometry.Coord
+			c, err = makeCoord(xys[0])
+			return geometry.Point, [][][]geometry.Coord{{{c}}}, err
+		}
+	case "LineString":
+		var xys [][]float64
+		if err = json.Unmarshal(gj.Coordinates, &xys); err == nil {
+			var ln []geometry.Coord
+			ln, err = makeRing(xys)
+			return geometry.Linestring, [][][]geometry.Coord{{ln}}, err
+		}
+	case "MultiLineString":
+		var lines [][][]float64
+		if err = json.Unmarshal(gj.Coordinates, &lines); err == nil {
+			var lns [][]geometry.Coord
+			lns, err = makePolygon(lines)
+			if len(lns) == 1 {
+				return geometry.Linestring, [][][]geometry.Coord{lns}, err
+			}
+			return geometry.MultiLinestring, [][][]geometry.Coord{lns}, err
+		}
+	case "Polygon":
+		var rings [][][]float64
+		if err = json.Unmarshal(gj.Coordinates, &rings); err == nil {
+			var py [][]geometry.Coord
+			py, err = makePolygon(rings)
+			return geometry.Polygon, [][][]geometry.Coord{py}, err
+		}
+	case "MultiPolygon":
+		var polys [][][][]float64
+		if err = json.Unmarshal(gj.Coordinates, &polys); err == nil {
+			parts := make([][][]geometry.Coord, len(polys))
+			for i, p := range polys {
+				parts[i], err = makePolygon(p)
+				if err != nil {
+					return geometry.NullGeometry, nil, err
+				}
+			}
+			if len(parts) == 1 {
+				return geometry.Polygon, parts, nil
+			}
+			return geometry.Multi, parts, nil
+		}
+	default:
+		return geometry.NullGeometry, nil, errors.New(fmt.Sprintf("unsupported geometry type %q", gj.Type))
+	}
+	return geometry.NullGeometry, nil, err
+}
+
+func packTagInt(i int64) string {
+	r := make([]byte, 10)
+	return string(r[:utils.WriteVarint(r, 0, i)])
+}
+
+func packTagFloat(f float64) string {
+	r := make([]byte, 10)
+	return string(r[:utils.WriteUvarint(r, 0, math.Float64bits(f))])
+}
+
+// makeTags converts the properties of a feature into tags, in the form
+// read by geometry.TagValue: integers are stored with a key starting !,
+// other numbers with a key starting %, and nulls with a key starting $.
+// Other values which aren't strings are stored as json. Also returns the
+// tags with all values as strings, for finding the z_order.
+func makeTags(props map[string]interface{}) (elements.Tags, elements.Tags) {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tk, tv := make([]string, 0, len(keys)), make([]string, 0, len(keys))
+	sk, sv := make([]string, 0, len(keys)), make([]string, 0, len(keys))
+	for _, k := range keys {
+		switch v := props[k].(type) {
+		case string:
+			tk, tv = append(tk, k), append(tv, v)
+			sk, sv = append(sk, k), append(sv, v)
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				tk, tv = append(tk, "!"+k), append(tv, packTagInt(i))
+			} else {
+				f, _ := v.Float64()
+				tk, tv = append(tk, "%"+k), append(tv, packTagFloat(f))
+			}
+			sk, sv = append(sk, k), append(sv, v.String())
+		case nil:
+			tk, tv = append(tk, "$"+k), append(tv, "")
+		default:
+			js, _ := json.Marshal(v)
+			tk, tv = append(tk, k), append(tv, string(js))
+			sk, sv = append(sk, k), append(sv, string(js))
+		}
+	}
+	return elements.MakeTags(tk, tv), elements.MakeTags(sk, sv)
+}
+
+// featureId returns the id of ft if it is an integer (or a string
+// containing an integer)
+func featureId(ft *geoJsonFeature) (elements.Ref, bool) {
+	var n json.Number
+	switch v := ft.Id.(type) {
+	case json.Number:
+		n = v
+	case string:
+		n = json.Number(v)
+	default:
+		return 0, false
+	}
+	i, err := n.Int64()
+	return elements.Ref(i), err == nil
+}
+
+func originalType(ft *geoJsonFeature, gt geometry.GeometryType) elements.ElementType {
+	switch strings.ToUpper(ft.OrigType) {
+	case "N", "NODE":
+		return elements.Node
+	case "W", "WAY":
+		return elements.Way
+	case "R", "RELATION":
+		return elements.Relation
+	}
+	switch gt {
+	case geometry.Point:
+		return elements.Node
+	case geometry.Multi, geometry.MultiLinestring:
+		return elements.Relation
+	}
+	return elements.Way
+}
+
+// ReadGeoJson reads the features of a GeoJSON file (compressed if fn ends
+// with .gz), which may be a FeatureCollection, or a sequence of Features
+// either one per line or as GeoJSON text sequences (RFC 8142), as written
+// by WriteGeoJson and WriteGeoJsonSeq. Each feature is returned as a
+// Geometry element (see geometry.PackGeometryData), with the properties as
+// tags (see makeTags) and the quadtree calculated using params. Features
+// are given their id if it is an integer, otherwise a sequential id
+// starting from one. If the feature has an origtype (as written by
+// MakeFeature) this gives the original element type. Coordinates must be
+// longitude and latitude. Features without a geometry, or with a geometry
+// which isn't supported or isn't valid, are skipped. The features are
+// read as needed, in blocks of 8000 elements: call the returned function
+// once the channel has been closed.
+func ReadGeoJson(fn string, params quadtree.Params) (<-chan elements.ExtendedBlock, func() error, error) {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var reader io.Reader = fl
+	if strings.HasSuffix(fn, ".gz") {
+		reader, err = gzip.NewReader(fl)
+		if err != nil {
+			fl.Close()
+			return nil, nil, err
+		}
+	}
+
+	res := make(chan elements.ExtendedBlock)
+	done := make(chan error, 1)
+	go func() {
+		defer fl.Close()
+		dec := json.NewDecoder(rsReader{reader})
+		dec.UseNumber()
+
+		ts := make(elements.ByElementId, 0, readBlockSize)
+		ii, nf, nextId := 0, 0, elements.Ref(1)
+		skipped := map[string]int{}
+		err := readFeatures(dec, func(ft *geoJsonFeature) error {
+			if ft.Geometry == nil {
+				skipped["no geometry"]++
+				return nil
+			}
+			gt, parts, err := geometryParts(ft.Geometry)
+			if err != nil {
+				skipped[err.Error()]++
+				return nil
+			}
+			tags, stags := makeTags(ft.Properties)
+			data, bx, err := geometry.PackGeometryData(gt, originalType(ft, gt), stags, nil, parts)
+			if err != nil {
+				skipped[err.Error()]++
+				return nil
+			}
+			var qt quadtree.Quadtree
+			if gt == geometry.Point {
+				qt, err = params.CalculatePoint(bx.Minx, bx.Miny)
+			} else {
+				qt, err = params.Calculate(bx)
+			}
+			if err != nil {
+				return err
+			}
+			id, ok := featureId(ft)
+			if !ok {
+				id = nextId
+				nextId++
+			}
+			ts = append(ts, elements.MakeGeometry(id, nil, tags, data, qt, elements.Normal))
+			nf++
+			if len(ts) == readBlockSize {
+				res <- elements.MakeExtendedBlock(ii, ts, -1, 0, 0, nil)
+				ii++
+				ts = make(elements.ByElementId, 0, readBlockSize)
+			}
+			return nil
+		})
+		if err == nil && len(ts) > 0 {
+			res <- elements.MakeExtendedBlock(ii, ts, -1, 0, 0, nil)
+		}
+		for k, v := range skipped {
+			log.Printf("%s: skipped %d features: %s\n", fn, v, k)
+		}
+		log.Printf("%s: read %d features\n", fn, nf)
+		close(res)
+		done <- err
+	}()
+	wait := func() error { return <-done }
+	return res, wait, nil
+}
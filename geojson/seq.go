@@ -0,0 +1,65 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geojson
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/utils"
+)
+
+// recordSeparator starts each GeoJSON text sequence record (RFC 8142)
+const recordSeparator = 0x1e
+
+// MakeFeatureSequence converts the Geometry elements of bl into GeoJSON
+// text sequence records: each feature (see MakeFeature) is written on its
+// own line, preceded by an ASCII record separator. If asMerc is true,
+// project coordinates into espg 900913, otherwise write as latitude and
+// longitude.
+func MakeFeatureSequence(bl elements.ExtendedBlock, asMerc bool) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := 0; i < bl.Len(); i++ {
+		e := bl.Element(i)
+		if e.Type() != elements.Geometry {
+			continue
+		}
+		o, err := geometry.ExtractGeometry(e)
+		if err != nil {
+			return nil, err
+		}
+		om, err := MakeFeature(o, asMerc)
+		if err != nil {
+			return nil, err
+		}
+		d, err := json.Marshal(om)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(recordSeparator)
+		buf.Write(d)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteGeoJsonSeq writes a stream of elements.ExtendedBlock, containing
+// Geometry elements, to outfn as GeoJSON text sequences (RFC 8142), with
+// one feature per line. If outfn ends with .gz the output is compressed.
+// Returns the number of bytes and blocks written.
+func WriteGeoJsonSeq(sblc <-chan elements.ExtendedBlock, outfn string) (int, int, error) {
+	outc := make(chan utils.Idxer)
+	go func() {
+		for bl := range sblc {
+			d, err := MakeFeatureSequence(bl, false)
+			outc <- idxData{bl.Idx(), d, err}
+		}
+		close(outc)
+	}()
+	return writeOsmJson(outc, outfn, "", "", "")
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geojson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+// TilePath returns the path of the tile at zoom z, column x and row y (row
+// 0 at the top, as given by quadtree.Quadtree.Tuple) within outdir.
+func TilePath(outdir string, z, x, y int64) string {
+	return filepath.Join(outdir, fmt.Sprintf("%d", z), fmt.Sprintf("%d", x), fmt.Sprintf("%d.geojson", y))
+}
+
+// WriteGeoJsonTiles writes each elements.ExtendedBlock of sblc, containing
+// Geometry elements, to a separate GeoJSON file in outdir, as given by
+// MakeFeatureCollection. The files are named z/x/y.geojson (see TilePath)
+// from the quadtree of each block. Blocks without any elements are
+// skipped. Returns the number of files written.
+func WriteGeoJsonTiles(sblc <-chan elements.ExtendedBlock, outdir string) (int, error) {
+	nt, tb := 0, 0
+	var resErr error
+	for bl := range sblc {
+		if resErr != nil || bl.Len() == 0 {
+			continue
+		}
+		if bl.Quadtree() < 0 {
+			resErr = errors.New(fmt.Sprintf("block %d has no quadtree", bl.Idx()))
+			continue
+		}
+		bll, err := MakeFeatureCollection(bl, false)
+		if err != nil {
+			resErr = err
+			continue
+		}
+		d, err := json.Marshal(bll)
+		if err != nil {
+			resErr = err
+			continue
+		}
+		x, y, z := bl.Quadtree().Tuple()
+		fn := TilePath(outdir, z, x, y)
+		err = os.MkdirAll(filepath.Dir(fn), 0775)
+		if err == nil {
+			err = ioutil.WriteFile(fn, d, 0664)
+		}
+		if err != nil {
+			resErr = err
+			continue
+		}
+		nt++
+		tb += len(d)
+		if (bl.Idx() % 100) == 0 {
+			log.Printf("%-6d: %d tiles, %10.1f mb\n", bl.Idx(), nt, float64(tb)/1024.0/1024.0)
+		}
+	}
+	if resErr != nil {
+		return nt, resErr
+	}
+	log.Printf("%s: %d tiles, %10.1f mb\n", outdir, nt, float64(tb)/1024.0/1024.0)
+	return nt, nil
+}
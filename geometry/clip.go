@@ -0,0 +1,433 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"math"
+)
+
+// ClipGeometry returns the parts of g within bx. Points outside bx are
+// dropped, Linestrings are split into a Linestring for each part within
+// bx (the lines of a MultiLinestring are split in the same way), and the
+// rings of a Polygon or MultiGeometry are clipped with clipRing: a concave
+// ring which leaves and reenters bx gives a polygon for each part within
+// bx, so a Polygon may become a MultiGeometry. Returns nil if nothing of g
+// is within bx, or g if g is entirely within bx.
+func ClipGeometry(g Geometry, bx quadtree.Bbox) []Geometry {
+	gb := g.Bbox()
+	if !bx.Intersects(gb) {
+		return nil
+	}
+	if bx.Contains(gb) {
+		return []Geometry{g}
+	}
+	switch g.GeometryType() {
+	case Linestring:
+		ln := g.(LinestringGeometry)
+		cc := make([]Coord, ln.NumCoords())
+		for i := range cc {
+			cc[i] = ln.Coord(i)
+		}
+		res := []Geometry{}
+		for _, p := range clipLine(cc, bx) {
+			res = append(res, makeLinestringGeometry(g, g.OriginalType(), g.Tags(), p, ln.ZOrder()))
+		}
+		return res
+	case MultiLinestring:
+		ml := g.(MultiLinestringGeometry)
+		lines, roles := [][]Coord{}, []string{}
+		for i := 0; i < ml.NumLines(); i++ {
+			cc := make([]Coord, ml.NumCoords(i))
+			for j := range cc {
+				cc[j] = ml.Coord(i, j)
+			}
+			for _, p := range clipLine(cc, bx) {
+				lines = append(lines, p)
+				roles = append(roles, ml.Role(i))
+			}
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		return []Geometry{makeMultiLinestringGeometry(g, g.OriginalType(), g.Tags(), lines, roles, ml.ZOrder())}
+	case Polygon:
+		py := g.(PolygonGeometry)
+		return clippedPolygons(g, clipPolygon(polygonRings(py.NumRings(), py.NumCoords, py.Coord), bx), py.ZOrder())
+	case Multi:
+		mg := g.(MultiGeometry)
+		polys := [][][]Coord{}
+		for i := 0; i < mg.NumGeometries(); i++ {
+			ii := i
+			polys = append(polys, clipPolygon(polygonRings(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) Coord { return mg.Coord(ii, j, k) }), bx)...)
+		}
+		return clippedPolygons(g, polys, mg.ZOrder())
+	}
+	// points are entirely within or outside bx
+	return nil
+}
+
+// clippedPolygons returns a Polygon, or MultiGeometry if there is more than
+// one of polys, with the tags and metadata of g
+func clippedPolygons(g Geometry, polys [][][]Coord, zorder int64) []Geometry {
+	ar := 0.0
+	for _, p := range polys {
+		a, _ := calculate_polygon_area(p)
+		ar += a
+	}
+	switch len(polys) {
+	case 0:
+		return nil
+	case 1:
+		return []Geometry{makePolygonGeometry(g, g.OriginalType(), g.Tags(), polys[0], zorder, ar)}
+	}
+	return []Geometry{makeMultiGeometry(g, g.OriginalType(), g.Tags(), polys, zorder, ar)}
+}
+
+// ClipToTiles splits each geometry in inc with a quadtree level less than
+// level into pieces for each tile at level, clipped to the bounds of the
+// tile (expanded by buffer, as a fraction of the tile size). The pieces are
+// given the quadtree of the tile, and returned in a block for each tile
+// following the geometries which were not clipped. Use after the
+// quadtrees of the geometries have been recalculated (see
+// GenerateGeometries).
+func ClipToTiles(inc <-chan elements.ExtendedBlock, level uint, buffer float64) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		ii := 0
+		for bl := range inc {
+			nb := make(elements.ByElementId, 0, bl.Len())
+			tiles := map[quadtree.Quadtree]elements.ByElementId{}
+			for i := 0; i < bl.Len(); i++ {
+				e := bl.Element(i)
+				g, ok := e.(Geometry)
+				if !ok || uint(g.Quadtree()&31) >= level {
+					nb = append(nb, e)
+					continue
+				}
+				tt := quadtree.Tiles(g.Bbox(), level)
+				if t, ok := containingTile(tt, g.Bbox(), buffer); ok {
+					g.SetQuadtree(t)
+					tiles[t] = append(tiles[t], g)
+					continue
+				}
+				for _, t := range tt {
+					for _, p := range ClipGeometry(g, t.Bounds(buffer)) {
+						p.SetQuadtree(t)
+						tiles[t] = append(tiles[t], p)
+					}
+				}
+			}
+			if len(nb) > 0 {
+				res <- elements.MakeExtendedBlock(ii, nb, bl.Quadtree(), bl.StartDate(), bl.EndDate(), bl.Tags())
+				ii++
+			}
+			qts := make(quadtree.QuadtreeSlice, 0, len(tiles))
+			for t := range tiles {
+				qts = append(qts, t)
+			}
+			qts.Sort()
+			for _, t := range qts {
+				tb := tiles[t]
+				tb.Sort()
+				res <- elements.MakeExtendedBlock(ii, tb, t, bl.StartDate(), bl.EndDate(), nil)
+				ii++
+			}
+		}
+		close(res)
+	}()
+	return res
+}
+
+// containingTile returns the first of tt which contains gb, when expanded
+// by buffer
+func containingTile(tt []quadtree.Quadtree, gb quadtree.Bbox, buffer float64) (quadtree.Quadtree, bool) {
+	for _, t := range tt {
+		if t.Bounds(buffer).Contains(gb) {
+			return t, true
+		}
+	}
+	return quadtree.Null, false
+}
+
+// clipLine returns the parts of cc within bx
+func clipLine(cc []Coord, bx quadtree.Bbox) [][]Coord {
+	res := [][]Coord{}
+	var curr []Coord
+	for i := 0; i < len(cc)-1; i++ {
+		a, b, ok, leaves := clipSegment(cc[i], cc[i+1], bx)
+		if !ok {
+			if len(curr) > 1 {
+				res = append(res, curr)
+			}
+			curr = nil
+			continue
+		}
+		if curr == nil {
+			curr = []Coord{a}
+		}
+		curr = append(curr, b)
+		if leaves {
+			res = append(res, curr)
+			curr = nil
+		}
+	}
+	if len(curr) > 1 {
+		res = append(res, curr)
+	}
+	return res
+}
+
+// clipSegment clips the segment a-b to bx, using the Liang-Barsky
+// algorithm. Points within bx are returned unchanged. Also returns true
+// if the segment leaves bx before reaching b.
+func clipSegment(a, b Coord, bx quadtree.Bbox) (Coord, Coord, bool, bool) {
+	x0, y0 := float64(a.Lon()), float64(a.Lat())
+	dx, dy := float64(b.Lon())-x0, float64(b.Lat())-y0
+	t0, t1 := 0.0, 1.0
+	clip := func(p, q float64) bool {
+		if p == 0 {
+			return q >= 0
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return false
+			}
+			if r > t0 {
+				t0 = r
+			}
+		} else {
+			if r < t0 {
+				return false
+			}
+			if r < t1 {
+				t1 = r
+			}
+		}
+		return true
+	}
+	if !clip(-dx, x0-float64(bx.Minx)) || !clip(dx, float64(bx.Maxx)-x0) ||
+		!clip(-dy, y0-float64(bx.Miny)) || !clip(dy, float64(bx.Maxy)-y0) {
+		return nil, nil, false, false
+	}
+	ca, cb := a, b
+	if t0 > 0 {
+		ca = coordImpl{0, int64(math.Floor(x0 + t0*dx + 0.5)), int64(math.Floor(y0 + t0*dy + 0.5))}
+	}
+	if t1 < 1 {
+		cb = coordImpl{0, int64(math.Floor(x0 + t1*dx + 0.5)), int64(math.Floor(y0 + t1*dy + 0.5))}
+	}
+	return ca, cb, true, t1 < 1
+}
+
+// clipPolygon clips the rings of py to bx, returning a polygon for each
+// part of the outer ring within bx, followed by the parts of the inner
+// rings it contains. Returns nil if nothing of py is within bx. Inner rings
+// which cross the edge of bx are clipped in the same way, so may touch
+// the outer ring along the edge of bx.
+func clipPolygon(py [][]Coord, bx quadtree.Bbox) [][][]Coord {
+	if len(py) == 0 {
+		return nil
+	}
+	outers, _ := clipRing(py[0], bx)
+	if len(outers) == 0 {
+		return nil
+	}
+	res := make([][][]Coord, len(outers))
+	for i, o := range outers {
+		res[i] = [][]Coord{o}
+	}
+	var refs []map[elements.Ref]bool
+	for _, r := range py[1:] {
+		inners, covers := clipRing(r, bx)
+		if covers {
+			// bx is within this inner ring
+			return nil
+		}
+		for _, in := range inners {
+			if len(res) == 1 {
+				res[0] = append(res[0], in)
+				continue
+			}
+			if refs == nil {
+				refs = make([]map[elements.Ref]bool, len(outers))
+				for i, o := range outers {
+					refs[i] = map[elements.Ref]bool{}
+					for _, c := range o {
+						refs[i][c.Ref()] = true
+					}
+				}
+			}
+			for i, o := range outers {
+				if ringWithin(in, o, refs[i]) {
+					res[i] = append(res[i], in)
+					break
+				}
+			}
+		}
+	}
+	return res
+}
+
+// clipRing clips the closed ring rr to bx, returning a ring for each part
+// of rr within bx. As with the Weiler-Atherton algorithm, each part of rr
+// leaving bx is joined to the next part reentering bx along the edge of
+// bx (in the direction of rr), so a concave ring which leaves and reenters
+// bx may give more than one ring, and no zero width sections are left
+// along the edge of bx. If bx is entirely within rr, the bounds of bx are
+// returned, and covers is true.
+func clipRing(rr []Coord, bx quadtree.Bbox) ([][]Coord, bool) {
+	rr = drop_repeats(rr)
+	if len(rr) < 4 {
+		return nil, false
+	}
+	// work with a counter-clockwise ring
+	_, ccw := calculate_ring_area(rr)
+	pts := append([]Coord{}, rr[:len(rr)-1]...)
+	if !ccw {
+		reverseCoords(pts)
+	}
+
+	// start from a point outside bx
+	st := -1
+	for i, c := range pts {
+		if c.Lon() < bx.Minx || c.Lon() > bx.Maxx || c.Lat() < bx.Miny || c.Lat() > bx.Maxy {
+			st = i
+			break
+		}
+	}
+	if st == -1 {
+		return [][]Coord{rr}, false
+	}
+
+	// the parts of the ring within bx, each starting and ending on the
+	// edge of bx. Parts which only touch the edge are dropped.
+	parts := [][]Coord{}
+	var curr []Coord
+	for i := range pts {
+		a, b, ok, leaves := clipSegment(pts[(st+i)%len(pts)], pts[(st+i+1)%len(pts)], bx)
+		if !ok {
+			continue
+		}
+		if curr == nil {
+			curr = []Coord{a}
+		}
+		curr = append(curr, b)
+		if leaves {
+			if cc := drop_repeats(curr); len(cc) > 1 {
+				parts = append(parts, cc)
+			}
+			curr = nil
+		}
+	}
+
+	if len(parts) == 0 {
+		// rr doesn't cross bx: bx is either entirely within or outside rr
+		if !quadtree.PointInPoly(llb(rr), (bx.Minx+bx.Maxx)/2, (bx.Miny+bx.Maxy)/2) {
+			return nil, false
+		}
+		box := []Coord{coordImpl{0, bx.Minx, bx.Miny}, coordImpl{0, bx.Maxx, bx.Miny},
+			coordImpl{0, bx.Maxx, bx.Maxy}, coordImpl{0, bx.Minx, bx.Maxy}, coordImpl{0, bx.Minx, bx.Miny}}
+		if !ccw {
+			reverseCoords(box)
+		}
+		return [][]Coord{box}, true
+	}
+
+	// distance along the edge of bx, counter-clockwise from (Minx, Miny)
+	w, h := float64(bx.Maxx-bx.Minx), float64(bx.Maxy-bx.Miny)
+	perim := 2 * (w + h)
+	edgePos := func(c Coord) float64 {
+		x, y := c.Lon(), c.Lat()
+		db, dr, dt, dl := y-bx.Miny, bx.Maxx-x, bx.Maxy-y, x-bx.Minx
+		switch {
+		case db <= dr && db <= dt && db <= dl:
+			return float64(x - bx.Minx)
+		case dr <= dt && dr <= dl:
+			return w + float64(y-bx.Miny)
+		case dt <= dl:
+			return 2*w + h - float64(x-bx.Minx)
+		}
+		return perim - float64(y-bx.Miny)
+	}
+	corners := []Coord{coordImpl{0, bx.Minx, bx.Miny}, coordImpl{0, bx.Maxx, bx.Miny},
+		coordImpl{0, bx.Maxx, bx.Maxy}, coordImpl{0, bx.Minx, bx.Maxy}}
+	cornerPos := []float64{0, w, w + h, 2*w + h}
+
+	res := [][]Coord{}
+	used := make([]bool, len(parts))
+	for i := range parts {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		ring := append([]Coord{}, parts[i]...)
+		for {
+			// find the next part reentering bx, counter-clockwise from
+			// where the ring leaves
+			e := edgePos(ring[len(ring)-1])
+			next, nd := -1, perim+1
+			for j, p := range parts {
+				if used[j] && j != i {
+					continue
+				}
+				d := edgePos(p[0]) - e
+				if d < 0 {
+					d += perim
+				}
+				if d < nd {
+					next, nd = j, d
+				}
+			}
+			// add the corners of bx passed on the way
+			c0 := cornerIdx(e, cornerPos)
+			for n := range corners {
+				k := (c0 + n) % 4
+				d := cornerPos[k] - e
+				if d <= 0 {
+					d += perim
+				}
+				if d < nd {
+					ring = append(ring, corners[k])
+				}
+			}
+			if next == i {
+				ring = append(ring, ring[0])
+				break
+			}
+			used[next] = true
+			ring = append(ring, parts[next]...)
+		}
+		ring = drop_repeats(ring)
+		if len(ring) < 4 {
+			continue
+		}
+		if a, _ := calculate_ring_area(ring); a == 0 {
+			continue
+		}
+		if !ccw {
+			reverseCoords(ring)
+		}
+		res = append(res, ring)
+	}
+	return res, false
+}
+
+// cornerIdx returns the index of the first corner of bx counter-clockwise
+// from edge position e
+func cornerIdx(e float64, cornerPos []float64) int {
+	for k, c := range cornerPos {
+		if c > e {
+			return k
+		}
+	}
+	return 0
+}
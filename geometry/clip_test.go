@@ -0,0 +1,174 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+func closedRing(ref elements.Ref, ll ...float64) []Coord {
+	r := testRing(ref, ll...)
+	return append(r, r[0])
+}
+
+// testBox is the bbox from (0, 0) to (10, 10) degrees
+var testBox = quadtree.Bbox{Minx: 0, Miny: 0, Maxx: 100000000, Maxy: 100000000}
+
+func ringBbox(r []Coord) quadtree.Bbox {
+	return *makeBbox(r)
+}
+
+func TestClipRingConcave(t *testing.T) {
+	// two prongs reaching into testBox from below, joined outside it
+	prongs := closedRing(1, 1, -5, 9, -5, 9, 5, 7, 5, 7, -2, 3, -2, 3, 5, 1, 5)
+
+	for _, reverse := range []bool{false, true} {
+		rr := append([]Coord{}, prongs...)
+		if reverse {
+			reverseCoords(rr)
+		}
+		res, covers := clipRing(rr, testBox)
+		if covers || len(res) != 2 {
+			t.Fatalf("reverse=%v: %d rings, covers %v, expected 2 rings", reverse, len(res), covers)
+		}
+		expected := []quadtree.Bbox{
+			{Minx: 70000000, Miny: 0, Maxx: 90000000, Maxy: 50000000},
+			{Minx: 10000000, Miny: 0, Maxx: 30000000, Maxy: 50000000},
+		}
+		for _, r := range res {
+			if len(r) != 5 {
+				t.Errorf("reverse=%v: ring with %d coords, expected 5", reverse, len(r))
+			}
+			if _, ccw := calculate_ring_area(r); ccw == reverse {
+				t.Errorf("reverse=%v: ring orientation changed", reverse)
+			}
+			bx := ringBbox(r)
+			if bx != expected[0] && bx != expected[1] {
+				t.Errorf("reverse=%v: unexpected ring bbox %s", reverse, bx)
+			}
+		}
+		if ringBbox(res[0]) == ringBbox(res[1]) {
+			t.Errorf("reverse=%v: rings both have bbox %s", reverse, ringBbox(res[0]))
+		}
+	}
+}
+
+func TestClipRingCorners(t *testing.T) {
+	// a ring covering the north east corner of testBox, and one leaving
+	// through the east edge and reentering through the north edge
+	tests := []struct {
+		name   string
+		ring   []Coord
+		coords int
+		bbox   quadtree.Bbox
+	}{
+		{"corner", closedRing(1, 5, 5, 15, 5, 15, 15, 5, 15),
+			5, quadtree.Bbox{Minx: 50000000, Miny: 50000000, Maxx: 100000000, Maxy: 100000000}},
+		{"around corner", closedRing(1, 5, 5, 15, 5, 15, 15, 8, 15, 8, 8, 5, 8),
+			7, quadtree.Bbox{Minx: 50000000, Miny: 50000000, Maxx: 100000000, Maxy: 100000000}},
+		{"within", closedRing(1, 2, 2, 4, 2, 4, 4, 2, 4),
+			5, quadtree.Bbox{Minx: 20000000, Miny: 20000000, Maxx: 40000000, Maxy: 40000000}},
+		{"encloses", closedRing(1, -5, -5, 15, -5, 15, 15, -5, 15),
+			5, testBox},
+	}
+	for _, tt := range tests {
+		res, covers := clipRing(tt.ring, testBox)
+		if len(res) != 1 {
+			t.Errorf("%s: %d rings", tt.name, len(res))
+			continue
+		}
+		if covers != (tt.name == "encloses") {
+			t.Errorf("%s: covers %v", tt.name, covers)
+		}
+		if len(res[0]) != tt.coords || ringBbox(res[0]) != tt.bbox {
+			t.Errorf("%s: %d coords, bbox %s: expected %d, %s", tt.name, len(res[0]), ringBbox(res[0]), tt.coords, tt.bbox)
+		}
+	}
+
+	if res, covers := clipRing(closedRing(1, 20, 20, 30, 20, 30, 30, 20, 30), testBox); res != nil || covers {
+		t.Errorf("ring outside bbox: %d rings, covers %v", len(res), covers)
+	}
+	// touching the edge of the box from outside
+	if res, _ := clipRing(closedRing(1, 10, 2, 15, 2, 15, 8, 10, 8), testBox); len(res) != 0 {
+		t.Errorf("ring touching bbox: %d rings", len(res))
+	}
+}
+
+func TestClipGeometryPolygon(t *testing.T) {
+	prongs := closedRing(1, 1, -5, 9, -5, 9, 5, 7, 5, 7, -2, 3, -2, 3, 5, 1, 5)
+	// a hole in the eastern prong
+	hole := closedRing(20, 7.5, 1, 7.5, 2, 8.5, 2, 8.5, 1)
+
+	py := makePolygonGeometry(testElement(1), elements.Way, nil, [][]Coord{prongs, hole}, 5, 0)
+	res := ClipGeometry(py, testBox)
+	if len(res) != 1 || res[0].GeometryType() != Multi {
+		t.Fatalf("ClipGeometry returned %v", res)
+	}
+	mg := res[0].(MultiGeometry)
+	if mg.NumGeometries() != 2 || mg.ZOrder() != 5 || mg.Id() != 1 {
+		t.Fatalf("clipped geometry %v", mg)
+	}
+	for i := 0; i < 2; i++ {
+		east := mg.Coord(i, 0, 0).Lon() > 50000000
+		if east != (mg.NumRings(i) == 2) {
+			t.Errorf("polygon %d (east %v) has %d rings", i, east, mg.NumRings(i))
+		}
+	}
+	ar := 0.0
+	for i := 0; i < 2; i++ {
+		for j := 0; j < mg.NumRings(i); j++ {
+			a, _ := calculate_ring_area(ringCoords(mg, i, j))
+			if j == 0 {
+				ar += a
+			} else {
+				ar -= a
+			}
+		}
+	}
+	if d := mg.Area() - ar; d*d > 1 {
+		t.Errorf("area %f, expected %f", mg.Area(), ar)
+	}
+
+	// a polygon with testBox inside its hole
+	big := closedRing(1, -20, -20, 30, -20, 30, 30, -20, 30)
+	bigHole := closedRing(10, -10, -10, 20, -10, 20, 20, -10, 20)
+	py = makePolygonGeometry(testElement(2), elements.Way, nil, [][]Coord{big, bigHole}, 0, 0)
+	if res := ClipGeometry(py, testBox); len(res) != 0 {
+		t.Errorf("polygon around bbox clipped to %v", res)
+	}
+	// and without the hole
+	py = makePolygonGeometry(testElement(2), elements.Way, nil, [][]Coord{big}, 0, 0)
+	res = ClipGeometry(py, testBox)
+	if len(res) != 1 || res[0].GeometryType() != Polygon || res[0].Bbox() != testBox {
+		t.Errorf("polygon around bbox clipped to %v", res)
+	}
+}
+
+func ringCoords(mg MultiGeometry, i, j int) []Coord {
+	res := make([]Coord, mg.NumCoords(i, j))
+	for k := range res {
+		res[k] = mg.Coord(i, j, k)
+	}
+	return res
+}
+
+func TestClipGeometryLinestring(t *testing.T) {
+	ln := makeLinestringGeometry(testElement(1), elements.Way, nil,
+		testRing(1, -5, 5, 5, 5, 5, 15, 6, 15, 6, 5, 15, 5), 0)
+	res := ClipGeometry(ln, testBox)
+	if len(res) != 2 {
+		t.Fatalf("linestring clipped to %d parts, expected 2", len(res))
+	}
+	for _, r := range res {
+		l := r.(LinestringGeometry)
+		if l.NumCoords() != 3 || !testBox.Contains(l.Bbox()) {
+			t.Errorf("clipped linestring with %d coords, bbox %s", l.NumCoords(), l.Bbox())
+		}
+	}
+}
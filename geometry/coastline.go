@@ -0,0 +1,673 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CoastlineProblemKind identifies a problem found when joining coastline
+// ways
+type CoastlineProblemKind int
+
+const (
+	CoastlineGap          CoastlineProblemKind = iota // end of a coastline which doesn't join another
+	CoastlineReversedWay                              // way reversed to join the adjacent coastline
+	CoastlineReversedRing                             // clockwise ring not within any land, reversed
+)
+
+func (k CoastlineProblemKind) String() string {
+	switch k {
+	case CoastlineGap:
+		return "gap"
+	case CoastlineReversedWay:
+		return "reversed way"
+	case CoastlineReversedRing:
+		return "reversed ring"
+	}
+	return fmt.Sprintf("CoastlineProblemKind(%d)", int(k))
+}
+
+// CoastlineProblem describes a problem with coastline way Way, at Lon, Lat.
+type CoastlineProblem struct {
+	Kind     CoastlineProblemKind
+	Way      elements.Ref
+	Lon, Lat int64
+}
+
+func (cp CoastlineProblem) String() string {
+	return fmt.Sprintf("coastline %s [way %d] @ %0.7f, %0.7f",
+		cp.Kind, cp.Way, quadtree.ToFloat(cp.Lon), quadtree.ToFloat(cp.Lat))
+}
+
+type coastLine struct {
+	ways   []elements.Ref
+	coords []Coord
+}
+
+func (cl *coastLine) first() elements.Ref { return cl.coords[0].Ref() }
+func (cl *coastLine) last() elements.Ref  { return cl.coords[len(cl.coords)-1].Ref() }
+
+func (cl *coastLine) reverse() {
+	reverseCoords(cl.coords)
+	for i := 0; i < len(cl.ways)/2; i++ {
+		j := len(cl.ways) - 1 - i
+		cl.ways[i], cl.ways[j] = cl.ways[j], cl.ways[i]
+	}
+}
+
+// coastJoiner joins coastline ways end to start
+type coastJoiner struct {
+	starts, ends map[elements.Ref]*coastLine
+	rings        []*coastLine
+	// lines which start or end at the same node as another line
+	conflicts []*coastLine
+}
+
+func (cj *coastJoiner) remove(cl *coastLine) {
+	delete(cj.starts, cl.first())
+	delete(cj.ends, cl.last())
+}
+
+func (cj *coastJoiner) add(cl *coastLine) {
+	if e, ok := cj.ends[cl.first()]; ok {
+		cj.remove(e)
+		e.coords = append(e.coords, cl.coords[1:]...)
+		e.ways = append(e.ways, cl.ways...)
+		cl = e
+	}
+	if cl.first() == cl.last() {
+		cj.rings = append(cj.rings, cl)
+		return
+	}
+	if s, ok := cj.starts[cl.last()]; ok {
+		cj.remove(s)
+		cl.coords = append(cl.coords, s.coords[1:]...)
+		cl.ways = append(cl.ways, s.ways...)
+	}
+	if cl.first() == cl.last() {
+		cj.rings = append(cj.rings, cl)
+		return
+	}
+	_, sc := cj.starts[cl.first()]
+	_, ec := cj.ends[cl.last()]
+	if sc || ec {
+		cj.conflicts = append(cj.conflicts, cl)
+		return
+	}
+	cj.starts[cl.first()] = cl
+	cj.ends[cl.last()] = cl
+}
+
+// fixConflicts reverses lines which start at the same node as another
+// line starts, or end where another line ends. The line with fewer ways is
+// assumed to be wrong.
+func (cj *coastJoiner) fixConflicts(report func(CoastlineProblem)) {
+	cc := cj.conflicts
+	cj.conflicts = nil
+	for _, cl := range cc {
+		at := cl.coords[0]
+		other, ok := cj.starts[cl.first()]
+		if !ok {
+			at = cl.coords[len(cl.coords)-1]
+			other, ok = cj.ends[cl.last()]
+		}
+		if ok && len(other.ways) < len(cl.ways) {
+			cj.remove(other)
+			cl, other = other, cl
+			cj.add(other)
+		}
+		cl.reverse()
+		if report != nil {
+			for _, w := range cl.ways {
+				report(CoastlineProblem{CoastlineReversedWay, w, at.Lon(), at.Lat()})
+			}
+		}
+		cj.add(cl)
+	}
+}
+
+type coastLinesByWay []*coastLine
+
+func (c coastLinesByWay) Len() int           { return len(c) }
+func (c coastLinesByWay) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c coastLinesByWay) Less(i, j int) bool { return c[i].ways[0] < c[j].ways[0] }
+
+// coastlineWayCoords returns the coordinates of e, if e is a natural=coastline
+// way with node locations (see AddWayCoords), or a Linestring or Polygon
+// geometry made from such a way.
+func coastlineWayCoords(e elements.Element) []Coord {
+	fe, ok := e.(elements.FullElement)
+	if !ok || fe.Tags() == nil {
+		return nil
+	}
+	tags := fe.Tags()
+	isCoast := false
+	for i := 0; i < tags.Len(); i++ {
+		if tags.Key(i) == "natural" && tags.Value(i) == "coastline" {
+			isCoast = true
+		}
+	}
+	if !isCoast {
+		return nil
+	}
+	switch e.Type() {
+	case elements.Way:
+		if wp, ok := e.(elements.WayPoints); ok && wp.Len() > 1 {
+			return make_ring(wp)
+		}
+	case elements.Geometry:
+		g := e.(Geometry)
+		if g.OriginalType() != elements.Way {
+			return nil
+		}
+		switch g.GeometryType() {
+		case Linestring:
+			return append([]Coord{}, getLinestringCoords(g.(LinestringGeometry))...)
+		case Polygon:
+			// the direction of the way has been lost: assume the way
+			// encloses land
+			cc := append([]Coord{}, getPolygonCoords(g.(PolygonGeometry))...)
+			if _, ccw := calculate_ring_area(cc); !ccw {
+				reverseCoords(cc)
+			}
+			return cc
+		}
+	}
+	return nil
+}
+
+// CollectCoastlines reads the natural=coastline ways from inc, either ways
+// with node locations (see AddWayCoords) or geometries made from ways
+// (closed ways made into polygons are assumed to enclose land), and joins
+// them into closed rings with the land on the left, i.e. islands are
+// anticlockwise. Ways which start or end at the same node as another way
+// are reversed, open lines which run west from 180° to -180°, such as the
+// Antarctic coastline, are closed around the bottom of the map, and
+// clockwise rings not within any other ring are reversed. Other open lines
+// are dropped. report, if not nil, is called for each problem found.
+func CollectCoastlines(inc <-chan elements.ExtendedBlock, report func(CoastlineProblem)) [][]Coord {
+	cj := &coastJoiner{map[elements.Ref]*coastLine{}, map[elements.Ref]*coastLine{}, nil, nil}
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if cc := coastlineWayCoords(e); len(cc) > 1 {
+				cj.add(&coastLine{[]elements.Ref{e.Id()}, cc})
+			}
+		}
+	}
+	cj.fixConflicts(report)
+
+	// lines still conflicting are left open
+	open := cj.conflicts
+	for _, cl := range cj.starts {
+		open = append(open, cl)
+	}
+	sort.Sort(coastLinesByWay(open))
+	minLat := quadtree.Quadtree(0).Bounds(0).Miny
+	for _, cl := range open {
+		s, e := cl.coords[0], cl.coords[len(cl.coords)-1]
+		if s.Lon() == quadtree.ToInt(180) && e.Lon() == quadtree.ToInt(-180) {
+			cl.coords = append(cl.coords,
+				coordImpl{0, e.Lon(), minLat}, coordImpl{0, s.Lon(), minLat}, s)
+			cj.rings = append(cj.rings, cl)
+			continue
+		}
+		if report != nil {
+			report(CoastlineProblem{CoastlineGap, cl.ways[0], s.Lon(), s.Lat()})
+			report(CoastlineProblem{CoastlineGap, cl.ways[len(cl.ways)-1], e.Lon(), e.Lat()})
+		}
+	}
+
+	rings := make([][]Coord, 0, len(cj.rings))
+	ways := make([]elements.Ref, 0, len(cj.rings))
+	for _, cl := range cj.rings {
+		if cc := drop_repeats(cl.coords); len(cc) >= 4 {
+			rings = append(rings, cc)
+			ways = append(ways, cl.ways[0])
+		}
+	}
+	fixReversedRings(rings, ways, report)
+	return rings
+}
+
+// fixReversedRings reverses clockwise rings (i.e. water enclosed by
+// coastline) which are not within any anticlockwise ring.
+func fixReversedRings(rings [][]Coord, ways []elements.Ref, report func(CoastlineProblem)) {
+	ccw := make([]bool, len(rings))
+	boxes := make([]*quadtree.Bbox, len(rings))
+	for i, r := range rings {
+		_, ccw[i] = calculate_ring_area(r)
+		boxes[i] = makeBbox(r)
+	}
+	for i, r := range rings {
+		if ccw[i] {
+			continue
+		}
+		within := false
+		for j, o := range rings {
+			if ccw[j] && boxes[j].Contains(*boxes[i]) && ringWithin(r, o, nil) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			reverseCoords(r)
+			if report != nil {
+				report(CoastlineProblem{CoastlineReversedRing, ways[i], r[0].Lon(), r[0].Lat()})
+			}
+		}
+	}
+}
+
+type coastSegment struct {
+	ring, idx int32
+}
+
+// CoastlinePolygons returns land (or, if land is false, water) polygons
+// made from the coastline rings (as returned by CollectCoastlines), clipped
+// to quadtree tiles. Tiles are split until they contain no coastline, or
+// reach maxLevel: tiles with no coastline are returned as a single polygon
+// if they are entirely land (or water). The polygons are given the tags
+// natural=land (or natural=water), an original type of Geometry, and ids
+// counting from 1, and are returned in a block for each tile, in quadtree
+// order. Tiles which cannot be classified as land or water, for example
+// if there is no coastline, are skipped.
+func CoastlinePolygons(rings [][]Coord, maxLevel uint, land bool) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		segs := []coastSegment{}
+		for i, r := range rings {
+			for j := 0; j < len(r)-1; j++ {
+				segs = append(segs, coastSegment{int32(i), int32(j)})
+			}
+		}
+
+		idx := 0
+		id := elements.Ref(0)
+		emit := func(qt quadtree.Quadtree, polys [][][]Coord) {
+			if len(polys) == 0 {
+				return
+			}
+			nb := make(elements.ByElementId, 0, len(polys))
+			for _, py := range polys {
+				ar, err := calculate_polygon_area(py)
+				if err != nil {
+					continue
+				}
+				id++
+				tags := MakeTagsEditable(nil)
+				if land {
+					tags.Put("natural", "land")
+				} else {
+					tags.Put("natural", "water")
+				}
+				nb = append(nb, &polygonGeometryImpl{elements.Normal, id, nil, tags, qt, elements.Geometry, py, 0, ar, makeBbox(py[0])})
+			}
+			if len(nb) > 0 {
+				res <- elements.MakeExtendedBlock(idx, nb, qt, 0, 0, nil)
+				idx++
+			}
+		}
+
+		var visit func(qt quadtree.Quadtree, psegs []coastSegment, pbox quadtree.Bbox)
+		visit = func(qt quadtree.Quadtree, psegs []coastSegment, pbox quadtree.Bbox) {
+			box := qt.Bounds(0)
+			ts := filterCoastSegments(rings, psegs, box)
+			if len(ts) == 0 {
+				cx, cy := (float64(box.Minx)+float64(box.Maxx))/2, (float64(box.Miny)+float64(box.Maxy))/2
+				if l, ok := classifyPoint(rings, psegs, pbox, cx, cy); ok && l == land {
+					emit(qt, [][][]Coord{{boxRing(box)}})
+				}
+				return
+			}
+			level := uint(qt & 31)
+			if level < maxLevel {
+				for i := int64(0); i < 4; i++ {
+					visit(childTile(qt, i), ts, box)
+				}
+				return
+			}
+			pieces, closed := clipCoastline(rings, ts, box)
+			if !land {
+				for _, p := range pieces {
+					reverseCoords(p)
+				}
+				for _, r := range closed {
+					reverseCoords(r)
+				}
+			}
+			base := false
+			if len(pieces) == 0 {
+				l, ok := classifyPoint(rings, psegs, pbox, float64(box.Minx), float64(box.Miny))
+				if !ok {
+					return
+				}
+				base = l == land
+			}
+			emit(qt, tilePolygons(pieces, closed, box, base))
+		}
+		if len(segs) > 0 {
+			visit(0, segs, quadtree.Quadtree(0).Bounds(0))
+		}
+		close(res)
+	}()
+	return res
+}
+
+// childTile returns the i'th child of qt, with i as in Quadtree.Bounds
+func childTile(qt quadtree.Quadtree, i int64) quadtree.Quadtree {
+	l := uint(qt & 31)
+	return quadtree.Quadtree((int64(qt)&^31)|(i<<(61-2*l))) + quadtree.Quadtree(l+1)
+}
+
+// boxRing returns the anticlockwise ring around box
+func boxRing(box quadtree.Bbox) []Coord {
+	return []Coord{
+		coordImpl{0, box.Minx, box.Miny}, coordImpl{0, box.Maxx, box.Miny},
+		coordImpl{0, box.Maxx, box.Maxy}, coordImpl{0, box.Minx, box.Maxy},
+		coordImpl{0, box.Minx, box.Miny}}
+}
+
+// filterCoastSegments returns the segments of segs which overlap box
+func filterCoastSegments(rings [][]Coord, segs []coastSegment, box quadtree.Bbox) []coastSegment {
+	res := []coastSegment{}
+	for _, s := range segs {
+		a, b := rings[s.ring][s.idx], rings[s.ring][s.idx+1]
+		if (a.Lon() < box.Minx && b.Lon() < box.Minx) || (a.Lon() > box.Maxx && b.Lon() > box.Maxx) ||
+			(a.Lat() < box.Miny && b.Lat() < box.Miny) || (a.Lat() > box.Maxy && b.Lat() > box.Maxy) {
+			continue
+		}
+		if _, _, ok, _ := clipSegment(a, b, box); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func orientationFloat(ax, ay, bx, by, cx, cy float64) int {
+	v := (bx-ax)*(cy-ay) - (by-ay)*(cx-ax)
+	if v > 0 {
+		return 1
+	} else if v < 0 {
+		return -1
+	}
+	return 0
+}
+
+// classifyPoint tests if the point x, y (within box) is land, given segs,
+// all the coastline segments overlapping box. A line is drawn from x, y to
+// the middle of one of segs: the point is land if it approaches from the
+// left of the segment, and the line crosses an even number of other
+// segments. Returns false if there are no segments to test.
+func classifyPoint(rings [][]Coord, segs []coastSegment, box quadtree.Bbox, x, y float64) (bool, bool) {
+	fc := func(c Coord) (float64, float64) { return float64(c.Lon()), float64(c.Lat()) }
+	for _, s := range segs {
+		a, b := rings[s.ring][s.idx], rings[s.ring][s.idx+1]
+		ca, cb, ok, _ := clipSegment(a, b, box)
+		if !ok || same_point(ca, cb) {
+			continue
+		}
+		ax, ay := fc(a)
+		bx, by := fc(b)
+		side := orientationFloat(ax, ay, bx, by, x, y)
+		if side == 0 {
+			continue
+		}
+		mx, my := (float64(ca.Lon())+float64(cb.Lon()))/2, (float64(ca.Lat())+float64(cb.Lat()))/2
+
+		crossings, degenerate := 0, false
+		for _, t := range segs {
+			if t == s {
+				continue
+			}
+			px, py := fc(rings[t.ring][t.idx])
+			qx, qy := fc(rings[t.ring][t.idx+1])
+			o1 := orientationFloat(x, y, mx, my, px, py)
+			o2 := orientationFloat(x, y, mx, my, qx, qy)
+			o3 := orientationFloat(px, py, qx, qy, x, y)
+			o4 := orientationFloat(px, py, qx, qy, mx, my)
+			if ((o1 == 0 || o2 == 0) && o3*o4 <= 0) || ((o3 == 0 || o4 == 0) && o1*o2 <= 0) {
+				degenerate = true
+				break
+			}
+			if o1*o2 < 0 && o3*o4 < 0 {
+				crossings++
+			}
+		}
+		if degenerate {
+			continue
+		}
+		return (side > 0) == (crossings%2 == 0), true
+	}
+	return false, false
+}
+
+// clipCoastline returns the parts of the coastline within box, given segs,
+// the segments overlapping box in ring order: pieces which enter and leave
+// box, and rings entirely within box.
+func clipCoastline(rings [][]Coord, segs []coastSegment, box quadtree.Bbox) ([][]Coord, [][]Coord) {
+	pieces, closed := [][]Coord{}, [][]Coord{}
+
+	clipRun := func(rr []Coord, run []int32) ([][]Coord, bool, bool) {
+		res := [][]Coord{}
+		var curr []Coord
+		entered, left := false, false
+		for k, i := range run {
+			ca, cb, ok, leaves := clipSegment(rr[i], rr[i+1], box)
+			if !ok {
+				if len(curr) > 1 {
+					res = append(res, curr)
+				}
+				curr = nil
+				continue
+			}
+			if k == 0 && !same_point(ca, rr[i]) {
+				entered = true
+			}
+			if curr == nil {
+				curr = []Coord{ca}
+			}
+			curr = append(curr, cb)
+			if leaves {
+				res = append(res, curr)
+				curr = nil
+				left = true
+			}
+		}
+		if len(curr) > 1 {
+			res = append(res, curr)
+		}
+		return res, entered, left
+	}
+
+	for i := 0; i < len(segs); {
+		r := segs[i].ring
+		j := i
+		for j < len(segs) && segs[j].ring == r {
+			j++
+		}
+		rr := rings[r]
+		// split into runs of consecutive segments
+		runs := [][]int32{}
+		for k := i; k < j; k++ {
+			if k == i || segs[k].idx != segs[k-1].idx+1 {
+				runs = append(runs, nil)
+			}
+			runs[len(runs)-1] = append(runs[len(runs)-1], segs[k].idx)
+		}
+		i = j
+
+		n := int32(len(rr) - 1)
+		if len(runs) == 1 && len(runs[0]) == int(n) {
+			// the whole ring overlaps box
+			pp, entered, left := clipRun(rr, runs[0])
+			if !entered && !left {
+				closed = append(closed, append([]Coord{}, rr...))
+				continue
+			}
+			if !entered && len(pp) > 1 && same_point(pp[len(pp)-1][len(pp[len(pp)-1])-1], rr[0]) {
+				// join the last piece to the first, at the start of the ring
+				l := pp[len(pp)-1]
+				pp[0] = append(append([]Coord{}, l...), pp[0][1:]...)
+				pp = pp[:len(pp)-1]
+			}
+			pieces = append(pieces, pp...)
+			continue
+		}
+		if len(runs) > 1 && runs[0][0] == 0 && runs[len(runs)-1][len(runs[len(runs)-1])-1] == n-1 {
+			// the run at the end of the ring continues at the start
+			l := len(runs) - 1
+			runs[0] = append(runs[l], runs[0]...)
+			runs = runs[:l]
+		}
+		for _, run := range runs {
+			pp, _, _ := clipRun(rr, run)
+			pieces = append(pieces, pp...)
+		}
+	}
+
+	res := make([][]Coord, 0, len(pieces))
+	for _, p := range pieces {
+		p[0] = snapToBox(p[0], box)
+		p[len(p)-1] = snapToBox(p[len(p)-1], box)
+		if p = drop_repeats(p); len(p) > 1 {
+			res = append(res, p)
+		}
+	}
+	return res, closed
+}
+
+// snapToBox moves c onto the nearest edge of box, to correct rounding of
+// points found by clipSegment
+func snapToBox(c Coord, box quadtree.Bbox) Coord {
+	x, y := c.Lon(), c.Lat()
+	dd := []int64{x - box.Minx, box.Maxx - x, y - box.Miny, box.Maxy - y}
+	mi := 0
+	for i, d := range dd {
+		if d < dd[mi] {
+			mi = i
+		}
+	}
+	switch mi {
+	case 0:
+		x = box.Minx
+	case 1:
+		x = box.Maxx
+	case 2:
+		y = box.Miny
+	case 3:
+		y = box.Maxy
+	}
+	if x == c.Lon() && y == c.Lat() {
+		return c
+	}
+	return coordImpl{0, x, y}
+}
+
+// boxPosition returns the position of c, on the edge of box, going
+// anticlockwise from the bottom left corner: each edge has length one.
+func boxPosition(c Coord, box quadtree.Bbox) float64 {
+	x, y := c.Lon(), c.Lat()
+	w, h := float64(box.Maxx-box.Minx), float64(box.Maxy-box.Miny)
+	switch {
+	case y == box.Miny && x < box.Maxx:
+		return float64(x-box.Minx) / w
+	case x == box.Maxx && y < box.Maxy:
+		return 1 + float64(y-box.Miny)/h
+	case y == box.Maxy && x > box.Minx:
+		return 2 + float64(box.Maxx-x)/w
+	}
+	return 3 + float64(box.Maxy-y)/h
+}
+
+// tilePolygons returns the polygons on the left of the coastline within
+// box: pieces are joined by walking anticlockwise around box to the start
+// of the next piece. If there are no pieces, box itself is included if
+// base is true. Clockwise closed rings are added as inner rings.
+func tilePolygons(pieces, closed [][]Coord, box quadtree.Bbox, base bool) [][][]Coord {
+	corners := boxRing(box)[:4]
+	starts, ends := make([]float64, len(pieces)), make([]float64, len(pieces))
+	for i, p := range pieces {
+		starts[i] = boxPosition(p[0], box)
+		ends[i] = boxPosition(p[len(p)-1], box)
+	}
+
+	outers := [][]Coord{}
+	used := make([]bool, len(pieces))
+	for i := range pieces {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		ring := append([]Coord{}, pieces[i]...)
+		for curr := i; ; {
+			x := ends[curr]
+			next, nd := -1, 0.0
+			for j := range pieces {
+				if used[j] && j != i {
+					continue
+				}
+				d := starts[j] - x
+				if d < 0 {
+					d += 4
+				}
+				if next == -1 || d < nd {
+					next, nd = j, d
+				}
+			}
+			for k := math.Floor(x) + 1; k < x+nd; k++ {
+				ring = append(ring, corners[int(k)%4])
+			}
+			if next == i {
+				ring = append(ring, ring[0])
+				break
+			}
+			used[next] = true
+			ring = append(ring, pieces[next]...)
+			curr = next
+		}
+		if ring = drop_repeats(ring); len(ring) >= 4 {
+			outers = append(outers, ring)
+		}
+	}
+
+	inners := [][]Coord{}
+	for _, r := range closed {
+		if _, ccw := calculate_ring_area(r); ccw {
+			outers = append(outers, r)
+		} else {
+			inners = append(inners, r)
+		}
+	}
+	if len(pieces) == 0 && base {
+		outers = append(outers, boxRing(box))
+	}
+
+	res := make([][][]Coord, len(outers))
+	areas := make([]float64, len(outers))
+	for i, o := range outers {
+		res[i] = [][]Coord{o}
+		areas[i], _ = calculate_ring_area(o)
+	}
+	for _, in := range inners {
+		best := -1
+		for i, o := range outers {
+			if (best == -1 || areas[i] < areas[best]) && ringWithin(in, o, nil) {
+				best = i
+			}
+		}
+		if best != -1 {
+			res[best] = append(res[best], in)
+		}
+	}
+	return res
+}
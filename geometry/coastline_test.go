@@ -0,0 +1,116 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+// coastWay returns a natural=coastline way through nodes refs, at the
+// points given as pairs of lon, lat values in degrees
+func coastWay(id elements.Ref, refs []elements.Ref, ll ...float64) elements.Element {
+	lons, lats := make([]int64, len(refs)), make([]int64, len(refs))
+	for i := range refs {
+		lons[i], lats[i] = quadtree.ToInt(ll[2*i]), quadtree.ToInt(ll[2*i+1])
+	}
+	tags := elements.MakeTags([]string{"natural"}, []string{"coastline"})
+	return elements.MakeWayPoints(id, nil, tags, refs, lons, lats, 0, elements.Normal)
+}
+
+func coastBlock(ee ...elements.Element) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock, 1)
+	res <- elements.MakeExtendedBlock(0, elements.ByElementId(ee), 0, 0, 0, nil)
+	close(res)
+	return res
+}
+
+// testIsland is an anticlockwise square from two ways
+func testIsland() []elements.Element {
+	return []elements.Element{
+		coastWay(1, []elements.Ref{1, 2, 3}, 10, 10, 12, 10, 12, 12),
+		coastWay(2, []elements.Ref{3, 4, 1}, 12, 12, 10, 12, 10, 10),
+	}
+}
+
+func TestCollectCoastlines(t *testing.T) {
+	ee := testIsland()
+	ee = append(ee,
+		// way 4 is reversed
+		coastWay(3, []elements.Ref{11, 12, 13}, 20, 10, 22, 10, 22, 12),
+		coastWay(4, []elements.Ref{11, 14, 13}, 20, 10, 20, 12, 22, 12),
+		// a clockwise island
+		coastWay(5, []elements.Ref{21, 22, 23, 24, 21}, 30, 10, 30, 12, 32, 12, 32, 10, 30, 10),
+		// an open line
+		coastWay(6, []elements.Ref{31, 32}, 40, 10, 41, 11),
+		// running west around the bottom of the map
+		coastWay(7, []elements.Ref{41, 42, 43}, 180, -80, 0, -81, -180, -80),
+	)
+
+	problems := map[CoastlineProblemKind][]elements.Ref{}
+	rings := CollectCoastlines(coastBlock(ee...), func(p CoastlineProblem) {
+		problems[p.Kind] = append(problems[p.Kind], p.Way)
+	})
+	if len(rings) != 4 {
+		t.Fatalf("%d rings, expected 4", len(rings))
+	}
+	for i, r := range rings {
+		if !same_point(r[0], r[len(r)-1]) {
+			t.Errorf("ring %d not closed", i)
+		}
+		if _, ccw := calculate_ring_area(r); !ccw {
+			t.Errorf("ring %d is clockwise", i)
+		}
+	}
+	if w := problems[CoastlineReversedWay]; len(w) != 1 || w[0] != 4 {
+		t.Errorf("reversed ways %v, expected [4]", w)
+	}
+	if w := problems[CoastlineReversedRing]; len(w) != 1 || w[0] != 5 {
+		t.Errorf("reversed rings %v, expected [5]", w)
+	}
+	if w := problems[CoastlineGap]; len(w) != 2 || w[0] != 6 || w[1] != 6 {
+		t.Errorf("gaps %v, expected [6 6]", w)
+	}
+}
+
+func TestCoastlinePolygons(t *testing.T) {
+	rings := CollectCoastlines(coastBlock(testIsland()...), nil)
+	if len(rings) != 1 {
+		t.Fatalf("%d rings, expected 1", len(rings))
+	}
+	islandArea, _ := calculate_ring_area(rings[0])
+	worldArea, _ := calculate_ring_area(boxRing(quadtree.Quadtree(0).Bounds(0)))
+
+	areas := map[bool]float64{}
+	for _, land := range []bool{true, false} {
+		id := elements.Ref(0)
+		for bl := range CoastlinePolygons(rings, 6, land) {
+			for i := 0; i < bl.Len(); i++ {
+				py := bl.Element(i).(PolygonGeometry)
+				id++
+				if py.Id() != id || py.OriginalType() != elements.Geometry || py.Quadtree() != bl.Quadtree() {
+					t.Errorf("unexpected polygon %d %s %s in block %s", py.Id(), py.OriginalType(), py.Quadtree(), bl.Quadtree())
+				}
+				if nat := py.Tags().(TagsEditable).Get("natural"); nat != map[bool]string{true: "land", false: "water"}[land] {
+					t.Errorf("land=%v: polygon tagged natural=%s", land, nat)
+				}
+				if !bl.Quadtree().Bounds(0).Contains(py.Bbox()) {
+					t.Errorf("polygon %s outside tile %s", py.Bbox(), bl.Quadtree())
+				}
+				areas[land] += py.Area()
+			}
+		}
+	}
+	if math.Abs(areas[true]-islandArea) > islandArea*1e-6 {
+		t.Errorf("land area %f, expected %f", areas[true], islandArea)
+	}
+	if tl := areas[true] + areas[false]; math.Abs(tl-worldArea) > worldArea*1e-6 {
+		t.Errorf("land and water area %f, expected %f", tl, worldArea)
+	}
+}
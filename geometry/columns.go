@@ -0,0 +1,160 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ColumnType is the type of the values of a Column
+type ColumnType int
+
+const (
+	TextColumn ColumnType = iota
+	IntegerColumn
+	FloatColumn
+	JsonColumn
+)
+
+func (ct ColumnType) String() string {
+	switch ct {
+	case TextColumn:
+		return "text"
+	case IntegerColumn:
+		return "integer"
+	case FloatColumn:
+		return "float"
+	case JsonColumn:
+		return "json"
+	}
+	return "??"
+}
+
+// Column is a property of geometries written to a file or table
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+var columnTypes = map[string]ColumnType{
+	"int": IntegerColumn, "int2": IntegerColumn, "int4": IntegerColumn, "int8": IntegerColumn,
+	"smallint": IntegerColumn, "integer": IntegerColumn, "bigint": IntegerColumn,
+	"real": FloatColumn, "float": FloatColumn, "float4": FloatColumn, "float8": FloatColumn,
+	"double": FloatColumn, "numeric": FloatColumn, "calc_area": FloatColumn, "calc_length": FloatColumn,
+	"json": JsonColumn, "jsonb": JsonColumn, "hstore": JsonColumn,
+}
+
+// StyleColumns returns a Column for each entry of tagsFilter, other than
+// those marked NoColumn or Delete, sorted by name. The type is given by TagTest.Type:
+// integer types (int4, bigint etc) give IntegerColumn, real, float types,
+// calc_area and calc_length give FloatColumn, json and hstore give
+// JsonColumn (other_tags are stored as json: see addOtherTags), and
+// anything else TextColumn.
+func StyleColumns(tagsFilter map[string]TagTest) []Column {
+	res := make([]Column, 0, len(tagsFilter))
+	for k, t := range tagsFilter {
+		if t.NoColumn || t.Delete {
+			continue
+		}
+		res = append(res, Column{k, columnTypes[t.Type]})
+	}
+	sort.Sort(columnsByName(res))
+	return res
+}
+
+type columnsByName []Column
+
+func (cs columnsByName) Len() int           { return len(cs) }
+func (cs columnsByName) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs columnsByName) Less(i, j int) bool { return cs[i].Name < cs[j].Name }
+
+// TagValue returns the key and value of tag i of tags. Keys starting !
+// have an integer value (returned as int64), keys starting % a float
+// (returned as float64), and keys starting $ are null (returned as nil):
+// the prefix is removed from the key. Other values are returned as string.
+func TagValue(tags elements.Tags, i int) (string, interface{}) {
+	k := tags.Key(i)
+	if k == "" {
+		return k, tags.Value(i)
+	}
+	switch k[0] {
+	case '!':
+		ii, _ := utils.ReadVarint([]byte(tags.Value(i)), 0)
+		return k[1:], ii
+	case '%':
+		ii, _ := utils.ReadUvarint([]byte(tags.Value(i)), 0)
+		return k[1:], math.Float64frombits(ii)
+	case '$':
+		return k[1:], nil
+	}
+	return k, tags.Value(i)
+}
+
+// Value converts v, as returned by TagValue, to the type of c: int64 for
+// IntegerColumn, float64 for FloatColumn, otherwise string. Returns nil
+// if v is nil or cannot be converted.
+func (c Column) Value(v interface{}) interface{} {
+	switch c.Type {
+	case IntegerColumn:
+		switch vv := v.(type) {
+		case int64:
+			return vv
+		case float64:
+			if vv == math.Trunc(vv) {
+				return int64(vv)
+			}
+		case string:
+			if ii, err := strconv.ParseInt(vv, 10, 64); err == nil {
+				return ii
+			}
+		}
+		return nil
+	case FloatColumn:
+		switch vv := v.(type) {
+		case int64:
+			return float64(vv)
+		case float64:
+			return vv
+		case string:
+			if ff, err := strconv.ParseFloat(vv, 64); err == nil {
+				return ff
+			}
+		}
+		return nil
+	}
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case int64:
+		return fmt.Sprintf("%d", vv)
+	case float64:
+		return strconv.FormatFloat(vv, 'f', -1, 64)
+	}
+	return nil
+}
+
+// ColumnValues returns the value of tags for each of columns, as given by
+// Column.Value, or nil where the tag is missing.
+func ColumnValues(tags elements.Tags, columns []Column) []interface{} {
+	idx := make(map[string]int, len(columns))
+	for i, c := range columns {
+		idx[c.Name] = i
+	}
+	res := make([]interface{}, len(columns))
+	for i := 0; i < tags.Len(); i++ {
+		k, v := TagValue(tags, i)
+		if j, ok := idx[k]; ok {
+			res[j] = columns[j].Value(v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,362 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// radius of a sphere with the same surface area as the WGS84 ellipsoid
+	authalicRadius = 6371007.2
+	// mean radius of the WGS84 ellipsoid
+	meanRadius = 6371008.8
+)
+
+// Measures are implemented by each of the Geometry types in this package.
+// Unlike Area (which is in square spherical mercator units, as expected by
+// osm2pgsql style way_area columns), GeodesicArea and GeodesicLength are
+// in square metres and metres, calculated on a sphere.
+type Measures interface {
+	GeodesicArea() float64   // area of polygons: zero for points and linestrings
+	GeodesicLength() float64 // length of linestrings, or perimeter of polygons
+	Centroid() Coord         // centre of mass: may not be within the geometry
+	PointOnSurface() Coord   // a point guaranteed to be within the geometry
+}
+
+func toRadians(d float64) float64 { return d * math.Pi / 180 }
+
+// geodesicRingArea returns the area of ring rr, in square metres
+func geodesicRingArea(rr []Coord) float64 {
+	if len(rr) < 4 {
+		return 0
+	}
+	s := 0.0
+	for i := 0; i < len(rr)-1; i++ {
+		x0, y0 := rr[i].LonLat()
+		x1, y1 := rr[i+1].LonLat()
+		s += toRadians(x1-x0) * (2 + math.Sin(toRadians(y0)) + math.Sin(toRadians(y1)))
+	}
+	return math.Abs(s * authalicRadius * authalicRadius / 2)
+}
+
+func geodesicPolygonArea(py [][]Coord) float64 {
+	a := 0.0
+	for i, r := range py {
+		if i == 0 {
+			a += geodesicRingArea(r)
+		} else {
+			a -= geodesicRingArea(r)
+		}
+	}
+	return a
+}
+
+// haversine returns the great circle distance between a and b, in metres
+func haversine(a, b Coord) float64 {
+	x0, y0 := a.LonLat()
+	x1, y1 := b.LonLat()
+	dl, dp := toRadians(x1-x0), toRadians(y1-y0)
+	h := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(toRadians(y0))*math.Cos(toRadians(y1))*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * meanRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func geodesicLineLength(cc []Coord) float64 {
+	l := 0.0
+	for i := 0; i < len(cc)-1; i++ {
+		l += haversine(cc[i], cc[i+1])
+	}
+	return l
+}
+
+func floatCoord(x, y float64) Coord {
+	return coordImpl{0, int64(math.Floor(x + 0.5)), int64(math.Floor(y + 0.5))}
+}
+
+// lineCentroid returns the midpoint of each segment of cc, weighted by
+// length, and the total length
+func lineCentroid(cc []Coord) (float64, float64, float64) {
+	sx, sy, sl := 0.0, 0.0, 0.0
+	for i := 0; i < len(cc)-1; i++ {
+		x0, y0 := float64(cc[i].Lon()), float64(cc[i].Lat())
+		x1, y1 := float64(cc[i+1].Lon()), float64(cc[i+1].Lat())
+		l := math.Hypot(x1-x0, y1-y0)
+		sx += l * (x0 + x1) / 2
+		sy += l * (y0 + y1) / 2
+		sl += l
+	}
+	if sl == 0 {
+		if len(cc) == 0 {
+			return 0, 0, 0
+		}
+		return float64(cc[0].Lon()), float64(cc[0].Lat()), 0
+	}
+	return sx / sl, sy / sl, sl
+}
+
+// ringCentroid returns the centroid of ring rr, and its (unsigned) area,
+// in lon/lat units.
+func ringCentroid(rr []Coord) (float64, float64, float64) {
+	if len(rr) < 4 {
+		return 0, 0, 0
+	}
+	// relative to the first point, to keep values small
+	ox, oy := float64(rr[0].Lon()), float64(rr[0].Lat())
+	sa, sx, sy := 0.0, 0.0, 0.0
+	for i := 0; i < len(rr)-1; i++ {
+		x0, y0 := float64(rr[i].Lon())-ox, float64(rr[i].Lat())-oy
+		x1, y1 := float64(rr[i+1].Lon())-ox, float64(rr[i+1].Lat())-oy
+		c := x0*y1 - x1*y0
+		sa += c
+		sx += (x0 + x1) * c
+		sy += (y0 + y1) * c
+	}
+	if sa == 0 {
+		return 0, 0, 0
+	}
+	return ox + sx/(3*sa), oy + sy/(3*sa), math.Abs(sa) / 2
+}
+
+// polygonsCentroid returns the area weighted centroid of polys, falling
+// back to the centroid of the outer rings if the area is zero
+func polygonsCentroid(polys [][][]Coord) Coord {
+	sx, sy, sa := 0.0, 0.0, 0.0
+	for _, py := range polys {
+		for i, r := range py {
+			x, y, a := ringCentroid(r)
+			if i > 0 {
+				a = -a
+			}
+			sx += x * a
+			sy += y * a
+			sa += a
+		}
+	}
+	if sa != 0 {
+		return floatCoord(sx/sa, sy/sa)
+	}
+	sl := 0.0
+	for _, py := range polys {
+		if len(py) > 0 {
+			x, y, l := lineCentroid(py[0])
+			sx += x * l
+			sy += y * l
+			sl += l
+		}
+	}
+	if sl == 0 {
+		if len(polys) > 0 && len(polys[0]) > 0 && len(polys[0][0]) > 0 {
+			return polys[0][0][0]
+		}
+		return nil
+	}
+	return floatCoord(sx/sl, sy/sl)
+}
+
+// polygonPointOnSurface finds the widest section of a horizontal line
+// through the middle of the outer ring which is inside py, and returns
+// the middle of this.
+func polygonPointOnSurface(py [][]Coord) Coord {
+	if len(py) == 0 || len(py[0]) == 0 {
+		return nil
+	}
+	bx := makeBbox(py[0])
+	// coordinates are integers, so the line never passes through a vertex
+	y := math.Floor(float64(bx.Miny+bx.Maxy)/2) + 0.5
+
+	xs := []float64{}
+	for _, r := range py {
+		for i := 0; i < len(r)-1; i++ {
+			y0, y1 := float64(r[i].Lat()), float64(r[i+1].Lat())
+			if (y0 < y) == (y1 < y) {
+				continue
+			}
+			x0, x1 := float64(r[i].Lon()), float64(r[i+1].Lon())
+			xs = append(xs, x0+(y-y0)/(y1-y0)*(x1-x0))
+		}
+	}
+	sort.Float64s(xs)
+	best, bx0, bx1 := -1.0, 0.0, 0.0
+	for i := 0; i+1 < len(xs); i += 2 {
+		if w := xs[i+1] - xs[i]; w > best {
+			best, bx0, bx1 = w, xs[i], xs[i+1]
+		}
+	}
+	if best < 0 {
+		return py[0][0]
+	}
+	return floatCoord((bx0+bx1)/2, y)
+}
+
+// linePointOnSurface returns the point half way along cc
+func linePointOnSurface(cc []Coord) Coord {
+	_, _, tl := lineCentroid(cc)
+	if tl == 0 {
+		if len(cc) == 0 {
+			return nil
+		}
+		return cc[0]
+	}
+	l := 0.0
+	for i := 0; i < len(cc)-1; i++ {
+		x0, y0 := float64(cc[i].Lon()), float64(cc[i].Lat())
+		x1, y1 := float64(cc[i+1].Lon()), float64(cc[i+1].Lat())
+		sl := math.Hypot(x1-x0, y1-y0)
+		if l+sl >= tl/2 && sl > 0 {
+			t := (tl/2 - l) / sl
+			return floatCoord(x0+t*(x1-x0), y0+t*(y1-y0))
+		}
+		l += sl
+	}
+	return cc[len(cc)-1]
+}
+
+func (pt *pointGeometryImpl) GeodesicArea() float64   { return 0 }
+func (pt *pointGeometryImpl) GeodesicLength() float64 { return 0 }
+func (pt *pointGeometryImpl) Centroid() Coord         { return pt.coord }
+func (pt *pointGeometryImpl) PointOnSurface() Coord   { return pt.coord }
+
+func (ln *linestringGeometryImpl) GeodesicArea() float64   { return 0 }
+func (ln *linestringGeometryImpl) GeodesicLength() float64 { return geodesicLineLength(ln.coords) }
+func (ln *linestringGeometryImpl) Centroid() Coord {
+	x, y, _ := lineCentroid(ln.coords)
+	return floatCoord(x, y)
+}
+func (ln *linestringGeometryImpl) PointOnSurface() Coord { return linePointOnSurface(ln.coords) }
+
+func (py *polygonGeometryImpl) GeodesicArea() float64 { return geodesicPolygonArea(py.coords) }
+func (py *polygonGeometryImpl) GeodesicLength() float64 {
+	l := 0.0
+	for _, r := range py.coords {
+		l += geodesicLineLength(r)
+	}
+	return l
+}
+func (py *polygonGeometryImpl) Centroid() Coord       { return polygonsCentroid([][][]Coord{py.coords}) }
+func (py *polygonGeometryImpl) PointOnSurface() Coord { return polygonPointOnSurface(py.coords) }
+
+func (mg *multiGeometryImpl) GeodesicArea() float64 {
+	a := 0.0
+	for _, py := range mg.coords {
+		a += geodesicPolygonArea(py)
+	}
+	return a
+}
+func (mg *multiGeometryImpl) GeodesicLength() float64 {
+	l := 0.0
+	for _, py := range mg.coords {
+		for _, r := range py {
+			l += geodesicLineLength(r)
+		}
+	}
+	return l
+}
+func (mg *multiGeometryImpl) Centroid() Coord { return polygonsCentroid(mg.coords) }
+
+// PointOnSurface returns a point within the largest polygon
+func (mg *multiGeometryImpl) PointOnSurface() Coord {
+	bi, ba := -1, -1.0
+	for i, py := range mg.coords {
+		if a := geodesicPolygonArea(py); a > ba {
+			bi, ba = i, a
+		}
+	}
+	if bi == -1 {
+		return nil
+	}
+	return polygonPointOnSurface(mg.coords[bi])
+}
+
+// calcTag returns the value for a tag with TagTest.Type ty (e.g.
+// calc_area), or false if not relevant to g.
+func calcTag(g Measures, ty string) (string, bool) {
+	switch ty {
+	case "calc_area":
+		a := g.GeodesicArea()
+		if a == 0 {
+			return "", false
+		}
+		return fmt.Sprintf("%0.1f", a), true
+	case "calc_length":
+		l := g.GeodesicLength()
+		if l == 0 {
+			return "", false
+		}
+		return fmt.Sprintf("%0.1f", l), true
+	case "calc_centroid":
+		return pointWkt(g.Centroid())
+	case "calc_point_on_surface":
+		return pointWkt(g.PointOnSurface())
+	}
+	return "", false
+}
+
+func pointWkt(c Coord) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	x, y := c.LonLat()
+	return fmt.Sprintf("POINT(%0.7f %0.7f)", x, y), true
+}
+
+var calcTypes = map[string]bool{"calc_area": true, "calc_length": true, "calc_centroid": true, "calc_point_on_surface": true}
+
+// calculatedTags returns the entries of tagsFilter with a Type starting
+// calc_, or an error if this isn't one of calc_area (geodesic area in
+// square metres), calc_length (geodesic length or perimeter in metres),
+// calc_centroid or calc_point_on_surface (as WKT points).
+func calculatedTags(tagsFilter map[string]TagTest) (map[string]string, error) {
+	res := map[string]string{}
+	for k, t := range tagsFilter {
+		if !strings.HasPrefix(t.Type, "calc_") {
+			continue
+		}
+		if !calcTypes[t.Type] {
+			return nil, errors.New(fmt.Sprintf("unknown calculated tag type %q for %q", t.Type, k))
+		}
+		res[k] = t.Type
+	}
+	return res, nil
+}
+
+// AddCalculatedTags adds tags to each geometry in inc for the entries of
+// tagsFilter with a Type starting calc_: see calculatedTags. Returns an
+// error for unknown types.
+func AddCalculatedTags(inc <-chan elements.ExtendedBlock, tagsFilter map[string]TagTest) (<-chan elements.ExtendedBlock, error) {
+	calc, err := calculatedTags(tagsFilter)
+	if err != nil {
+		return nil, err
+	}
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		for bl := range inc {
+			for i := 0; i < bl.Len(); i++ {
+				g, ok := bl.Element(i).(Measures)
+				if !ok {
+					continue
+				}
+				tags, ok := bl.Element(i).(elements.FullElement).Tags().(TagsEditable)
+				if !ok {
+					continue
+				}
+				for k, ty := range calc {
+					if v, ok := calcTag(g, ty); ok {
+						tags.Put(k, v)
+					}
+				}
+			}
+			res <- bl
+		}
+		close(res)
+	}()
+	return res, nil
+}
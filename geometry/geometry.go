@@ -110,6 +110,20 @@ type MultiGeometry interface {
 	Area() float64
 }
 
+// MultiLinestringGeometry is made from the member ways of a route
+// relation (see HandleRouteRelations). Role returns the member role of
+// each line.
+type MultiLinestringGeometry interface {
+	Geometry
+
+	NumLines() int
+	NumCoords(int) int
+	Coord(int, int) Coord
+	Role(int) string
+
+	ZOrder() int64
+}
+
 func ExtractGeometryBboxData(o elements.Element) (GeometryType, *quadtree.Bbox, []byte, error) {
 	gg, ok := o.(Geometry)
 	if ok {
@@ -173,6 +187,8 @@ func ExtractGeometryBbox(o elements.Element) (GeometryType, *quadtree.Bbox, erro
 	return 0, nil, UnrecognisedGeometryError
 }
 
+// ReadGeometryZOrderWayArea returns the z_order (see ZOrderTable) and area
+// stored in the geometry data gd. The area is zero for linestrings.
 func ReadGeometryZOrderWayArea(gd []byte) (int64, float64, error) {
 	zo := int64(0)
 	ar := float64(0)
@@ -192,6 +208,10 @@ func ReadGeometryZOrderWayArea(gd []byte) (int64, float64, error) {
 			return zo, ar, nil
 		}
 	}
+	if fa {
+		// linestrings have a z_order but no area
+		return zo, 0, nil
+	}
 
 	return 0, 0, UnrecognisedGeometryError
 }
@@ -211,61 +231,86 @@ func ExtractGeometry(e elements.Element) (Geometry, error) {
 	return extractGeometry(gp)
 }
 
-func hasTags(needed map[string]string) func(TagsEditable) bool {
-	return func(tt TagsEditable) bool {
-		for k, v := range needed {
-			if !tt.Has(k) || tt.Get(k) != v {
-				return false
-			}
-		}
-		return true
-	}
-}
-
 func GenerateGeometries(
 	makeInChan func() <-chan elements.ExtendedBlock,
 	fbx *quadtree.Bbox,
 	tagsFilter map[string]TagTest,
 	recalc bool, msgs bool) (<-chan elements.ExtendedBlock, error) {
 
-	A := makeInChan()
+	return GenerateGeometriesOptions(makeInChan, fbx, tagsFilter, GenerateOptions{Recalc: recalc, Msgs: msgs})
+}
 
-	B := AddWayCoords(A, fbx)
-	var C <-chan elements.ExtendedBlock
+// GenerateOptions are the optional stages of GenerateGeometriesOptions
+type GenerateOptions struct {
+	// Recalc the quadtree of each geometry, using Params. If Params is not
+	// set, a buffer of 0.025 and max level 18 are used (as by
+	// GenerateGeometries): the output should be written with these (see
+	// RecalcParams and writefile.WritePbfFileParams). Without Recalc the
+	// geometries keep the quadtrees of the input, so the params of the
+	// input file should be written instead.
+	Recalc bool
+	Msgs   bool
+	Params quadtree.Params
+
+	// TagRules are applied after the tags parent_highway, min_admin_level,
+	// bus_routes and cycle_routes (added if present in tagsFilter): see
+	// TransformTags
+	TagRules TagRules
+	// ZOrder, if not nil, replaces DefaultZOrderTable (see ZOrderTable)
+	ZOrder *ZOrderTable
+	// MakeValid repairs polygons (see MakeValid)
+	MakeValid bool
+	// Routes lists the route types (e.g. bus, bicycle) to assemble into
+	// MultiLinestring geometries (see HandleRouteRelations)
+	Routes []string
+	// Simplify geometries, if not nil
+	Simplify *Simplification
+	// ClipLevel, if greater than zero, clips geometries to tiles at this
+	// level, expanded by ClipBuffer (see ClipToTiles)
+	ClipLevel  uint
+	ClipBuffer float64
+}
 
-	if _, ok := tagsFilter["parent_highway"]; ok {
-		C = AddNodeParent(B, FindParentHighway, "highway", "highway", "parent_highway")
-	} else {
-		println("skip parent_highway")
-		C = B
+// recalcParams are used when GenerateOptions.Params is not set: geometries
+// have always been given a smaller buffer than quadtree.DefaultParams
+var recalcParams = quadtree.Params{Buffer: 0.025, MaxLevel: 18}
+
+// RecalcParams returns the quadtree.Params used to recalc the quadtree of
+// each geometry
+func (opts GenerateOptions) RecalcParams() quadtree.Params {
+	if opts.Params == (quadtree.Params{}) {
+		return recalcParams
 	}
-	var D <-chan elements.ExtendedBlock
-	if _, ok := tagsFilter["min_admin_level"]; ok {
-        //println("AddRelationRange min_admin_level ...")
-		D = AddRelationRange(C, hasTags(map[string]string{"boundary": "administrative", "type": "boundary"}), "admin_level", AdminLevels)
-	} else {
-		println("skip admin_level")
-		D = C
+	return opts.Params
+}
+
+// GenerateGeometriesOptions is GenerateGeometries, with the optional
+// stages given by opts.
+func GenerateGeometriesOptions(
+	makeInChan func() <-chan elements.ExtendedBlock,
+	fbx *quadtree.Bbox,
+	tagsFilter map[string]TagTest,
+	opts GenerateOptions) (<-chan elements.ExtendedBlock, error) {
+
+	recalc, params := opts.Recalc, opts.RecalcParams()
+	calc, err := calculatedTags(tagsFilter)
+	if err != nil {
+		return nil, err
 	}
-	var D2 <-chan elements.ExtendedBlock
-	if _, ok := tagsFilter["bus_routes"]; ok {
-        //println("AddRelationRange bus_routes ...")
-		D2 = AddRelationRange(D, hasTags(map[string]string{"type": "route", "route": "bus"}), "ref", RouteList("bus_routes").Proc)
-	} else {
-		println("skip bus_routes")
-		D2 = D
+	stages, err := compileTagRules(append(builtinTagRules(tagsFilter), opts.TagRules...))
+	if err != nil {
+		return nil, err
 	}
 
-	var D3 <-chan elements.ExtendedBlock
-	if _, ok := tagsFilter["cycle_routes"]; ok {
+	A := makeInChan()
 
-		D3 = AddRelationRange(D2, hasTags(map[string]string{"type": "route", "route": "bicycle"}), "network", RouteList("cycle_routes").Proc)
-	} else {
-		println("skip cycle_routes")
-		D3 = D2
-	}
+	B := AddWayCoords(A, fbx)
+	D := applyTagStages(B, stages)
 
-	E := MakeGeometries(D3, tagsFilter)
+	E := MakeGeometriesZOrder(D, tagsFilter, opts.ZOrder)
+	if len(opts.Routes) > 0 {
+		E = HandleRouteRelations(E, opts.Routes, tagsFilter, opts.ZOrder, nil)
+	}
 
 	hasArea := false
 	for _, t := range tagsFilter {
@@ -275,9 +320,11 @@ func GenerateGeometries(
 	}
 	var F <-chan elements.ExtendedBlock
 	if hasArea {
-		F = HandleRelations(E, tagsFilter)
+		F = HandleRelationsReport(E, tagsFilter, opts.ZOrder, nil)
 	} else {
-		println("skip relations")
+		if opts.Msgs {
+			println("skip relations")
+		}
 		Ff := make(chan elements.ExtendedBlock)
 		go func() {
 			for b := range E {
@@ -299,6 +346,17 @@ func GenerateGeometries(
 		F = Ff
 	}
 
+	if opts.MakeValid {
+		F = MakeValidGeometries(F)
+	}
+	if len(calc) > 0 {
+		// calculate before simplifying
+		F, _ = AddCalculatedTags(F, tagsFilter)
+	}
+	if opts.Simplify != nil {
+		F = SimplifyGeometries(F, *opts.Simplify)
+	}
+
 	result := make(chan elements.ExtendedBlock)
 
 	go func() {
@@ -311,7 +369,7 @@ func GenerateGeometries(
 			if recalc {
 				for i := 0; i < b.Len(); i++ {
 					fe := b.Element(i).(Geometry)
-					qt, _ := quadtree.Calculate(fe.Bbox(), 0.025, 18)
+					qt, _ := params.Calculate(fe.Bbox())
 					fe.SetQuadtree(qt)
 				}
 			}
@@ -322,6 +380,9 @@ func GenerateGeometries(
 		close(result)
 	}()
 
+	if opts.ClipLevel > 0 {
+		return ClipToTiles(result, opts.ClipLevel, opts.ClipBuffer), nil
+	}
 	return result, nil
 
 }
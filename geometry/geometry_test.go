@@ -0,0 +1,21 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+func TestRecalcParams(t *testing.T) {
+	if p := (GenerateOptions{Recalc: true}).RecalcParams(); p != (quadtree.Params{Buffer: 0.025, MaxLevel: 18}) {
+		t.Errorf("default recalc params %s", p)
+	}
+	if p := (GenerateOptions{Recalc: true, Params: quadtree.DefaultParams}).RecalcParams(); p != quadtree.DefaultParams {
+		t.Errorf("recalc params %s, expected %s", p, quadtree.DefaultParams)
+	}
+}
@@ -173,8 +173,10 @@ func makeMultiGeometry(gp elements.FullElement, ot elements.ElementType, tg elem
     
 
 	bb := quadtree.NullBbox()
-	for _, cc := range coords[0] {
-		expandBbox(bb, cc)
+	for _, py := range coords {
+		for _, cc := range py {
+			expandBbox(bb, cc)
+		}
 	}
 	return &multiGeometryImpl{gp.ChangeType(), i, gp.Info(), tg, gp.Quadtree(), ot, coords, zorder, area, bb}
 }
@@ -444,8 +446,8 @@ func (py *polygonGeometryImpl) Area() float64        { return py.area }
 
 func (mg *multiGeometryImpl) NumGeometries() int      { return len(mg.coords) }
 func (mg *multiGeometryImpl) NumRings(i int) int      { return len(mg.coords[i]) }
-func (mg *multiGeometryImpl) NumCoords(i, j int) int  { return len(mg.coords[i][i]) }
-func (mg *multiGeometryImpl) Coord(i, j, k int) Coord { return mg.coords[i][j][i] }
+func (mg *multiGeometryImpl) NumCoords(i, j int) int  { return len(mg.coords[i][j]) }
+func (mg *multiGeometryImpl) Coord(i, j, k int) Coord { return mg.coords[i][j][k] }
 func (mg *multiGeometryImpl) ZOrder() int64           { return mg.zorder }
 func (mg *multiGeometryImpl) Area() float64           { return mg.area }
 
@@ -0,0 +1,39 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+func TestMultiGeometryBbox(t *testing.T) {
+	coords := [][][]Coord{
+		{testRing(1, 0, 0, 0, 1, 1, 1, 1, 0, 0, 0)},
+		{testRing(10, 2, -1, 2, 0.5, 3, 0.5, 3, -1, 2, -1)},
+	}
+	mg := makeMultiGeometry(testElement(1), elements.Relation, nil, coords, 0, 0)
+
+	expected := quadtree.Bbox{Minx: 0, Miny: -10000000, Maxx: 30000000, Maxy: 10000000}
+	if bx := mg.Bbox(); bx != expected {
+		t.Errorf("Bbox() = %s, expected %s", bx, expected)
+	}
+}
+
+func TestPolygonGeometryBbox(t *testing.T) {
+	coords := [][]Coord{
+		testRing(1, 0, 0, 0, 1, 1, 1, 1, 0, 0, 0),
+		testRing(10, 0.2, 0.2, 0.5, 0.8, 0.8, 0.2, 0.2, 0.2),
+	}
+	py := makePolygonGeometry(testElement(1), elements.Way, nil, coords, 0, 0)
+
+	expected := quadtree.Bbox{Minx: 0, Miny: 0, Maxx: 10000000, Maxy: 10000000}
+	if bx := py.Bbox(); bx != expected {
+		t.Errorf("Bbox() = %s, expected %s", bx, expected)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package geometrytest makes Geometry elements for the tests of packages
+// which write them.
+package geometrytest
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"testing"
+)
+
+// Element returns a Geometry element of type gt, made from a Way, with the
+// tags given as key, value pairs by kv. Each of rings is a list of
+// longitude, latitude pairs in degrees. The rings are those of a single
+// part (see geometry.PackGeometryData), apart from Multi geometries where
+// each ring is a separate polygon. The quadtree is calculated from the
+// bbox with quadtree.DefaultParams.
+func Element(t testing.TB, id elements.Ref, gt geometry.GeometryType, kv []string, rings ...[]float64) elements.Element {
+	cc := make([][]geometry.Coord, len(rings))
+	for i, ll := range rings {
+		cc[i] = make([]geometry.Coord, 0, len(ll)/2)
+		for j := 0; j+1 < len(ll); j += 2 {
+			cc[i] = append(cc[i], geometry.MakeCoord(0, quadtree.ToInt(ll[j]), quadtree.ToInt(ll[j+1])))
+		}
+	}
+	parts := [][][]geometry.Coord{cc}
+	if gt == geometry.Multi {
+		parts = make([][][]geometry.Coord, len(cc))
+		for i, r := range cc {
+			parts[i] = [][]geometry.Coord{r}
+		}
+	}
+
+	keys, vals := []string{}, []string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		keys, vals = append(keys, kv[i]), append(vals, kv[i+1])
+	}
+	tags := elements.MakeTags(keys, vals)
+	data, bx, err := geometry.PackGeometryData(gt, elements.Way, tags, nil, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt, err := quadtree.DefaultParams.Calculate(bx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return elements.MakeGeometry(id, nil, tags, data, qt, elements.Normal)
+}
+
+// Geometry returns Element, read with geometry.ExtractGeometry
+func Geometry(t testing.TB, id elements.Ref, gt geometry.GeometryType, kv []string, rings ...[]float64) geometry.Geometry {
+	g, err := geometry.ExtractGeometry(Element(t, id, gt, kv, rings...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// TileQt returns the quadtree of tile x, y at zoom z
+func TileQt(t testing.TB, x, y, z int64) quadtree.Quadtree {
+	qt, err := quadtree.FromTuple(x, y, z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qt
+}
@@ -6,7 +6,6 @@
 package geometry
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -42,6 +41,7 @@ func addOtherTags(tags TagsEditable, rms []string, storetype string) {
 
 func nodeTags(tags TagsEditable, tagsFilter map[string]TagTest) bool {
 	rms := make([]string, 0, tags.Len())
+	dels := []string{}
 	isfeat := false
 	for i := 0; i < tags.Len(); i++ {
 		tt, ok := tagsFilter[tags.Key(i)]
@@ -49,6 +49,10 @@ func nodeTags(tags TagsEditable, tagsFilter map[string]TagTest) bool {
 			rms = append(rms, tags.Key(i))
 			continue
 		}
+		if tt.Delete {
+			dels = append(dels, tags.Key(i))
+			continue
+		}
 		if !tt.IsNode {
 			rms = append(rms, tags.Key(i))
 			continue
@@ -56,6 +60,9 @@ func nodeTags(tags TagsEditable, tagsFilter map[string]TagTest) bool {
 		if tt.IsFeature {
 			isfeat = true
 		}
+		if tt.NoColumn {
+			rms = append(rms, tags.Key(i))
+		}
 	}
     if len(rms)>0 || tags.Has("other_tags") {
         if tt,ok:= tagsFilter["other_tags"]; ok {
@@ -66,6 +73,9 @@ func nodeTags(tags TagsEditable, tagsFilter map[string]TagTest) bool {
 	for _, t := range rms {
 		tags.Delete(t)
 	}
+	for _, t := range dels {
+		tags.Delete(t)
+	}
 	return isfeat
 }
 
@@ -83,15 +93,20 @@ func IsFeature(tags elements.Tags, tagsFilter map[string]TagTest) bool {
 	return false
 }
 
-func wayTags(tags TagsEditable, tagsFilter map[string]TagTest) (int64, bool) {
+func wayTags(tags TagsEditable, tagsFilter map[string]TagTest, zt *ZOrderTable) (int64, bool) {
 	isp := false
 	rms := make([]string, 0, tags.Len())
+	dels := []string{}
 	for i := 0; i < tags.Len(); i++ {
 		tt, ok := tagsFilter[tags.Key(i)]
 		if !ok {
 			rms = append(rms, tags.Key(i))
 			continue
 		}
+		if tt.Delete {
+			dels = append(dels, tags.Key(i))
+			continue
+		}
 		if !tt.IsWay {
 			rms = append(rms, tags.Key(i))
 			continue
@@ -99,6 +114,9 @@ func wayTags(tags TagsEditable, tagsFilter map[string]TagTest) (int64, bool) {
 		if (tt.IsPoly == "yes") || ((tags.Key(i) == "area") && is_true(tags.Value(i))) {
 			isp = true
 		}
+		if tt.NoColumn {
+			rms = append(rms, tags.Key(i))
+		}
 	}
 
 	if tags.Has("boundary") /* && tags.Get("boundary")=="administrative"*/ {
@@ -113,8 +131,11 @@ func wayTags(tags TagsEditable, tagsFilter map[string]TagTest) (int64, bool) {
 	for _, t := range rms {
 		tags.Delete(t)
 	}
+	for _, t := range dels {
+		tags.Delete(t)
+	}
 
-	zo, _ := find_zorder(tags)
+	zo, _ := zt.ZOrder(tags)
 
 	return zo, isp
 }
@@ -137,6 +158,12 @@ func make_ring(waypoints elements.WayPoints) []Coord {
 // objects are passed to the output chanel directly: these are handled by
 // HandleRelations.
 func MakeGeometries(inc <-chan elements.ExtendedBlock, tagsFilter map[string]TagTest) <-chan elements.ExtendedBlock {
+	return MakeGeometriesZOrder(inc, tagsFilter, nil)
+}
+
+// MakeGeometriesZOrder is MakeGeometries, finding the z_order of each way
+// with zt (DefaultZOrderTable if nil).
+func MakeGeometriesZOrder(inc <-chan elements.ExtendedBlock, tagsFilter map[string]TagTest, zt *ZOrderTable) <-chan elements.ExtendedBlock {
 
 	res := make(chan elements.ExtendedBlock)
 
@@ -155,7 +182,7 @@ func MakeGeometries(inc <-chan elements.ExtendedBlock, tagsFilter map[string]Tag
 					}
 				case elements.Way:
 					fw := e.(elements.FullWay)
-					zo, isp := wayTags(fw.Tags().(TagsEditable), tagsFilter)
+					zo, isp := wayTags(fw.Tags().(TagsEditable), tagsFilter, zt)
 
 					cc := make_ring(fw.(elements.WayPoints))
                     if len(cc) == 0 {
@@ -227,6 +254,16 @@ func relType(e elements.Element) string {
 // the inner rings. This behaviour should be similar to the osm2pgsql
 // application.
 func HandleRelations(inc <-chan elements.ExtendedBlock, tagsFilter map[string]TagTest) <-chan elements.ExtendedBlock {
+	return HandleRelationsReport(inc, tagsFilter, nil, nil)
+}
+
+// HandleRelationsReport is HandleRelations, also calling report (if not
+// nil) for each problem found when assembling the rings of a relation (see
+// AssembleRings). Member ways are joined into rings regardless of their
+// roles: rings are classified as inner or outer by containment. report is
+// called from a single goroutine. The z_order of each relation is found
+// with zt (DefaultZOrderTable if nil).
+func HandleRelationsReport(inc <-chan elements.ExtendedBlock, tagsFilter map[string]TagTest, zt *ZOrderTable, report func(RingProblem)) <-chan elements.ExtendedBlock {
 
 	res := make(chan elements.ExtendedBlock)
 
@@ -235,7 +272,7 @@ func HandleRelations(inc <-chan elements.ExtendedBlock, tagsFilter map[string]Ta
 	//wg.Add(1)
 
 	go func() {
-		err := finishRelations(relc, res, tagsFilter)
+		err := finishRelations(relc, res, tagsFilter, zt, report)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -332,25 +369,6 @@ func getPolygonCoords(ls PolygonGeometry) []Coord {
 	return res
 }
 
-func joinrings(A []Coord, revA bool, B []Coord, revB bool) ([]Coord, elements.Ref, elements.Ref) {
-	ans := make([]Coord, len(A)+len(B)-1)
-	for i, p := range A {
-		j := i
-		if revA {
-			j = len(A) - 1 - i
-		}
-		ans[j] = p
-	}
-	for i, p := range B {
-		j := len(A) - 1 + i
-		if revB {
-			j = len(B) + len(A) - 2 - i
-		}
-		ans[j] = p
-	}
-	return ans, ans[0].Ref(), ans[len(ans)-1].Ref()
-}
-
 func check_ring(rr []Coord) bool {
 	if len(rr) < 3 {
 		return false
@@ -361,127 +379,17 @@ func check_ring(rr []Coord) bool {
 	return true
 }
 
-func merge_rings(rings [][]Coord) ([][]Coord, error) {
-	if len(rings) == 0 {
-		return nil, nil
-	}
-	if len(rings) == 1 {
-		return rings, nil
-	}
-
-	var r0 []Coord
-	a, b := elements.Ref(0), elements.Ref(0)
-
-	rem := make([][]Coord, 0, len(rings))
-	fin := make([][]Coord, 0, len(rings))
-	added := false
-
-	for _, r := range rings {
-		//if i==0 { continue }
-		if r[0].Ref() == r[len(r)-1].Ref() {
-			fin = append(fin, r)
-		} else if r0 == nil {
-			r0 = r
-			a = r0[0].Ref()
-			b = r0[len(r0)-1].Ref()
-		} else if r[0].Ref() == a {
-			r0, a, b = joinrings(r0, true, r, false)
-			added = true
-		} else if r[0].Ref() == b {
-			r0, a, b = joinrings(r0, false, r, false)
-			added = true
-		} else if r[len(r)-1].Ref() == a {
-			r0, a, b = joinrings(r0, true, r, true)
-			added = true
-		} else if r[len(r)-1].Ref() == b {
-			r0, a, b = joinrings(r0, false, r, true)
-			added = true
-		} else {
-			rem = append(rem, r)
-			//added=true
-		}
-
-	}
-	if r0 != nil {
-		if a == b || !added {
-			fin = append(fin, r0)
-		} else {
-			rem = append(rem, r0)
-		}
-	}
-
-	if len(rem) > 0 {
-
-		pp, err := merge_rings(rem)
-		if err != nil {
-			return nil, err
-		}
-		fin = append(fin, pp...)
-	}
-
-	return fin, nil
-	/*
-	   //rm[0]=r0
-	   if added {
-	       return mergeRings(rm)
-	   }
-	   return rm, nil*/
-}
-
-func group_rings(outers [][]Coord, inners [][]Coord, allowLoose bool) ([][][]Coord, error) {
-	if len(outers) == 1 {
-		nobj := make([][]Coord, len(inners)+1)
-		nobj[0] = outers[0]
-		copy(nobj[1:], inners)
-		return [][][]Coord{nobj}, nil
-	}
-	if len(inners) == 0 {
-		ans := make([][][]Coord, len(outers))
-		for i, o := range outers {
-			ans[i] = [][]Coord{o}
-		}
-		return ans, nil
-	}
-
-	ans := make([][][]Coord, len(outers))
-
-	for i, o := range outers {
-		ans[i] = make([][]Coord, 0, len(inners)+1)
-		ans[i] = append(ans[i], o)
-	}
-
-	for z, in := range inners {
-		added := false
-		for i, o := range ans {
-			if ring_contains(o[0], in) {
-				ans[i] = append(ans[i], in)
-				added = true
-				continue
-			}
-		}
-		if !added && !allowLoose {
-			return nil, errors.New(fmt.Sprintf("inner %d not contained by any outer", z))
-		}
-	}
-
-	return ans, nil
-
-	//return nil, errors.New("multi outers and multi inners")
-}
-
-func finishRel(ways *pendingEleMap, rel *pendingEle, tagsFilter map[string]TagTest) (finished elements.ByElementId, err error) {
+func finishRel(ways *pendingEleMap, rel *pendingEle, tagsFilter map[string]TagTest, zt *ZOrderTable, report func(RingProblem)) (finished elements.ByElementId, err error) {
 	ri := rel.ee.Id()
 	//println("finishRel",ri,len(rel.ww))
 
 	ele := rel.ee.(elements.FullRelation)
-	outers := make([][]Coord, 0, len(rel.ww))
-	outerTags := MakeTagsEditable(nil)
-	inners := make([][]Coord, 0, len(rel.ww))
+	members := make([]RingMember, 0, len(rel.ww))
+	memberTags := map[elements.Ref]elements.Tags{}
 	finished = elements.ByElementId{}
 
 	rt := ele.Tags().(TagsEditable)
 	isboundary := (rt.Has("boundary") /*&& rt.Get("boundary")=="administrative"*/)
-	outerRefs := make([]elements.Ref, 0, len(rel.ww))
 	for i := 0; i < ele.Len(); i++ {
 		if ele.MemberType(i) != elements.Way {
 			continue
@@ -491,6 +399,9 @@ func finishRel(ways *pendingEleMap, rel *pendingEle, tagsFilter map[string]TagTe
 
 		wy, ok := (*ways)[w]
 		if !ok || wy.ee == nil {
+			if report != nil {
+				report(RingProblem{ri, MissingMember, w, 0, 0})
+			}
 			continue
 		}
 
@@ -499,30 +410,15 @@ func finishRel(ways *pendingEleMap, rel *pendingEle, tagsFilter map[string]TagTe
 		}).GeometryType()
 		if gt == Linestring {
 			ls := wy.ee.(LinestringGeometry)
-			if ele.Role(i) == "inner" {
-				inners = append(inners, getLinestringCoords(ls))
-			} else {
-				outers = append(outers, getLinestringCoords(ls))
-				if !isboundary {
-					outerTags.Add(ls.Tags())
-				}
-				outerRefs = append(outerRefs, w)
-			}
+			members = append(members, RingMember{w, ele.Role(i), getLinestringCoords(ls)})
+			memberTags[w] = ls.Tags()
 		} else if gt == Polygon {
 			ls := wy.ee.(PolygonGeometry)
 			if ls.NumRings() != 1 {
 				panic("??")
 			}
-			if ele.Role(i) == "inner" {
-				inners = append(inners, getPolygonCoords(ls))
-			} else {
-				outers = append(outers, getPolygonCoords(ls))
-				if !isboundary {
-					outerTags.Add(ls.Tags())
-				}
-				outerRefs = append(outerRefs, w)
-				//outerTags = append(outerTags, ls.Tags().(TagsEditable))
-			}
+			members = append(members, RingMember{w, ele.Role(i), getPolygonCoords(ls)})
+			memberTags[w] = ls.Tags()
 		}
 		delete((*ways)[w].ww, ri)
 	}
@@ -556,53 +452,41 @@ func finishRel(ways *pendingEleMap, rel *pendingEle, tagsFilter map[string]TagTe
 
 	}()
 
-	if len(outers) == 0 {
-		return
-	}
-	var outerRings, innerRings, outerChecked, innerChecked [][]Coord
-	var groups [][][]Coord
-	err = nil
-
-	outerRings, err = merge_rings(outers)
-	if err != nil {
+	if len(members) == 0 {
 		return
 	}
 
-	outerChecked = make([][]Coord, 0, len(outerRings))
-	for _, r := range outerRings {
-		if check_ring(r) {
-			outerChecked = append(outerChecked, r)
+	rings, problems := AssembleRings(ri, members)
+	if report != nil {
+		for _, p := range problems {
+			report(p)
 		}
 	}
 
-	innerRings, err = merge_rings(inners)
-	if err != nil {
-		return
-	}
-	innerChecked = make([][]Coord, 0, len(innerRings))
-	for _, r := range innerRings {
-		if check_ring(r) {
-			innerChecked = append(innerChecked, r)
+	// the ways forming outer rings are found from the assembled rings,
+	// rather than from the member roles
+	outerTags := MakeTagsEditable(nil)
+	outerRefs := make([]elements.Ref, 0, len(members))
+	for _, r := range rings {
+		if r.Inner {
+			continue
+		}
+		for _, w := range r.Ways {
+			if !isboundary {
+				outerTags.Add(memberTags[w])
+			}
+			outerRefs = append(outerRefs, w)
 		}
 	}
 
-	if len(outerChecked) == 0 {
-		return
-	}
-
-	groups, err = group_rings(outerChecked, innerChecked, true)
-	if err != nil {
+	groups := GroupRings(rings)
+	if len(groups) == 0 {
 		return
 	}
-	/*
-	   wo := ""
-	   if rt.Len()<2 {
-	       wo = "**"
-	   }*/
 
 	rt.Add(outerTags)
 	rt.Clip()
-	zo, isp := wayTags(rt, tagsFilter)
+	zo, isp := wayTags(rt, tagsFilter, zt)
 
 	if rt.Len() == 0 || !isp {
 		return
@@ -661,7 +545,9 @@ func writeMsgs() chan<- string {
 func finishRelations(
 	inc <-chan elements.ExtendedBlock,
 	res chan<- elements.ExtendedBlock,
-	tagsFilter map[string]TagTest) error {
+	tagsFilter map[string]TagTest,
+	zt *ZOrderTable,
+	report func(RingProblem)) error {
 
 	rels := pendingEleMap{}
 	ways := pendingEleMap{}
@@ -695,7 +581,13 @@ func finishRelations(
 
 				ei := e.Id()
 
-				if _, ok := ways[ei]; !ok {
+				_, ok := ways[ei]
+				if g, isg := e.(Geometry); ok && isg && g.OriginalType() != elements.Way {
+					// geometries from relations (e.g. routes, see
+					// HandleRouteRelations) may share an id with a pending way
+					ok = false
+				}
+				if !ok {
 					//log.Println("Not needed?", e)
 					finished = append(finished, e)
 					
@@ -736,7 +628,7 @@ func finishRelations(
 					continue
 				}
 				//rc++
-				gg, err := finishRel(&ways, rl, tagsFilter)
+				gg, err := finishRel(&ways, rl, tagsFilter, zt, report)
 				if err != nil {
 					panic(err.Error())
 				}
@@ -761,7 +653,7 @@ func finishRelations(
 	finished := make(elements.ByElementId, 0, len(rels)+len(ways))
 	for _, r := range rels {
 		var err error
-		gg, err := finishRel(&ways, r, tagsFilter)
+		gg, err := finishRel(&ways, r, tagsFilter, zt, report)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -0,0 +1,66 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+func testTags(kv ...string) TagsEditable {
+	tg := MakeTagsEditable(nil)
+	for i := 0; i+1 < len(kv); i += 2 {
+		tg.Put(kv[i], kv[i+1])
+	}
+	return tg
+}
+
+func TestFinishRelationsRouteId(t *testing.T) {
+	tagsFilter := map[string]TagTest{
+		"building": {IsWay: true, IsPoly: "yes", Tag: "building", Type: "text", IsFeature: true},
+		"route":    {IsWay: true, IsPoly: "no", Tag: "route", Type: "text", IsFeature: true},
+	}
+
+	// multipolygon relation 9 with member way 5, and a route geometry
+	// made from relation 5
+	rel := elements.MakeRelation(9, nil, testTags("type", "multipolygon", "building", "yes"),
+		[]elements.ElementType{elements.Way}, []elements.Ref{5}, []string{"outer"}, 0, elements.Normal)
+	way := makePolygonGeometry(testElement(5), elements.Way, testTags(),
+		[][]Coord{closedRing(1, 0, 0, 1, 0, 1, 1, 0, 1)}, 0, 0)
+	route := makeMultiLinestringGeometry(testElement(5), elements.Relation, testTags("route", "bus"),
+		[][]Coord{testRing(10, 0, 0, 2, 2)}, []string{""}, 0)
+
+	for _, order := range []elements.ByElementId{{rel, way, route}, {rel, route, way}} {
+		inc := make(chan elements.ExtendedBlock)
+		res := make(chan elements.ExtendedBlock)
+		go func() {
+			inc <- elements.MakeExtendedBlock(0, order, 0, 0, 0, nil)
+			close(inc)
+		}()
+		go func() {
+			if err := finishRelations(inc, res, tagsFilter, nil, nil); err != nil {
+				t.Error(err)
+			}
+			close(res)
+		}()
+
+		found := map[GeometryType]elements.Ref{}
+		for bl := range res {
+			for i := 0; i < bl.Len(); i++ {
+				g := bl.Element(i).(Geometry)
+				if g.OriginalType() != elements.Relation {
+					t.Errorf("unexpected %s geometry %d", g.OriginalType(), g.Id())
+					continue
+				}
+				found[g.GeometryType()] = g.Id()
+			}
+		}
+		if len(found) != 2 || found[Polygon] != 9 || found[MultiLinestring] != 5 {
+			t.Errorf("found %v, expected multipolygon 9 and route 5", found)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+// MakeValid repairs Polygon and MultiGeometry geometries: repeated points
+// and spikes (where a ring doubles back on itself) are removed, rings which
+// cross or touch themselves are split into separate rings, and rings are
+// oriented as calculate_polygon_area expects (clockwise outer rings, anti
+// clockwise inner rings). Inner rings are placed in the smallest outer
+// ring containing them, or dropped. The result may be a Polygon or a
+// MultiGeometry, or nil if no valid rings remain. Other geometry types are
+// returned unchanged.
+//
+// Note that inner rings crossing their outer ring are not fixed.
+func MakeValid(g Geometry) Geometry {
+	var polys [][][]Coord
+	var zo int64
+	switch g.GeometryType() {
+	case Polygon:
+		py := g.(PolygonGeometry)
+		polys = [][][]Coord{polygonRings(py.NumRings(), py.NumCoords, py.Coord)}
+		zo = py.ZOrder()
+	case Multi:
+		mg := g.(MultiGeometry)
+		polys = make([][][]Coord, mg.NumGeometries())
+		for i := range polys {
+			ii := i
+			polys[i] = polygonRings(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) Coord { return mg.Coord(ii, j, k) })
+		}
+		zo = mg.ZOrder()
+	default:
+		return g
+	}
+
+	res := [][][]Coord{}
+	for _, py := range polys {
+		res = append(res, makeValidPolygon(py)...)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+
+	ar := 0.0
+	for _, py := range res {
+		a, _ := calculate_polygon_area(py)
+		ar += a
+	}
+	if len(res) == 1 {
+		return makePolygonGeometry(g, g.OriginalType(), g.Tags(), res[0], zo, ar)
+	}
+	return makeMultiGeometry(g, g.OriginalType(), g.Tags(), res, zo, ar)
+}
+
+// MakeValidGeometries applies MakeValid to each Polygon and MultiGeometry
+// in inc. Geometries with no valid rings are dropped.
+func MakeValidGeometries(inc <-chan elements.ExtendedBlock) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		for bl := range inc {
+			nb := make(elements.ByElementId, 0, bl.Len())
+			for i := 0; i < bl.Len(); i++ {
+				e := bl.Element(i)
+				g, ok := e.(Geometry)
+				if !ok {
+					nb = append(nb, e)
+					continue
+				}
+				if v := MakeValid(g); v != nil {
+					nb = append(nb, v)
+				}
+			}
+			res <- elements.MakeExtendedBlock(bl.Idx(), nb, bl.Quadtree(), bl.StartDate(), bl.EndDate(), bl.Tags())
+		}
+		close(res)
+	}()
+	return res
+}
+
+func polygonRings(nr int, nc func(int) int, co func(int, int) Coord) [][]Coord {
+	res := make([][]Coord, nr)
+	for i := range res {
+		res[i] = make([]Coord, nc(i))
+		for j := range res[i] {
+			res[i][j] = co(i, j)
+		}
+	}
+	return res
+}
+
+// makeValidPolygon returns one or more valid polygons from the rings of
+// py, the first of which is the outer ring.
+func makeValidPolygon(py [][]Coord) [][][]Coord {
+	if len(py) == 0 {
+		return nil
+	}
+	outers := splitRing(py[0], 0)
+	if len(outers) == 0 {
+		return nil
+	}
+	inners := [][]Coord{}
+	for _, r := range py[1:] {
+		inners = append(inners, splitRing(r, 0)...)
+	}
+
+	res := make([][][]Coord, len(outers))
+	areas := make([]float64, len(outers))
+	refs := make([]map[elements.Ref]bool, len(outers))
+	for i, o := range outers {
+		res[i] = [][]Coord{o}
+		areas[i], _ = calculate_ring_area(o)
+		refs[i] = map[elements.Ref]bool{}
+		for _, c := range o {
+			refs[i][c.Ref()] = true
+		}
+	}
+	for _, in := range inners {
+		best := -1
+		for i, o := range outers {
+			if (best == -1 || areas[i] < areas[best]) && ringWithin(in, o, refs[i]) {
+				best = i
+			}
+		}
+		if best != -1 {
+			res[best] = append(res[best], in)
+		}
+	}
+	return res
+}
+
+// removeSpikes removes repeated points, and points where the ring doubles
+// back on itself, from the closed ring rr.
+func removeSpikes(rr []Coord) []Coord {
+	if len(rr) < 2 {
+		return nil
+	}
+	// work on the ring without the closing point
+	pts := append([]Coord{}, rr[:len(rr)-1]...)
+	for changed := true; changed && len(pts) >= 3; {
+		changed = false
+		for k := 0; k < len(pts) && len(pts) >= 3; {
+			p := pts[(k+len(pts)-1)%len(pts)]
+			c := pts[k]
+			n := pts[(k+1)%len(pts)]
+			if same_point(p, c) || isSpike(p, c, n) {
+				pts = append(pts[:k], pts[k+1:]...)
+				changed = true
+				continue
+			}
+			k++
+		}
+	}
+	if len(pts) < 3 {
+		return nil
+	}
+	return append(pts, pts[0])
+}
+
+// isSpike tests if c lies on a line with p and n, and the line from p to c
+// turns back at c.
+func isSpike(p, c, n Coord) bool {
+	if same_point(p, n) {
+		return true
+	}
+	if orientation(p.Lon(), p.Lat(), c.Lon(), c.Lat(), n.Lon(), n.Lat()) != 0 {
+		return false
+	}
+	dx := float64(c.Lon()-p.Lon())*float64(n.Lon()-c.Lon()) + float64(c.Lat()-p.Lat())*float64(n.Lat()-c.Lat())
+	return dx < 0
+}
+
+// maximum number of times a single ring is split by splitRing
+const maxSplits = 64
+
+// splitRing returns valid rings made from the closed ring rr, splitting it
+// where it touches or crosses itself, with each ring oriented clockwise.
+// Rings with zero area are dropped.
+func splitRing(rr []Coord, depth int) [][]Coord {
+	rr = removeSpikes(rr)
+	if len(rr) < 4 {
+		return nil
+	}
+	if depth < maxSplits {
+		if a, b, ok := splitAtRepeat(rr); ok {
+			return append(splitRing(a, depth+1), splitRing(b, depth+1)...)
+		}
+		if a, b, ok := splitAtCrossing(rr); ok {
+			return append(splitRing(a, depth+1), splitRing(b, depth+1)...)
+		}
+	}
+	ar, ccw := calculate_ring_area(rr)
+	if ar == 0 {
+		return nil
+	}
+	if ccw {
+		reverse_ring(rr)
+	}
+	return [][]Coord{rr}
+}
+
+// splitAtRepeat splits rr into two rings if any point (other than the
+// closing point) appears more than once.
+func splitAtRepeat(rr []Coord) ([]Coord, []Coord, bool) {
+	type xy struct{ x, y int64 }
+	seen := map[xy]int{}
+	for j := 0; j < len(rr)-1; j++ {
+		k := xy{rr[j].Lon(), rr[j].Lat()}
+		if i, ok := seen[k]; ok {
+			a := append(append([]Coord{}, rr[:i+1]...), rr[j+1:]...)
+			b := append([]Coord{}, rr[i:j+1]...)
+			return a, b, true
+		}
+		seen[k] = j
+	}
+	return nil, nil, false
+}
+
+// splitAtCrossing splits rr into two rings at the first place found where
+// two segments cross.
+func splitAtCrossing(rr []Coord) ([]Coord, []Coord, bool) {
+	found := false
+	var i, j int
+	var x, y int64
+	sweepSegments([][]Coord{rr}, func(s, t ringSegment, sx, sy int64) bool {
+		i, j, x, y = s.idx, t.idx, sx, sy
+		found = true
+		return false
+	})
+	if !found {
+		return nil, nil, false
+	}
+	if i > j {
+		i, j = j, i
+	}
+	p := coordImpl{0, x, y}
+	a := append(append(append([]Coord{}, rr[:i+1]...), p), rr[j+1:]...)
+	b := append(append([]Coord{p}, rr[i+1:j+1]...), p)
+	return drop_repeats(a), drop_repeats(b), true
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+// testRing returns a ring from pairs of lon, lat values (in degrees),
+// with refs starting at ref
+func testRing(ref elements.Ref, ll ...float64) []Coord {
+	res := make([]Coord, 0, len(ll)/2)
+	for i := 0; i+1 < len(ll); i += 2 {
+		res = append(res, coordImpl{ref + elements.Ref(i/2), int64(ll[i] * 1e7), int64(ll[i+1] * 1e7)})
+	}
+	return res
+}
+
+func testElement(id elements.Ref) elements.FullElement {
+	return elements.MakeNode(id, nil, nil, 0, 0, 0, elements.Normal)
+}
+
+func ringLens(g Geometry) [][]int {
+	switch g.GeometryType() {
+	case Polygon:
+		py := g.(PolygonGeometry)
+		res := []int{}
+		for j := 0; j < py.NumRings(); j++ {
+			res = append(res, py.NumCoords(j))
+		}
+		return [][]int{res}
+	case Multi:
+		mg := g.(MultiGeometry)
+		res := [][]int{}
+		for i := 0; i < mg.NumGeometries(); i++ {
+			rr := []int{}
+			for j := 0; j < mg.NumRings(i); j++ {
+				rr = append(rr, mg.NumCoords(i, j))
+			}
+			res = append(res, rr)
+		}
+		return res
+	}
+	return nil
+}
+
+func TestMakeValidMulti(t *testing.T) {
+	coords := [][][]Coord{
+		{testRing(1, 0, 0, 0, 1, 1, 1, 1, 0, 0, 0)},
+		{
+			testRing(10, 2, 0, 2, 1, 3, 1, 3, 0, 2, 0),
+			testRing(20, 2.2, 0.2, 2.5, 0.8, 2.8, 0.2, 2.2, 0.2),
+		},
+		{testRing(30, 4, 0, 4, 1, 5, 1, 5, 0, 4, 0)},
+	}
+	mg := makeMultiGeometry(testElement(1), elements.Relation, nil, coords, 0, 0)
+
+	if l := mg.NumCoords(1, 0); l != 5 {
+		t.Errorf("NumCoords(1, 0) = %d, expected 5", l)
+	}
+	if l := mg.NumCoords(2, 0); l != 5 {
+		t.Errorf("NumCoords(2, 0) = %d, expected 5", l)
+	}
+
+	v := MakeValid(mg)
+	if v == nil {
+		t.Fatalf("MakeValid returned nil")
+	}
+	if v.GeometryType() != Multi {
+		t.Fatalf("MakeValid returned %s, expected Multi", v.GeometryType())
+	}
+	rl := ringLens(v)
+	expected := [][]int{{5}, {5, 4}, {5}}
+	if len(rl) != len(expected) {
+		t.Fatalf("ring lengths %v, expected %v", rl, expected)
+	}
+	for i := range expected {
+		if len(rl[i]) != len(expected[i]) {
+			t.Fatalf("ring lengths %v, expected %v", rl, expected)
+		}
+		for j := range expected[i] {
+			if rl[i][j] != expected[i][j] {
+				t.Errorf("ring lengths %v, expected %v", rl, expected)
+			}
+		}
+	}
+}
+
+func TestMakeValidBowtie(t *testing.T) {
+	py := makePolygonGeometry(testElement(2), elements.Way, nil,
+		[][]Coord{testRing(1, 0, 0, 1, 1, 1, 0, 0, 1, 0, 0)}, 0, 0)
+
+	v := MakeValid(py)
+	if v == nil {
+		t.Fatalf("MakeValid returned nil")
+	}
+	if v.GeometryType() != Multi {
+		t.Fatalf("MakeValid returned %s, expected Multi", v.GeometryType())
+	}
+	rl := ringLens(v)
+	if len(rl) != 2 || len(rl[0]) != 1 || len(rl[1]) != 1 || rl[0][0] != 4 || rl[1][0] != 4 {
+		t.Errorf("ring lengths %v, expected [[4] [4]]", rl)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"fmt"
+	"strings"
+)
+
+type multiLinestringGeometryImpl struct {
+	ct   elements.ChangeType
+	id   elements.Ref
+	info elements.Info
+	tags elements.Tags
+	qt   quadtree.Quadtree
+
+	ot     elements.ElementType
+	coords [][]Coord
+	roles  []string
+	zorder int64
+	bbox   *quadtree.Bbox
+}
+
+func makeMultiLinestringGeometry(gp elements.FullElement, ot elements.ElementType, tg elements.Tags, coords [][]Coord, roles []string, zorder int64) MultiLinestringGeometry {
+	bb := quadtree.NullBbox()
+	for _, cc := range coords {
+		expandBbox(bb, cc)
+	}
+	if len(roles) != len(coords) {
+		roles = make([]string, len(coords))
+	}
+	return &multiLinestringGeometryImpl{gp.ChangeType(), gp.Id(), gp.Info(), tg, gp.Quadtree(), ot, coords, roles, zorder, bb}
+}
+
+func (ml *multiLinestringGeometryImpl) Type() elements.ElementType         { return elements.Geometry }
+func (ml *multiLinestringGeometryImpl) Id() elements.Ref                   { return ml.id }
+func (ml *multiLinestringGeometryImpl) OriginalType() elements.ElementType { return ml.ot }
+func (ml *multiLinestringGeometryImpl) Info() elements.Info                { return ml.info }
+func (ml *multiLinestringGeometryImpl) Tags() elements.Tags                { return ml.tags }
+func (ml *multiLinestringGeometryImpl) ChangeType() elements.ChangeType    { return ml.ct }
+func (ml *multiLinestringGeometryImpl) Quadtree() quadtree.Quadtree        { return ml.qt }
+func (ml *multiLinestringGeometryImpl) SetChangeType(ct elements.ChangeType) {
+	ml.ct = ct
+}
+func (ml *multiLinestringGeometryImpl) SetQuadtree(qt quadtree.Quadtree) { ml.qt = qt }
+func (ml *multiLinestringGeometryImpl) Pack() []byte {
+	return elements.PackFullElement(ml, ml.GeometryData())
+}
+func (ml *multiLinestringGeometryImpl) String() string {
+	return fmt.Sprintf("MultiLinestring %8d %.20s", ml.id, ml.AsWkt(false))
+}
+
+func (ml *multiLinestringGeometryImpl) NumLines() int              { return len(ml.coords) }
+func (ml *multiLinestringGeometryImpl) NumCoords(i int) int        { return len(ml.coords[i]) }
+func (ml *multiLinestringGeometryImpl) Coord(i, j int) Coord       { return ml.coords[i][j] }
+func (ml *multiLinestringGeometryImpl) Role(i int) string          { return ml.roles[i] }
+func (ml *multiLinestringGeometryImpl) ZOrder() int64              { return ml.zorder }
+func (ml *multiLinestringGeometryImpl) GeometryType() GeometryType { return MultiLinestring }
+func (ml *multiLinestringGeometryImpl) Bbox() quadtree.Bbox        { return *ml.bbox }
+
+func (ml *multiLinestringGeometryImpl) GeometryData() []byte {
+	return packMultiLinestringData(ml.ot, ml.coords, ml.roles, ml.zorder, ml.bbox)
+}
+
+func (ml *multiLinestringGeometryImpl) IsValid() bool {
+	for _, l := range ml.coords {
+		if len(l) < 2 {
+			return false
+		}
+	}
+	return len(ml.coords) > 0
+}
+
+func (ml *multiLinestringGeometryImpl) AsWkt(prj bool) string {
+	ss := make([]string, len(ml.coords))
+	for i, cc := range ml.coords {
+		ss[i] = ringWkt(cc, prj)
+	}
+	return fmt.Sprintf("MULTILINESTRING(%s)", strings.Join(ss, ", "))
+}
+
+func (ml *multiLinestringGeometryImpl) AsWkb(prj bool) []byte {
+	rr := make([][]byte, len(ml.coords)+1)
+	rr[0] = make([]byte, 9)
+	utils.WriteInt32(rr[0], 1, 5)
+	utils.WriteInt32(rr[0], 5, int32(len(ml.coords)))
+	for i, cc := range ml.coords {
+		rr[i+1] = LinestringWkb(cc, prj)
+	}
+	return joinArr(rr)
+}
+
+// AsWkbPostgis returns a separate linestring for each line, as
+// multiGeometryImpl does for polygons.
+func (ml *multiLinestringGeometryImpl) AsWkbPostgis(prj bool) [][]byte {
+	ans := make([][]byte, 0, len(ml.coords))
+	for _, cc := range ml.coords {
+		g := make([]byte, 9)
+		utils.WriteInt32(g, 1, int32(2+(1<<29)))
+		if prj {
+			utils.WriteInt32(g, 5, 900913)
+		} else {
+			utils.WriteInt32(g, 5, 4326)
+		}
+		ans = append(ans, append(g, ringWkb(cc, prj)...))
+	}
+	return ans
+}
+
+func (ml *multiLinestringGeometryImpl) AsGeoJson(asMerc bool) interface{} {
+	cc := make([]interface{}, len(ml.coords))
+	for i, r := range ml.coords {
+		cc[i] = coordSliceGeom(r, asMerc)
+	}
+	return map[string]interface{}{"type": "MultiLineString", "coordinates": cc}
+}
+
+func (ml *multiLinestringGeometryImpl) GeodesicArea() float64 { return 0 }
+func (ml *multiLinestringGeometryImpl) GeodesicLength() float64 {
+	l := 0.0
+	for _, cc := range ml.coords {
+		l += geodesicLineLength(cc)
+	}
+	return l
+}
+func (ml *multiLinestringGeometryImpl) Centroid() Coord {
+	sx, sy, sl := 0.0, 0.0, 0.0
+	for _, cc := range ml.coords {
+		x, y, l := lineCentroid(cc)
+		sx += x * l
+		sy += y * l
+		sl += l
+	}
+	if sl == 0 {
+		if len(ml.coords) == 0 || len(ml.coords[0]) == 0 {
+			return nil
+		}
+		return ml.coords[0][0]
+	}
+	return floatCoord(sx/sl, sy/sl)
+}
+
+// PointOnSurface returns the point half way along the longest line
+func (ml *multiLinestringGeometryImpl) PointOnSurface() Coord {
+	bi, bl := -1, -1.0
+	for i, cc := range ml.coords {
+		if _, _, l := lineCentroid(cc); l > bl {
+			bi, bl = i, l
+		}
+	}
+	if bi == -1 {
+		return nil
+	}
+	return linePointOnSurface(ml.coords[bi])
+}
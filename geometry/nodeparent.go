@@ -24,13 +24,40 @@ import (
 // for proccesParentValue. This can then replace the geospatial join for
 // rendering turning circles.
 func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]string) string, nodetag, waytag, parenttag string) <-chan elements.ExtendedBlock {
+	rule := nodeParentRule{
+		func(tt TagsEditable) bool { return tt.Has(nodetag) },
+		func(tt TagsEditable) bool { return true },
+		waytag,
+		func(tt TagsEditable, ss []string) {
+			hw := processParentValue(ss)
+			if hw != "" {
+				tt.Put(parenttag, hw)
+			}
+		},
+	}
+	return addNodeParentRules(inc, []nodeParentRule{rule})
+}
+
+// nodeParentRule selects nodes with testNode and parent ways with testWay
+// (and having tag waytag). The values of waytag are passed to proc.
+type nodeParentRule struct {
+	testNode func(TagsEditable) bool
+	testWay  func(TagsEditable) bool
+	waytag   string
+	proc     func(TagsEditable, []string)
+}
+
+// addNodeParentRules is AddNodeParent for several rules at once. This
+// must be a single stage: the affected nodes are written after their
+// parent ways, so a second stage would not find any parent values.
+func addNodeParentRules(inc <-chan elements.ExtendedBlock, rules []nodeParentRule) <-chan elements.ExtendedBlock {
 
 	res := make(chan elements.ExtendedBlock)
 
 	go func() {
 
 		nodes := map[quadtree.Quadtree][]elements.FullNode{}
-		ss := map[elements.Ref][]string{} //nodes waiting parent values
+		ss := map[elements.Ref][][]string{} //nodes waiting parent values, for each rule
 		idx := 0
 		for bl := range inc {
 			nn := make([]elements.FullNode, 0, 25)
@@ -45,9 +72,17 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 					if !ok {
 						panic("unconverted tags")
 					}
-					if tt.Has(nodetag) {
+					vv := make([][]string, len(rules))
+					found := false
+					for j, r := range rules {
+						if r.testNode(tt) {
+							vv[j] = make([]string, 0, 5)
+							found = true
+						}
+					}
+					if found {
 						nn = append(nn, fn)
-						ss[fn.Id()] = make([]string, 0, 5)
+						ss[fn.Id()] = vv
 					} else {
 						nb = append(nb, e) //pass on
 					}
@@ -58,13 +93,16 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 					if !ok {
 						panic("unconverted tags")
 					}
-					if tt.Has(waytag) {
-						h := tt.Get(waytag)
+					for j, r := range rules {
+						if !tt.Has(r.waytag) || !r.testWay(tt) {
+							continue
+						}
+						h := tt.Get(r.waytag)
 						for i := 0; i < fw.Len(); i++ {
 							n := fw.Ref(i)
-							if _, ok := ss[n]; ok {
+							if vv, ok := ss[n]; ok && vv[j] != nil {
 								//add to pending map
-								ss[n] = append(ss[n], h)
+								vv[j] = append(vv[j], h)
 							}
 						}
 					}
@@ -76,7 +114,7 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 			res <- elements.MakeExtendedBlock(idx, nb, bq, bl.StartDate(), bl.EndDate(), nil)
 			idx++
 
-			nodes[bq] = nn
+			nodes[bq] = append(nodes[bq], nn...)
 			ds := make([]quadtree.Quadtree, 0, len(nodes))
 			for k, v := range nodes {
 				if k.Common(bq) != k {
@@ -85,10 +123,7 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 					// output channel
 					r := make(elements.ByElementId, len(v))
 					for i, n := range v {
-						hw := processParentValue(ss[n.Id()])
-						if hw != "" {
-							n.Tags().(TagsEditable).Put(parenttag, hw)
-						}
+						procNodeParent(rules, n, ss[n.Id()])
 						r[i] = n
 						delete(ss, n.Id())
 					}
@@ -108,11 +143,7 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 		for k, v := range nodes {
 			r := make(elements.ByElementId, len(v))
 			for i, n := range v {
-				hw := processParentValue(ss[n.Id()])
-
-				if hw != "" {
-					n.Tags().(TagsEditable).Put(parenttag, hw)
-				}
+				procNodeParent(rules, n, ss[n.Id()])
 				r[i] = n
 				delete(ss, n.Id())
 			}
@@ -126,3 +157,12 @@ func AddNodeParent(inc <-chan elements.ExtendedBlock, processParentValue func([]
 	}()
 	return res
 }
+
+func procNodeParent(rules []nodeParentRule, n elements.FullNode, vv [][]string) {
+	tt := n.Tags().(TagsEditable)
+	for j, r := range rules {
+		if vv[j] != nil {
+			r.proc(tt, vv[j])
+		}
+	}
+}
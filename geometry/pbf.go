@@ -6,6 +6,7 @@
 package geometry
 
 import (
+	"errors"
 	"math"
     "fmt"
 	"github.com/jharris2268/osmquadtree/elements"
@@ -159,7 +160,13 @@ func extractGeometry(gp elements.PackedGeometry) (Geometry, error) {
 		return makeLinestringGeometry(gp, ot, gp.Tags(), objs[0][0], zorder), nil
 	case Polygon:
 		return makePolygonGeometry(gp, ot, gp.Tags(), objs[0], zorder, area), nil
-	case MultiPoint, MultiLinestring, MultiPolygon, Multi:
+	case MultiLinestring:
+		lines := make([][]Coord, len(objs))
+		for i, o := range objs {
+			lines[i] = o[0]
+		}
+		return makeMultiLinestringGeometry(gp, ot, gp.Tags(), lines, readGeometryRoles(gp.GeometryData()), zorder), nil
+	case MultiPoint, MultiPolygon, Multi:
 		return makeMultiGeometry(gp, ot, gp.Tags(), objs, zorder, area), nil
 	}
     fmt.Println("???",gt,objs,zorder,area)
@@ -290,3 +297,99 @@ func packMultiGeometryData(ot elements.ElementType, cc [][][]Coord, zo int64, ar
     msgs = append(msgs, utils.PbfMsg{17, nil, uint64(ot)})
 	return msgs.Pack()
 }
+
+func packMultiLinestringData(ot elements.ElementType, cc [][]Coord, roles []string, zo int64, bb *quadtree.Bbox) []byte {
+	msgs := make(utils.PbfMsgSlice, 0, 4+2*len(cc))
+	msgs = append(msgs, utils.PbfMsg{10, nil, uint64(MultiLinestring)})
+	msgs = append(msgs, utils.PbfMsg{11, nil, utils.Zigzag(zo)})
+	for _, c := range cc {
+		msgs = append(msgs, utils.PbfMsg{14, packRing(c), 0})
+	}
+	if bb != nil {
+		msgs = append(msgs, utils.PbfMsg{16, packBbox(*bb), 0})
+	}
+	msgs = append(msgs, utils.PbfMsg{17, nil, uint64(ot)})
+	for _, r := range roles {
+		msgs = append(msgs, utils.PbfMsg{18, []byte(r), 0})
+	}
+	return msgs.Pack()
+}
+
+func readGeometryRoles(indata []byte) []string {
+	roles := []string{}
+	for pos, msg := utils.ReadPbfTag(indata, 0); msg.Tag > 0; pos, msg = utils.ReadPbfTag(indata, pos) {
+		if msg.Tag == 18 {
+			roles = append(roles, string(msg.Data))
+		}
+	}
+	return roles
+}
+
+// MakeCoord returns a Coord at lon, lat (in 10^-7 degrees, see
+// quadtree.ToInt) with node ref.
+func MakeCoord(ref elements.Ref, lon, lat int64) Coord {
+	return coordImpl{ref, lon, lat}
+}
+
+// PackGeometryData returns the GeometryData for a geometry of type gt, as
+// read by ExtractGeometry, and its bounding box. The coordinates are given
+// in the same form for each type: a list of parts, each a list of rings.
+// A Point has a single part with a single coordinate, a Linestring a
+// single part with one ring, a MultiLinestring a part with one ring for
+// each line, a Polygon a single part and a Multi any number of polygon
+// parts. Polygon rings are reoriented (outer rings clockwise, inner rings
+// anticlockwise) and the area calculated as for geometries made by
+// MakeGeometries. The z_order is found from tags with zt
+// (DefaultZOrderTable if nil), and ot is the original element type.
+func PackGeometryData(gt GeometryType, ot elements.ElementType, tags elements.Tags, zt *ZOrderTable, parts [][][]Coord) ([]byte, quadtree.Bbox, error) {
+	bx := quadtree.NullBbox()
+	for _, p := range parts {
+		for _, r := range p {
+			expandBbox(bx, r)
+		}
+	}
+	zo, _ := zt.ZOrder(tags)
+
+	switch gt {
+	case Point:
+		if len(parts) != 1 || len(parts[0]) != 1 || len(parts[0][0]) != 1 {
+			return nil, *bx, errors.New("Point must have a single coordinate")
+		}
+		return packPointData(ot, parts[0][0][0]), *bx, nil
+	case Linestring:
+		if len(parts) != 1 || len(parts[0]) != 1 || len(parts[0][0]) < 2 {
+			return nil, *bx, errors.New("Linestring must have a single line of at least two coordinates")
+		}
+		return packLinestringData(ot, parts[0][0], zo, bx), *bx, nil
+	case MultiLinestring:
+		if len(parts) != 1 || len(parts[0]) == 0 {
+			return nil, *bx, errors.New("MultiLinestring must have a single part")
+		}
+		for _, ln := range parts[0] {
+			if len(ln) < 2 {
+				return nil, *bx, errors.New("lines must have at least two coordinates")
+			}
+		}
+		return packMultiLinestringData(ot, parts[0], nil, zo, bx), *bx, nil
+	case Polygon, Multi:
+		if len(parts) == 0 || (gt == Polygon && len(parts) != 1) {
+			return nil, *bx, errors.New(fmt.Sprintf("wrong number of parts (%d) for %s", len(parts), gt))
+		}
+		ar := 0.0
+		for _, p := range parts {
+			if len(p) == 0 {
+				return nil, *bx, errors.New("polygon without rings")
+			}
+			a, err := calculate_polygon_area(p)
+			if err != nil {
+				return nil, *bx, err
+			}
+			ar += a
+		}
+		if gt == Polygon {
+			return packPolygonData(ot, parts[0], zo, ar, bx), *bx, nil
+		}
+		return packMultiGeometryData(ot, parts, zo, ar, bx), *bx, nil
+	}
+	return nil, *bx, UnrecognisedGeometryError
+}
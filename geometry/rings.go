@@ -0,0 +1,438 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"fmt"
+	"sort"
+)
+
+// RingProblemKind identifies a problem found when assembling the rings of
+// a multipolygon or boundary relation
+type RingProblemKind int
+
+const (
+	MissingMember    RingProblemKind = iota // way member not present in the input
+	UnclosedRing                            // member ways don't join into a closed ring
+	TooFewPoints                            // ring (or way) with less than three distinct points
+	SelfIntersection                        // ring crosses itself
+	RingIntersection                        // two rings cross each other
+	RoleMismatch                            // way with role inner in an outer ring, or vice versa
+	NoOuterRing                             // no complete rings found
+)
+
+func (k RingProblemKind) String() string {
+	switch k {
+	case MissingMember:
+		return "missing member"
+	case UnclosedRing:
+		return "unclosed ring"
+	case TooFewPoints:
+		return "too few points"
+	case SelfIntersection:
+		return "self intersection"
+	case RingIntersection:
+		return "ring intersection"
+	case RoleMismatch:
+		return "role mismatch"
+	case NoOuterRing:
+		return "no outer ring"
+	}
+	return fmt.Sprintf("RingProblemKind(%d)", int(k))
+}
+
+// RingProblem describes a problem with relation Relation. Way is the member
+// way concerned (or zero), and Lon, Lat the location of the problem (zero
+// if not known).
+type RingProblem struct {
+	Relation elements.Ref
+	Kind     RingProblemKind
+	Way      elements.Ref
+	Lon, Lat int64
+}
+
+func (rp RingProblem) String() string {
+	return fmt.Sprintf("relation %d: %s [way %d] @ %0.7f, %0.7f",
+		rp.Relation, rp.Kind, rp.Way, quadtree.ToFloat(rp.Lon), quadtree.ToFloat(rp.Lat))
+}
+
+// RingMember is a way member of a relation, with its coordinates
+type RingMember struct {
+	Way    elements.Ref
+	Role   string
+	Coords []Coord
+}
+
+// AssembledRing is a closed ring made from the member ways Ways. Rings
+// contained by an odd number of other rings are inner rings: Parent is the
+// index of the smallest ring containing this ring, or -1.
+type AssembledRing struct {
+	Coords []Coord
+	Ways   []elements.Ref
+	Inner  bool
+	Parent int
+}
+
+// AssembleRings joins the member ways of relation rel into closed rings,
+// ignoring the member roles. Whether a ring is inner or outer is decided by
+// how many other rings contain it. Unclosed rings, and rings with too few
+// points, are dropped. Rings which cross themselves, or another ring, are
+// kept, but reported along with any other problems found.
+func AssembleRings(rel elements.Ref, members []RingMember) ([]AssembledRing, []RingProblem) {
+	problems := []RingProblem{}
+	addProblem := func(k RingProblemKind, w elements.Ref, c Coord) {
+		p := RingProblem{rel, k, w, 0, 0}
+		if c != nil {
+			p.Lon, p.Lat = c.Lon(), c.Lat()
+		}
+		problems = append(problems, p)
+	}
+
+	rings := []AssembledRing{}
+	addRing := func(cc []Coord, ww []elements.Ref) {
+		cc = drop_repeats(cc)
+		if len(cc) < 4 {
+			addProblem(TooFewPoints, ww[0], cc[0])
+			return
+		}
+		rings = append(rings, AssembledRing{cc, ww, false, -1})
+	}
+
+	// closed ways are rings by themselves: index the ends of the others
+	open := []int{}
+	ends := map[elements.Ref][]int{}
+	for i, m := range members {
+		if len(m.Coords) < 2 {
+			var c Coord
+			if len(m.Coords) > 0 {
+				c = m.Coords[0]
+			}
+			addProblem(TooFewPoints, m.Way, c)
+			continue
+		}
+		a, b := m.Coords[0].Ref(), m.Coords[len(m.Coords)-1].Ref()
+		if a == b {
+			addRing(m.Coords, []elements.Ref{m.Way})
+			continue
+		}
+		open = append(open, i)
+		ends[a] = append(ends[a], i)
+		ends[b] = append(ends[b], i)
+	}
+
+	used := map[int]bool{}
+	// find an unused way with an end at node r
+	next := func(r elements.Ref) (int, bool) {
+		for _, j := range ends[r] {
+			if !used[j] {
+				return j, true
+			}
+		}
+		return -1, false
+	}
+
+	for _, i := range open {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		cc := append([]Coord{}, members[i].Coords...)
+		ww := []elements.Ref{members[i].Way}
+		flipped := false
+		for cc[0].Ref() != cc[len(cc)-1].Ref() {
+			j, ok := next(cc[len(cc)-1].Ref())
+			if !ok {
+				if flipped {
+					break
+				}
+				// try extending the other end
+				reverseCoords(cc)
+				flipped = true
+				continue
+			}
+			used[j] = true
+			jc := members[j].Coords
+			if jc[0].Ref() == cc[len(cc)-1].Ref() {
+				cc = append(cc, jc[1:]...)
+			} else {
+				for k := len(jc) - 2; k >= 0; k-- {
+					cc = append(cc, jc[k])
+				}
+			}
+			ww = append(ww, members[j].Way)
+		}
+		if cc[0].Ref() != cc[len(cc)-1].Ref() {
+			addProblem(UnclosedRing, ww[len(ww)-1], cc[len(cc)-1])
+			continue
+		}
+		addRing(cc, ww)
+	}
+
+	problems = append(problems, findIntersections(rel, rings)...)
+	classifyRings(rings)
+
+	// check roles agree with containment
+	roles := map[elements.Ref]string{}
+	for _, m := range members {
+		roles[m.Way] = m.Role
+	}
+	for _, r := range rings {
+		for _, w := range r.Ways {
+			if (roles[w] == "inner" && !r.Inner) || (roles[w] == "outer" && r.Inner) {
+				addProblem(RoleMismatch, w, r.Coords[0])
+			}
+		}
+	}
+	if len(rings) == 0 && len(members) > 0 {
+		addProblem(NoOuterRing, 0, nil)
+	}
+	return rings, problems
+}
+
+// GroupRings returns a polygon for each outer ring, followed by the inner
+// rings it directly contains.
+func GroupRings(rings []AssembledRing) [][][]Coord {
+	res := [][][]Coord{}
+	idx := map[int]int{}
+	for i, r := range rings {
+		if !r.Inner {
+			idx[i] = len(res)
+			res = append(res, [][]Coord{r.Coords})
+		}
+	}
+	for _, r := range rings {
+		if r.Inner {
+			if j, ok := idx[r.Parent]; ok {
+				res[j] = append(res[j], r.Coords)
+			}
+		}
+	}
+	return res
+}
+
+type ringsByArea struct {
+	idx  []int
+	area []float64
+}
+
+func (r ringsByArea) Len() int           { return len(r.idx) }
+func (r ringsByArea) Swap(i, j int)      { r.idx[i], r.idx[j] = r.idx[j], r.idx[i] }
+func (r ringsByArea) Less(i, j int) bool { return r.area[r.idx[i]] > r.area[r.idx[j]] }
+
+// classifyRings sets Parent to the smallest ring containing each ring, and
+// Inner if there are an odd number of containing rings.
+func classifyRings(rings []AssembledRing) {
+	if len(rings) < 2 {
+		return
+	}
+	ra := ringsByArea{make([]int, len(rings)), make([]float64, len(rings))}
+	bxs := make([]*quadtree.Bbox, len(rings))
+	refs := make([]map[elements.Ref]bool, len(rings))
+	for i, r := range rings {
+		ra.idx[i] = i
+		ra.area[i], _ = calculate_ring_area(r.Coords)
+		bxs[i] = makeBbox(r.Coords)
+	}
+	sort.Sort(ra)
+
+	depth := make([]int, len(rings))
+	for a, i := range ra.idx {
+		// larger rings come first: search from the smallest of these
+		for b := a - 1; b >= 0; b-- {
+			j := ra.idx[b]
+			if !bxs[j].Contains(*bxs[i]) {
+				continue
+			}
+			if refs[j] == nil {
+				refs[j] = map[elements.Ref]bool{}
+				for _, c := range rings[j].Coords {
+					refs[j][c.Ref()] = true
+				}
+			}
+			if ringWithin(rings[i].Coords, rings[j].Coords, refs[j]) {
+				rings[i].Parent = j
+				depth[i] = depth[j] + 1
+				break
+			}
+		}
+		rings[i].Inner = depth[i]%2 == 1
+	}
+}
+
+// ringWithin tests if inner is inside outer, using the first point of inner
+// not on outer. Rings may share nodes.
+func ringWithin(inner, outer []Coord, outerRefs map[elements.Ref]bool) bool {
+	for _, c := range inner {
+		if !outerRefs[c.Ref()] {
+			return quadtree.PointInPoly(llb(outer), c.Lon(), c.Lat())
+		}
+	}
+	// all points shared: test the middle of the first segment
+	for i := 0; i < len(inner)-1; i++ {
+		x, y := (inner[i].Lon()+inner[i+1].Lon())/2, (inner[i].Lat()+inner[i+1].Lat())/2
+		if !onRing(outer, x, y) {
+			return quadtree.PointInPoly(llb(outer), x, y)
+		}
+	}
+	return false
+}
+
+func onRing(rr []Coord, x, y int64) bool {
+	for i := 0; i < len(rr)-1; i++ {
+		if orientation(rr[i].Lon(), rr[i].Lat(), rr[i+1].Lon(), rr[i+1].Lat(), x, y) == 0 &&
+			between(rr[i].Lon(), rr[i+1].Lon(), x) && between(rr[i].Lat(), rr[i+1].Lat(), y) {
+			return true
+		}
+	}
+	return false
+}
+
+func between(a, b, v int64) bool {
+	if a > b {
+		a, b = b, a
+	}
+	return a <= v && v <= b
+}
+
+func orientation(ax, ay, bx, by, cx, cy int64) int {
+	v := float64(bx-ax)*float64(cy-ay) - float64(by-ay)*float64(cx-ax)
+	if v > 0 {
+		return 1
+	} else if v < 0 {
+		return -1
+	}
+	return 0
+}
+
+type ringSegment struct {
+	ring, idx int
+	minx      int64
+}
+
+type segmentsByMinx []ringSegment
+
+func (s segmentsByMinx) Len() int           { return len(s) }
+func (s segmentsByMinx) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s segmentsByMinx) Less(i, j int) bool { return s[i].minx < s[j].minx }
+
+// maximum number of intersections reported for each relation
+const maxIntersections = 10
+
+// sweepSegments calls fn for each pair of segments of rings which cross,
+// sweeping segments in order of minimum x so only nearby segments are
+// compared. Segments which touch at an end, such as adjacent segments of
+// the same ring, are not counted. Stops if fn returns false.
+func sweepSegments(rings [][]Coord, fn func(a, b ringSegment, x, y int64) bool) {
+	segs := segmentsByMinx{}
+	for i, r := range rings {
+		for j := 0; j < len(r)-1; j++ {
+			mx := r[j].Lon()
+			if r[j+1].Lon() < mx {
+				mx = r[j+1].Lon()
+			}
+			segs = append(segs, ringSegment{i, j, mx})
+		}
+	}
+	sort.Sort(segs)
+
+	get := func(s ringSegment) (Coord, Coord) {
+		cc := rings[s.ring]
+		return cc[s.idx], cc[s.idx+1]
+	}
+
+	active := []ringSegment{}
+	for _, s := range segs {
+		p0, p1 := get(s)
+		na := active[:0]
+		for _, t := range active {
+			q0, q1 := get(t)
+			if q0.Lon() >= s.minx || q1.Lon() >= s.minx {
+				na = append(na, t)
+			}
+		}
+		active = na
+
+		for _, t := range active {
+			if t.ring == s.ring && adjacentSegments(len(rings[s.ring]), s.idx, t.idx) {
+				continue
+			}
+			q0, q1 := get(t)
+			x, y, ok := segmentsCross(p0, p1, q0, q1)
+			if ok && !fn(t, s, x, y) {
+				return
+			}
+		}
+		active = append(active, s)
+	}
+}
+
+// findIntersections reports rings which cross themselves or each other.
+// Rings which touch at a point are allowed.
+func findIntersections(rel elements.Ref, rings []AssembledRing) []RingProblem {
+	cc := make([][]Coord, len(rings))
+	for i, r := range rings {
+		cc[i] = r.Coords
+	}
+	problems := []RingProblem{}
+	sweepSegments(cc, func(a, b ringSegment, x, y int64) bool {
+		k := RingIntersection
+		if a.ring == b.ring {
+			k = SelfIntersection
+		}
+		problems = append(problems, RingProblem{rel, k, rings[b.ring].Ways[0], x, y})
+		return len(problems) < maxIntersections
+	})
+	return problems
+}
+
+func adjacentSegments(n, a, b int) bool {
+	if a > b {
+		a, b = b, a
+	}
+	// the first and last segments of a closed ring share a point
+	return b-a <= 1 || (a == 0 && b == n-2)
+}
+
+// segmentsCross returns the crossing point of segments p0-p1 and q0-q1, if
+// they cross (or overlap). Segments which touch at an end are not counted.
+func segmentsCross(p0, p1, q0, q1 Coord) (int64, int64, bool) {
+	o1 := orientation(p0.Lon(), p0.Lat(), p1.Lon(), p1.Lat(), q0.Lon(), q0.Lat())
+	o2 := orientation(p0.Lon(), p0.Lat(), p1.Lon(), p1.Lat(), q1.Lon(), q1.Lat())
+	o3 := orientation(q0.Lon(), q0.Lat(), q1.Lon(), q1.Lat(), p0.Lon(), p0.Lat())
+	o4 := orientation(q0.Lon(), q0.Lat(), q1.Lon(), q1.Lat(), p1.Lon(), p1.Lat())
+
+	if o1*o2 < 0 && o3*o4 < 0 {
+		sx, sy := float64(p1.Lon()-p0.Lon()), float64(p1.Lat()-p0.Lat())
+		tx, ty := float64(q1.Lon()-q0.Lon()), float64(q1.Lat()-q0.Lat())
+		d := sx*ty - sy*tx
+		u := (float64(q0.Lon()-p0.Lon())*ty - float64(q0.Lat()-p0.Lat())*tx) / d
+		return p0.Lon() + int64(u*sx), p0.Lat() + int64(u*sy), true
+	}
+	if o1 == 0 && o2 == 0 {
+		// collinear: overlapping if an end of one is strictly inside the other
+		for _, c := range []Coord{q0, q1} {
+			if strictlyWithin(p0, p1, c) {
+				return c.Lon(), c.Lat(), true
+			}
+		}
+		for _, c := range []Coord{p0, p1} {
+			if strictlyWithin(q0, q1, c) {
+				return c.Lon(), c.Lat(), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func strictlyWithin(a, b, c Coord) bool {
+	if same_point(a, c) || same_point(b, c) {
+		return false
+	}
+	return between(a.Lon(), b.Lon(), c.Lon()) && between(a.Lat(), b.Lat(), c.Lat())
+}
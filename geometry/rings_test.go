@@ -0,0 +1,144 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+// gridWay returns a way member through the points (x, y) given as pairs of
+// integer degrees. The ref of each point is found from its location, so
+// that ways meeting at a point share a node.
+func gridWay(way elements.Ref, role string, xy ...int) RingMember {
+	cc := make([]Coord, 0, len(xy)/2)
+	for i := 0; i+1 < len(xy); i += 2 {
+		x, y := int64(xy[i]), int64(xy[i+1])
+		cc = append(cc, coordImpl{elements.Ref(x*1000 + y + 1), x * 10000000, y * 10000000})
+	}
+	return RingMember{way, role, cc}
+}
+
+func problemKinds(pp []RingProblem) map[RingProblemKind]int {
+	res := map[RingProblemKind]int{}
+	for _, p := range pp {
+		res[p.Kind]++
+	}
+	return res
+}
+
+func TestAssembleRings(t *testing.T) {
+	members := []RingMember{
+		// outer ring from three ways, the second reversed
+		gridWay(1, "outer", 0, 0, 0, 10, 10, 10),
+		gridWay(2, "outer", 10, 0, 10, 10),
+		gridWay(3, "outer", 10, 0, 0, 0),
+		// a hole, and an island within the hole
+		gridWay(4, "inner", 2, 2, 8, 2, 8, 8, 2, 8, 2, 2),
+		gridWay(5, "outer", 4, 4, 6, 4, 6, 6, 4, 6, 4, 4),
+		// a second outer ring touching the first at a point
+		gridWay(6, "outer", 10, 10, 12, 10, 12, 12, 10, 10),
+	}
+	rings, problems := AssembleRings(17, members)
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	if len(rings) != 4 {
+		t.Fatalf("%d rings, expected 4", len(rings))
+	}
+	byWay := map[elements.Ref]int{}
+	for i, r := range rings {
+		byWay[r.Ways[0]] = i
+		if r.Coords[0].Ref() != r.Coords[len(r.Coords)-1].Ref() {
+			t.Errorf("ring %v not closed", r.Ways)
+		}
+	}
+	outer := rings[byWay[1]]
+	if len(outer.Ways) != 3 || len(outer.Coords) != 5 || outer.Inner || outer.Parent != -1 {
+		t.Errorf("outer ring: ways %v, %d coords, inner %v, parent %d", outer.Ways, len(outer.Coords), outer.Inner, outer.Parent)
+	}
+	if r := rings[byWay[4]]; !r.Inner || r.Parent != byWay[1] {
+		t.Errorf("hole: inner %v, parent %d", r.Inner, r.Parent)
+	}
+	if r := rings[byWay[5]]; r.Inner || r.Parent != byWay[4] {
+		t.Errorf("island: inner %v, parent %d", r.Inner, r.Parent)
+	}
+	if r := rings[byWay[6]]; r.Inner || r.Parent != -1 {
+		t.Errorf("touching ring: inner %v, parent %d", r.Inner, r.Parent)
+	}
+
+	polys := GroupRings(rings)
+	if len(polys) != 3 {
+		t.Fatalf("%d polygons, expected 3", len(polys))
+	}
+	nr := 0
+	for _, p := range polys {
+		nr += len(p)
+		if len(p) == 2 && len(p[0]) != 5 {
+			t.Errorf("polygon with hole has outer ring of %d coords", len(p[0]))
+		}
+	}
+	if nr != 4 {
+		t.Errorf("polygons have %d rings, expected 4", nr)
+	}
+}
+
+func TestAssembleRingsProblems(t *testing.T) {
+	tests := []struct {
+		name     string
+		members  []RingMember
+		rings    int
+		expected map[RingProblemKind]int
+	}{
+		{"unclosed", []RingMember{
+			gridWay(1, "outer", 0, 0, 0, 10, 10, 10),
+			gridWay(2, "outer", 10, 10, 10, 0),
+			gridWay(3, "outer", 20, 20, 20, 30, 30, 30, 20, 20),
+		}, 1, map[RingProblemKind]int{UnclosedRing: 1}},
+		{"too few points", []RingMember{
+			gridWay(1, "outer", 0, 0),
+			gridWay(2, "outer", 0, 0, 1, 1, 0, 0),
+			gridWay(3, "outer", 20, 20, 20, 30, 30, 30, 20, 20),
+		}, 1, map[RingProblemKind]int{TooFewPoints: 2}},
+		{"self intersection", []RingMember{
+			gridWay(1, "outer", 0, 0, 10, 10, 10, 0, 0, 10, 0, 0),
+		}, 1, map[RingProblemKind]int{SelfIntersection: 1}},
+		{"ring intersection", []RingMember{
+			gridWay(1, "outer", 0, 0, 0, 10, 10, 10, 10, 0, 0, 0),
+			gridWay(2, "outer", 5, 5, 5, 15, 15, 15, 15, 5, 5, 5),
+		}, 2, map[RingProblemKind]int{RingIntersection: 2}},
+		{"role mismatch", []RingMember{
+			gridWay(1, "inner", 0, 0, 0, 10, 10, 10, 10, 0, 0, 0),
+			gridWay(2, "outer", 2, 2, 2, 8, 8, 8, 8, 2, 2, 2),
+		}, 2, map[RingProblemKind]int{RoleMismatch: 2}},
+		{"no outer ring", []RingMember{
+			gridWay(1, "outer", 0, 0, 0, 10, 10, 10),
+		}, 0, map[RingProblemKind]int{UnclosedRing: 1, NoOuterRing: 1}},
+	}
+
+	for _, tt := range tests {
+		rings, problems := AssembleRings(5, tt.members)
+		if len(rings) != tt.rings {
+			t.Errorf("%s: %d rings, expected %d", tt.name, len(rings), tt.rings)
+		}
+		got := problemKinds(problems)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: problems %v", tt.name, problems)
+			continue
+		}
+		for k, v := range tt.expected {
+			if got[k] != v {
+				t.Errorf("%s: %d %s problems, expected %d: %v", tt.name, got[k], k, v, problems)
+			}
+		}
+		for _, p := range problems {
+			if p.Relation != 5 {
+				t.Errorf("%s: problem %s has wrong relation", tt.name, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"fmt"
+	"strings"
+)
+
+// RouteProblemKind identifies a problem found when assembling a route
+// relation
+type RouteProblemKind int
+
+const (
+	RouteMissingMember RouteProblemKind = iota // way member not present in the input
+	RouteGap                                   // consecutive member ways which don't join
+)
+
+func (k RouteProblemKind) String() string {
+	switch k {
+	case RouteMissingMember:
+		return "missing member"
+	case RouteGap:
+		return "gap"
+	}
+	return fmt.Sprintf("RouteProblemKind(%d)", int(k))
+}
+
+// RouteProblem describes a problem with route relation Relation. For a
+// RouteGap, Way is the member way following the gap, and Lon, Lat the end
+// of the line before the gap.
+type RouteProblem struct {
+	Relation elements.Ref
+	Kind     RouteProblemKind
+	Way      elements.Ref
+	Lon, Lat int64
+}
+
+func (rp RouteProblem) String() string {
+	return fmt.Sprintf("route %d: %s [way %d] @ %0.7f, %0.7f",
+		rp.Relation, rp.Kind, rp.Way, quadtree.ToFloat(rp.Lon), quadtree.ToFloat(rp.Lat))
+}
+
+// isRoutePath returns false for member roles which are not part of the
+// path of the route, such as platforms and stops
+func isRoutePath(role string) bool {
+	return !(strings.HasPrefix(role, "platform") || strings.HasPrefix(role, "stop"))
+}
+
+type pendingRoute struct {
+	qt     quadtree.Quadtree
+	rel    elements.FullRelation
+	ww     map[elements.Ref]bool
+	coords map[elements.Ref][]Coord
+}
+
+// HandleRouteRelations adds a MultiLinestringGeometry for each relation in
+// inc with type=route and a route tag in routeTypes (e.g. bus, bicycle,
+// hiking, road). The Linestring and Polygon geometries of the member ways
+// are joined in the order of the relation: a new line is started when the
+// member role changes, or when a way doesn't join the previous way (which
+// is reported as a RouteGap). Platform and stop members are skipped. The
+// relation tags are filtered by tagsFilter, as for ways, and the z_order
+// found with zt (DefaultZOrderTable if nil). All other
+// elements are passed through unchanged: the relations themselves are
+// dropped by HandleRelations. report, if not nil, is called for each
+// problem found.
+func HandleRouteRelations(inc <-chan elements.ExtendedBlock, routeTypes []string, tagsFilter map[string]TagTest, zt *ZOrderTable, report func(RouteProblem)) <-chan elements.ExtendedBlock {
+	rts := map[string]bool{}
+	for _, r := range routeTypes {
+		rts[r] = true
+	}
+
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		routes := map[elements.Ref]*pendingRoute{}
+		wayRoutes := map[elements.Ref][]elements.Ref{}
+
+		finish := func(r elements.Ref) elements.Element {
+			pr := routes[r]
+			delete(routes, r)
+			for w := range pr.ww {
+				wr := wayRoutes[w][:0]
+				for _, x := range wayRoutes[w] {
+					if x != r {
+						wr = append(wr, x)
+					}
+				}
+				if len(wr) == 0 {
+					delete(wayRoutes, w)
+				} else {
+					wayRoutes[w] = wr
+				}
+			}
+			return finishRoute(pr, tagsFilter, zt, report)
+		}
+
+		li := 0
+		for bl := range inc {
+			nb := make(elements.ByElementId, 0, bl.Len())
+			bq := bl.Quadtree()
+			for i := 0; i < bl.Len(); i++ {
+				e := bl.Element(i)
+				nb = append(nb, e)
+				switch e.Type() {
+				case elements.Relation:
+					if relType(e) != "route" {
+						continue
+					}
+					fr := e.(elements.FullRelation)
+					if !rts[fr.Tags().(TagsEditable).Get("route")] {
+						continue
+					}
+					pr := &pendingRoute{bq, fr, map[elements.Ref]bool{}, map[elements.Ref][]Coord{}}
+					for j := 0; j < fr.Len(); j++ {
+						if fr.MemberType(j) == elements.Way && isRoutePath(fr.Role(j)) {
+							w := fr.Ref(j)
+							if !pr.ww[w] {
+								pr.ww[w] = true
+								wayRoutes[w] = append(wayRoutes[w], fr.Id())
+							}
+						}
+					}
+					routes[fr.Id()] = pr
+				case elements.Geometry:
+					rr, ok := wayRoutes[e.Id()]
+					if !ok {
+						continue
+					}
+					g, ok := e.(Geometry)
+					if !ok || g.OriginalType() != elements.Way {
+						continue
+					}
+					var cc []Coord
+					switch g.GeometryType() {
+					case Linestring:
+						cc = getLinestringCoords(g.(LinestringGeometry))
+					case Polygon:
+						cc = getPolygonCoords(g.(PolygonGeometry))
+					default:
+						continue
+					}
+					for _, r := range rr {
+						routes[r].coords[e.Id()] = cc
+					}
+				}
+			}
+
+			// as for finishRelations: all members have been seen once the
+			// input has left the relation's tile
+			fin := []elements.Ref{}
+			for r, pr := range routes {
+				if len(pr.coords) == len(pr.ww) || bq.Common(pr.qt) != pr.qt {
+					fin = append(fin, r)
+				}
+			}
+			for _, r := range fin {
+				if g := finish(r); g != nil {
+					nb = append(nb, g)
+				}
+			}
+			nb.Sort()
+			res <- elements.MakeExtendedBlock(bl.Idx(), nb, bq, bl.StartDate(), bl.EndDate(), bl.Tags())
+			li = bl.Idx()
+		}
+
+		if len(routes) > 0 {
+			nb := make(elements.ByElementId, 0, len(routes))
+			rr := make([]elements.Ref, 0, len(routes))
+			for r := range routes {
+				rr = append(rr, r)
+			}
+			for _, r := range rr {
+				if g := finish(r); g != nil {
+					nb = append(nb, g)
+				}
+			}
+			if len(nb) > 0 {
+				nb.Sort()
+				res <- elements.MakeExtendedBlock(li+1, nb, 0, 0, 0, nil)
+			}
+		}
+		close(res)
+	}()
+	return res
+}
+
+// finishRoute joins the member ways of pr, returning nil if none were
+// found.
+func finishRoute(pr *pendingRoute, tagsFilter map[string]TagTest, zt *ZOrderTable, report func(RouteProblem)) Geometry {
+	rel := pr.rel
+	lines := [][]Coord{}
+	roles := []string{}
+	var curr []Coord
+	currRole := ""
+	// curr is a single way, so may be reversed
+	single := false
+
+	finishLine := func() {
+		if len(curr) > 1 {
+			lines = append(lines, curr)
+			roles = append(roles, currRole)
+		}
+		curr = nil
+	}
+	startLine := func(cc []Coord, role string) {
+		curr = append([]Coord{}, cc...)
+		currRole = role
+		single = true
+	}
+
+	for j := 0; j < rel.Len(); j++ {
+		if rel.MemberType(j) != elements.Way || !isRoutePath(rel.Role(j)) {
+			continue
+		}
+		w := rel.Ref(j)
+		cc, ok := pr.coords[w]
+		if !ok {
+			if report != nil {
+				report(RouteProblem{rel.Id(), RouteMissingMember, w, 0, 0})
+			}
+			finishLine()
+			continue
+		}
+		role := rel.Role(j)
+		if curr == nil {
+			startLine(cc, role)
+			continue
+		}
+
+		end := curr[len(curr)-1].Ref()
+		atStart, atEnd := cc[0].Ref() == end, cc[len(cc)-1].Ref() == end
+		if !atStart && !atEnd && single {
+			if s := curr[0].Ref(); cc[0].Ref() == s || cc[len(cc)-1].Ref() == s {
+				reverseCoords(curr)
+				atStart, atEnd = cc[0].Ref() == s, cc[len(cc)-1].Ref() == s
+			}
+		}
+		if !atStart && !atEnd {
+			if report != nil {
+				last := curr[len(curr)-1]
+				report(RouteProblem{rel.Id(), RouteGap, w, last.Lon(), last.Lat()})
+			}
+			finishLine()
+			startLine(cc, role)
+			continue
+		}
+
+		next := cc
+		if !atStart {
+			next = make([]Coord, len(cc))
+			for k, c := range cc {
+				next[len(cc)-1-k] = c
+			}
+		}
+		if role != currRole {
+			// start a new line, sharing the joining point
+			finishLine()
+			startLine(next, role)
+			single = false
+			continue
+		}
+		curr = append(curr, next[1:]...)
+		single = false
+	}
+	finishLine()
+
+	if len(lines) == 0 {
+		return nil
+	}
+	tags := rel.Tags().(TagsEditable)
+	zo, _ := wayTags(tags, tagsFilter, zt)
+	return makeMultiLinestringGeometry(rel, elements.Relation, tags, lines, roles, zo)
+}
@@ -0,0 +1,294 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"container/heap"
+	"fmt"
+	"math"
+)
+
+type SimplifyMethod int
+
+const (
+	// DouglasPeucker removes points less than Tolerance from the
+	// simplified line
+	DouglasPeucker SimplifyMethod = iota
+	// Visvalingam removes points forming a triangle, with the points
+	// either side, of area less than Tolerance squared
+	Visvalingam
+)
+
+func (m SimplifyMethod) String() string {
+	switch m {
+	case DouglasPeucker:
+		return "DouglasPeucker"
+	case Visvalingam:
+		return "Visvalingam"
+	}
+	return fmt.Sprintf("SimplifyMethod(%d)", int(m))
+}
+
+// Simplification describes how to simplify geometries. Tolerance is in
+// spherical mercator units, or in metres on the ground if Metres is true
+// (these are the same at the equator: mercator units are stretched by
+// 1/cos(latitude) further north or south).
+type Simplification struct {
+	Method    SimplifyMethod
+	Tolerance float64
+	Metres    bool
+}
+
+// mercTolerance returns the tolerance in mercator units for geometries
+// with bounds bx
+func (s Simplification) mercTolerance(bx quadtree.Bbox) float64 {
+	if !s.Metres {
+		return s.Tolerance
+	}
+	lt := quadtree.ToFloat((bx.Miny + bx.Maxy) / 2)
+	return s.Tolerance / math.Cos(lt*math.Pi/180)
+}
+
+// maximum number of times the tolerance is halved when simplifying a
+// polygon produces invalid rings
+const maxSimplifyRetries = 4
+
+// Simplify returns a simplified copy of a Linestring, MultiLinestring,
+// Polygon or MultiGeometry. Polygons are simplified so that each ring is
+// still valid, and rings don't cross (if necessary by simplifying less):
+// rings which cannot be simplified are left unchanged. Other geometries
+// are returned unchanged.
+func (s Simplification) Simplify(g Geometry) Geometry {
+	tol := s.mercTolerance(g.Bbox())
+	if tol <= 0 {
+		return g
+	}
+	switch g.GeometryType() {
+	case Linestring:
+		ln := g.(LinestringGeometry)
+		cc := make([]Coord, ln.NumCoords())
+		for i := range cc {
+			cc[i] = ln.Coord(i)
+		}
+		return makeLinestringGeometry(g, g.OriginalType(), g.Tags(), s.simplifyLine(cc, tol, 2), ln.ZOrder())
+	case MultiLinestring:
+		ml := g.(MultiLinestringGeometry)
+		lines := make([][]Coord, ml.NumLines())
+		roles := make([]string, ml.NumLines())
+		for i := range lines {
+			cc := make([]Coord, ml.NumCoords(i))
+			for j := range cc {
+				cc[j] = ml.Coord(i, j)
+			}
+			lines[i] = s.simplifyLine(cc, tol, 2)
+			roles[i] = ml.Role(i)
+		}
+		return makeMultiLinestringGeometry(g, g.OriginalType(), g.Tags(), lines, roles, ml.ZOrder())
+	case Polygon:
+		py := g.(PolygonGeometry)
+		rings := s.simplifyPolygon(polygonRings(py.NumRings(), py.NumCoords, py.Coord), tol)
+		ar, _ := calculate_polygon_area(rings)
+		return makePolygonGeometry(g, g.OriginalType(), g.Tags(), rings, py.ZOrder(), ar)
+	case Multi:
+		mg := g.(MultiGeometry)
+		polys := make([][][]Coord, mg.NumGeometries())
+		ar := 0.0
+		for i := range polys {
+			ii := i
+			polys[i] = s.simplifyPolygon(polygonRings(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) Coord { return mg.Coord(ii, j, k) }), tol)
+			a, _ := calculate_polygon_area(polys[i])
+			ar += a
+		}
+		return makeMultiGeometry(g, g.OriginalType(), g.Tags(), polys, mg.ZOrder(), ar)
+	}
+	return g
+}
+
+// SimplifyGeometries applies s.Simplify to each geometry in inc, for use
+// after MakeGeometries or GenerateGeometries.
+func SimplifyGeometries(inc <-chan elements.ExtendedBlock, s Simplification) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		for bl := range inc {
+			nb := make(elements.ByElementId, bl.Len())
+			for i := range nb {
+				e := bl.Element(i)
+				if g, ok := e.(Geometry); ok {
+					e = s.Simplify(g)
+				}
+				nb[i] = e
+			}
+			res <- elements.MakeExtendedBlock(bl.Idx(), nb, bl.Quadtree(), bl.StartDate(), bl.EndDate(), bl.Tags())
+		}
+		close(res)
+	}()
+	return res
+}
+
+// simplifyPolygon simplifies each ring of py, halving the tolerance until
+// the rings are valid and do not cross.
+func (s Simplification) simplifyPolygon(py [][]Coord, tol float64) [][]Coord {
+	for try := 0; try < maxSimplifyRetries; try++ {
+		res := make([][]Coord, len(py))
+		for i, r := range py {
+			res[i] = s.simplifyLine(r, tol, 4)
+			if a, _ := calculate_ring_area(res[i]); a == 0 {
+				res[i] = r
+			}
+		}
+		crosses := false
+		sweepSegments(res, func(a, b ringSegment, x, y int64) bool {
+			crosses = true
+			return false
+		})
+		if !crosses {
+			return res
+		}
+		tol /= 2
+	}
+	return py
+}
+
+// simplifyLine simplifies the line cc, keeping the first and last points
+// and at least minPoints points.
+func (s Simplification) simplifyLine(cc []Coord, tol float64, minPoints int) []Coord {
+	if len(cc) <= minPoints {
+		return cc
+	}
+	xy := make([][2]float64, len(cc))
+	for i, c := range cc {
+		xy[i][0], xy[i][1] = c.XY()
+	}
+	var keep []bool
+	if s.Method == Visvalingam {
+		keep = visvalingam(xy, tol*tol, minPoints)
+	} else {
+		keep = douglasPeucker(xy, tol, minPoints)
+	}
+	res := make([]Coord, 0, len(cc))
+	for i, c := range cc {
+		if keep[i] {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// segmentDistance returns the distance from p to the segment a-b
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	px, py := p[0]-a[0], p[1]-a[1]
+	l := dx*dx + dy*dy
+	if l > 0 {
+		t := (px*dx + py*dy) / l
+		if t > 1 {
+			t = 1
+		} else if t < 0 {
+			t = 0
+		}
+		px, py = px-t*dx, py-t*dy
+	}
+	return math.Sqrt(px*px + py*py)
+}
+
+func douglasPeucker(xy [][2]float64, tol float64, minPoints int) []bool {
+	keep := make([]bool, len(xy))
+	keep[0], keep[len(xy)-1] = true, true
+	nk := 2
+
+	type span struct{ a, b int }
+	stack := []span{{0, len(xy) - 1}}
+	for len(stack) > 0 {
+		sp := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		mx, mi := 0.0, -1
+		for i := sp.a + 1; i < sp.b; i++ {
+			d := segmentDistance(xy[i], xy[sp.a], xy[sp.b])
+			if d > mx {
+				mx, mi = d, i
+			}
+		}
+		// always split spans until there are enough points (e.g. the two
+		// halves of a closed ring)
+		if mi != -1 && (mx > tol || nk < minPoints) {
+			keep[mi] = true
+			nk++
+			stack = append(stack, span{sp.a, mi}, span{mi, sp.b})
+		}
+	}
+	return keep
+}
+
+type vwPoint struct {
+	idx        int
+	prev, next int
+	area       float64
+	hidx       int
+}
+
+type vwHeap []*vwPoint
+
+func (h vwHeap) Len() int            { return len(h) }
+func (h vwHeap) Less(i, j int) bool  { return h[i].area < h[j].area }
+func (h vwHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i]; h[i].hidx = i; h[j].hidx = j }
+func (h *vwHeap) Push(x interface{}) { p := x.(*vwPoint); p.hidx = len(*h); *h = append(*h, p) }
+func (h *vwHeap) Pop() interface{} {
+	o := *h
+	p := o[len(o)-1]
+	*h = o[:len(o)-1]
+	return p
+}
+
+func triangleArea(a, b, c [2]float64) float64 {
+	return math.Abs((b[0]-a[0])*(c[1]-a[1])-(c[0]-a[0])*(b[1]-a[1])) / 2
+}
+
+func visvalingam(xy [][2]float64, minArea float64, minPoints int) []bool {
+	keep := make([]bool, len(xy))
+	for i := range keep {
+		keep[i] = true
+	}
+	pts := make([]*vwPoint, len(xy))
+	h := vwHeap{}
+	for i := range xy {
+		pts[i] = &vwPoint{i, i - 1, i + 1, math.Inf(1), -1}
+		if i > 0 && i < len(xy)-1 {
+			pts[i].area = triangleArea(xy[i-1], xy[i], xy[i+1])
+			heap.Push(&h, pts[i])
+		}
+	}
+	nk := len(xy)
+	update := func(p *vwPoint, mn float64) {
+		if p.prev < 0 || p.next >= len(xy) {
+			return
+		}
+		a := triangleArea(xy[p.prev], xy[p.idx], xy[p.next])
+		// effective area is never less than that of a point already removed
+		if a < mn {
+			a = mn
+		}
+		p.area = a
+		heap.Fix(&h, p.hidx)
+	}
+	for h.Len() > 0 && nk > minPoints {
+		p := heap.Pop(&h).(*vwPoint)
+		if p.area >= minArea {
+			break
+		}
+		keep[p.idx] = false
+		nk--
+		pts[p.prev].next = p.next
+		pts[p.next].prev = p.prev
+		update(pts[p.prev], p.area)
+		update(pts[p.next], p.area)
+	}
+	return keep
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+)
+
+// one degree of longitude, in mercator units
+const testDegree = 6378137 * math.Pi / 180
+
+func coordRefs(cc []Coord) []elements.Ref {
+	res := make([]elements.Ref, len(cc))
+	for i, c := range cc {
+		res[i] = c.Ref()
+	}
+	return res
+}
+
+func sameRefs(a, b []elements.Ref) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSimplifyLine(t *testing.T) {
+	// a line along the equator, with small wiggles and one large spike
+	line := testRing(1, 0, 0, 1, 0.01, 2, -0.01, 3, 0, 4, 2, 5, 0, 6, 0.01, 7, 0)
+	expected := []elements.Ref{1, 4, 5, 6, 8}
+	for _, m := range []SimplifyMethod{DouglasPeucker, Visvalingam} {
+		s := Simplification{m, 0.2 * testDegree, false}
+		got := coordRefs(s.simplifyLine(line, s.Tolerance, 2))
+		if !sameRefs(got, expected) {
+			t.Errorf("%s: kept %v, expected %v", m, got, expected)
+		}
+		// a large tolerance keeps only the ends, or minPoints points
+		s.Tolerance = 10 * testDegree
+		if got := coordRefs(s.simplifyLine(line, s.Tolerance, 2)); !sameRefs(got, []elements.Ref{1, 8}) {
+			t.Errorf("%s: large tolerance kept %v", m, got)
+		}
+		if got := s.simplifyLine(line, s.Tolerance, 4); len(got) != 4 || got[0].Ref() != 1 || got[3].Ref() != 8 {
+			t.Errorf("%s: minPoints 4 kept %v", m, coordRefs(got))
+		}
+	}
+}
+
+func TestSimplifyMetres(t *testing.T) {
+	s := Simplification{DouglasPeucker, 100, true}
+	eq := quadtree.Bbox{Minx: 0, Miny: -10000000, Maxx: 10000000, Maxy: 10000000}
+	if tol := s.mercTolerance(eq); math.Abs(tol-100) > 1e-6 {
+		t.Errorf("tolerance at equator %f, expected 100", tol)
+	}
+	north := quadtree.Bbox{Minx: 0, Miny: 590000000, Maxx: 10000000, Maxy: 610000000}
+	if tol := s.mercTolerance(north); math.Abs(tol-200) > 1e-6 {
+		t.Errorf("tolerance at 60N %f, expected 200", tol)
+	}
+	s.Metres = false
+	if tol := s.mercTolerance(north); tol != 100 {
+		t.Errorf("tolerance in mercator units %f, expected 100", tol)
+	}
+}
+
+func TestSimplifyGeometry(t *testing.T) {
+	s := Simplification{DouglasPeucker, 0.1 * testDegree, false}
+
+	ln := makeLinestringGeometry(testElement(1), elements.Way, nil,
+		testRing(1, 0, 0, 1, 0.01, 2, 0, 3, 1, 4, 0), 7)
+	sl, ok := s.Simplify(ln).(LinestringGeometry)
+	if !ok || sl.NumCoords() != 4 || sl.ZOrder() != 7 || sl.Id() != ln.Id() {
+		t.Errorf("simplified linestring %v", sl)
+	}
+
+	// a square with extra points along each side
+	sq := testRing(1, 0, 0, 0, 0.5, 0, 1, 0.5, 1.01, 1, 1, 1, 0.5, 1, 0, 0.5, -0.01)
+	sq = append(sq, sq[0])
+	py := makePolygonGeometry(testElement(2), elements.Way, nil, [][]Coord{sq}, 0, 0)
+	sp, ok := s.Simplify(py).(PolygonGeometry)
+	if !ok || sp.NumRings() != 1 || sp.NumCoords(0) != 5 {
+		t.Fatalf("simplified polygon %v", sp)
+	}
+	if sp.Coord(0, 0).Ref() != sp.Coord(0, 4).Ref() {
+		t.Errorf("simplified ring not closed")
+	}
+	if a := sp.Area(); a <= 0 {
+		t.Errorf("simplified polygon area %f", a)
+	}
+
+	// points are unchanged
+	pt := makePointGeometry(testElement(3), elements.Node, nil, testRing(1, 0, 0)[0])
+	if s.Simplify(pt) != Geometry(pt) {
+		t.Errorf("point changed by Simplify")
+	}
+}
+
+func TestSimplifyPolygonRings(t *testing.T) {
+	// outer ring with a bump to the south, and an inner ring just inside
+	// the bump
+	outer := testRing(1, 0, 0, 5, -1, 10, 0, 10, 10, 0, 10)
+	outer = append(outer, outer[0])
+	inner := testRing(10, 4.8, -0.5, 5.2, -0.5, 5.2, 0.5, 4.8, 0.5)
+	inner = append(inner, inner[0])
+
+	s := Simplification{DouglasPeucker, 1.2 * testDegree, false}
+
+	// without the inner ring the bump is removed
+	res := s.simplifyPolygon([][]Coord{outer}, s.Tolerance)
+	if len(res[0]) != 5 {
+		t.Errorf("outer ring simplified to %v", coordRefs(res[0]))
+	}
+
+	// removing the bump would cross the inner ring: the tolerance is
+	// reduced
+	res = s.simplifyPolygon([][]Coord{outer, inner}, s.Tolerance)
+	if len(res) != 2 {
+		t.Fatalf("%d rings", len(res))
+	}
+	found := false
+	for _, c := range res[0] {
+		if c.Ref() == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("bump removed: outer ring %v", coordRefs(res[0]))
+	}
+	sweepSegments(res, func(a, b ringSegment, x, y int64) bool {
+		t.Errorf("simplified rings cross at %d %d", x, y)
+		return false
+	})
+}
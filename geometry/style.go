@@ -0,0 +1,98 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadOsm2pgsqlStyle reads an osm2pgsql style file, with a line for each
+// tag giving OsmType (node, way or node,way), Tag, DataType and optional
+// comma separated Flags, returning a map[string]TagTest. Text following a
+// # is ignored. The flags are:
+//
+//	polygon   closed ways with this tag are polygons (IsPoly "yes")
+//	linear    closed ways with this tag are not polygons (IsPoly "no")
+//	nocolumn  the tag is only used to decide IsPoly (NoColumn)
+//	delete    the tag is removed, rather than moved to other_tags (Delete)
+//	phstore   as polygon
+//	nocache   ignored
+//
+// All other tags, apart from those deleted, are marked IsFeature, as osm2pgsql keeps any object with
+// at least one tag listed. DataType is copied to Type. Tags listed more
+// than once (e.g. separately for nodes and ways) are merged.
+func ReadOsm2pgsqlStyle(r io.Reader) (map[string]TagTest, error) {
+	res := map[string]TagTest{}
+
+	sc := bufio.NewScanner(r)
+	ln := 0
+	for sc.Scan() {
+		ln++
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		ff := strings.Fields(line)
+		if len(ff) == 0 {
+			continue
+		}
+		if len(ff) < 3 || len(ff) > 4 {
+			return nil, errors.New(fmt.Sprintf("style line %d: expected OsmType Tag DataType [Flags], found %q", ln, sc.Text()))
+		}
+
+		tt := TagTest{Tag: ff[1], Type: ff[2], IsPoly: "no", IsFeature: true}
+		for _, ot := range strings.Split(ff[0], ",") {
+			switch ot {
+			case "node":
+				tt.IsNode = true
+			case "way":
+				tt.IsWay = true
+			default:
+				return nil, errors.New(fmt.Sprintf("style line %d: unknown OsmType %q", ln, ot))
+			}
+		}
+
+		if len(ff) == 4 {
+			for _, f := range strings.Split(ff[3], ",") {
+				switch f {
+				case "polygon", "phstore":
+					tt.IsPoly = "yes"
+				case "linear":
+					tt.IsPoly = "no"
+				case "nocolumn":
+					tt.NoColumn = true
+					tt.IsFeature = false
+				case "delete":
+					tt.Delete = true
+					tt.IsFeature = false
+				case "nocache", "":
+				default:
+					return nil, errors.New(fmt.Sprintf("style line %d: unknown flag %q", ln, f))
+				}
+			}
+		}
+
+		if p, ok := res[tt.Tag]; ok {
+			tt.IsNode = tt.IsNode || p.IsNode
+			tt.IsWay = tt.IsWay || p.IsWay
+			if p.IsPoly == "yes" {
+				tt.IsPoly = "yes"
+			}
+			tt.NoColumn = tt.NoColumn && p.NoColumn
+			tt.Delete = tt.Delete || p.Delete
+			tt.IsFeature = tt.IsFeature || p.IsFeature
+		}
+		res[tt.Tag] = tt
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+const testStyle = `
+# OsmType  Tag          DataType     Flags
+node,way   highway      text         linear
+way        building     text         polygon
+node,way   name         text
+way        area         text         nocolumn   # only decides polygons
+node,way   note         text         delete
+node       tourism      text
+way        tourism      text         polygon,nocache
+way        way_area     real
+`
+
+func TestReadOsm2pgsqlStyle(t *testing.T) {
+	tt, err := ReadOsm2pgsqlStyle(strings.NewReader(testStyle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]TagTest{
+		"highway":  {IsWay: true, IsNode: true, IsPoly: "no", Tag: "highway", Type: "text", IsFeature: true},
+		"building": {IsWay: true, IsPoly: "yes", Tag: "building", Type: "text", IsFeature: true},
+		"name":     {IsWay: true, IsNode: true, IsPoly: "no", Tag: "name", Type: "text", IsFeature: true},
+		"area":     {IsWay: true, IsPoly: "no", Tag: "area", Type: "text", NoColumn: true},
+		"tourism":  {IsWay: true, IsNode: true, IsPoly: "yes", Tag: "tourism", Type: "text", IsFeature: true},
+		"way_area": {IsWay: true, IsPoly: "no", Tag: "way_area", Type: "real", IsFeature: true},
+		"note":     {IsWay: true, IsNode: true, IsPoly: "no", Tag: "note", Type: "text", Delete: true},
+	}
+	if len(tt) != len(expected) {
+		t.Errorf("read %d tags, expected %d: %v", len(tt), len(expected), tt)
+	}
+	for k, v := range expected {
+		if tt[k] != v {
+			t.Errorf("%s: %+v, expected %+v", k, tt[k], v)
+		}
+	}
+
+	for _, bad := range []string{
+		"node highway",
+		"node highway text linear extra",
+		"relation highway text",
+		"way highway text sideways",
+	} {
+		if _, err := ReadOsm2pgsqlStyle(strings.NewReader(testStyle + bad + "\n")); err == nil {
+			t.Errorf("%q: expected error", bad)
+		} else if !strings.Contains(err.Error(), "line 11") {
+			t.Errorf("%q: error %q doesn't give line number", bad, err)
+		}
+	}
+}
+
+func TestReadStyleFile(t *testing.T) {
+	dir := t.TempDir()
+	stylefn := filepath.Join(dir, "test.style")
+	if err := ioutil.WriteFile(stylefn, []byte(testStyle), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jsonfn := filepath.Join(dir, "test.json")
+	err := ioutil.WriteFile(jsonfn, []byte(`[{"Tag":"highway","IsWay":true,"IsNode":true,"IsPoly":"no","Type":"text","IsFeature":true}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromStyle, err := ReadStyleFile(stylefn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJson, err := ReadStyleFile(jsonfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromStyle) != 7 || len(fromJson) != 1 || fromJson["highway"] != fromStyle["highway"] {
+		t.Errorf("read %v and %v", fromStyle, fromJson)
+	}
+}
+
+func TestMakeGeometriesStyleDelete(t *testing.T) {
+	tagsFilter, err := ReadOsm2pgsqlStyle(strings.NewReader(testStyle + "node,way   other_tags   json\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		bl := elements.ByElementId{
+			elements.MakeNode(1, nil, testTags("tourism", "hotel", "note", "fixme", "stars", "3"), 10, 10, 0, elements.Normal),
+			elements.MakeWayPoints(2, nil, testTags("highway", "primary", "note", "fixme", "surface", "asphalt"),
+				[]elements.Ref{1, 2}, []int64{0, 10}, []int64{0, 10}, 0, elements.Normal),
+			elements.MakeWayPoints(3, nil, testTags("note", "fixme"),
+				[]elements.Ref{1, 2}, []int64{0, 10}, []int64{0, 10}, 0, elements.Normal),
+		}
+		inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+		close(inc)
+	}()
+
+	expected := map[elements.Ref]string{1: "stars", 2: "surface"}
+	found := 0
+	for bl := range MakeGeometries(inc, tagsFilter) {
+		for i := 0; i < bl.Len(); i++ {
+			g := bl.Element(i).(Geometry)
+			found++
+			tags := g.Tags().(TagsEditable)
+			if tags.Has("note") {
+				t.Errorf("%d: deleted tag note kept", g.Id())
+			}
+			if g.Id() == 3 {
+				if tags.Len() != 0 {
+					t.Errorf("3: tags %v, expected none", tags)
+				}
+				continue
+			}
+			other := map[string]string{}
+			if err := json.Unmarshal([]byte(tags.Get("other_tags")), &other); err != nil {
+				t.Errorf("%d: other_tags %q: %s", g.Id(), tags.Get("other_tags"), err)
+				continue
+			}
+			if _, ok := other["note"]; ok || len(other) != 1 || other[expected[g.Id()]] == "" {
+				t.Errorf("%d: other_tags %v, expected only %s", g.Id(), other, expected[g.Id()])
+			}
+		}
+	}
+	if found != 3 {
+		t.Errorf("made %d geometries, expected 3", found)
+	}
+}
@@ -8,10 +8,12 @@ package geometry
 import (
 	"github.com/jharris2268/osmquadtree/elements"
 
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 )
 
 type TagTest struct {
@@ -21,29 +23,72 @@ type TagTest struct {
 	Tag       string // tag key
 	Type      string // text for normal tags, calc_?? for function
 	IsFeature bool   // true if enough to make an object: e.g. highway would be true, name would be false
+	NoColumn  bool   // tag only used to decide IsPoly, then moved to other_tags (or removed)
+	Delete    bool   // tag removed: neither a column nor moved to other_tags
 }
 
 // ReadStyleFile reads a json file conisting of a list of TagTest objects,
-// returning a map[string]TagTest.
+// returning a map[string]TagTest. Files ending .style are read as osm2pgsql
+// style files: see ReadOsm2pgsqlStyle.
 func ReadStyleFile(fn string) (map[string]TagTest, error) {
+	tt, _, err := ReadStyleFileZOrder(fn)
+	return tt, err
+}
+
+// ReadStyleFileZOrder is ReadStyleFile, also accepting a json object with
+// the list of TagTest objects as Tags and a ZOrderTable as ZOrder (see
+// ReadZOrderTable). The ZOrderTable is nil if not given.
+func ReadStyleFileZOrder(fn string) (map[string]TagTest, *ZOrderTable, error) {
+	if strings.HasSuffix(fn, ".style") {
+		fl, err := os.Open(fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer fl.Close()
+		tt, err := ReadOsm2pgsqlStyle(fl)
+		return tt, nil, err
+	}
 	fl, err := os.Open(fn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer fl.Close()
 
 	data, err := ioutil.ReadAll(fl)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var res []TagTest
-	err = json.Unmarshal(data, &res)
-	if err != nil {
-		return nil, err
+	var zt *ZOrderTable
+	if d := bytes.TrimSpace(data); len(d) > 0 && d[0] == '{' {
+		var sf struct {
+			Tags   []TagTest
+			ZOrder json.RawMessage
+		}
+		err = json.Unmarshal(data, &sf)
+		if err != nil {
+			return nil, nil, err
+		}
+		res = sf.Tags
+		if len(sf.ZOrder) > 0 {
+			zt, err = parseZOrderTable(sf.ZOrder)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		err = json.Unmarshal(data, &res)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	ans := map[string]TagTest{}
 	for _, t := range res {
 		ans[t.Tag] = t
 	}
-	return ans, nil
+	return ans, zt, nil
 }
 
 // TagsEditable extends elements.Tag to allow looking up, adding and deleting
@@ -0,0 +1,518 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"gopkg.in/yaml.v3"
+
+	"github.com/jharris2268/osmquadtree/elements"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TagRule describes a change to the tags of each element matching Types
+// and Match. Match maps tag keys to a value pattern: * for any value, or a
+// list of values separated by |. Keys starting ! must not match. The
+// changes are applied in the order Rename (old key to new key), Delete,
+// Set (literal values) and Compute (values given by a template, where
+// {key} is replaced by the value of tag key: the tag isn't set if any key
+// is missing).
+//
+// If Relations is set, the rule instead adds tags to way members of
+// relations: see RelationTagRule. If Ways is set, the rule adds tags to
+// the nodes of ways: see WayTagRule.
+type TagRule struct {
+	Types     []string // node, way and/or relation: all if empty
+	Match     map[string]string
+	Rename    map[string]string
+	Delete    []string
+	Set       map[string]string
+	Compute   map[string]string
+	Relations *RelationTagRule
+	Ways      *WayTagRule
+}
+
+// RelationTagRule copies the values of tag Tag from the parent relations
+// matching Match. Set maps the new way tag keys to how the values are
+// combined: list (sorted unique values separated by ;), min or max (of the
+// integer values), first (in the order the relations are found) or
+// highway (the value with the highest z_order, see FindParentHighway).
+type RelationTagRule struct {
+	Match map[string]string
+	Tag   string
+	Set   map[string]string
+}
+
+// WayTagRule copies the values of tag Tag from the parent ways matching
+// Match to the nodes matching TagRule.Match. Set maps the new node tag
+// keys to how the values are combined, as for RelationTagRule. These
+// rules are applied before all other rules (see TransformTags).
+type WayTagRule struct {
+	Match map[string]string
+	Tag   string
+	Set   map[string]string
+}
+
+// TagRules are applied in order by TransformTags
+type TagRules []TagRule
+
+// ReadTagRules reads a json file consisting of a list of TagRule objects.
+// Files ending .yaml or .yml are read as yaml, with the same keys.
+func ReadTagRules(fn string) (TagRules, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		data, err = yamlAsJson(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res TagRules
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// yamlAsJson converts yaml to json, so that yaml rules are read exactly as
+// json rules are. Scalars (e.g. numbers in Set) become strings, as all the
+// values of a TagRule are strings.
+func yamlAsJson(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	var conv func(v interface{}) (interface{}, error)
+	conv = func(v interface{}) (interface{}, error) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			for k, x := range vv {
+				c, err := conv(x)
+				if err != nil {
+					return nil, err
+				}
+				vv[k] = c
+			}
+			return vv, nil
+		case []interface{}:
+			for i, x := range vv {
+				c, err := conv(x)
+				if err != nil {
+					return nil, err
+				}
+				vv[i] = c
+			}
+			return vv, nil
+		case map[interface{}]interface{}:
+			return nil, errors.New(fmt.Sprintf("yaml map with non-string keys %v", vv))
+		case nil, string:
+			return vv, nil
+		}
+		return fmt.Sprint(v), nil
+	}
+	v, err := conv(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+type tagPattern struct {
+	key    string
+	negate bool
+	any    bool
+	values map[string]bool
+}
+
+func compileMatch(match map[string]string) []tagPattern {
+	res := make([]tagPattern, 0, len(match))
+	for k, v := range match {
+		p := tagPattern{key: k}
+		if strings.HasPrefix(k, "!") {
+			p.key, p.negate = k[1:], true
+		}
+		if v == "*" {
+			p.any = true
+		} else {
+			p.values = map[string]bool{}
+			for _, s := range strings.Split(v, "|") {
+				p.values[s] = true
+			}
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func matchTags(tags TagsEditable, pp []tagPattern) bool {
+	for _, p := range pp {
+		m := tags.Has(p.key) && (p.any || p.values[tags.Get(p.key)])
+		if m == p.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// TagMatch tests tags against patterns as given by TagRule.Match
+type TagMatch []tagPattern
+
+// CompileTagMatch returns a TagMatch for the patterns match
+func CompileTagMatch(match map[string]string) TagMatch {
+	return TagMatch(compileMatch(match))
+}
+
+// Matches returns true if tags match all the patterns of tm
+func (tm TagMatch) Matches(tags elements.Tags) bool {
+	te, ok := tags.(TagsEditable)
+	if !ok {
+		te = MakeTagsEditable(tags)
+	}
+	return matchTags(te, tm)
+}
+
+// tagTemplate is a value for TagRule.Compute: the literal text parts
+// alternate with tag keys.
+type tagTemplate []string
+
+func compileTemplate(s string) (tagTemplate, error) {
+	res := tagTemplate{}
+	for {
+		i := strings.Index(s, "{")
+		if i < 0 {
+			if strings.Contains(s, "}") {
+				return nil, errors.New(fmt.Sprintf("unmatched } in %q", s))
+			}
+			return append(res, s), nil
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			return nil, errors.New(fmt.Sprintf("unmatched { in %q", s))
+		}
+		res = append(res, s[:i], s[i+1:i+j])
+		s = s[i+j+1:]
+	}
+}
+
+func (tt tagTemplate) value(tags TagsEditable) (string, bool) {
+	res := ""
+	for i, s := range tt {
+		if i%2 == 0 {
+			res += s
+			continue
+		}
+		if !tags.Has(s) {
+			return "", false
+		}
+		res += tags.Get(s)
+	}
+	return res, true
+}
+
+type compiledTagRule struct {
+	types   map[elements.ElementType]bool
+	match   []tagPattern
+	rule    TagRule
+	compute map[string]tagTemplate
+}
+
+func (cr *compiledTagRule) apply(et elements.ElementType, tags TagsEditable) {
+	if len(cr.types) > 0 && !cr.types[et] {
+		return
+	}
+	if !matchTags(tags, cr.match) {
+		return
+	}
+	for k, n := range cr.rule.Rename {
+		if tags.Has(k) {
+			v := tags.Get(k)
+			tags.Delete(k)
+			tags.Put(n, v)
+		}
+	}
+	for _, k := range cr.rule.Delete {
+		tags.Delete(k)
+	}
+	for k, v := range cr.rule.Set {
+		tags.Put(k, v)
+	}
+	for k, t := range cr.compute {
+		if v, ok := t.value(tags); ok {
+			tags.Put(k, v)
+		}
+	}
+}
+
+var ruleTypes = map[string]elements.ElementType{"node": elements.Node, "way": elements.Way, "relation": elements.Relation}
+
+func compileTagRule(r TagRule) (*compiledTagRule, error) {
+	cr := &compiledTagRule{map[elements.ElementType]bool{}, compileMatch(r.Match), r, map[string]tagTemplate{}}
+	for _, t := range r.Types {
+		et, ok := ruleTypes[t]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown element type %q", t))
+		}
+		cr.types[et] = true
+	}
+	for k, s := range r.Compute {
+		t, err := compileTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		cr.compute[k] = t
+	}
+	return cr, nil
+}
+
+// combineValues returns the values ss, from parent relations, combined as
+// given by RelationTagRule.Set
+func combineValues(how string, ss []string) (string, bool) {
+	switch how {
+	case "list":
+		sm := map[string]bool{}
+		for _, s := range ss {
+			sm[s] = true
+		}
+		uu := make([]string, 0, len(sm))
+		for s := range sm {
+			uu = append(uu, s)
+		}
+		sort.Strings(uu)
+		return strings.Join(uu, ";"), len(uu) > 0
+	case "min", "max":
+		found := false
+		var r int64
+		for _, s := range ss {
+			ii, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				continue
+			}
+			if !found || (how == "min" && ii < r) || (how == "max" && ii > r) {
+				r = ii
+			}
+			found = true
+		}
+		return fmt.Sprintf("%d", r), found
+	case "first":
+		if len(ss) > 0 {
+			return ss[0], true
+		}
+	case "highway":
+		v := FindParentHighway(ss)
+		return v, v != ""
+	}
+	return "", false
+}
+
+var combineTypes = map[string]bool{"list": true, "min": true, "max": true, "first": true, "highway": true}
+
+func relationTagStage(r TagRule) (tagStage, error) {
+	rr := r.Relations
+	for _, t := range r.Types {
+		if t != "way" {
+			return nil, errors.New("relation tag rules only apply to ways")
+		}
+	}
+	if len(r.Rename) > 0 || len(r.Delete) > 0 || len(r.Set) > 0 || len(r.Compute) > 0 {
+		return nil, errors.New("relation tag rules can only Match way tags")
+	}
+	if rr.Tag == "" {
+		return nil, errors.New("relation tag rule without Tag")
+	}
+	for k, how := range rr.Set {
+		if !combineTypes[how] {
+			return nil, errors.New(fmt.Sprintf("unknown combine %q for %q", how, k))
+		}
+	}
+	relMatch := compileMatch(rr.Match)
+	wayMatch := compileMatch(r.Match)
+	testRel := func(tags TagsEditable) bool { return matchTags(tags, relMatch) }
+	proc := func(tags TagsEditable, ss []string) bool {
+		if !matchTags(tags, wayMatch) {
+			return false
+		}
+		added := false
+		for k, how := range rr.Set {
+			if v, ok := combineValues(how, ss); ok {
+				tags.Put(k, v)
+				added = true
+			}
+		}
+		return added
+	}
+	return func(inc <-chan elements.ExtendedBlock) <-chan elements.ExtendedBlock {
+		return AddRelationRange(inc, testRel, rr.Tag, proc)
+	}, nil
+}
+
+func wayTagRule(r TagRule) (nodeParentRule, error) {
+	wr := r.Ways
+	for _, t := range r.Types {
+		if t != "node" {
+			return nodeParentRule{}, errors.New("way tag rules only apply to nodes")
+		}
+	}
+	if len(r.Rename) > 0 || len(r.Delete) > 0 || len(r.Set) > 0 || len(r.Compute) > 0 {
+		return nodeParentRule{}, errors.New("way tag rules can only Match node tags")
+	}
+	if wr.Tag == "" {
+		return nodeParentRule{}, errors.New("way tag rule without Tag")
+	}
+	for k, how := range wr.Set {
+		if !combineTypes[how] {
+			return nodeParentRule{}, errors.New(fmt.Sprintf("unknown combine %q for %q", how, k))
+		}
+	}
+	nodeMatch := compileMatch(r.Match)
+	wayMatch := compileMatch(wr.Match)
+	testNode := func(tags TagsEditable) bool { return matchTags(tags, nodeMatch) }
+	testWay := func(tags TagsEditable) bool { return matchTags(tags, wayMatch) }
+	proc := func(tags TagsEditable, ss []string) {
+		for k, how := range wr.Set {
+			if v, ok := combineValues(how, ss); ok {
+				tags.Put(k, v)
+			}
+		}
+	}
+	return nodeParentRule{testNode, testWay, wr.Tag, proc}, nil
+}
+
+// TransformTags applies rules to the tags of each element in inc, which
+// should be the result of AddWayCoords (so the tags are TagsEditable).
+// Consecutive rules without Relations or Ways are applied in a single
+// stage, and each rule with Relations uses AddRelationRange. The rules
+// with Ways are all applied first, together in one AddNodeParent stage,
+// so they only see the original tags. Returns an error if a rule is not
+// valid.
+func TransformTags(inc <-chan elements.ExtendedBlock, rules TagRules) (<-chan elements.ExtendedBlock, error) {
+	stages, err := compileTagRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return applyTagStages(inc, stages), nil
+}
+
+type tagStage func(<-chan elements.ExtendedBlock) <-chan elements.ExtendedBlock
+
+func applyTagStages(inc <-chan elements.ExtendedBlock, stages []tagStage) <-chan elements.ExtendedBlock {
+	for _, st := range stages {
+		inc = st(inc)
+	}
+	return inc
+}
+
+func compileTagRules(rules TagRules) ([]tagStage, error) {
+	stages := []tagStage{}
+	curr := []*compiledTagRule{}
+	wayRules := []nodeParentRule{}
+	addCurr := func() {
+		if len(curr) == 0 {
+			return
+		}
+		cc := curr
+		stages = append(stages, func(inc <-chan elements.ExtendedBlock) <-chan elements.ExtendedBlock {
+			return applyTagRules(inc, cc)
+		})
+		curr = []*compiledTagRule{}
+	}
+	for i, r := range rules {
+		if r.Relations != nil && r.Ways != nil {
+			return nil, errors.New(fmt.Sprintf("tag rule %d: both Relations and Ways", i))
+		}
+		if r.Ways != nil {
+			wr, err := wayTagRule(r)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("tag rule %d: %s", i, err.Error()))
+			}
+			wayRules = append(wayRules, wr)
+			continue
+		}
+		if r.Relations != nil {
+			addCurr()
+			st, err := relationTagStage(r)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("tag rule %d: %s", i, err.Error()))
+			}
+			stages = append(stages, st)
+			continue
+		}
+		cr, err := compileTagRule(r)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("tag rule %d: %s", i, err.Error()))
+		}
+		curr = append(curr, cr)
+	}
+	addCurr()
+	if len(wayRules) > 0 {
+		stages = append([]tagStage{func(inc <-chan elements.ExtendedBlock) <-chan elements.ExtendedBlock {
+			return addNodeParentRules(inc, wayRules)
+		}}, stages...)
+	}
+	return stages, nil
+}
+
+func applyTagRules(inc <-chan elements.ExtendedBlock, rules []*compiledTagRule) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		for bl := range inc {
+			for i := 0; i < bl.Len(); i++ {
+				e := bl.Element(i)
+				fe, ok := e.(elements.FullElement)
+				if !ok {
+					continue
+				}
+				tags, ok := fe.Tags().(TagsEditable)
+				if !ok {
+					continue
+				}
+				for _, r := range rules {
+					r.apply(e.Type(), tags)
+				}
+			}
+			res <- bl
+		}
+		close(res)
+	}()
+	return res
+}
+
+// builtinTagRules returns the rules for the tags parent_highway,
+// min_admin_level (and max_admin_level), bus_routes and cycle_routes, if
+// present in tagsFilter.
+func builtinTagRules(tagsFilter map[string]TagTest) TagRules {
+	rules := TagRules{}
+	if _, ok := tagsFilter["parent_highway"]; ok {
+		rules = append(rules, TagRule{Types: []string{"node"}, Match: map[string]string{"highway": "*"},
+			Ways: &WayTagRule{nil, "highway", map[string]string{"parent_highway": "highway"}}})
+	}
+	if _, ok := tagsFilter["min_admin_level"]; ok {
+		rules = append(rules, TagRule{Relations: &RelationTagRule{
+			map[string]string{"boundary": "administrative", "type": "boundary"}, "admin_level",
+			map[string]string{"min_admin_level": "min", "max_admin_level": "max"}}})
+	}
+	if _, ok := tagsFilter["bus_routes"]; ok {
+		rules = append(rules, TagRule{Relations: &RelationTagRule{
+			map[string]string{"type": "route", "route": "bus"}, "ref",
+			map[string]string{"bus_routes": "list"}}})
+	}
+	if _, ok := tagsFilter["cycle_routes"]; ok {
+		rules = append(rules, TagRule{Relations: &RelationTagRule{
+			map[string]string{"type": "route", "route": "bicycle"}, "network",
+			map[string]string{"cycle_routes": "list"}}})
+	}
+	return rules
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+func transformBlock(t *testing.T, rules TagRules, bl elements.ByElementId) map[elements.Ref]TagsEditable {
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+		close(inc)
+	}()
+	res, err := TransformTags(inc, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[elements.Ref]TagsEditable{}
+	for b := range res {
+		for i := 0; i < b.Len(); i++ {
+			e := b.Element(i).(elements.FullElement)
+			tags[elements.Ref(e.Type())<<59|e.Id()] = e.Tags().(TagsEditable)
+		}
+	}
+	if len(tags) != len(bl) {
+		t.Errorf("returned %d elements, expected %d", len(tags), len(bl))
+	}
+	return tags
+}
+
+func checkTag(t *testing.T, tags TagsEditable, k, v string) {
+	if v == "" {
+		if tags.Has(k) {
+			t.Errorf("%v: unexpected %s=%s", tags, k, tags.Get(k))
+		}
+	} else if !tags.Has(k) || tags.Get(k) != v {
+		t.Errorf("%v: expected %s=%s", tags, k, v)
+	}
+}
+
+func TestTransformTags(t *testing.T) {
+	rules := TagRules{
+		{Types: []string{"way"}, Match: map[string]string{"highway": "primary|secondary", "!access": "*"},
+			Rename: map[string]string{"ref": "road_ref"}, Delete: []string{"note"},
+			Set: map[string]string{"major": "yes"}, Compute: map[string]string{"label": "{road_ref} {name}"}},
+		{Match: map[string]string{"major": "*"}, Set: map[string]string{"checked": "yes"}},
+	}
+	bl := elements.ByElementId{
+		elements.MakeNode(1, nil, testTags("highway", "primary", "ref", "A1"), 0, 0, 0, elements.Normal),
+		elements.MakeWay(2, nil, testTags("highway", "primary", "ref", "A1", "name", "High St", "note", "x"), nil, 0, elements.Normal),
+		elements.MakeWay(3, nil, testTags("highway", "secondary", "ref", "B2"), nil, 0, elements.Normal),
+		elements.MakeWay(4, nil, testTags("highway", "primary", "access", "no"), nil, 0, elements.Normal),
+	}
+	tags := transformBlock(t, rules, bl)
+
+	node := tags[elements.Ref(elements.Node)<<59|1]
+	checkTag(t, node, "ref", "A1")
+	checkTag(t, node, "major", "")
+
+	w2 := tags[elements.Ref(elements.Way)<<59|2]
+	checkTag(t, w2, "ref", "")
+	checkTag(t, w2, "road_ref", "A1")
+	checkTag(t, w2, "note", "")
+	checkTag(t, w2, "label", "A1 High St")
+	checkTag(t, w2, "checked", "yes")
+
+	w3 := tags[elements.Ref(elements.Way)<<59|3]
+	checkTag(t, w3, "major", "yes")
+	checkTag(t, w3, "label", "")
+
+	checkTag(t, tags[elements.Ref(elements.Way)<<59|4], "major", "")
+}
+
+func TestWayTagRule(t *testing.T) {
+	rules := builtinTagRules(map[string]TagTest{"parent_highway": {}})
+	rules = append(rules, TagRule{Types: []string{"node"}, Match: map[string]string{"barrier": "*"},
+		Ways: &WayTagRule{map[string]string{"!highway": "*"}, "name", map[string]string{"parent_names": "list"}}})
+
+	bl := elements.ByElementId{
+		elements.MakeNode(1, nil, testTags("highway", "turning_circle"), 0, 0, 0, elements.Normal),
+		elements.MakeNode(2, nil, testTags("highway", "crossing", "barrier", "gate"), 0, 0, 0, elements.Normal),
+		elements.MakeNode(3, nil, testTags("barrier", "gate"), 0, 0, 0, elements.Normal),
+		elements.MakeNode(4, nil, testTags("highway", "stop"), 0, 0, 0, elements.Normal),
+		elements.MakeWay(10, nil, testTags("highway", "residential"), []elements.Ref{1, 2}, 0, elements.Normal),
+		elements.MakeWay(11, nil, testTags("highway", "primary", "name", "High St"), []elements.Ref{2, 3}, 0, elements.Normal),
+		elements.MakeWay(12, nil, testTags("waterway", "stream", "name", "Brook"), []elements.Ref{3, 4}, 0, elements.Normal),
+		elements.MakeWay(13, nil, testTags("landuse", "grass", "name", "Green"), []elements.Ref{2, 3}, 0, elements.Normal),
+	}
+	tags := transformBlock(t, rules, bl)
+
+	n := func(i elements.Ref) TagsEditable { return tags[elements.Ref(elements.Node)<<59|i] }
+	checkTag(t, n(1), "parent_highway", "residential")
+	checkTag(t, n(2), "parent_highway", "primary")
+	checkTag(t, n(3), "parent_highway", "")
+	checkTag(t, n(4), "parent_highway", "")
+	checkTag(t, n(2), "parent_names", "Green")
+	checkTag(t, n(3), "parent_names", "Brook;Green")
+	checkTag(t, n(4), "parent_names", "")
+}
+
+func TestTagRuleErrors(t *testing.T) {
+	for i, r := range []TagRule{
+		{Types: []string{"area"}},
+		{Compute: map[string]string{"a": "{b"}},
+		{Relations: &RelationTagRule{Tag: "ref"}, Ways: &WayTagRule{Tag: "ref"}},
+		{Types: []string{"node"}, Relations: &RelationTagRule{Tag: "ref"}},
+		{Types: []string{"way"}, Ways: &WayTagRule{Tag: "highway"}},
+		{Ways: &WayTagRule{}},
+		{Set: map[string]string{"a": "b"}, Ways: &WayTagRule{Tag: "highway"}},
+		{Ways: &WayTagRule{Tag: "highway", Set: map[string]string{"a": "sum"}}},
+	} {
+		if _, err := compileTagRules(TagRules{r}); err == nil {
+			t.Errorf("rule %d: expected error", i)
+		}
+	}
+}
+
+func TestReadTagRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	jsonfn := write("rules.json", `[
+		{"Types": ["way"], "Match": {"building": "yes", "!layer": "*"}, "Set": {"layer": "0"}},
+		{"Relations": {"Match": {"route": "bus"}, "Tag": "ref", "Set": {"bus_routes": "list"}}}
+	]`)
+	yamlRules := `
+- types: [way]
+  match:
+    building: yes
+    "!layer": "*"
+  set:
+    layer: 0
+- relations:
+    match: {route: bus}
+    tag: ref
+    set: {bus_routes: list}
+`
+	expected, err := ReadTagRules(jsonfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 2 || expected[0].Match["building"] != "yes" || expected[1].Relations == nil {
+		t.Fatalf("read %+v", expected)
+	}
+	for _, name := range []string{"rules.yaml", "rules.yml"} {
+		rules, err := ReadTagRules(write(name, yamlRules))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Errorf("%s: read %+v, expected %+v", name, rules, expected)
+		}
+	}
+
+	// the extension decides the format
+	if _, err := ReadTagRules(write("yaml.json", yamlRules)); err == nil {
+		t.Errorf("expected error reading yaml as json")
+	}
+	if _, err := ReadTagRules(write("bad.yaml", "- types: [way\n")); err == nil {
+		t.Errorf("expected error for bad yaml")
+	}
+}
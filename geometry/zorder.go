@@ -7,14 +7,76 @@ package geometry
 
 import (
 	"github.com/jharris2268/osmquadtree/elements"
-	"github.com/jharris2268/osmquadtree/quadtree"
 
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"math"
 	"strconv"
 	"strings"
 )
 
+// ZOrderTable calculates the z_order of geometries from their tags: the
+// largest weight of any tag given by Weights (tag key to value to weight,
+// with * for any other value), plus LayerMultiplier times the layer. The
+// layer is the value of the layer tag, plus BridgeOffset for bridges and
+// TunnelOffset for tunnels. A z_order tag replaces the largest weight. The
+// z_order is stored with the geometry data: see ReadGeometryZOrderWayArea.
+type ZOrderTable struct {
+	Weights         map[string]map[string]int64
+	LayerMultiplier int64
+	BridgeOffset    int64
+	TunnelOffset    int64
+}
+
+// DefaultZOrderTable returns the z_order table used when none is given
+// (for example by a nil *ZOrderTable): roads are ordered by highway class,
+// with railways between tertiary and secondary roads.
+func DefaultZOrderTable() *ZOrderTable {
+	return &ZOrderTable{
+		map[string]map[string]int64{
+			"highway": {
+				"living_street": 2, "pedestrian": 2,
+				"residential": 3, "unclassified": 3, "road": 3,
+				"tertiary_link": 4, "tertiary": 4,
+				"secondary_link": 6, "secondary": 6,
+				"primary_link": 7, "primary": 7,
+				"trunk_link": 8, "trunk": 8,
+				"motorway_link": 9, "motorway": 9,
+			},
+			"railway": {"*": 5},
+		},
+		10, 1, -1}
+}
+
+// defaultZOrderTable is used by a nil *ZOrderTable. It must not be changed.
+var defaultZOrderTable = DefaultZOrderTable()
+
+// ReadZOrderTable reads a ZOrderTable from a json file. LayerMultiplier,
+// BridgeOffset and TunnelOffset default to the values of
+// DefaultZOrderTable, as do the Weights if not given.
+func ReadZOrderTable(fn string) (*ZOrderTable, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseZOrderTable(data)
+}
+
+func parseZOrderTable(data []byte) (*ZOrderTable, error) {
+	zt := DefaultZOrderTable()
+	zt.Weights = nil
+	err := json.Unmarshal(data, zt)
+	if err != nil {
+		return nil, err
+	}
+	if zt.Weights == nil {
+		zt.Weights = DefaultZOrderTable().Weights
+	}
+	return zt, nil
+}
+
+// hworder orders highway values for FindParentHighway
 var hworder map[string]int64
 
 func init_hworder() {
@@ -58,11 +120,12 @@ func is_false(v string) bool {
 	return false
 }
 
-func find_zorder(tt elements.Tags) (int64, error) {
-	if hworder == nil {
-		init_hworder()
+// ZOrder returns the z_order for tags tt, or an error if tt has a z_order
+// tag which isn't an integer. A nil zt uses DefaultZOrderTable.
+func (zt *ZOrderTable) ZOrder(tt elements.Tags) (int64, error) {
+	if zt == nil {
+		zt = defaultZOrderTable
 	}
-
 	zo := int64(0)
 	l := int64(0)
 	haszo := ""
@@ -74,21 +137,17 @@ func find_zorder(tt elements.Tags) (int64, error) {
 			haszo = v
 		}
 
-		switch k {
-		case "highway":
-			if len(hworder) == 0 {
-				init_hworder()
+		if ww, ok := zt.Weights[k]; ok {
+			z, ok := ww[v]
+			if !ok {
+				z, ok = ww["*"]
 			}
-			z, ok := hworder[v]
-			if ok && z > 1 {
-				if z > zo {
-					zo = z
-				}
-			}
-		case "railway":
-			if 5 > zo {
-				zo = 5
+			if ok && z > zo {
+				zo = z
 			}
+		}
+
+		switch k {
 		case "layer":
 			ll, e := strconv.Atoi(v)
 
@@ -97,11 +156,11 @@ func find_zorder(tt elements.Tags) (int64, error) {
 			}
 		case "bridge":
 			if !is_false(v) {
-				l += 1
+				l += zt.BridgeOffset
 			}
 		case "tunnel":
 			if !is_false(v) {
-				l -= 1
+				l += zt.TunnelOffset
 			}
 		}
 	}
@@ -115,7 +174,7 @@ func find_zorder(tt elements.Tags) (int64, error) {
 
 	}
 
-	zo += l * 10
+	zo += l * zt.LayerMultiplier
 
 	return zo, nil
 }
@@ -198,45 +257,12 @@ func calculate_ring_area(rr []Coord) (float64, bool) {
 
 }
 
-func rings_intersect(lhs, rhs []Coord) bool {
-	for i := 0; i < len(lhs)-1; i++ {
-		for j := 0; j < len(rhs)-1; j++ {
-			if lines_intersect(lhs[i], lhs[i+1], rhs[j], rhs[j+1]) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 type llb []Coord
 
 func (l llb) Len() int        { return len(l) }
 func (l llb) Lat(i int) int64 { return l[i].Lat() }
 func (l llb) Lon(i int) int64 { return l[i].Lon() }
 
-func ring_contains(outer, inner []Coord) bool {
-	if !rings_intersect(outer, inner) {
-		return quadtree.PointInPoly(llb(outer), inner[0].Lon(), inner[0].Lat())
-	}
-	return false
-}
-
-func lines_intersect(p0, p1, p2, p3 Coord) bool {
-	s1_x := float64(p1.Lon() - p0.Lon())
-	s1_y := float64(p1.Lat() - p0.Lat())
-	s2_x := float64(p3.Lon() - p2.Lon())
-	s2_y := float64(p3.Lat() - p2.Lat())
-
-	qx := float64(p0.Lon() - p2.Lon())
-	qy := float64(p0.Lat() - p2.Lat())
-
-	s := (-s1_y*qx + s1_x*qy) / (-s2_x*s1_y + s1_x*s2_y)
-	t := (s2_x*qy - s2_y*qx) / (-s2_x*s1_y + s1_x*s2_y)
-
-	return (s >= 0 && s <= 1 && t >= 0 && t <= 1)
-}
-
 // FindParentHighway returns the highway value from highways with the
 // highest z_order value. This behaviour should match that of osm2pgsql.
 func FindParentHighway(highways []string) string {
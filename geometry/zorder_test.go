@@ -0,0 +1,82 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geometry
+
+import (
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+)
+
+func TestZOrderTable(t *testing.T) {
+	var nilTable *ZOrderTable
+	zt, err := parseZOrderTable([]byte(`{"Weights":{"waterway":{"canal":3,"*":1}},"LayerMultiplier":100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		zt     *ZOrderTable
+		tags   []string
+		zorder int64
+	}{
+		{nilTable, []string{"highway", "primary"}, 7},
+		{nilTable, []string{"highway", "primary", "bridge", "yes"}, 17},
+		{nilTable, []string{"railway", "rail", "layer", "-1"}, -5},
+		{nilTable, []string{"waterway", "canal"}, 0},
+		{zt, []string{"highway", "primary"}, 0},
+		{zt, []string{"waterway", "canal", "layer", "1"}, 103},
+		{zt, []string{"waterway", "river", "tunnel", "yes"}, -99},
+		{zt, []string{"waterway", "river", "z_order", "20"}, 20},
+	} {
+		zo, err := c.zt.ZOrder(testTags(c.tags...))
+		if err != nil || zo != c.zorder {
+			t.Errorf("%v: z_order %d %v, expected %d", c.tags, zo, err, c.zorder)
+		}
+	}
+	if _, err := zt.ZOrder(testTags("z_order", "high")); err == nil {
+		t.Errorf("expected error for z_order=high")
+	}
+}
+
+func TestMakeGeometriesZOrder(t *testing.T) {
+	tagsFilter := map[string]TagTest{
+		"highway":  {IsWay: true, IsPoly: "no", Tag: "highway", Type: "text", IsFeature: true},
+		"waterway": {IsWay: true, IsPoly: "no", Tag: "waterway", Type: "text", IsFeature: true},
+	}
+	zt := &ZOrderTable{map[string]map[string]int64{"waterway": {"*": 12}}, 10, 1, -1}
+
+	makeGeoms := func(zt *ZOrderTable, res chan<- map[elements.Ref]int64) {
+		inc := make(chan elements.ExtendedBlock)
+		go func() {
+			bl := elements.ByElementId{
+				elements.MakeWayPoints(1, nil, testTags("highway", "primary"), []elements.Ref{1, 2}, []int64{0, 10}, []int64{0, 10}, 0, elements.Normal),
+				elements.MakeWayPoints(2, nil, testTags("waterway", "river"), []elements.Ref{3, 4}, []int64{0, 10}, []int64{10, 0}, 0, elements.Normal),
+			}
+			inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+			close(inc)
+		}()
+		zz := map[elements.Ref]int64{}
+		for bl := range MakeGeometriesZOrder(inc, tagsFilter, zt) {
+			for i := 0; i < bl.Len(); i++ {
+				g := bl.Element(i).(Geometry)
+				zz[g.Id()] = g.(LinestringGeometry).ZOrder()
+			}
+		}
+		res <- zz
+	}
+
+	// run both at once: the tables must not affect each other
+	withTable, withDefault := make(chan map[elements.Ref]int64), make(chan map[elements.Ref]int64)
+	go makeGeoms(zt, withTable)
+	go makeGeoms(nil, withDefault)
+
+	if zz := <-withTable; len(zz) != 2 || zz[1] != 0 || zz[2] != 12 {
+		t.Errorf("with table: %v", zz)
+	}
+	if zz := <-withDefault; len(zz) != 2 || zz[1] != 7 || zz[2] != 0 {
+		t.Errorf("with default: %v", zz)
+	}
+}
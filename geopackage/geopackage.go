@@ -0,0 +1,305 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package geopackage writes geometries to GeoPackage (version 1.3) files.
+package geopackage
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const srsId = 4326
+
+const wgs84Wkt = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AXIS["Latitude",NORTH],AXIS["Longitude",EAST],AUTHORITY["EPSG","4326"]]`
+
+var gpkgSchema = []string{
+	`PRAGMA application_id = 1196444487`,
+	`PRAGMA user_version = 10300`,
+	`CREATE TABLE gpkg_spatial_ref_sys (
+  srs_name TEXT NOT NULL,
+  srs_id INTEGER NOT NULL PRIMARY KEY,
+  organization TEXT NOT NULL,
+  organization_coordsys_id INTEGER NOT NULL,
+  definition  TEXT NOT NULL,
+  description TEXT)`,
+	`CREATE TABLE gpkg_contents (
+  table_name TEXT NOT NULL PRIMARY KEY,
+  data_type TEXT NOT NULL,
+  identifier TEXT UNIQUE,
+  description TEXT DEFAULT '',
+  last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+  min_x DOUBLE,
+  min_y DOUBLE,
+  max_x DOUBLE,
+  max_y DOUBLE,
+  srs_id INTEGER,
+  CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`,
+	`CREATE TABLE gpkg_geometry_columns (
+  table_name TEXT NOT NULL,
+  column_name TEXT NOT NULL,
+  geometry_type_name TEXT NOT NULL,
+  srs_id INTEGER NOT NULL,
+  z TINYINT NOT NULL,
+  m TINYINT NOT NULL,
+  CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+  CONSTRAINT uk_gc_table_name UNIQUE (table_name),
+  CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+  CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`,
+	`CREATE TABLE gpkg_extensions (
+  table_name TEXT,
+  column_name TEXT,
+  extension_name TEXT NOT NULL,
+  definition TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name))`,
+	`INSERT INTO gpkg_spatial_ref_sys VALUES
+  ('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+  ('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+  ('WGS 84 geodetic', 4326, 'EPSG', 4326, '` + wgs84Wkt + `', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid')`,
+}
+
+// rtreeTriggers maintain the spatial index of table t if it is changed
+// after being written, as required by the gpkg_rtree_index extension. The
+// ST_ functions are provided by GIS software reading the file.
+const rtreeTriggers = `
+CREATE TRIGGER "rtree_{t}_geom_insert" AFTER INSERT ON "{t}"
+  WHEN (new.geom NOT NULL AND NOT ST_IsEmpty(NEW.geom))
+BEGIN
+  INSERT OR REPLACE INTO "rtree_{t}_geom" VALUES (
+    NEW.fid, ST_MinX(NEW.geom), ST_MaxX(NEW.geom), ST_MinY(NEW.geom), ST_MaxY(NEW.geom));
+END;
+CREATE TRIGGER "rtree_{t}_geom_update1" AFTER UPDATE OF geom ON "{t}"
+  WHEN OLD.fid = NEW.fid AND (NEW.geom NOTNULL AND NOT ST_IsEmpty(NEW.geom))
+BEGIN
+  INSERT OR REPLACE INTO "rtree_{t}_geom" VALUES (
+    NEW.fid, ST_MinX(NEW.geom), ST_MaxX(NEW.geom), ST_MinY(NEW.geom), ST_MaxY(NEW.geom));
+END;
+CREATE TRIGGER "rtree_{t}_geom_update2" AFTER UPDATE OF geom ON "{t}"
+  WHEN OLD.fid = NEW.fid AND (NEW.geom ISNULL OR ST_IsEmpty(NEW.geom))
+BEGIN
+  DELETE FROM "rtree_{t}_geom" WHERE id = OLD.fid;
+END;
+CREATE TRIGGER "rtree_{t}_geom_update3" AFTER UPDATE ON "{t}"
+  WHEN OLD.fid != NEW.fid AND (NEW.geom NOTNULL AND NOT ST_IsEmpty(NEW.geom))
+BEGIN
+  DELETE FROM "rtree_{t}_geom" WHERE id = OLD.fid;
+  INSERT OR REPLACE INTO "rtree_{t}_geom" VALUES (
+    NEW.fid, ST_MinX(NEW.geom), ST_MaxX(NEW.geom), ST_MinY(NEW.geom), ST_MaxY(NEW.geom));
+END;
+CREATE TRIGGER "rtree_{t}_geom_update4" AFTER UPDATE ON "{t}"
+  WHEN OLD.fid != NEW.fid AND (NEW.geom ISNULL OR ST_IsEmpty(NEW.geom))
+BEGIN
+  DELETE FROM "rtree_{t}_geom" WHERE id IN (OLD.fid, NEW.fid);
+END;
+CREATE TRIGGER "rtree_{t}_geom_delete" AFTER DELETE ON "{t}"
+  WHEN old.geom NOT NULL
+BEGIN
+  DELETE FROM "rtree_{t}_geom" WHERE id = OLD.fid;
+END;`
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func sqlType(ct geometry.ColumnType) string {
+	switch ct {
+	case geometry.IntegerColumn:
+		return "INTEGER"
+	case geometry.FloatColumn:
+		return "DOUBLE"
+	}
+	return "TEXT"
+}
+
+// featureTable is one of the point, line and polygon tables
+type featureTable struct {
+	name     string
+	geomType string
+	bbox     *quadtree.Bbox
+	count    int
+	insert   *sql.Stmt
+	index    *sql.Stmt
+}
+
+func (ft *featureTable) create(tx *sql.Tx, columns []geometry.Column) error {
+	cols := []string{"fid INTEGER PRIMARY KEY AUTOINCREMENT", "geom " + ft.geomType, "osm_id INTEGER"}
+	qq := []string{"?", "?"}
+	names := []string{"geom", "osm_id"}
+	for _, c := range columns {
+		cols = append(cols, quoteIdent(c.Name)+" "+sqlType(c.Type))
+		qq = append(qq, "?")
+		names = append(names, quoteIdent(c.Name))
+	}
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(ft.name), strings.Join(cols, ", ")))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE %s USING rtree(id, minx, maxx, miny, maxy)", quoteIdent("rtree_"+ft.name+"_geom")))
+	if err != nil {
+		return err
+	}
+	ft.insert, err = tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(ft.name), strings.Join(names, ", "), strings.Join(qq, ", ")))
+	if err != nil {
+		return err
+	}
+	ft.index, err = tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?)", quoteIdent("rtree_"+ft.name+"_geom")))
+	return err
+}
+
+func (ft *featureTable) add(g geometry.Geometry, columns []geometry.Column) error {
+	blob, err := geometryBlob(g)
+	if err != nil {
+		return err
+	}
+	vals := append([]interface{}{blob, int64(g.Id())}, geometry.ColumnValues(g.Tags(), columns)...)
+	res, err := ft.insert.Exec(vals...)
+	if err != nil {
+		return err
+	}
+	fid, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	bx := g.Bbox()
+	_, err = ft.index.Exec(fid, quadtree.ToFloat(bx.Minx), quadtree.ToFloat(bx.Maxx), quadtree.ToFloat(bx.Miny), quadtree.ToFloat(bx.Maxy))
+	if err != nil {
+		return err
+	}
+	ft.bbox.ExpandBox(bx)
+	ft.count++
+	return nil
+}
+
+// finish adds the table to gpkg_contents and gpkg_geometry_columns, and
+// adds the triggers for the spatial index.
+func (ft *featureTable) finish(tx *sql.Tx, lastChange string) error {
+	ft.insert.Close()
+	ft.index.Close()
+
+	var mx, my, Mx, My interface{}
+	if ft.count > 0 {
+		mx, my = quadtree.ToFloat(ft.bbox.Minx), quadtree.ToFloat(ft.bbox.Miny)
+		Mx, My = quadtree.ToFloat(ft.bbox.Maxx), quadtree.ToFloat(ft.bbox.Maxy)
+	}
+	_, err := tx.Exec("INSERT INTO gpkg_contents VALUES (?, 'features', ?, '', ?, ?, ?, ?, ?, ?)",
+		ft.name, ft.name, lastChange, mx, my, Mx, My, srsId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO gpkg_geometry_columns VALUES (?, 'geom', ?, ?, 0, 0)", ft.name, ft.geomType, srsId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO gpkg_extensions VALUES (?, 'geom', 'gpkg_rtree_index', 'http://www.geopackage.org/spec120/#extension_rtree', 'write-only')", ft.name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(strings.Replace(rtreeTriggers, "{t}", strings.Replace(ft.name, `"`, `""`, -1), -1))
+	return err
+}
+
+// WriteGeoPackage writes the Geometry elements of inc to a new GeoPackage
+// file outfn (replacing any existing file), with coordinates as longitude
+// and latitude (EPSG:4326). Points, lines (Linestring and MultiLinestring
+// geometries, stored as MULTILINESTRING) and polygons (Polygon and Multi
+// geometries, stored as MULTIPOLYGON) are written to separate tables named
+// prefix_point, prefix_line and prefix_polygon. Each table has an osm_id
+// column, followed by the tags of each of columns (see
+// geometry.StyleColumns), and an rtree spatial index. Returns the number
+// of features written.
+func WriteGeoPackage(inc <-chan elements.ExtendedBlock, outfn string, prefix string, columns []geometry.Column) (int, error) {
+	err := os.Remove(outfn)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", outfn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	for _, s := range gpkgSchema {
+		_, err = db.Exec(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	point := &featureTable{prefix + "_point", "POINT", quadtree.NullBbox(), 0, nil, nil}
+	line := &featureTable{prefix + "_line", "MULTILINESTRING", quadtree.NullBbox(), 0, nil, nil}
+	polygon := &featureTable{prefix + "_polygon", "MULTIPOLYGON", quadtree.NullBbox(), 0, nil, nil}
+	tables := []*featureTable{point, line, polygon}
+	for _, ft := range tables {
+		err = ft.create(tx, columns)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	nf := 0
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if e.Type() != elements.Geometry {
+				continue
+			}
+			g, err := geometry.ExtractGeometry(e)
+			if err != nil {
+				return nf, err
+			}
+			var ft *featureTable
+			switch g.GeometryType() {
+			case geometry.Point:
+				ft = point
+			case geometry.Linestring, geometry.MultiLinestring:
+				ft = line
+			case geometry.Polygon, geometry.Multi:
+				ft = polygon
+			default:
+				continue
+			}
+			err = ft.add(g, columns)
+			if err != nil {
+				return nf, err
+			}
+			nf++
+		}
+		if (bl.Idx() % 100) == 0 {
+			log.Printf("%-6d: %d points, %d lines, %d polygons\n", bl.Idx(), point.count, line.count, polygon.count)
+		}
+	}
+
+	lastChange := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	for _, ft := range tables {
+		err = ft.finish(tx, lastChange)
+		if err != nil {
+			return nf, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nf, err
+	}
+	log.Printf("%s: %d points, %d lines, %d polygons\n", outfn, point.count, line.count, polygon.count)
+	return nf, nil
+}
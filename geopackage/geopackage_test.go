@@ -0,0 +1,133 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geopackage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+// queryRows returns each row of query as its values joined with "|", with
+// NULL values empty
+func queryRows(t *testing.T, db *sql.DB, query string) []string {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := make([]string, len(vals))
+		for i, v := range vals {
+			switch v := v.(type) {
+			case nil:
+			case []byte:
+				ss[i] = string(v)
+			default:
+				ss[i] = fmt.Sprint(v)
+			}
+		}
+		res = append(res, strings.Join(ss, "|"))
+	}
+	err = rows.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestWriteGeoPackage(t *testing.T) {
+	bl := elements.ByElementId{
+		geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub", "name", "The Crown"}, []float64{5, 5}),
+		geometrytest.Element(t, 2, geometry.Linestring, []string{"highway", "primary", "lanes", "4"}, []float64{-1, -1, 0, 0, 1, -2}),
+		geometrytest.Element(t, 3, geometry.Point, []string{"amenity", "cafe"}, []float64{-1, 5}),
+		geometrytest.Element(t, 4, geometry.Polygon, []string{"building", "yes"}, []float64{4, 0, 4, 1, 5, 1, 4, 0}),
+		geometrytest.Element(t, 5, geometry.Multi, []string{"landuse", "grass", "name", "park"},
+			[]float64{6, 0, 6, 1, 7, 1, 6, 0}, []float64{8, 2, 8, 3, 9, 3, 8, 2}),
+	}
+	columns := []geometry.Column{
+		{Name: "amenity", Type: geometry.TextColumn},
+		{Name: "lanes", Type: geometry.IntegerColumn},
+		{Name: "name", Type: geometry.TextColumn},
+	}
+	inc := make(chan elements.ExtendedBlock, 1)
+	inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+	close(inc)
+	fn := filepath.Join(t.TempDir(), "test.gpkg")
+	nf, err := WriteGeoPackage(inc, fn, "osm", columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nf != 5 {
+		t.Errorf("wrote %d features, expected 5", nf)
+	}
+
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, c := range []struct {
+		query string
+		exp   []string
+	}{
+		{"SELECT fid, osm_id, amenity, lanes, name FROM osm_point ORDER BY fid",
+			[]string{"1|1|pub||The Crown", "2|3|cafe||"}},
+		{"SELECT fid, osm_id, amenity, lanes, name FROM osm_line ORDER BY fid",
+			[]string{"1|2||4|"}},
+		{"SELECT fid, osm_id, amenity, lanes, name FROM osm_polygon ORDER BY fid",
+			[]string{"1|4|||", "2|5|||park"}},
+		{"SELECT table_name, data_type, identifier, min_x, min_y, max_x, max_y, srs_id FROM gpkg_contents ORDER BY table_name",
+			[]string{"osm_line|features|osm_line|-1|-2|1|0|4326", "osm_point|features|osm_point|-1|5|5|5|4326",
+				"osm_polygon|features|osm_polygon|4|0|9|3|4326"}},
+		{"SELECT table_name, column_name, geometry_type_name, srs_id, z, m FROM gpkg_geometry_columns ORDER BY table_name",
+			[]string{"osm_line|geom|MULTILINESTRING|4326|0|0", "osm_point|geom|POINT|4326|0|0",
+				"osm_polygon|geom|MULTIPOLYGON|4326|0|0"}},
+		{"SELECT table_name, column_name, extension_name FROM gpkg_extensions ORDER BY table_name",
+			[]string{"osm_line|geom|gpkg_rtree_index", "osm_point|geom|gpkg_rtree_index", "osm_polygon|geom|gpkg_rtree_index"}},
+		{"SELECT id, minx, maxx, miny, maxy FROM rtree_osm_point_geom ORDER BY id",
+			[]string{"1|5|5|5|5", "2|-1|-1|5|5"}},
+		{"SELECT id, minx, maxx, miny, maxy FROM rtree_osm_line_geom ORDER BY id",
+			[]string{"1|-1|1|-2|0"}},
+		{"SELECT id, minx, maxx, miny, maxy FROM rtree_osm_polygon_geom ORDER BY id",
+			[]string{"1|4|5|0|1", "2|6|9|0|3"}},
+	} {
+		rows := queryRows(t, db, c.query)
+		if strings.Join(rows, "\n") != strings.Join(c.exp, "\n") {
+			t.Errorf("%s: %q, expected %q", c.query, rows, c.exp)
+		}
+	}
+
+	blobs := queryRows(t, db, "SELECT geom FROM osm_polygon ORDER BY fid")
+	if len(blobs) == 2 {
+		r := &wkbReader{[]byte(blobs[1]), 40}
+		exp := "MULTI6(POLYGON((6 0,6 1,7 1,6 0)),POLYGON((8 2,8 3,9 3,8 2)))"
+		if wkt := r.geometry(); wkt != exp {
+			t.Errorf("multi polygon blob %s, expected %s", wkt, exp)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geopackage
+
+import (
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	wkbPoint           = 1
+	wkbLinestring      = 2
+	wkbPolygon         = 3
+	wkbMultiLinestring = 5
+	wkbMultiPolygon    = 6
+)
+
+// wkbWriter writes little endian WKB
+type wkbWriter struct {
+	buf []byte
+}
+
+func (w *wkbWriter) uint32(v uint32) {
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(w.buf[len(w.buf)-4:], v)
+}
+
+func (w *wkbWriter) float64(v float64) {
+	w.buf = append(w.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(w.buf[len(w.buf)-8:], math.Float64bits(v))
+}
+
+func (w *wkbWriter) header(ty uint32) {
+	w.buf = append(w.buf, 1)
+	w.uint32(ty)
+}
+
+func (w *wkbWriter) coords(n int, coord func(int) geometry.Coord) {
+	w.uint32(uint32(n))
+	for i := 0; i < n; i++ {
+		x, y := coord(i).LonLat()
+		w.float64(x)
+		w.float64(y)
+	}
+}
+
+func (w *wkbWriter) polygon(nr int, nc func(int) int, coord func(int, int) geometry.Coord) {
+	w.header(wkbPolygon)
+	w.uint32(uint32(nr))
+	for i := 0; i < nr; i++ {
+		ii := i
+		w.coords(nc(i), func(j int) geometry.Coord { return coord(ii, j) })
+	}
+}
+
+// multiWkb returns g as WKB, with Linestrings and Polygons converted to
+// MultiLinestrings and MultiPolygons, so that each table has a single
+// geometry type.
+func multiWkb(g geometry.Geometry) ([]byte, error) {
+	w := &wkbWriter{make([]byte, 0, 64)}
+	switch g.GeometryType() {
+	case geometry.Point:
+		x, y := g.(geometry.PointGeometry).Coord().LonLat()
+		w.header(wkbPoint)
+		w.float64(x)
+		w.float64(y)
+	case geometry.Linestring:
+		ln := g.(geometry.LinestringGeometry)
+		w.header(wkbMultiLinestring)
+		w.uint32(1)
+		w.header(wkbLinestring)
+		w.coords(ln.NumCoords(), ln.Coord)
+	case geometry.MultiLinestring:
+		ml := g.(geometry.MultiLinestringGeometry)
+		w.header(wkbMultiLinestring)
+		w.uint32(uint32(ml.NumLines()))
+		for i := 0; i < ml.NumLines(); i++ {
+			ii := i
+			w.header(wkbLinestring)
+			w.coords(ml.NumCoords(i), func(j int) geometry.Coord { return ml.Coord(ii, j) })
+		}
+	case geometry.Polygon:
+		py := g.(geometry.PolygonGeometry)
+		w.header(wkbMultiPolygon)
+		w.uint32(1)
+		w.polygon(py.NumRings(), py.NumCoords, py.Coord)
+	case geometry.Multi:
+		mg := g.(geometry.MultiGeometry)
+		w.header(wkbMultiPolygon)
+		w.uint32(uint32(mg.NumGeometries()))
+		for i := 0; i < mg.NumGeometries(); i++ {
+			ii := i
+			w.polygon(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) geometry.Coord { return mg.Coord(ii, j, k) })
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("can't write %s geometry", g.GeometryType()))
+	}
+	return w.buf, nil
+}
+
+// geometryBlob returns g in the GeoPackage binary format: a header giving
+// the srs_id and (other than for points) the envelope, followed by WKB.
+func geometryBlob(g geometry.Geometry) ([]byte, error) {
+	wkb, err := multiWkb(g)
+	if err != nil {
+		return nil, err
+	}
+	w := &wkbWriter{make([]byte, 0, 40+len(wkb))}
+	w.buf = append(w.buf, 'G', 'P', 0)
+	if g.GeometryType() == geometry.Point {
+		// little endian, no envelope
+		w.buf = append(w.buf, 1)
+		w.uint32(srsId)
+	} else {
+		// little endian, envelope [minx, maxx, miny, maxy]
+		w.buf = append(w.buf, 3)
+		w.uint32(srsId)
+		bx := g.Bbox()
+		for _, v := range []int64{bx.Minx, bx.Maxx, bx.Miny, bx.Maxy} {
+			w.float64(quadtree.ToFloat(v))
+		}
+	}
+	w.buf = append(w.buf, wkb...)
+	return w.buf, nil
+}
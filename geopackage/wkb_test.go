@@ -0,0 +1,143 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package geopackage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+// wkbReader reads little endian WKB as text, similar to WKT
+type wkbReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *wkbReader) uint32() uint32 {
+	v := binary.LittleEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *wkbReader) float64() float64 {
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos:]))
+	r.pos += 8
+	return v
+}
+
+func (r *wkbReader) coords() string {
+	n := int(r.uint32())
+	cc := make([]string, n)
+	for i := range cc {
+		cc[i] = fmt.Sprintf("%g %g", r.float64(), r.float64())
+	}
+	return "(" + strings.Join(cc, ",") + ")"
+}
+
+func (r *wkbReader) geometry() string {
+	if r.buf[r.pos] != 1 {
+		return "big endian"
+	}
+	r.pos++
+	ty := r.uint32()
+	switch ty {
+	case wkbPoint:
+		return fmt.Sprintf("POINT(%g %g)", r.float64(), r.float64())
+	case wkbLinestring:
+		return "LINESTRING" + r.coords()
+	case wkbPolygon:
+		rr := make([]string, r.uint32())
+		for i := range rr {
+			rr[i] = r.coords()
+		}
+		return "POLYGON(" + strings.Join(rr, ",") + ")"
+	case wkbMultiLinestring, wkbMultiPolygon:
+		gg := make([]string, r.uint32())
+		for i := range gg {
+			gg[i] = r.geometry()
+		}
+		return fmt.Sprintf("MULTI%d(%s)", ty, strings.Join(gg, ","))
+	}
+	return fmt.Sprintf("unknown %d", ty)
+}
+
+func TestMultiWkb(t *testing.T) {
+	for _, c := range []struct {
+		g   geometry.Geometry
+		wkt string
+	}{
+		{geometrytest.Geometry(t, 1, geometry.Point, nil, []float64{1.5, -2}), "POINT(1.5 -2)"},
+		{geometrytest.Geometry(t, 1, geometry.Linestring, nil, []float64{0, 0, 1, 1, 2, 0}),
+			"MULTI5(LINESTRING(0 0,1 1,2 0))"},
+		{geometrytest.Geometry(t, 1, geometry.MultiLinestring, nil, []float64{0, 0, 1, 1}, []float64{2, 2, 3, 3}),
+			"MULTI5(LINESTRING(0 0,1 1),LINESTRING(2 2,3 3))"},
+		{geometrytest.Geometry(t, 1, geometry.Polygon, nil, []float64{0, 0, 0, 2, 2, 2, 0, 0}),
+			"MULTI6(POLYGON((0 0,0 2,2 2,0 0)))"},
+		{geometrytest.Geometry(t, 1, geometry.Multi, nil, []float64{0, 0, 0, 2, 2, 2, 0, 0}, []float64{5, 5, 5, 6, 6, 6, 5, 5}),
+			"MULTI6(POLYGON((0 0,0 2,2 2,0 0)),POLYGON((5 5,5 6,6 6,5 5)))"},
+	} {
+		wkb, err := multiWkb(c.g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &wkbReader{wkb, 0}
+		if wkt := r.geometry(); wkt != c.wkt || r.pos != len(wkb) {
+			t.Errorf("%s: read %d of %d bytes: %s, expected %s", c.g.GeometryType(), r.pos, len(wkb), wkt, c.wkt)
+		}
+	}
+}
+
+func TestGeometryBlob(t *testing.T) {
+	pt := geometrytest.Geometry(t, 1, geometry.Point, nil, []float64{1.5, -2})
+	blob, err := geometryBlob(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob[:3]) != "GP\x00" || blob[3] != 1 || binary.LittleEndian.Uint32(blob[4:]) != srsId {
+		t.Errorf("point blob header %v", blob[:8])
+	}
+	if r := (&wkbReader{blob, 8}); r.geometry() != "POINT(1.5 -2)" {
+		t.Errorf("point blob %v", blob)
+	}
+
+	ln := geometrytest.Geometry(t, 1, geometry.Linestring, nil, []float64{-1, 3, 2, 0.5})
+	blob, err = geometryBlob(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob[:3]) != "GP\x00" || blob[3] != 3 || binary.LittleEndian.Uint32(blob[4:]) != srsId {
+		t.Errorf("line blob header %v", blob[:8])
+	}
+	r := &wkbReader{blob, 8}
+	env := []float64{r.float64(), r.float64(), r.float64(), r.float64()}
+	if fmt.Sprint(env) != "[-1 2 0.5 3]" {
+		t.Errorf("line envelope %v, expected [minx maxx miny maxy]", env)
+	}
+	if wkt := r.geometry(); wkt != "MULTI5(LINESTRING(-1 3,2 0.5))" || r.pos != len(blob) {
+		t.Errorf("line blob %s", wkt)
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	if q := quoteIdent(`addr:street`); q != `"addr:street"` {
+		t.Errorf("quoted %s", q)
+	}
+	if q := quoteIdent(`a"b`); q != `"a""b"` {
+		t.Errorf("quoted %s", q)
+	}
+	for ct, s := range map[geometry.ColumnType]string{geometry.TextColumn: "TEXT", geometry.IntegerColumn: "INTEGER",
+		geometry.FloatColumn: "DOUBLE", geometry.JsonColumn: "TEXT"} {
+		if sqlType(ct) != s {
+			t.Errorf("%s: sql type %s, expected %s", ct, sqlType(ct), s)
+		}
+	}
+}
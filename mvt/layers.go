@@ -0,0 +1,117 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package mvt
+
+import (
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Layer selects the geometries written to a layer of each vector tile.
+// Match is as for geometry.TagRule. Geometry lists the kinds of geometry
+// included (point, linestring and/or polygon: all if empty), and Tags the
+// tags kept as feature properties (all if empty). The layer is only
+// included for tiles with a zoom (quadtree level) from MinZoom to MaxZoom
+// (no limit if MaxZoom is zero).
+type Layer struct {
+	Name     string
+	Match    map[string]string
+	Geometry []string
+	Tags     []string
+	MinZoom  int64
+	MaxZoom  int64
+}
+
+// ReadLayers reads a json file consisting of either a list of Layer
+// objects, or a style file object (see geometry.ReadStyleFileZOrder) with
+// the list as Layers.
+func ReadLayers(fn string) ([]Layer, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if d := bytes.TrimSpace(data); len(d) > 0 && d[0] == '{' {
+		var sf struct {
+			Layers []Layer
+		}
+		err = json.Unmarshal(data, &sf)
+		if err != nil {
+			return nil, err
+		}
+		if len(sf.Layers) == 0 {
+			return nil, errors.New(fmt.Sprintf("no Layers in %s", fn))
+		}
+		return sf.Layers, nil
+	}
+	var res []Layer
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+var geometryKinds = map[geometry.GeometryType]string{
+	geometry.Point:           "point",
+	geometry.Linestring:      "linestring",
+	geometry.MultiLinestring: "linestring",
+	geometry.Polygon:         "polygon",
+	geometry.Multi:           "polygon",
+}
+
+type compiledLayer struct {
+	layer Layer
+	match geometry.TagMatch
+	kinds map[string]bool
+	tags  map[string]bool
+}
+
+func compileLayer(l Layer) (*compiledLayer, error) {
+	if l.Name == "" {
+		return nil, errors.New("layer without Name")
+	}
+	cl := &compiledLayer{l, geometry.CompileTagMatch(l.Match), map[string]bool{}, map[string]bool{}}
+	for _, k := range l.Geometry {
+		switch k {
+		case "point", "linestring", "polygon":
+			cl.kinds[k] = true
+		default:
+			return nil, errors.New(fmt.Sprintf("layer %s: unknown geometry %q", l.Name, k))
+		}
+	}
+	for _, t := range l.Tags {
+		cl.tags[t] = true
+	}
+	return cl, nil
+}
+
+func (cl *compiledLayer) accepts(zoom int64, g geometry.Geometry) bool {
+	if zoom < cl.layer.MinZoom || (cl.layer.MaxZoom > 0 && zoom > cl.layer.MaxZoom) {
+		return false
+	}
+	k, ok := geometryKinds[g.GeometryType()]
+	if !ok {
+		return false
+	}
+	if len(cl.kinds) > 0 && !cl.kinds[k] {
+		return false
+	}
+	return cl.match.Matches(g.Tags())
+}
+
+// keepTag returns true if the tag key k (without a type prefix) is a
+// feature property of the layer
+func (cl *compiledLayer) keepTag(k string) bool {
+	if len(cl.tags) == 0 {
+		return true
+	}
+	return cl.tags[k]
+}
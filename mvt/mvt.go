@@ -0,0 +1,493 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package mvt encodes geometries as Mapbox Vector Tiles (version 2 of the
+// specification).
+package mvt
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// DefaultExtent is the size of a tile in tile coordinates used if no
+// extent is given to MakeEncoder
+const DefaultExtent = 4096
+
+const (
+	cmdMoveTo    = 1
+	cmdLineTo    = 2
+	cmdClosePath = 7
+
+	featurePoint      = 1
+	featureLinestring = 2
+	featurePolygon    = 3
+)
+
+// Encoder assigns geometries to layers and encodes them as vector tiles.
+type Encoder struct {
+	layers []*compiledLayer
+	extent uint32
+	buffer uint32
+}
+
+// MakeEncoder returns an Encoder for layers. Geometries are quantised to
+// extent units across each tile, and clipped to the tile expanded by
+// buffer units. Returns an error if a layer is not valid.
+func MakeEncoder(layers []Layer, extent uint32, buffer uint32) (*Encoder, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("no layers")
+	}
+	if extent == 0 {
+		extent = DefaultExtent
+	}
+	enc := &Encoder{nil, extent, buffer}
+	names := map[string]bool{}
+	for _, l := range layers {
+		cl, err := compileLayer(l)
+		if err != nil {
+			return nil, err
+		}
+		if names[l.Name] {
+			return nil, errors.New(fmt.Sprintf("repeated layer %s", l.Name))
+		}
+		names[l.Name] = true
+		enc.layers = append(enc.layers, cl)
+	}
+	return enc, nil
+}
+
+// tileTransform converts spherical mercator coordinates into tile
+// coordinates, with the origin at the top left of the tile.
+type tileTransform struct {
+	minx, maxy, scale float64
+}
+
+func makeTileTransform(qt quadtree.Quadtree, extent uint32) tileTransform {
+	ehc, _ := quadtree.Mercator(180, 0)
+	x, y, z := qt.Tuple()
+	size := 2 * ehc / float64(int64(1)<<uint(z))
+	return tileTransform{-ehc + float64(x)*size, ehc - float64(y)*size, float64(extent) / size}
+}
+
+func (tt tileTransform) point(c geometry.Coord) [2]int64 {
+	x, y := c.XY()
+	return [2]int64{
+		int64(math.Floor((x-tt.minx)*tt.scale + 0.5)),
+		int64(math.Floor((tt.maxy-y)*tt.scale + 0.5)),
+	}
+}
+
+// line returns the coordinates of a linestring or ring in tile
+// coordinates, dropping repeated points
+func (tt tileTransform) line(n int, coord func(int) geometry.Coord) [][2]int64 {
+	res := make([][2]int64, 0, n)
+	for i := 0; i < n; i++ {
+		p := tt.point(coord(i))
+		if len(res) > 0 && res[len(res)-1] == p {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// ringArea returns twice the signed area of the ring rr: positive for a
+// clockwise ring, given the y axis of tile coordinates points down.
+func ringArea(rr [][2]int64) int64 {
+	a := int64(0)
+	for i, p := range rr {
+		q := rr[(i+1)%len(rr)]
+		a += p[0]*q[1] - q[0]*p[1]
+	}
+	return a
+}
+
+// ring returns the coordinates of a polygon ring in tile coordinates,
+// without the closing point, oriented clockwise if exterior and
+// anticlockwise otherwise. Returns nil if the ring has no area.
+func (tt tileTransform) ring(n int, coord func(int) geometry.Coord, exterior bool) [][2]int64 {
+	rr := tt.line(n, coord)
+	if len(rr) > 1 && rr[0] == rr[len(rr)-1] {
+		rr = rr[:len(rr)-1]
+	}
+	if len(rr) < 3 {
+		return nil
+	}
+	a := ringArea(rr)
+	if a == 0 {
+		return nil
+	}
+	if (a > 0) != exterior {
+		for i, j := 0, len(rr)-1; i < j; i, j = i+1, j-1 {
+			rr[i], rr[j] = rr[j], rr[i]
+		}
+	}
+	return rr
+}
+
+// commands encodes geometry commands, tracking the cursor position
+type commands struct {
+	vals []uint64
+	cur  [2]int64
+}
+
+func command(id, count int) uint64 {
+	return uint64((id & 7) | (count << 3))
+}
+
+func (cs *commands) points(pp [][2]int64) {
+	for _, p := range pp {
+		cs.vals = append(cs.vals, utils.Zigzag(p[0]-cs.cur[0]), utils.Zigzag(p[1]-cs.cur[1]))
+		cs.cur = p
+	}
+}
+
+func (cs *commands) line(pp [][2]int64, close bool) {
+	cs.vals = append(cs.vals, command(cmdMoveTo, 1))
+	cs.points(pp[:1])
+	cs.vals = append(cs.vals, command(cmdLineTo, len(pp)-1))
+	cs.points(pp[1:])
+	if close {
+		cs.vals = append(cs.vals, command(cmdClosePath, 1))
+	}
+}
+
+func (cs *commands) polygon(n int, numCoords func(int) int, coord func(int, int) geometry.Coord, tt tileTransform) {
+	for i := 0; i < n; i++ {
+		ii := i
+		rr := tt.ring(numCoords(i), func(j int) geometry.Coord { return coord(ii, j) }, i == 0)
+		if rr == nil {
+			if i == 0 {
+				// drop the holes of a degenerate polygon
+				return
+			}
+			continue
+		}
+		cs.line(rr, true)
+	}
+}
+
+// add appends the commands for g, which should already be clipped to the
+// tile.
+func (cs *commands) add(g geometry.Geometry, tt tileTransform) {
+	switch g.GeometryType() {
+	case geometry.Point:
+		p := tt.point(g.(geometry.PointGeometry).Coord())
+		cs.vals = append(cs.vals, command(cmdMoveTo, 1))
+		cs.points([][2]int64{p})
+	case geometry.Linestring:
+		ln := g.(geometry.LinestringGeometry)
+		if pp := tt.line(ln.NumCoords(), ln.Coord); len(pp) > 1 {
+			cs.line(pp, false)
+		}
+	case geometry.MultiLinestring:
+		ml := g.(geometry.MultiLinestringGeometry)
+		for i := 0; i < ml.NumLines(); i++ {
+			ii := i
+			if pp := tt.line(ml.NumCoords(i), func(j int) geometry.Coord { return ml.Coord(ii, j) }); len(pp) > 1 {
+				cs.line(pp, false)
+			}
+		}
+	case geometry.Polygon:
+		py := g.(geometry.PolygonGeometry)
+		cs.polygon(py.NumRings(), py.NumCoords, py.Coord, tt)
+	case geometry.Multi:
+		mg := g.(geometry.MultiGeometry)
+		for i := 0; i < mg.NumGeometries(); i++ {
+			ii := i
+			cs.polygon(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) geometry.Coord { return mg.Coord(ii, j, k) }, tt)
+		}
+	}
+}
+
+var featureTypes = map[string]uint64{"point": featurePoint, "linestring": featureLinestring, "polygon": featurePolygon}
+
+// layerBuilder collects the features, keys and values of a layer
+type layerBuilder struct {
+	layer    *compiledLayer
+	features [][]byte
+	keys     []string
+	keyIdx   map[string]uint64
+	values   [][]byte
+	valueIdx map[string]uint64
+}
+
+func (lb *layerBuilder) key(k string) uint64 {
+	i, ok := lb.keyIdx[k]
+	if !ok {
+		i = uint64(len(lb.keys))
+		lb.keys = append(lb.keys, k)
+		lb.keyIdx[k] = i
+	}
+	return i
+}
+
+func (lb *layerBuilder) value(v []byte) uint64 {
+	i, ok := lb.valueIdx[string(v)]
+	if !ok {
+		i = uint64(len(lb.values))
+		lb.values = append(lb.values, v)
+		lb.valueIdx[string(v)] = i
+	}
+	return i
+}
+
+// tagValue returns the key and encoded Value message of tag i of tt, as
+// given by geometry.TagValue. Returns false for null values.
+func tagValue(tt elements.Tags, i int) (string, []byte, bool) {
+	k, v := geometry.TagValue(tt, i)
+	if k == "" {
+		return "", nil, false
+	}
+	switch vv := v.(type) {
+	case int64:
+		return k, utils.PbfMsgSlice{utils.PbfMsg{6, nil, utils.Zigzag(vv)}}.Pack(), true
+	case float64:
+		// double is a fixed64 field, which PbfMsg doesn't support
+		res := make([]byte, 9)
+		res[0] = (3 << 3) | 1
+		binary.LittleEndian.PutUint64(res[1:], math.Float64bits(vv))
+		return k, res, true
+	case string:
+		return k, utils.PbfMsgSlice{utils.PbfMsg{1, []byte(vv), 0}}.Pack(), true
+	}
+	return "", nil, false
+}
+
+func (lb *layerBuilder) addFeature(g geometry.Geometry, gg []geometry.Geometry, tt tileTransform) error {
+	cs := &commands{}
+	for _, p := range gg {
+		cs.add(p, tt)
+	}
+	if len(cs.vals) == 0 {
+		return nil
+	}
+	geom, err := utils.PackPackedList(cs.vals)
+	if err != nil {
+		return err
+	}
+
+	tv := []uint64{}
+	tags := g.Tags()
+	for i := 0; i < tags.Len(); i++ {
+		k, v, ok := tagValue(tags, i)
+		if !ok || !lb.layer.keepTag(k) {
+			continue
+		}
+		tv = append(tv, lb.key(k), lb.value(v))
+	}
+	tp, err := utils.PackPackedList(tv)
+	if err != nil {
+		return err
+	}
+
+	msgs := make(utils.PbfMsgSlice, 0, 4)
+	if g.Id() > 0 {
+		msgs = append(msgs, utils.PbfMsg{1, nil, uint64(g.Id())})
+	}
+	if len(tv) > 0 {
+		msgs = append(msgs, utils.PbfMsg{2, tp, 0})
+	}
+	msgs = append(msgs, utils.PbfMsg{3, nil, featureTypes[geometryKinds[g.GeometryType()]]})
+	msgs = append(msgs, utils.PbfMsg{4, geom, 0})
+	lb.features = append(lb.features, msgs.Pack())
+	return nil
+}
+
+func (lb *layerBuilder) pack(extent uint32) []byte {
+	msgs := make(utils.PbfMsgSlice, 0, 3+len(lb.features)+len(lb.keys)+len(lb.values))
+	msgs = append(msgs, utils.PbfMsg{15, nil, 2})
+	msgs = append(msgs, utils.PbfMsg{1, []byte(lb.layer.layer.Name), 0})
+	for _, f := range lb.features {
+		msgs = append(msgs, utils.PbfMsg{2, f, 0})
+	}
+	for _, k := range lb.keys {
+		msgs = append(msgs, utils.PbfMsg{3, []byte(k), 0})
+	}
+	for _, v := range lb.values {
+		msgs = append(msgs, utils.PbfMsg{4, v, 0})
+	}
+	msgs = append(msgs, utils.PbfMsg{5, nil, uint64(extent)})
+	return msgs.Pack()
+}
+
+// EncodeTile returns the vector tile for quadtree qt. Each geometry in gg
+// is added to the first layer it matches, clipped to the tile (expanded by
+// the encoder's buffer). Geometries matching no layer, or entirely outside
+// the tile, are skipped. Returns nil if no geometries are included.
+func (enc *Encoder) EncodeTile(qt quadtree.Quadtree, gg []geometry.Geometry) ([]byte, error) {
+	if qt < 0 {
+		return nil, errors.New(fmt.Sprintf("not a tile: %d", qt))
+	}
+	_, _, zoom := qt.Tuple()
+	tt := makeTileTransform(qt, enc.extent)
+	bx := qt.Bounds(float64(enc.buffer) / float64(enc.extent))
+
+	lbs := make([]*layerBuilder, len(enc.layers))
+	for _, g := range gg {
+		for i, cl := range enc.layers {
+			if !cl.accepts(zoom, g) {
+				continue
+			}
+			parts := geometry.ClipGeometry(g, bx)
+			if len(parts) == 0 {
+				break
+			}
+			if lbs[i] == nil {
+				lbs[i] = &layerBuilder{cl, nil, nil, map[string]uint64{}, nil, map[string]uint64{}}
+			}
+			if err := lbs[i].addFeature(g, parts, tt); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	msgs := utils.PbfMsgSlice{}
+	for _, lb := range lbs {
+		if lb == nil || len(lb.features) == 0 {
+			continue
+		}
+		msgs = append(msgs, utils.PbfMsg{3, lb.pack(enc.extent), 0})
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	return msgs.Pack(), nil
+}
+
+// EncodeBlock returns the vector tile for the Geometry elements of bl, as
+// given by EncodeTile for bl.Quadtree().
+func (enc *Encoder) EncodeBlock(bl elements.ExtendedBlock) ([]byte, error) {
+	gg := make([]geometry.Geometry, 0, bl.Len())
+	for i := 0; i < bl.Len(); i++ {
+		e := bl.Element(i)
+		if e.Type() != elements.Geometry {
+			continue
+		}
+		g, err := geometry.ExtractGeometry(e)
+		if err != nil {
+			return nil, err
+		}
+		gg = append(gg, g)
+	}
+	return enc.EncodeTile(bl.Quadtree(), gg)
+}
+
+// Tile is an encoded vector tile
+type Tile struct {
+	Idx      int
+	Quadtree quadtree.Quadtree
+	Data     []byte
+}
+
+// GatherTiles groups the blocks of inc, which must be in quadtree order
+// (as read from a file sorted by quadtree), into one block for each tile
+// at level zoom. Each geometry is stored in the block of the smallest
+// quadtree containing it, so the block for a tile has the elements of all
+// blocks within the tile, and also of all the blocks with a quadtree
+// containing the tile (which are repeated for each of these tiles). Only
+// tiles with at least one block within them are returned: a tile covered
+// only by geometries from larger quadtrees is skipped.
+func GatherTiles(inc <-chan elements.ExtendedBlock, zoom uint) <-chan elements.ExtendedBlock {
+	res := make(chan elements.ExtendedBlock)
+	go func() {
+		ancestors := []elements.ExtendedBlock{}
+		curr, ee := quadtree.Quadtree(-1), elements.ByElementId{}
+		ii := 0
+		finish := func() {
+			if len(ee) > 0 {
+				nb := elements.ByElementId{}
+				for _, a := range ancestors {
+					for i := 0; i < a.Len(); i++ {
+						nb = append(nb, a.Element(i))
+					}
+				}
+				nb = append(nb, ee...)
+				res <- elements.MakeExtendedBlock(ii, nb, curr, 0, 0, nil)
+				ii++
+			}
+			curr, ee = -1, elements.ByElementId{}
+		}
+		// drop the ancestors which don't contain qt
+		trim := func(qt quadtree.Quadtree) {
+			for len(ancestors) > 0 {
+				a := ancestors[len(ancestors)-1].Quadtree()
+				if a.Common(qt) == a {
+					return
+				}
+				ancestors = ancestors[:len(ancestors)-1]
+			}
+		}
+		for bl := range inc {
+			qt := bl.Quadtree()
+			if qt < 0 {
+				continue
+			}
+			if uint(qt&31) < zoom {
+				finish()
+				trim(qt)
+				ancestors = append(ancestors, bl)
+				continue
+			}
+			if t := qt.Round(zoom); t != curr {
+				finish()
+				trim(t)
+				curr = t
+			}
+			for i := 0; i < bl.Len(); i++ {
+				ee = append(ee, bl.Element(i))
+			}
+		}
+		finish()
+		close(res)
+	}()
+	return res
+}
+
+// EncodeTiles encodes each block of inc, which should contain the Geometry
+// elements for the tile given by the quadtree of the block, returning the
+// tiles which are not empty. The blocks read from a file only contain the
+// geometries with exactly that quadtree, so should be passed through
+// GatherTiles first. If a block can't be encoded no more tiles are
+// returned: call the returned function once the channel has been closed.
+func EncodeTiles(inc <-chan elements.ExtendedBlock, enc *Encoder) (<-chan Tile, func() error) {
+	res := make(chan Tile)
+	done := make(chan error, 1)
+	go func() {
+		ii := 0
+		var err error
+		for bl := range inc {
+			if err != nil || bl.Quadtree() < 0 {
+				continue
+			}
+			var data []byte
+			data, err = enc.EncodeBlock(bl)
+			if err != nil {
+				err = errors.New(fmt.Sprintf("tile %s: %s", bl.Quadtree(), err.Error()))
+				continue
+			}
+			if data == nil {
+				continue
+			}
+			res <- Tile{ii, bl.Quadtree(), data}
+			ii++
+		}
+		close(res)
+		done <- err
+	}()
+	wait := func() error { return <-done }
+	return res, wait
+}
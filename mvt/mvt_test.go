@@ -0,0 +1,282 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package mvt
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+)
+
+type decodedFeature struct {
+	id    uint64
+	ty    uint64
+	tags  map[string]string
+	parts [][][2]int64
+	close int
+}
+
+type decodedLayer struct {
+	version  uint64
+	extent   uint64
+	features []decodedFeature
+}
+
+// decodeValue returns string and sint values as a string, prefixing sint
+// values with !
+func decodeValue(data []byte) string {
+	for _, m := range utils.ReadPbfTagSlice(data) {
+		switch m.Tag {
+		case 1:
+			return string(m.Data)
+		case 6:
+			return fmt.Sprintf("!%d", utils.UnZigzag(m.Value))
+		}
+	}
+	return "?"
+}
+
+func decodeGeometry(t *testing.T, f *decodedFeature, data []byte) {
+	vals, err := utils.ReadPackedList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := [2]int64{}
+	for i := 0; i < len(vals); {
+		id, count := vals[i]&7, int(vals[i]>>3)
+		i++
+		switch id {
+		case cmdMoveTo, cmdLineTo:
+			if id == cmdMoveTo {
+				f.parts = append(f.parts, nil)
+			}
+			for j := 0; j < count; j++ {
+				cur[0] += utils.UnZigzag(vals[i])
+				cur[1] += utils.UnZigzag(vals[i+1])
+				i += 2
+				f.parts[len(f.parts)-1] = append(f.parts[len(f.parts)-1], cur)
+			}
+		case cmdClosePath:
+			f.close++
+		default:
+			t.Fatalf("unexpected command %d", id)
+		}
+	}
+}
+
+func decodeTile(t *testing.T, data []byte) map[string]decodedLayer {
+	res := map[string]decodedLayer{}
+	for _, lm := range utils.ReadPbfTagSlice(data) {
+		if lm.Tag != 3 {
+			t.Fatalf("unexpected tile field %d", lm.Tag)
+		}
+		name, layer := "", decodedLayer{}
+		keys, values := []string{}, []string{}
+		features := [][]byte{}
+		for _, m := range utils.ReadPbfTagSlice(lm.Data) {
+			switch m.Tag {
+			case 1:
+				name = string(m.Data)
+			case 2:
+				features = append(features, m.Data)
+			case 3:
+				keys = append(keys, string(m.Data))
+			case 4:
+				values = append(values, decodeValue(m.Data))
+			case 5:
+				layer.extent = m.Value
+			case 15:
+				layer.version = m.Value
+			}
+		}
+		for _, fd := range features {
+			f := decodedFeature{tags: map[string]string{}}
+			for _, m := range utils.ReadPbfTagSlice(fd) {
+				switch m.Tag {
+				case 1:
+					f.id = m.Value
+				case 2:
+					tv, err := utils.ReadPackedList(m.Data)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for i := 0; i+1 < len(tv); i += 2 {
+						f.tags[keys[tv[i]]] = values[tv[i+1]]
+					}
+				case 3:
+					f.ty = m.Value
+				case 4:
+					decodeGeometry(t, &f, m.Data)
+				}
+			}
+			layer.features = append(layer.features, f)
+		}
+		res[name] = layer
+	}
+	return res
+}
+
+// tilePoint returns the tile coordinates of lon, lat in the tile 0, 0, 1
+// with an extent of 4096
+func tilePoint(lon, lat float64) [2]int64 {
+	x, y := quadtree.Mercator(lon, lat)
+	ehc, _ := quadtree.Mercator(180, 0)
+	return [2]int64{int64(math.Floor((x+ehc)*4096/ehc + 0.5)), int64(math.Floor((ehc-y)*4096/ehc + 0.5))}
+}
+
+func TestEncodeTile(t *testing.T) {
+	enc, err := MakeEncoder([]Layer{
+		{Name: "roads", Match: map[string]string{"highway": "*"}, Geometry: []string{"linestring"}, Tags: []string{"highway", "lanes"}},
+		{Name: "buildings", Match: map[string]string{"building": "*"}, MinZoom: 1},
+		{Name: "hidden", Match: map[string]string{"building": "*"}, MinZoom: 2},
+	}, 0, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lanes := make([]byte, 10)
+	lanes = lanes[:utils.WriteVarint(lanes, 0, 2)]
+	bl := elements.ByElementId{
+		geometrytest.Element(t, 1, geometry.Linestring, []string{"highway", "primary", "!lanes", string(lanes), "name", "High St"}, []float64{-90, 10, -45, 40, 45, 40}),
+		geometrytest.Element(t, 2, geometry.Polygon, []string{"building", "yes"}, []float64{-100, 20, -80, 20, -80, 40, -100, 40, -100, 20}),
+		geometrytest.Element(t, 3, geometry.Point, []string{"amenity", "pub"}, []float64{-10, 10}),
+		geometrytest.Element(t, 4, geometry.Point, []string{"highway", "crossing"}, []float64{-10, 10}),
+		geometrytest.Element(t, 5, geometry.Polygon, []string{"building", "yes"}, []float64{100, 20, 120, 20, 120, 40, 100, 40, 100, 20}),
+	}
+	data, err := enc.EncodeBlock(elements.MakeExtendedBlock(0, bl, geometrytest.TileQt(t, 0, 0, 1), 0, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := decodeTile(t, data)
+	if len(layers) != 2 {
+		t.Fatalf("expected roads and buildings layers, found %v", layers)
+	}
+
+	roads := layers["roads"]
+	if roads.version != 2 || roads.extent != DefaultExtent || len(roads.features) != 1 {
+		t.Fatalf("roads: %+v", roads)
+	}
+	rd := roads.features[0]
+	if rd.id != 1 || rd.ty != featureLinestring || len(rd.tags) != 2 || rd.tags["highway"] != "primary" || rd.tags["lanes"] != "!2" {
+		t.Errorf("road: %+v", rd)
+	}
+	// clipped to the tile, expanded by 64 units
+	if len(rd.parts) != 1 || len(rd.parts[0]) != 3 || rd.close != 0 ||
+		rd.parts[0][0] != tilePoint(-90, 10) || rd.parts[0][1] != tilePoint(-45, 40) || rd.parts[0][2][0] != 4096+64 {
+		t.Errorf("road geometry: %v", rd.parts)
+	}
+
+	buildings := layers["buildings"]
+	if len(buildings.features) != 1 {
+		t.Fatalf("buildings: %+v", buildings)
+	}
+	bd := buildings.features[0]
+	if bd.id != 2 || bd.ty != featurePolygon || bd.tags["building"] != "yes" {
+		t.Errorf("building: %+v", bd)
+	}
+	if len(bd.parts) != 1 || len(bd.parts[0]) != 4 || bd.close != 1 {
+		t.Fatalf("building geometry: %v", bd.parts)
+	}
+	if ringArea(bd.parts[0]) <= 0 {
+		t.Errorf("exterior ring %v not clockwise", bd.parts[0])
+	}
+
+	if data, err := enc.EncodeBlock(elements.MakeExtendedBlock(0, bl[2:3], geometrytest.TileQt(t, 0, 0, 1), 0, 0, nil)); err != nil || data != nil {
+		t.Errorf("expected empty tile, got %v %v", data, err)
+	}
+}
+
+func blockIds(t *testing.T, bl elements.ExtendedBlock) []elements.Ref {
+	res := []elements.Ref{}
+	for i := 0; i < bl.Len(); i++ {
+		res = append(res, bl.Element(i).Id())
+	}
+	return res
+}
+
+func TestGatherTiles(t *testing.T) {
+	// blocks in quadtree order, each with a single element whose id is
+	// the block's position
+	qts := []quadtree.Quadtree{
+		0,
+		geometrytest.TileQt(t, 0, 0, 1),
+		geometrytest.TileQt(t, 0, 0, 2),
+		geometrytest.TileQt(t, 1, 0, 3),
+		geometrytest.TileQt(t, 1, 1, 2),
+		geometrytest.TileQt(t, 2, 2, 2),
+		geometrytest.TileQt(t, 3, 3, 1),
+		geometrytest.TileQt(t, 7, 7, 3),
+	}
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		for i, qt := range qts {
+			e := elements.MakeNode(elements.Ref(i), nil, nil, 0, 0, qt, elements.Normal)
+			inc <- elements.MakeExtendedBlock(i, elements.ByElementId{e}, qt, 0, 0, nil)
+		}
+		close(inc)
+	}()
+
+	expected := []struct {
+		qt  quadtree.Quadtree
+		ids []elements.Ref
+	}{
+		{geometrytest.TileQt(t, 0, 0, 2), []elements.Ref{0, 1, 2, 3}},
+		{geometrytest.TileQt(t, 1, 1, 2), []elements.Ref{0, 1, 4}},
+		{geometrytest.TileQt(t, 2, 2, 2), []elements.Ref{0, 5}},
+		{geometrytest.TileQt(t, 3, 3, 2), []elements.Ref{0, 6, 7}},
+	}
+	i := 0
+	for bl := range GatherTiles(inc, 2) {
+		ids := blockIds(t, bl)
+		if i >= len(expected) {
+			t.Errorf("unexpected tile %s: %v", bl.Quadtree(), ids)
+			continue
+		}
+		ex := expected[i]
+		same := len(ids) == len(ex.ids)
+		for j := 0; same && j < len(ids); j++ {
+			same = ids[j] == ex.ids[j]
+		}
+		if bl.Quadtree() != ex.qt || !same {
+			t.Errorf("tile %d: %s %v, expected %s %v", i, bl.Quadtree(), ids, ex.qt, ex.ids)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("found %d tiles, expected %d", i, len(expected))
+	}
+}
+
+func TestEncodeTilesError(t *testing.T) {
+	enc, err := MakeEncoder([]Layer{{Name: "all"}}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub"}, []float64{-10, 10})
+	bad := elements.MakeGeometry(2, nil, elements.MakeTags(nil, nil), []byte{0xff}, 0, elements.Normal)
+
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		for i, e := range []elements.Element{good, bad, good} {
+			inc <- elements.MakeExtendedBlock(i, elements.ByElementId{e}, geometrytest.TileQt(t, 0, 0, 1), 0, 0, nil)
+		}
+		close(inc)
+	}()
+	tiles, wait := EncodeTiles(inc, enc)
+	nt := 0
+	for range tiles {
+		nt++
+	}
+	if err := wait(); err == nil || nt != 1 {
+		t.Errorf("returned %d tiles and error %v, expected 1 tile and an error", nt, err)
+	}
+}
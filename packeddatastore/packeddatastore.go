@@ -11,6 +11,7 @@ import (
 	"github.com/jharris2268/osmquadtree/elements"
 	"github.com/jharris2268/osmquadtree/geometry"
 	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
 	"github.com/jharris2268/osmquadtree/sqlselect"
 	"github.com/jharris2268/osmquadtree/utils"
 
@@ -37,7 +38,29 @@ type PackedDataStore interface {
 	ByKey(q quadtree.Quadtree) elements.Block
 }
 
+// MakePackedDataStore returns a PackedDataStore, where qtalloc returns
+// quadtree values calculated with quadtree.DefaultParams. Use
+// MakePackedDataStoreFile when qtalloc returns the quadtrees of the elements
+// of an input file.
 func MakePackedDataStore(commonstrs []string, qtalloc func(e elements.FullElement) quadtree.Quadtree, bs BlockStore) PackedDataStore {
+	return MakePackedDataStoreParams(commonstrs, qtalloc, bs, quadtree.DefaultParams)
+}
+
+// MakePackedDataStoreFile is MakePackedDataStore, where qtalloc returns
+// quadtree values calculated with the quadtree.Params recorded in the
+// header of infn
+func MakePackedDataStoreFile(commonstrs []string, qtalloc func(e elements.FullElement) quadtree.Quadtree, bs BlockStore, infn string) (PackedDataStore, error) {
+	params, err := readfile.GetQuadtreeParams(infn)
+	if err != nil {
+		return nil, err
+	}
+	return MakePackedDataStoreParams(commonstrs, qtalloc, bs, params), nil
+}
+
+// MakePackedDataStoreParams is MakePackedDataStore, where qtalloc returns
+// quadtree values calculated with params (overriding those of the input
+// file)
+func MakePackedDataStoreParams(commonstrs []string, qtalloc func(e elements.FullElement) quadtree.Quadtree, bs BlockStore, params quadtree.Params) PackedDataStore {
 	if len(commonstrs) > 300000 {
 		panic("too many strings")
 	}
@@ -55,6 +78,7 @@ func MakePackedDataStore(commonstrs []string, qtalloc func(e elements.FullElemen
 		map[quadtree.Quadtree][]objRow{},
 		map[quadtree.Quadtree][]objRow{},
 		qtalloc,
+		params,
 	}
 }
 
@@ -66,6 +90,7 @@ type packedDataStoreImpl struct {
 	line       map[quadtree.Quadtree][]objRow
 	polygon    map[quadtree.Quadtree][]objRow
 	qtalloc    func(e elements.FullElement) quadtree.Quadtree
+	params     quadtree.Params
 }
 
 /*blockstore... */
@@ -247,7 +272,7 @@ func (pdsi *packedDataStoreImpl) AddBlock(bl elements.ExtendedBlock) {
 		switch gt {
 		case geometry.Point:
 			pdsi.point[k] = append(pdsi.point[k], or)
-		case geometry.Linestring:
+		case geometry.Linestring, geometry.MultiLinestring:
 			pdsi.line[k] = append(pdsi.line[k], or)
 		case geometry.Polygon, geometry.Multi:
 			pdsi.polygon[k] = append(pdsi.polygon[k], or)
@@ -400,7 +425,7 @@ func (pdsi *packedDataStoreImpl) Filter(bb quadtree.Bbox, gt geometry.GeometryTy
 	}
 
 	for k, v := range objs {
-		if !k.Bounds(0.05).Intersects(bb) {
+		if !pdsi.params.Bounds(k).Intersects(bb) {
 			continue
 		}
 		for _, o := range v {
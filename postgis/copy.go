@@ -0,0 +1,372 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package postgis
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// jsonText is the value of a jsonb column
+type jsonText string
+
+// otherTags are the tags not given a column, written as hstore or jsonb
+type otherTags struct {
+	keys []string
+	vals []interface{}
+}
+
+func (ot *otherTags) add(k string, v interface{}) {
+	ot.keys = append(ot.keys, k)
+	ot.vals = append(ot.vals, v)
+}
+
+func (ot *otherTags) asJson() jsonText {
+	mm := make(map[string]interface{}, len(ot.keys))
+	for i, k := range ot.keys {
+		mm[k] = ot.vals[i]
+	}
+	js, _ := json.Marshal(mm)
+	return jsonText(js)
+}
+
+func hstoreQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// asHstore returns the hstore text representation of ot
+func (ot *otherTags) asHstore() string {
+	pp := make([]string, len(ot.keys))
+	for i, k := range ot.keys {
+		if ot.vals[i] == nil {
+			pp[i] = hstoreQuote(k) + "=>NULL"
+		} else {
+			pp[i] = hstoreQuote(k) + "=>" + hstoreQuote(textValue(ot.vals[i]))
+		}
+	}
+	return strings.Join(pp, ", ")
+}
+
+func textValue(v interface{}) string {
+	s, _ := geometry.Column{Type: geometry.TextColumn}.Value(v).(string)
+	return s
+}
+
+// makeOtherTags returns the tags of g without a column in cols. If g has
+// an other_tags tag containing a json object, its contents are included.
+func makeOtherTags(tags elements.Tags, cols map[string]bool) *otherTags {
+	ot := &otherTags{}
+	for i := 0; i < tags.Len(); i++ {
+		k, v := geometry.TagValue(tags, i)
+		if k == "" || cols[k] {
+			continue
+		}
+		if k == "other_tags" {
+			mm := map[string]interface{}{}
+			if s, ok := v.(string); ok && json.Unmarshal([]byte(s), &mm) == nil {
+				for mk, mv := range mm {
+					if !cols[mk] {
+						ot.add(mk, mv)
+					}
+				}
+				continue
+			}
+		}
+		ot.add(k, v)
+	}
+	return ot
+}
+
+// rows returns the values for each row of g, in the order given by
+// table.columnDefs
+func (t table) rows(g geometry.Geometry, opts Options, cols []geometry.Column, colNames map[string]bool) ([][]interface{}, error) {
+	wp, ok := g.(geometry.AsWkbPostgis)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("can't write %s geometry", g.GeometryType()))
+	}
+	vals := []interface{}{int64(g.Id())}
+	for i, v := range geometry.ColumnValues(g.Tags(), cols) {
+		if s, ok := v.(string); ok && cols[i].Type == geometry.JsonColumn {
+			if !json.Valid([]byte(s)) {
+				js, _ := json.Marshal(s)
+				s = string(js)
+			}
+			v = jsonText(s)
+		}
+		vals = append(vals, v)
+	}
+	switch opts.OtherTags {
+	case "hstore":
+		vals = append(vals, makeOtherTags(g.Tags(), colNames))
+	case "jsonb":
+		vals = append(vals, makeOtherTags(g.Tags(), colNames).asJson())
+	}
+	if t.zorder {
+		var zo int32
+		if z, ok := g.(interface {
+			ZOrder() int64
+		}); ok {
+			zo = int32(z.ZOrder())
+		}
+		vals = append(vals, zo)
+	}
+	if t.area {
+		var ar float32
+		if a, ok := g.(interface {
+			Area() float64
+		}); ok {
+			ar = float32(a.Area())
+		}
+		vals = append(vals, ar)
+	}
+
+	parts := wp.AsWkbPostgis(opts.Merc)
+	res := make([][]interface{}, len(parts))
+	for i, p := range parts {
+		res[i] = append(append(make([]interface{}, 0, len(vals)+1), vals...), p)
+	}
+	return res, nil
+}
+
+var textEscapes = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// copyWriter writes rows in the text or binary COPY format
+type copyWriter struct {
+	w      *bufio.Writer
+	binary bool
+	buf    []byte
+}
+
+var binaryHeader = []byte("PGCOPY\n\377\r\n\000\000\000\000\000\000\000\000\000")
+
+func (cw *copyWriter) header() {
+	if cw.binary {
+		cw.w.Write(binaryHeader)
+	}
+}
+
+func (cw *copyWriter) trailer() {
+	if cw.binary {
+		cw.w.Write([]byte{0xff, 0xff})
+	}
+}
+
+func (cw *copyWriter) textRow(vals []interface{}) {
+	for i, v := range vals {
+		if i > 0 {
+			cw.w.WriteByte('\t')
+		}
+		switch vv := v.(type) {
+		case nil:
+			cw.w.WriteString(`\N`)
+		case int32:
+			cw.w.WriteString(strconv.FormatInt(int64(vv), 10))
+		case int64:
+			cw.w.WriteString(strconv.FormatInt(vv, 10))
+		case float32:
+			cw.w.WriteString(strconv.FormatFloat(float64(vv), 'g', -1, 32))
+		case float64:
+			cw.w.WriteString(strconv.FormatFloat(vv, 'g', -1, 64))
+		case string:
+			textEscapes.WriteString(cw.w, vv)
+		case jsonText:
+			textEscapes.WriteString(cw.w, string(vv))
+		case *otherTags:
+			textEscapes.WriteString(cw.w, vv.asHstore())
+		case []byte:
+			cw.w.WriteString(hex.EncodeToString(vv))
+		}
+	}
+	cw.w.WriteByte('\n')
+}
+
+func (cw *copyWriter) uint32(v uint32) {
+	binary.BigEndian.PutUint32(cw.buf, v)
+	cw.w.Write(cw.buf[:4])
+}
+
+func (cw *copyWriter) uint64(v uint64) {
+	binary.BigEndian.PutUint64(cw.buf, v)
+	cw.w.Write(cw.buf[:8])
+}
+
+func (cw *copyWriter) data(d []byte) {
+	cw.uint32(uint32(len(d)))
+	cw.w.Write(d)
+}
+
+// hstoreBinary returns ot in the format of hstore_send
+func (ot *otherTags) hstoreBinary() []byte {
+	res := make([]byte, 4, 64)
+	binary.BigEndian.PutUint32(res, uint32(len(ot.keys)))
+	add := func(s string, null bool) {
+		l := len(res)
+		res = append(res, 0, 0, 0, 0)
+		if null {
+			binary.BigEndian.PutUint32(res[l:], math.MaxUint32)
+			return
+		}
+		binary.BigEndian.PutUint32(res[l:], uint32(len(s)))
+		res = append(res, s...)
+	}
+	for i, k := range ot.keys {
+		add(k, false)
+		add(textValue(ot.vals[i]), ot.vals[i] == nil)
+	}
+	return res
+}
+
+func (cw *copyWriter) binaryRow(vals []interface{}) {
+	binary.BigEndian.PutUint16(cw.buf, uint16(len(vals)))
+	cw.w.Write(cw.buf[:2])
+	for _, v := range vals {
+		switch vv := v.(type) {
+		case nil:
+			cw.uint32(math.MaxUint32)
+		case int32:
+			cw.uint32(4)
+			cw.uint32(uint32(vv))
+		case int64:
+			cw.uint32(8)
+			cw.uint64(uint64(vv))
+		case float32:
+			cw.uint32(4)
+			cw.uint32(math.Float32bits(vv))
+		case float64:
+			cw.uint32(8)
+			cw.uint64(math.Float64bits(vv))
+		case string:
+			cw.data([]byte(vv))
+		case jsonText:
+			// jsonb version 1
+			cw.data(append([]byte{1}, vv...))
+		case *otherTags:
+			cw.data(vv.hstoreBinary())
+		case []byte:
+			cw.data(vv)
+		}
+	}
+}
+
+func (cw *copyWriter) row(vals []interface{}) {
+	if cw.binary {
+		cw.binaryRow(vals)
+	} else {
+		cw.textRow(vals)
+	}
+}
+
+func (opts Options) copyFile(t table) string {
+	if opts.Binary {
+		return t.name(opts) + ".bin"
+	}
+	return t.name(opts) + ".copy"
+}
+
+// LoadScript returns a psql script which creates the tables, loads the
+// files written by WriteCopy (run from the same directory) and creates the
+// indexes.
+func LoadScript(opts Options) (string, error) {
+	res, err := CreateTables(opts)
+	if err != nil {
+		return "", err
+	}
+	res += "\n"
+	for _, t := range tables {
+		f := ""
+		if opts.Binary {
+			f = " (FORMAT binary)"
+		}
+		res += fmt.Sprintf("\\copy %s FROM '%s'%s\n", quoteIdent(t.name(opts)), opts.copyFile(t), f)
+	}
+	return res + "\n" + CreateIndexes(opts), nil
+}
+
+// WriteCopy writes the Geometry elements of inc to files in outdir, one
+// for each table (Prefix_point.copy etc, or .bin if opts.Binary), along
+// with load.sql (see LoadScript). Returns the number of rows written.
+func WriteCopy(inc <-chan elements.ExtendedBlock, outdir string, opts Options) (int, error) {
+	script, err := LoadScript(opts)
+	if err != nil {
+		return 0, err
+	}
+	err = ioutil.WriteFile(filepath.Join(outdir, "load.sql"), []byte(script), 0664)
+	if err != nil {
+		return 0, err
+	}
+
+	cols := opts.columns()
+	colNames := map[string]bool{}
+	for _, c := range cols {
+		colNames[c.Name] = true
+	}
+
+	writers := make([]*copyWriter, len(tables))
+	counts := make([]int, len(tables))
+	for i, t := range tables {
+		fl, err := os.OpenFile(filepath.Join(outdir, opts.copyFile(t)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+		if err != nil {
+			return 0, err
+		}
+		defer fl.Close()
+		writers[i] = &copyWriter{bufio.NewWriter(fl), opts.Binary, make([]byte, 8)}
+		writers[i].header()
+	}
+
+	nr := 0
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if e.Type() != elements.Geometry {
+				continue
+			}
+			g, err := geometry.ExtractGeometry(e)
+			if err != nil {
+				return nr, err
+			}
+			ti, ok := tableFor(g.GeometryType())
+			if !ok {
+				continue
+			}
+			rows, err := tables[ti].rows(g, opts, cols, colNames)
+			if err != nil {
+				return nr, err
+			}
+			for _, r := range rows {
+				writers[ti].row(r)
+			}
+			counts[ti] += len(rows)
+			nr += len(rows)
+		}
+		if (bl.Idx() % 100) == 0 {
+			log.Printf("%-6d: %d points, %d lines, %d polygons\n", bl.Idx(), counts[0], counts[1], counts[2])
+		}
+	}
+
+	for _, cw := range writers {
+		cw.trailer()
+		err = cw.w.Flush()
+		if err != nil {
+			return nr, err
+		}
+	}
+	log.Printf("%s: %d points, %d lines, %d polygons\n", outdir, counts[0], counts[1], counts[2])
+	return nr, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package postgis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+func testOtherTags() *otherTags {
+	ot := &otherTags{}
+	ot.add("name", `The "Bell"`)
+	ot.add(`a\b`, int64(3))
+	ot.add("note", nil)
+	return ot
+}
+
+func TestHstore(t *testing.T) {
+	ot := testOtherTags()
+	if h := ot.asHstore(); h != `"name"=>"The \"Bell\"", "a\\b"=>"3", "note"=>NULL` {
+		t.Errorf("hstore %s", h)
+	}
+	expected := []byte{0, 0, 0, 3,
+		0, 0, 0, 4, 'n', 'a', 'm', 'e', 0, 0, 0, 10, 'T', 'h', 'e', ' ', '"', 'B', 'e', 'l', 'l', '"',
+		0, 0, 0, 3, 'a', '\\', 'b', 0, 0, 0, 1, '3',
+		0, 0, 0, 4, 'n', 'o', 't', 'e', 0xff, 0xff, 0xff, 0xff}
+	if hb := ot.hstoreBinary(); !bytes.Equal(hb, expected) {
+		t.Errorf("hstore binary %v, expected %v", hb, expected)
+	}
+	if js := ot.asJson(); js != `{"a\\b":3,"name":"The \"Bell\"","note":null}` {
+		t.Errorf("json %s", js)
+	}
+}
+
+func testRow() []interface{} {
+	return []interface{}{int64(-12), "tab\there\nand \\", nil, int32(7), float32(1.5), float64(0.1),
+		jsonText(`{"a":"b\tc"}`), testOtherTags(), []byte{1, 0xab}}
+}
+
+func TestTextRow(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &copyWriter{bufio.NewWriter(&buf), false, make([]byte, 8)}
+	cw.header()
+	cw.row(testRow())
+	cw.trailer()
+	cw.w.Flush()
+	// backslashes in the json and hstore text are escaped
+	expected := `-12	tab\there\nand \\	\N	7	1.5	0.1	{"a":"b\\tc"}	"name"=>"The \\"Bell\\"", "a\\\\b"=>"3", "note"=>NULL	01ab` + "\n"
+	if buf.String() != expected {
+		t.Errorf("text row\n%q, expected\n%q", buf.String(), expected)
+	}
+}
+
+func TestBinaryRow(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &copyWriter{bufio.NewWriter(&buf), true, make([]byte, 8)}
+	cw.header()
+	cw.row(testRow())
+	cw.trailer()
+	cw.w.Flush()
+
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, binaryHeader) || len(binaryHeader) != 19 {
+		t.Fatalf("binary header %q", data[:19])
+	}
+	if !bytes.HasSuffix(data, []byte{0xff, 0xff}) {
+		t.Errorf("no trailer")
+	}
+	data = data[19 : len(data)-2]
+	if nf := binary.BigEndian.Uint16(data); nf != 9 {
+		t.Fatalf("%d fields", nf)
+	}
+	fields := [][]byte{}
+	for p := 2; p < len(data); {
+		l := binary.BigEndian.Uint32(data[p:])
+		p += 4
+		if l == math.MaxUint32 {
+			fields = append(fields, nil)
+			continue
+		}
+		fields = append(fields, data[p:p+int(l)])
+		p += int(l)
+	}
+	if len(fields) != 9 {
+		t.Fatalf("read %d fields", len(fields))
+	}
+	if v := int64(binary.BigEndian.Uint64(fields[0])); v != -12 {
+		t.Errorf("int64 %d", v)
+	}
+	if string(fields[1]) != "tab\there\nand \\" || fields[2] != nil {
+		t.Errorf("text %q, null %v", fields[1], fields[2])
+	}
+	if v := int32(binary.BigEndian.Uint32(fields[3])); v != 7 {
+		t.Errorf("int32 %d", v)
+	}
+	if v := math.Float32frombits(binary.BigEndian.Uint32(fields[4])); v != 1.5 {
+		t.Errorf("float32 %g", v)
+	}
+	if v := math.Float64frombits(binary.BigEndian.Uint64(fields[5])); v != 0.1 {
+		t.Errorf("float64 %g", v)
+	}
+	if string(fields[6]) != "\x01"+`{"a":"b\tc"}` {
+		t.Errorf("jsonb %q", fields[6])
+	}
+	if !bytes.Equal(fields[7], testOtherTags().hstoreBinary()) || !bytes.Equal(fields[8], []byte{1, 0xab}) {
+		t.Errorf("hstore %v, bytea %v", fields[7], fields[8])
+	}
+}
+
+func TestWriteCopy(t *testing.T) {
+	bl := elements.ByElementId{
+		geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub", "name", "Bell", "!lanes", "\x04"}, []float64{1, 2}),
+		geometrytest.Element(t, 2, geometry.Multi, []string{"building", "yes", "other_tags", `{"height":"10"}`}, []float64{0, 0, 0, 1, 1, 1, 0, 0}, []float64{5, 5, 5, 6, 6, 6, 5, 5}),
+	}
+	opts := Options{Prefix: "osm", OtherTags: "hstore", Columns: []geometry.Column{
+		{Name: "amenity", Type: geometry.TextColumn}, {Name: "building", Type: geometry.TextColumn},
+		{Name: "lanes", Type: geometry.IntegerColumn}, {Name: "other_tags", Type: geometry.JsonColumn}}}
+
+	for _, bin := range []bool{false, true} {
+		opts.Binary = bin
+		dir := t.TempDir()
+		inc := make(chan elements.ExtendedBlock, 1)
+		inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+		close(inc)
+		nr, err := WriteCopy(inc, dir, opts)
+		if err != nil || nr != 3 {
+			t.Fatalf("binary %v: wrote %d rows: %v", bin, nr, err)
+		}
+		script, err := ioutil.ReadFile(filepath.Join(dir, "load.sql"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext := ".copy"
+		if bin {
+			ext = ".bin"
+		}
+		if !strings.Contains(string(script), `\copy "osm_polygon" FROM 'osm_polygon`+ext+`'`) {
+			t.Errorf("load script %s", script)
+		}
+		for _, tn := range []string{"osm_point", "osm_line", "osm_polygon"} {
+			data, err := ioutil.ReadFile(filepath.Join(dir, tn+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bin {
+				if !bytes.HasPrefix(data, binaryHeader) || !bytes.HasSuffix(data, []byte{0xff, 0xff}) {
+					t.Errorf("%s: missing header or trailer", tn)
+				}
+				continue
+			}
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			switch tn {
+			case "osm_point":
+				ff := strings.Split(lines[0], "\t")
+				if len(lines) != 1 || len(ff) != 6 || strings.Join(ff[:5], "|") != `1|pub|\N|2|"name"=>"Bell"` {
+					t.Errorf("point rows %q", lines)
+				}
+				if _, err := hex.DecodeString(ff[5]); err != nil {
+					t.Errorf("point geometry %s: %s", ff[5], err)
+				}
+			case "osm_line":
+				if len(data) != 0 {
+					t.Errorf("line rows %q", data)
+				}
+			case "osm_polygon":
+				// a row for each part of the multipolygon, with the
+				// other_tags contents in the hstore column
+				if len(lines) != 2 || !strings.HasPrefix(lines[0], "2\t\\N\tyes\t\\N\t\"height\"=>\"10\"\t") ||
+					!strings.HasPrefix(lines[1], "2\t\\N\tyes\t\\N\t\"height\"=>\"10\"\t") {
+					t.Errorf("polygon rows %q", lines)
+				}
+			}
+		}
+	}
+}
+
+func TestCreateTables(t *testing.T) {
+	opts := Options{Prefix: "planet", Merc: true, OtherTags: "jsonb",
+		Columns: []geometry.Column{{Name: "addr:street", Type: geometry.TextColumn}, {Name: "other_tags", Type: geometry.JsonColumn}}}
+	defs := strings.Join(tables[2].columnDefs(opts), ", ")
+	if defs != `osm_id bigint, "addr:street" text, other_tags jsonb, z_order int4, way_area real, way geometry(Polygon, 900913)` {
+		t.Errorf("polygon columns %s", defs)
+	}
+	if _, err := CreateTables(Options{OtherTags: "json"}); err == nil {
+		t.Errorf("expected error for other_tags json")
+	}
+}
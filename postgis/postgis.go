@@ -0,0 +1,161 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package postgis writes geometries as PostgreSQL COPY data, for loading
+// into osm2pgsql style point, line and polygon tables, along with the
+// statements to create the tables and their indexes.
+package postgis
+
+import (
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Options describe the tables written. Columns are the tag columns (see
+// geometry.StyleColumns). If OtherTags is hstore or jsonb, the remaining
+// tags (including any other_tags tag made by geometry.MakeGeometries) are
+// written to an other_tags column of that type, otherwise they are
+// dropped. If Merc is set the geometries are in spherical mercator (srid
+// 900913, as given by geometry.AsWkbPostgis), otherwise longitude and
+// latitude (srid 4326). Binary selects the binary COPY format.
+type Options struct {
+	Prefix    string
+	Columns   []geometry.Column
+	OtherTags string
+	Merc      bool
+	Binary    bool
+}
+
+func (opts Options) srid() int {
+	if opts.Merc {
+		return 900913
+	}
+	return 4326
+}
+
+// columns returns the tag columns, leaving out other_tags if it is
+// written separately
+func (opts Options) columns() []geometry.Column {
+	if opts.OtherTags == "" {
+		return opts.Columns
+	}
+	res := make([]geometry.Column, 0, len(opts.Columns))
+	for _, c := range opts.Columns {
+		if c.Name != "other_tags" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func (opts Options) check() error {
+	switch opts.OtherTags {
+	case "", "hstore", "jsonb":
+		return nil
+	}
+	return errors.New(fmt.Sprintf("OtherTags must be hstore or jsonb, not %q", opts.OtherTags))
+}
+
+// table is one of the point, line and polygon tables. Multi geometries are
+// written as a row for each part (see geometry.AsWkbPostgis), so each
+// table has a single geometry type.
+type table struct {
+	suffix   string
+	geomType string
+	zorder   bool
+	area     bool
+}
+
+var tables = []table{
+	{"point", "Point", false, false},
+	{"line", "LineString", true, false},
+	{"polygon", "Polygon", true, true},
+}
+
+func tableFor(gt geometry.GeometryType) (int, bool) {
+	switch gt {
+	case geometry.Point:
+		return 0, true
+	case geometry.Linestring, geometry.MultiLinestring:
+		return 1, true
+	case geometry.Polygon, geometry.Multi:
+		return 2, true
+	}
+	return -1, false
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func (t table) name(opts Options) string {
+	return opts.Prefix + "_" + t.suffix
+}
+
+func sqlType(ct geometry.ColumnType) string {
+	switch ct {
+	case geometry.IntegerColumn:
+		return "bigint"
+	case geometry.FloatColumn:
+		return "float8"
+	case geometry.JsonColumn:
+		return "jsonb"
+	}
+	return "text"
+}
+
+// columnDefs returns the columns of t, in the order of each row written
+func (t table) columnDefs(opts Options) []string {
+	res := []string{"osm_id bigint"}
+	for _, c := range opts.columns() {
+		res = append(res, quoteIdent(c.Name)+" "+sqlType(c.Type))
+	}
+	if opts.OtherTags != "" {
+		res = append(res, "other_tags "+opts.OtherTags)
+	}
+	if t.zorder {
+		res = append(res, "z_order int4")
+	}
+	if t.area {
+		res = append(res, "way_area real")
+	}
+	return append(res, fmt.Sprintf("way geometry(%s, %d)", t.geomType, opts.srid()))
+}
+
+// CreateTables returns the SQL statements to (re)create the point, line
+// and polygon tables, named Prefix_point etc, matching the data written
+// by WriteCopy.
+func CreateTables(opts Options) (string, error) {
+	if err := opts.check(); err != nil {
+		return "", err
+	}
+	res := []string{"CREATE EXTENSION IF NOT EXISTS postgis;\n"}
+	if opts.OtherTags == "hstore" {
+		res = append(res, "CREATE EXTENSION IF NOT EXISTS hstore;\n")
+	}
+	for _, t := range tables {
+		n := quoteIdent(t.name(opts))
+		res = append(res, fmt.Sprintf("DROP TABLE IF EXISTS %s;\nCREATE TABLE %s (\n    %s\n);\n",
+			n, n, strings.Join(t.columnDefs(opts), ",\n    ")))
+	}
+	return strings.Join(res, "\n"), nil
+}
+
+// CreateIndexes returns the SQL statements to add a spatial index and an
+// osm_id index to each table, to be run after the data is loaded.
+func CreateIndexes(opts Options) string {
+	res := []string{}
+	for _, t := range tables {
+		n := t.name(opts)
+		res = append(res,
+			fmt.Sprintf("CREATE INDEX %s ON %s USING GIST (way);", quoteIdent(n+"_way_idx"), quoteIdent(n)),
+			fmt.Sprintf("CREATE INDEX %s ON %s (osm_id);", quoteIdent(n+"_osm_id_idx"), quoteIdent(n)),
+			fmt.Sprintf("ANALYZE %s;", quoteIdent(n)))
+	}
+	return strings.Join(res, "\n") + "\n"
+}
@@ -77,7 +77,7 @@ func (bbox Bbox) Contains(other Bbox) bool {
 	if bbox.Minx > other.Minx {
 		return false
 	}
-	if bbox.Miny > other.Minx {
+	if bbox.Miny > other.Miny {
 		return false
 	}
 	if bbox.Maxx < other.Maxx {
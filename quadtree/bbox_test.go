@@ -0,0 +1,44 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package quadtree
+
+import (
+	"testing"
+)
+
+func TestBboxContains(t *testing.T) {
+	bx := Bbox{0, 500, 1000, 1500}
+	tests := []struct {
+		other    Bbox
+		expected bool
+	}{
+		{Bbox{100, 600, 900, 1400}, true},
+		{Bbox{0, 500, 1000, 1500}, true},
+		{Bbox{-100, 600, 900, 1400}, false},
+		{Bbox{100, 400, 900, 1400}, false},
+		{Bbox{100, 600, 1100, 1400}, false},
+		{Bbox{100, 600, 900, 1600}, false},
+		// Miny below bbox, but Minx within it
+		{Bbox{600, 100, 900, 1400}, false},
+		// Miny within bbox, but less than bbox.Minx
+		{Bbox{100, 550, 900, 1400}, true},
+	}
+	for _, tt := range tests {
+		if got := bx.Contains(tt.other); got != tt.expected {
+			t.Errorf("%s.Contains(%s) = %v, expected %v", bx, tt.other, got, tt.expected)
+		}
+	}
+}
+
+func TestBboxIntersects(t *testing.T) {
+	bx := Bbox{0, 0, 1000, 1000}
+	if !bx.Intersects(Bbox{900, 900, 1100, 1100}) {
+		t.Errorf("expected overlapping boxes to intersect")
+	}
+	if bx.Intersects(Bbox{1100, 0, 1200, 1000}) {
+		t.Errorf("expected separate boxes not to intersect")
+	}
+}
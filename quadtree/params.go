@@ -0,0 +1,56 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package quadtree
+
+import (
+	"fmt"
+)
+
+//Params are the values used to calculate the quadtree of each object in a
+//file. Buffer allows objects which extend a little beyond a tile (as a
+//fraction of the tile size) to be placed in that tile, and MaxLevel is the
+//greatest depth of tile used. Anything which tests if an object may be
+//found in a tile (e.g. with Bounds) must use the same Buffer as was used to
+//calculate the quadtrees: the values used are stored in the file header
+//(see read.HeaderBlock).
+type Params struct {
+	Buffer   float64
+	MaxLevel uint
+}
+
+//DefaultParams are used for files which don't record their own Params.
+var DefaultParams = Params{0.05, 18}
+
+//Check returns an error if Buffer is not between zero and one, or MaxLevel
+//is greater than 28 (the most that can be stored in a Quadtree).
+func (p Params) Check() error {
+	if p.Buffer < 0 || p.Buffer >= 1 {
+		return fmt.Errorf("quadtree buffer must be between 0 and 1, not %f", p.Buffer)
+	}
+	if p.MaxLevel > 28 {
+		return fmt.Errorf("quadtree max level must be at most 28, not %d", p.MaxLevel)
+	}
+	return nil
+}
+
+//Calculate returns the quadtree for box, using Buffer and MaxLevel
+func (p Params) Calculate(box Bbox) (Quadtree, error) {
+	return Calculate(box, p.Buffer, p.MaxLevel)
+}
+
+//CalculatePoint returns the quadtree for a single point
+func (p Params) CalculatePoint(x, y int64) (Quadtree, error) {
+	return Calculate(Bbox{x, y, x + 1, y + 1}, p.Buffer, p.MaxLevel)
+}
+
+//Bounds returns the area which may contain objects in tile qt
+func (p Params) Bounds(qt Quadtree) Bbox {
+	return qt.Bounds(p.Buffer)
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("buffer=%g maxlevel=%d", p.Buffer, p.MaxLevel)
+}
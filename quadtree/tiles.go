@@ -0,0 +1,41 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package quadtree
+
+//Tiles returns the quadtree tiles at level which overlap box
+func Tiles(box Bbox, level uint) []Quadtree {
+	if box.Minx > box.Maxx || box.Miny > box.Maxy {
+		return nil
+	}
+	n := int64(1) << level
+	tx := func(x int64) int64 {
+		return clampTile(int64((ToFloat(x)+180.0)/360.0*float64(n)), n)
+	}
+	ty := func(y int64) int64 {
+		return clampTile(int64((90.0-merc(ToFloat(y)))/180.0*float64(n)), n)
+	}
+	mx, Mx := tx(box.Minx), tx(box.Maxx)
+	my, My := ty(box.Maxy), ty(box.Miny)
+
+	res := make([]Quadtree, 0, (Mx-mx+1)*(My-my+1))
+	for x := mx; x <= Mx; x++ {
+		for y := my; y <= My; y++ {
+			q, _ := FromTuple(x, y, int64(level))
+			res = append(res, q)
+		}
+	}
+	return res
+}
+
+func clampTile(v, n int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	if v >= n {
+		return n - 1
+	}
+	return v
+}
@@ -76,6 +76,10 @@ type HeaderBlock struct {
 	Features  map[string][]string //The required_features, optional_features, and writing_program fields
 	Index     BlockIdx
 	Timestamp elements.Timestamp
+
+	// QuadtreeParams used to calculate the quadtree values of the file:
+	// quadtree.DefaultParams if not recorded
+	QuadtreeParams quadtree.Params
 }
 
 func (hi *HeaderBlock) String() string {
@@ -100,7 +104,7 @@ func (hi *HeaderBlock) String() string {
 		}
 	}
 
-	ans := fmt.Sprintf("HeaderInfo: %s %s %s", bs, as, fs)
+	ans := fmt.Sprintf("HeaderInfo: %s %s %s [%s]", bs, as, fs, hi.QuadtreeParams)
 	return ans
 }
 
@@ -126,6 +130,21 @@ func readBlockIdx(indata []byte) (*blockIdx, error) {
 	return ans, nil
 }
 
+func readQuadtreeParams(indata []byte) (quadtree.Params, error) {
+	ans := quadtree.DefaultParams
+	a, msg := utils.ReadPbfTag(indata, 0)
+	for msg.Tag > 0 {
+		switch msg.Tag {
+		case 1:
+			ans.Buffer = float64(msg.Value) / 1000000
+		case 2:
+			ans.MaxLevel = uint(msg.Value)
+		}
+		a, msg = utils.ReadPbfTag(indata, a)
+	}
+	return ans, ans.Check()
+}
+
 // ReadHeaderBlock returns a HeaderBlock from pbf message indata. filePos
 // is the file position after the HeaderBlock has been read: this allows
 // the BlockIdx to calculate file positions from the stored block lengths
@@ -133,6 +152,7 @@ func ReadHeaderBlock(indata []byte, filePos int64) (*HeaderBlock, error) {
 	a, msg := utils.ReadPbfTag(indata, 0)
 
 	ans := &HeaderBlock{}
+	ans.QuadtreeParams = quadtree.DefaultParams
 	var idx blockIdxSlice
 	for msg.Tag > 0 {
 		switch msg.Tag {
@@ -171,6 +191,12 @@ func ReadHeaderBlock(indata []byte, filePos int64) (*HeaderBlock, error) {
 				return nil, err
 			}
 			idx = append(idx, *ii)
+		case 23:
+			qp, err := readQuadtreeParams(msg.Data)
+			if err != nil {
+				return nil, err
+			}
+			ans.QuadtreeParams = qp
 		case 32:
 			ans.Timestamp = elements.Timestamp(msg.Value)
 		}
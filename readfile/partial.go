@@ -46,6 +46,17 @@ func GetHeaderBlock(fn string) (*os.File, *read.HeaderBlock, error) {
 	return fl, hb, nil
 }
 
+// GetQuadtreeParams returns the quadtree.Params recorded in the header of
+// file fn (quadtree.DefaultParams if not present)
+func GetQuadtreeParams(fn string) (quadtree.Params, error) {
+	fl, hb, err := GetHeaderBlock(fn)
+	if err != nil {
+		return quadtree.Params{}, err
+	}
+	fl.Close()
+	return hb.QuadtreeParams, nil
+}
+
 // MakeFileBlockChanSplitPartial reads the blocks at locations locs from
 // input file fn, returning as nc parallel channels
 func MakeFileBlockChanSplitPartial(fn string, nc int, locs []int64) ([]<-chan pbffile.FileBlock, error) {
@@ -0,0 +1,233 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package shapefile
+
+import (
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxFieldName = 10
+
+// ReadFieldNames reads a json file consisting of either an object giving
+// the dbf field name for each tag, or a style file object (see
+// geometry.ReadStyleFileZOrder) with the object as FieldNames.
+func ReadFieldNames(fn string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var sf struct {
+		FieldNames map[string]string
+	}
+	if json.Unmarshal(data, &sf) == nil && len(sf.FieldNames) > 0 {
+		return sf.FieldNames, nil
+	}
+	res := map[string]string{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func fieldNameChar(r rune) rune {
+	if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+		return r
+	}
+	return '_'
+}
+
+// fieldNames returns the dbf field name for osm_id and each of columns.
+// Names given by mapping are used as they are, others are truncated to
+// ten characters, with any characters other than letters, digits and _
+// replaced, and the end replaced by _1, _2 etc where they would clash
+// with another field (dbf field names are not case sensitive).
+func fieldNames(columns []geometry.Column, mapping map[string]string) ([]string, error) {
+	res := make([]string, len(columns)+1)
+	res[0] = "osm_id"
+	used := map[string]bool{"OSM_ID": true}
+	for i, c := range columns {
+		n, ok := mapping[c.Name]
+		if !ok {
+			continue
+		}
+		if n == "" || len(n) > maxFieldName || strings.Map(fieldNameChar, n) != n {
+			return nil, errors.New(fmt.Sprintf("invalid field name %q for %s", n, c.Name))
+		}
+		if used[strings.ToUpper(n)] {
+			return nil, errors.New(fmt.Sprintf("repeated field name %q", n))
+		}
+		used[strings.ToUpper(n)] = true
+		res[i+1] = n
+	}
+	for i, c := range columns {
+		if res[i+1] != "" {
+			continue
+		}
+		n := strings.Map(fieldNameChar, c.Name)
+		if len(n) > maxFieldName {
+			n = n[:maxFieldName]
+		}
+		for j := 1; used[strings.ToUpper(n)]; j++ {
+			s := fmt.Sprintf("_%d", j)
+			if len(n)+len(s) > maxFieldName {
+				n = n[:maxFieldName-len(s)]
+			}
+			n = strings.TrimRight(n, "_0123456789")
+			if n == "" {
+				n = "f"
+			}
+			n += s
+		}
+		used[strings.ToUpper(n)] = true
+		res[i+1] = n
+	}
+	return res, nil
+}
+
+// dbfField describes a dBase III field: C (text) or N (number)
+type dbfField struct {
+	name     string
+	typ      byte
+	length   int
+	decimals int
+}
+
+func makeFields(columns []geometry.Column, names []string) []dbfField {
+	res := make([]dbfField, len(names))
+	res[0] = dbfField{names[0], 'N', 20, 0}
+	for i, c := range columns {
+		switch c.Type {
+		case geometry.IntegerColumn:
+			res[i+1] = dbfField{names[i+1], 'N', 20, 0}
+		case geometry.FloatColumn:
+			res[i+1] = dbfField{names[i+1], 'N', 24, 15}
+		default:
+			res[i+1] = dbfField{names[i+1], 'C', 254, 0}
+		}
+	}
+	return res
+}
+
+// value appends v to rec, as given by geometry.Column.Value, padded to the
+// field length. Text longer than the field is truncated (at the start of
+// a utf8 character), and numbers which don't fit are left empty.
+func (f dbfField) value(rec []byte, v interface{}) []byte {
+	s := ""
+	switch vv := v.(type) {
+	case int64:
+		s = strconv.FormatInt(vv, 10)
+	case float64:
+		for d := f.decimals; d >= 0; d-- {
+			s = strconv.FormatFloat(vv, 'f', d, 64)
+			if len(s) <= f.length {
+				break
+			}
+		}
+	case string:
+		s = vv
+		if len(s) > f.length {
+			n := f.length
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+			s = s[:n]
+		}
+	}
+	if len(s) > f.length {
+		s = ""
+	}
+	pad := strings.Repeat(" ", f.length-len(s))
+	if f.typ == 'N' {
+		return append(append(rec, pad...), s...)
+	}
+	return append(append(rec, s...), pad...)
+}
+
+// dbfWriter writes a dBase III file, with the record count filled in by
+// close
+type dbfWriter struct {
+	file       *os.File
+	w          *bufio.Writer
+	fields     []dbfField
+	recordSize int
+	count      int
+	size       int64
+	rec        []byte
+}
+
+func (d *dbfWriter) header() []byte {
+	res := make([]byte, 32, 33+32*len(d.fields))
+	now := time.Now()
+	res[0] = 3
+	res[1], res[2], res[3] = byte(now.Year()-1900), byte(now.Month()), byte(now.Day())
+	binary.LittleEndian.PutUint32(res[4:], uint32(d.count))
+	binary.LittleEndian.PutUint16(res[8:], uint16(33+32*len(d.fields)))
+	binary.LittleEndian.PutUint16(res[10:], uint16(d.recordSize))
+	for _, f := range d.fields {
+		fd := make([]byte, 32)
+		copy(fd, f.name)
+		fd[11] = f.typ
+		fd[16], fd[17] = byte(f.length), byte(f.decimals)
+		res = append(res, fd...)
+	}
+	return append(res, 0x0d)
+}
+
+func createDbf(fn string, fields []dbfField) (*dbfWriter, error) {
+	if len(fields) > 255 {
+		return nil, errors.New(fmt.Sprintf("too many fields (%d)", len(fields)))
+	}
+	fl, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return nil, err
+	}
+	d := &dbfWriter{file: fl, w: bufio.NewWriter(fl), fields: fields, recordSize: 1}
+	for _, f := range fields {
+		d.recordSize += f.length
+	}
+	d.rec = make([]byte, 0, d.recordSize)
+	h := d.header()
+	d.w.Write(h)
+	d.size = int64(len(h))
+	return d, nil
+}
+
+func (d *dbfWriter) write(vals []interface{}) error {
+	d.rec = append(d.rec[:0], ' ')
+	for i, f := range d.fields {
+		d.rec = f.value(d.rec, vals[i])
+	}
+	_, err := d.w.Write(d.rec)
+	d.count++
+	d.size += int64(len(d.rec))
+	return err
+}
+
+// close writes the end of file marker and the final header
+func (d *dbfWriter) close() error {
+	d.w.WriteByte(0x1a)
+	err := d.w.Flush()
+	if err == nil {
+		_, err = d.file.WriteAt(d.header(), 0)
+	}
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
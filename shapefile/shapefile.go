@@ -0,0 +1,188 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package shapefile writes geometries to ESRI Shapefiles, with a set of
+// .shp, .shx, .dbf, .prj and .cpg files for each of points, lines and
+// polygons.
+package shapefile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// DefaultMaxSize is the largest .shp or .dbf file written: many programs
+// can't read files of 2gb or more.
+const DefaultMaxSize = 1<<31 - 1
+
+const prj = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// Options describe the shapefiles written. Columns are the tag columns
+// (see geometry.StyleColumns). FieldNames gives the dbf field name for
+// tags which don't make valid field names (up to ten letters, digits or
+// _): other tags are truncated (see ReadFieldNames). When either the .shp
+// or .dbf file would become larger than MaxSize (DefaultMaxSize if zero),
+// a new set of files is started.
+type Options struct {
+	Columns    []geometry.Column
+	FieldNames map[string]string
+	MaxSize    int64
+}
+
+// layerSet writes the geometries of one shape type, to Prefix_point.shp,
+// then Prefix_point_2.shp etc.
+type layerSet struct {
+	base      string
+	shapeType uint32
+	fields    []dbfField
+	maxSize   int64
+	part      int
+	shp       *shpWriter
+	dbf       *dbfWriter
+	files     []string
+}
+
+func (ls *layerSet) open() error {
+	ls.part++
+	fn := ls.base
+	if ls.part > 1 {
+		fn = fmt.Sprintf("%s_%d", ls.base, ls.part)
+	}
+	err := ioutil.WriteFile(fn+".prj", []byte(prj), 0664)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fn+".cpg", []byte("UTF-8"), 0664)
+	if err != nil {
+		return err
+	}
+	ls.shp, err = createShp(fn, ls.shapeType)
+	if err != nil {
+		return err
+	}
+	ls.dbf, err = createDbf(fn+".dbf", ls.fields)
+	if err != nil {
+		ls.shp.close()
+		ls.shp = nil
+		return err
+	}
+	ls.files = append(ls.files, fn+".shp")
+	return nil
+}
+
+func (ls *layerSet) close() error {
+	if ls.shp == nil {
+		return nil
+	}
+	err := ls.shp.close()
+	if err2 := ls.dbf.close(); err == nil {
+		err = err2
+	}
+	ls.shp, ls.dbf = nil, nil
+	return err
+}
+
+func (ls *layerSet) write(sh *shape, vals []interface{}) error {
+	content := sh.content()
+	if ls.shp.count > 0 && (ls.shp.size+recordSize(content) > ls.maxSize ||
+		ls.dbf.size+int64(ls.dbf.recordSize)+1 > ls.maxSize) {
+
+		err := ls.close()
+		if err != nil {
+			return err
+		}
+		err = ls.open()
+		if err != nil {
+			return err
+		}
+	}
+	err := ls.shp.write(sh, content)
+	if err != nil {
+		return err
+	}
+	return ls.dbf.write(vals)
+}
+
+var setIndex = map[uint32]int{shapePoint: 0, shapePolyLine: 1, shapePolygon: 2}
+
+// WriteShapefiles writes the Geometry elements of inc to shapefiles named
+// prefix_point, prefix_line and prefix_polygon, with coordinates as
+// longitude and latitude (EPSG:4326). Linestrings and MultiLinestrings are
+// written as PolyLines, and Polygons and MultiPolygons as Polygons. Each
+// record has an osm_id field, followed by the tags of each of
+// opts.Columns: text is truncated to 254 bytes. Returns the .shp files
+// written.
+func WriteShapefiles(inc <-chan elements.ExtendedBlock, prefix string, opts Options) ([]string, error) {
+	names, err := fieldNames(opts.Columns, opts.FieldNames)
+	if err != nil {
+		return nil, err
+	}
+	fields := makeFields(opts.Columns, names)
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	sets := []*layerSet{
+		{base: prefix + "_point", shapeType: shapePoint},
+		{base: prefix + "_line", shapeType: shapePolyLine},
+		{base: prefix + "_polygon", shapeType: shapePolygon},
+	}
+	defer func() {
+		for _, ls := range sets {
+			ls.close()
+		}
+	}()
+	for _, ls := range sets {
+		ls.fields, ls.maxSize = fields, maxSize
+		err = ls.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make([]int, len(sets))
+	for bl := range inc {
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if e.Type() != elements.Geometry {
+				continue
+			}
+			g, err := geometry.ExtractGeometry(e)
+			if err != nil {
+				return nil, err
+			}
+			sh, err := makeShape(g)
+			if err != nil {
+				return nil, err
+			}
+			vals := append([]interface{}{int64(g.Id())}, geometry.ColumnValues(g.Tags(), opts.Columns)...)
+			si := setIndex[sh.shapeType]
+			err = sets[si].write(sh, vals)
+			if err != nil {
+				return nil, err
+			}
+			counts[si]++
+		}
+		if (bl.Idx() % 100) == 0 {
+			log.Printf("%-6d: %d points, %d lines, %d polygons\n", bl.Idx(), counts[0], counts[1], counts[2])
+		}
+	}
+
+	files := []string{}
+	for _, ls := range sets {
+		err = ls.close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ls.files...)
+	}
+	log.Printf("%s: %d points, %d lines, %d polygons in %d files\n", prefix, counts[0], counts[1], counts[2], len(files))
+	return files, nil
+}
@@ -0,0 +1,376 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package shapefile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/geometry"
+	"github.com/jharris2268/osmquadtree/geometry/geometrytest"
+)
+
+func TestFieldNames(t *testing.T) {
+	columns := []geometry.Column{
+		{Name: "name", Type: geometry.TextColumn},
+		{Name: "addr:housenumber", Type: geometry.TextColumn},
+		{Name: "addr:housename", Type: geometry.TextColumn},
+		{Name: "highway", Type: geometry.TextColumn},
+		{Name: "NAME", Type: geometry.TextColumn},
+		{Name: "osm_id", Type: geometry.IntegerColumn},
+	}
+	names, err := fieldNames(columns, map[string]string{"highway": "hwy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"osm_id", "name", "addr_house", "addr_hou_1", "hwy", "NAME_1", "osm_id_1"}
+	if strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Errorf("field names %v, expected %v", names, exp)
+	}
+
+	for _, mapping := range []map[string]string{
+		{"name": "bad name"},
+		{"name": "much_too_long"},
+		{"name": ""},
+		{"name": "n", "highway": "N"},
+		{"name": "OSM_ID"},
+	} {
+		if _, err := fieldNames(columns, mapping); err == nil {
+			t.Errorf("mapping %v accepted", mapping)
+		}
+	}
+}
+
+func TestReadFieldNames(t *testing.T) {
+	dir := t.TempDir()
+	for i, s := range []string{
+		`{"addr:housenumber": "housenum"}`,
+		`{"FieldNames": {"addr:housenumber": "housenum"}, "ZOrder": {}}`,
+	} {
+		fn := filepath.Join(dir, "names.json")
+		if err := ioutil.WriteFile(fn, []byte(s), 0664); err != nil {
+			t.Fatal(err)
+		}
+		mapping, err := ReadFieldNames(fn)
+		if err != nil || len(mapping) != 1 || mapping["addr:housenumber"] != "housenum" {
+			t.Errorf("%d: read %v %v", i, mapping, err)
+		}
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	num := dbfField{"n", 'N', 20, 0}
+	flt := dbfField{"f", 'N', 24, 15}
+	txt := dbfField{"t", 'C', 4, 0}
+	for i, tc := range []struct {
+		f   dbfField
+		v   interface{}
+		exp string
+	}{
+		{num, int64(-12), strings.Repeat(" ", 17) + "-12"},
+		{num, nil, strings.Repeat(" ", 20)},
+		{flt, 1.5, strings.Repeat(" ", 7) + "1.500000000000000"},
+		{flt, 123456789012.25, "123456789012.250000000000"[:24]},
+		{flt, 1e30, strings.Repeat(" ", 24)},
+		{txt, "ab", "ab  "},
+		{txt, "abcd", "abcd"},
+		{txt, "abcde", "abcd"},
+		{txt, "abcé", "abc "},
+	} {
+		got := string(tc.f.value([]byte{'x'}, tc.v))
+		if got != "x"+tc.exp {
+			t.Errorf("%d: value %v gave %q, expected %q", i, tc.v, got[1:], tc.exp)
+		}
+	}
+}
+
+func TestShapeContent(t *testing.T) {
+	sh := &shape{shapePolyLine, [][][2]float64{{{0, 0}, {2, 1}}, {{-1, 3}, {1, 3}, {1, 4}}}}
+	c := sh.content()
+	if len(c) != 44+4*2+16*5 {
+		t.Fatalf("content length %d", len(c))
+	}
+	r := &shpReader{buf: c}
+	if st := r.uint32(); st != shapePolyLine {
+		t.Errorf("shape type %d", st)
+	}
+	if bx := r.box(); bx != (box{-1, 0, 2, 4}) {
+		t.Errorf("bbox %v", bx)
+	}
+	if np, nc := r.uint32(), r.uint32(); np != 2 || nc != 5 {
+		t.Errorf("%d parts, %d points", np, nc)
+	}
+	if p0, p1 := r.uint32(), r.uint32(); p0 != 0 || p1 != 2 {
+		t.Errorf("parts start at %d %d", p0, p1)
+	}
+	exp := []float64{0, 0, 2, 1, -1, 3, 1, 3, 1, 4}
+	for i, e := range exp {
+		if v := r.float64(); v != e {
+			t.Errorf("coordinate %d: %f, expected %f", i, v, e)
+		}
+	}
+
+	pt := (&shape{shapePoint, [][][2]float64{{{1.5, -2}}}}).content()
+	r = &shpReader{buf: pt}
+	if len(pt) != 20 || r.uint32() != shapePoint || r.float64() != 1.5 || r.float64() != -2 {
+		t.Errorf("point content %v", pt)
+	}
+}
+
+func TestMakeShape(t *testing.T) {
+	// outer ring given anticlockwise, hole clockwise: both are reversed
+	g, err := geometry.ExtractGeometry(geometrytest.Element(t, 1, geometry.Polygon, nil, []float64{0, 0, 0, 1, 1, 1, 1, 0, 0, 0}, []float64{0.25, 0.25, 0.5, 0.25, 0.5, 0.5, 0.25, 0.25}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := makeShape(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.shapeType != shapePolygon || len(sh.parts) != 2 {
+		t.Fatalf("shape type %d with %d parts", sh.shapeType, len(sh.parts))
+	}
+	if signedArea(sh.parts[0]) >= 0 || signedArea(sh.parts[1]) <= 0 {
+		t.Errorf("outer ring area %f, hole %f", signedArea(sh.parts[0]), signedArea(sh.parts[1]))
+	}
+	if sh.bbox() != (box{0, 0, 1, 1}) {
+		t.Errorf("bbox %v", sh.bbox())
+	}
+
+	g, err = geometry.ExtractGeometry(geometrytest.Element(t, 2, geometry.Linestring, nil, []float64{3, 4, 5, 6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err = makeShape(g)
+	if err != nil || sh.shapeType != shapePolyLine || len(sh.parts) != 1 || len(sh.parts[0]) != 2 || sh.parts[0][1] != [2]float64{5, 6} {
+		t.Errorf("linestring shape %v %v", sh, err)
+	}
+}
+
+// shpReader reads the little endian values of a shape record
+type shpReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *shpReader) uint32() uint32 {
+	v := binary.LittleEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *shpReader) float64() float64 {
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos:]))
+	r.pos += 8
+	return v
+}
+
+func (r *shpReader) box() box {
+	return box{r.float64(), r.float64(), r.float64(), r.float64()}
+}
+
+func readFile(t *testing.T, fn string) []byte {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkShp checks the headers of a .shp file and its .shx index, and
+// returns the contents of each record
+func checkShp(t *testing.T, fn string, shapeType uint32) ([][]byte, box) {
+	shp := readFile(t, fn+".shp")
+	shx := readFile(t, fn+".shx")
+	for _, d := range [][]byte{shp, shx} {
+		if len(d) < headerSize || binary.BigEndian.Uint32(d) != 9994 ||
+			int(binary.BigEndian.Uint32(d[24:]))*2 != len(d) ||
+			binary.LittleEndian.Uint32(d[28:]) != 1000 ||
+			binary.LittleEndian.Uint32(d[32:]) != shapeType {
+			t.Fatalf("%s: bad header", fn)
+		}
+	}
+	if !bytes.Equal(shp[36:headerSize], shx[36:headerSize]) {
+		t.Errorf("%s: shp and shx extents differ", fn)
+	}
+	r := &shpReader{buf: shp, pos: 36}
+	bx := r.box()
+
+	recs := [][]byte{}
+	pos := headerSize
+	for i := 0; pos < len(shp); i++ {
+		num := binary.BigEndian.Uint32(shp[pos:])
+		ln := 2 * int(binary.BigEndian.Uint32(shp[pos+4:]))
+		if num != uint32(i+1) {
+			t.Errorf("%s: record %d numbered %d", fn, i, num)
+		}
+		idx := shx[headerSize+8*i:]
+		if 2*int(binary.BigEndian.Uint32(idx)) != pos || 2*int(binary.BigEndian.Uint32(idx[4:])) != ln {
+			t.Errorf("%s: index %d doesn't match record at %d", fn, i, pos)
+		}
+		recs = append(recs, shp[pos+8:pos+8+ln])
+		pos += 8 + ln
+	}
+	if pos != len(shp) || len(shx) != headerSize+8*len(recs) {
+		t.Errorf("%s: %d records, shp length %d, shx length %d", fn, len(recs), len(shp), len(shx))
+	}
+	return recs, bx
+}
+
+// readDbf checks the header of a .dbf file against fields, and returns
+// the values of each record with the padding removed
+func readDbf(t *testing.T, fn string, fields []dbfField) [][]string {
+	data := readFile(t, fn)
+	if data[0] != 3 || data[2] < 1 || data[2] > 12 || data[3] < 1 || data[3] > 31 {
+		t.Errorf("%s: version %d, date %v", fn, data[0], data[1:4])
+	}
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	headerLen := int(binary.LittleEndian.Uint16(data[8:]))
+	recordLen := int(binary.LittleEndian.Uint16(data[10:]))
+	if headerLen != 33+32*len(fields) || data[headerLen-1] != 0x0d {
+		t.Fatalf("%s: header length %d", fn, headerLen)
+	}
+	rl := 1
+	for i, f := range fields {
+		fd := data[32+32*i:]
+		name := string(bytes.TrimRight(fd[:11], "\x00"))
+		if name != f.name || fd[11] != f.typ || int(fd[16]) != f.length || int(fd[17]) != f.decimals {
+			t.Errorf("%s: field %d is %q %c %d %d", fn, i, name, fd[11], fd[16], fd[17])
+		}
+		rl += f.length
+	}
+	if recordLen != rl || len(data) != headerLen+count*recordLen+1 || data[len(data)-1] != 0x1a {
+		t.Fatalf("%s: %d records of length %d, file length %d", fn, count, recordLen, len(data))
+	}
+	res := make([][]string, count)
+	for i := range res {
+		rec := data[headerLen+i*recordLen:]
+		if rec[0] != ' ' {
+			t.Errorf("%s: record %d deleted", fn, i)
+		}
+		p := 1
+		for _, f := range fields {
+			res[i] = append(res[i], strings.TrimSpace(string(rec[p:p+f.length])))
+			p += f.length
+		}
+	}
+	return res
+}
+
+func TestWriteShapefiles(t *testing.T) {
+	bl := elements.ByElementId{
+		geometrytest.Element(t, 1, geometry.Point, []string{"amenity", "pub", "name", "The Crown"}, []float64{5, 5}),
+		geometrytest.Element(t, 2, geometry.Linestring, []string{"highway", "primary", "!lanes", "\x08"}, []float64{-1, -1, 0, 0, 1, -2}),
+		geometrytest.Element(t, 3, geometry.Point, []string{"amenity", "cafe"}, []float64{-1, 5}),
+		geometrytest.Element(t, 4, geometry.Polygon, []string{"building", "yes"}, []float64{4, 0, 5, 0, 5, 1, 4, 0}),
+	}
+	columns := []geometry.Column{
+		{Name: "amenity", Type: geometry.TextColumn},
+		{Name: "lanes", Type: geometry.IntegerColumn},
+		{Name: "name", Type: geometry.TextColumn},
+	}
+	inc := make(chan elements.ExtendedBlock, 1)
+	inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+	close(inc)
+	prefix := filepath.Join(t.TempDir(), "test")
+	files, err := WriteShapefiles(inc, prefix, Options{Columns: columns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{prefix + "_point.shp", prefix + "_line.shp", prefix + "_polygon.shp"}
+	if strings.Join(files, ",") != strings.Join(exp, ",") {
+		t.Fatalf("wrote %v", files)
+	}
+	for _, fn := range []string{"_point", "_line", "_polygon"} {
+		if s := string(readFile(t, prefix+fn+".prj")); s != prj {
+			t.Errorf("%s.prj: %q", fn, s)
+		}
+		if s := string(readFile(t, prefix+fn+".cpg")); s != "UTF-8" {
+			t.Errorf("%s.cpg: %q", fn, s)
+		}
+	}
+
+	fields := []dbfField{{"osm_id", 'N', 20, 0}, {"amenity", 'C', 254, 0}, {"lanes", 'N', 20, 0}, {"name", 'C', 254, 0}}
+
+	recs, bx := checkShp(t, prefix+"_point", shapePoint)
+	if len(recs) != 2 || bx != (box{-1, 5, 5, 5}) {
+		t.Errorf("%d points, extent %v", len(recs), bx)
+	}
+	vals := readDbf(t, prefix+"_point.dbf", fields)
+	if len(vals) != 2 || strings.Join(vals[0], "|") != "1|pub||The Crown" || strings.Join(vals[1], "|") != "3|cafe||" {
+		t.Errorf("point values %q", vals)
+	}
+
+	recs, bx = checkShp(t, prefix+"_line", shapePolyLine)
+	if len(recs) != 1 || bx != (box{-1, -2, 1, 0}) {
+		t.Errorf("%d lines, extent %v", len(recs), bx)
+	}
+	vals = readDbf(t, prefix+"_line.dbf", fields)
+	if len(vals) != 1 || strings.Join(vals[0], "|") != "2||4|" {
+		t.Errorf("line values %q", vals)
+	}
+
+	recs, bx = checkShp(t, prefix+"_polygon", shapePolygon)
+	if len(recs) != 1 || bx != (box{4, 0, 5, 1}) {
+		t.Errorf("%d polygons, extent %v", len(recs), bx)
+	}
+	if len(recs) == 1 {
+		r := &shpReader{buf: recs[0], pos: 48}
+		ring := make([][2]float64, 4)
+		for i := range ring {
+			ring[i] = [2]float64{r.float64(), r.float64()}
+		}
+		if signedArea(ring) >= 0 {
+			t.Errorf("outer ring %v not clockwise", ring)
+		}
+	}
+}
+
+func TestWriteShapefilesMaxSize(t *testing.T) {
+	bl := elements.ByElementId{}
+	for i := 1; i <= 3; i++ {
+		bl = append(bl, geometrytest.Element(t, elements.Ref(i), geometry.Point, nil, []float64{float64(i), 0}))
+	}
+	inc := make(chan elements.ExtendedBlock, 1)
+	inc <- elements.MakeExtendedBlock(0, bl, 0, 0, 0, nil)
+	close(inc)
+
+	// each .dbf has a header of 97 bytes, and records of 275 bytes
+	columns := []geometry.Column{{Name: "name", Type: geometry.TextColumn}}
+	prefix := filepath.Join(t.TempDir(), "test")
+	files, err := WriteShapefiles(inc, prefix, Options{Columns: columns, MaxSize: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 || files[1] != prefix+"_point_2.shp" || files[2] != prefix+"_point_3.shp" {
+		t.Fatalf("wrote %v", files)
+	}
+	fields := []dbfField{{"osm_id", 'N', 20, 0}, {"name", 'C', 254, 0}}
+	for i, fn := range []string{"_point", "_point_2", "_point_3"} {
+		recs, bx := checkShp(t, prefix+fn, shapePoint)
+		if len(recs) != 1 || bx != (box{float64(i + 1), 0, float64(i + 1), 0}) {
+			t.Errorf("%s: %d points, extent %v", fn, len(recs), bx)
+		}
+		vals := readDbf(t, prefix+fn+".dbf", fields)
+		if len(vals) != 1 || vals[0][0] != string(rune('1'+i)) {
+			t.Errorf("%s: values %q", fn, vals)
+		}
+	}
+	// empty files have a zero extent
+	recs, bx := checkShp(t, prefix+"_line", shapePolyLine)
+	if len(recs) != 0 || bx != (box{}) {
+		t.Errorf("empty file has %d lines, extent %v", len(recs), bx)
+	}
+	if vals := readDbf(t, prefix+"_line.dbf", fields); len(vals) != 0 {
+		t.Errorf("empty dbf has values %q", vals)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package shapefile
+
+import (
+	"github.com/jharris2268/osmquadtree/geometry"
+
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	shapePoint    = 1
+	shapePolyLine = 3
+	shapePolygon  = 5
+
+	headerSize = 100
+)
+
+// shape is a geometry as a list of parts, with coordinates as longitude
+// and latitude
+type shape struct {
+	shapeType uint32
+	parts     [][][2]float64
+}
+
+func coordsPart(n int, coord func(int) geometry.Coord) [][2]float64 {
+	res := make([][2]float64, n)
+	for i := range res {
+		res[i][0], res[i][1] = coord(i).LonLat()
+	}
+	return res
+}
+
+// signedArea is positive for anticlockwise rings
+func signedArea(ring [][2]float64) float64 {
+	a := 0.0
+	for i := 1; i < len(ring); i++ {
+		a += ring[i-1][0]*ring[i][1] - ring[i][0]*ring[i-1][1]
+	}
+	return a / 2
+}
+
+// addPolygon adds the rings of a polygon to sh, with the outer ring
+// clockwise and any holes anticlockwise, as required by the shapefile
+// specification.
+func (sh *shape) addPolygon(nr int, nc func(int) int, coord func(int, int) geometry.Coord) {
+	for i := 0; i < nr; i++ {
+		ii := i
+		r := coordsPart(nc(i), func(j int) geometry.Coord { return coord(ii, j) })
+		if (i == 0) == (signedArea(r) > 0) {
+			for a, b := 0, len(r)-1; a < b; a, b = a+1, b-1 {
+				r[a], r[b] = r[b], r[a]
+			}
+		}
+		sh.parts = append(sh.parts, r)
+	}
+}
+
+func makeShape(g geometry.Geometry) (*shape, error) {
+	switch g.GeometryType() {
+	case geometry.Point:
+		pt := g.(geometry.PointGeometry)
+		return &shape{shapePoint, [][][2]float64{coordsPart(1, func(int) geometry.Coord { return pt.Coord() })}}, nil
+	case geometry.Linestring:
+		ln := g.(geometry.LinestringGeometry)
+		return &shape{shapePolyLine, [][][2]float64{coordsPart(ln.NumCoords(), ln.Coord)}}, nil
+	case geometry.MultiLinestring:
+		ml := g.(geometry.MultiLinestringGeometry)
+		sh := &shape{shapePolyLine, make([][][2]float64, ml.NumLines())}
+		for i := range sh.parts {
+			ii := i
+			sh.parts[i] = coordsPart(ml.NumCoords(i), func(j int) geometry.Coord { return ml.Coord(ii, j) })
+		}
+		return sh, nil
+	case geometry.Polygon:
+		py := g.(geometry.PolygonGeometry)
+		sh := &shape{shapePolygon, nil}
+		sh.addPolygon(py.NumRings(), py.NumCoords, py.Coord)
+		return sh, nil
+	case geometry.Multi:
+		mg := g.(geometry.MultiGeometry)
+		sh := &shape{shapePolygon, nil}
+		for i := 0; i < mg.NumGeometries(); i++ {
+			ii := i
+			sh.addPolygon(mg.NumRings(i),
+				func(j int) int { return mg.NumCoords(ii, j) },
+				func(j, k int) geometry.Coord { return mg.Coord(ii, j, k) })
+		}
+		return sh, nil
+	}
+	return nil, errors.New(fmt.Sprintf("can't write %s geometry", g.GeometryType()))
+}
+
+type box [4]float64
+
+func emptyBox() box {
+	return box{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+func (b *box) expand(o box) {
+	b[0], b[1] = math.Min(b[0], o[0]), math.Min(b[1], o[1])
+	b[2], b[3] = math.Max(b[2], o[2]), math.Max(b[3], o[3])
+}
+
+func (sh *shape) bbox() box {
+	b := emptyBox()
+	for _, p := range sh.parts {
+		for _, c := range p {
+			b.expand(box{c[0], c[1], c[0], c[1]})
+		}
+	}
+	return b
+}
+
+func putFloat64(buf []byte, v float64) {
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+}
+
+// content returns the record contents for sh
+func (sh *shape) content() []byte {
+	if sh.shapeType == shapePoint {
+		res := make([]byte, 20)
+		binary.LittleEndian.PutUint32(res, shapePoint)
+		putFloat64(res[4:], sh.parts[0][0][0])
+		putFloat64(res[12:], sh.parts[0][0][1])
+		return res
+	}
+	np := 0
+	for _, p := range sh.parts {
+		np += len(p)
+	}
+	res := make([]byte, 44+4*len(sh.parts)+16*np)
+	binary.LittleEndian.PutUint32(res, sh.shapeType)
+	for i, v := range sh.bbox() {
+		putFloat64(res[4+8*i:], v)
+	}
+	binary.LittleEndian.PutUint32(res[36:], uint32(len(sh.parts)))
+	binary.LittleEndian.PutUint32(res[40:], uint32(np))
+	pos, idx := 44+4*len(sh.parts), 0
+	for i, p := range sh.parts {
+		binary.LittleEndian.PutUint32(res[44+4*i:], uint32(idx))
+		for _, c := range p {
+			putFloat64(res[pos:], c[0])
+			putFloat64(res[pos+8:], c[1])
+			pos += 16
+		}
+		idx += len(p)
+	}
+	return res
+}
+
+// shpWriter writes a .shp file and the matching .shx index, with the
+// headers filled in by close
+type shpWriter struct {
+	shpFile, shxFile *os.File
+	shp, shx         *bufio.Writer
+	shapeType        uint32
+	bbox             box
+	count            int
+	size             int64
+}
+
+func (s *shpWriter) header(size int64) []byte {
+	res := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(res, 9994)
+	binary.BigEndian.PutUint32(res[24:], uint32(size/2))
+	binary.LittleEndian.PutUint32(res[28:], 1000)
+	binary.LittleEndian.PutUint32(res[32:], s.shapeType)
+	if s.count > 0 {
+		for i, v := range s.bbox {
+			putFloat64(res[36+8*i:], v)
+		}
+	}
+	return res
+}
+
+func (s *shpWriter) shxSize() int64 {
+	return headerSize + 8*int64(s.count)
+}
+
+func createShp(fn string, shapeType uint32) (*shpWriter, error) {
+	shpFile, err := os.OpenFile(fn+".shp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return nil, err
+	}
+	shxFile, err := os.OpenFile(fn+".shx", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		shpFile.Close()
+		return nil, err
+	}
+	s := &shpWriter{shpFile, shxFile, bufio.NewWriter(shpFile), bufio.NewWriter(shxFile), shapeType, emptyBox(), 0, headerSize}
+	s.shp.Write(s.header(headerSize))
+	s.shx.Write(s.header(headerSize))
+	return s, nil
+}
+
+// recordSize is the number of bytes taken by the record for content
+func recordSize(content []byte) int64 {
+	return 8 + int64(len(content))
+}
+
+func (s *shpWriter) write(sh *shape, content []byte) error {
+	if sh.shapeType != s.shapeType {
+		return errors.New(fmt.Sprintf("shape type %d written to file of type %d", sh.shapeType, s.shapeType))
+	}
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint32(rec, uint32(s.count+1))
+	binary.BigEndian.PutUint32(rec[4:], uint32(len(content)/2))
+
+	idx := make([]byte, 8)
+	binary.BigEndian.PutUint32(idx, uint32(s.size/2))
+	binary.BigEndian.PutUint32(idx[4:], uint32(len(content)/2))
+
+	s.shp.Write(rec)
+	_, err := s.shp.Write(content)
+	if err != nil {
+		return err
+	}
+	_, err = s.shx.Write(idx)
+	if err != nil {
+		return err
+	}
+	s.bbox.expand(sh.bbox())
+	s.count++
+	s.size += recordSize(content)
+	return nil
+}
+
+func finishFile(fl *os.File, w *bufio.Writer, header []byte) error {
+	err := w.Flush()
+	if err == nil {
+		_, err = fl.WriteAt(header, 0)
+	}
+	if cerr := fl.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close writes the final headers, giving the file lengths and extent
+func (s *shpWriter) close() error {
+	err := finishFile(s.shpFile, s.shp, s.header(s.size))
+	if err2 := finishFile(s.shxFile, s.shx, s.header(s.shxSize())); err == nil {
+		err = err2
+	}
+	return err
+}
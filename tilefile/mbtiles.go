@@ -0,0 +1,124 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package tilefile
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+const mbtilesSchema = `
+CREATE TABLE metadata (name text, value text);
+CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+CREATE UNIQUE INDEX tile_index on tiles (zoom_level, tile_column, tile_row);`
+
+// WriteMBTiles writes tiles to a new MBTiles (SQLite) file fn, replacing
+// any existing file, followed by the metadata md. Rows are numbered from
+// the bottom of each zoom, as given by the MBTiles specification. Returns
+// the number of tiles written. All of tiles is read, even on error.
+func WriteMBTiles(fn string, tiles <-chan TileData, md Metadata) (int, error) {
+	defer drainTiles(tiles)
+
+	err := os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(mbtilesSchema)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	st, err := tx.Prepare("INSERT INTO tiles VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer st.Close()
+
+	tr := makeTileRange()
+	nt := 0
+	for t := range tiles {
+		data := t.Data
+		if md.Gzip {
+			data, err = gzipData(data)
+			if err != nil {
+				return nt, err
+			}
+		}
+		_, err = st.Exec(t.Z, t.X, (int64(1)<<uint(t.Z))-1-t.Y, data)
+		if err != nil {
+			return nt, err
+		}
+		tr.add(t)
+		nt++
+		if (nt % 10000) == 0 {
+			log.Printf("%s: %d tiles\n", fn, nt)
+		}
+	}
+
+	mm, err := mbtilesMetadata(md, tr)
+	if err != nil {
+		return nt, err
+	}
+	for _, kv := range mm {
+		_, err = tx.Exec("INSERT INTO metadata VALUES (?, ?)", kv[0], kv[1])
+		if err != nil {
+			return nt, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nt, err
+	}
+	log.Printf("%s: %d tiles\n", fn, nt)
+	return nt, nil
+}
+
+func mbtilesMetadata(md Metadata, tr *tileRange) ([][2]string, error) {
+	res := [][2]string{{"name", md.Name}, {"format", md.Format}}
+	if md.Description != "" {
+		res = append(res, [2]string{"description", md.Description})
+	}
+	if md.Attribution != "" {
+		res = append(res, [2]string{"attribution", md.Attribution})
+	}
+	if tr.minZoom >= 0 {
+		cx, cy := tr.center()
+		res = append(res,
+			[2]string{"bounds", fmt.Sprintf("%0.7f,%0.7f,%0.7f,%0.7f",
+				quadtree.ToFloat(tr.bbox.Minx), quadtree.ToFloat(tr.bbox.Miny),
+				quadtree.ToFloat(tr.bbox.Maxx), quadtree.ToFloat(tr.bbox.Maxy))},
+			[2]string{"center", fmt.Sprintf("%0.7f,%0.7f,%d", quadtree.ToFloat(cx), quadtree.ToFloat(cy), tr.minZoom)},
+			[2]string{"minzoom", fmt.Sprintf("%d", tr.minZoom)},
+			[2]string{"maxzoom", fmt.Sprintf("%d", tr.maxZoom)})
+	}
+	if len(md.VectorLayers) > 0 {
+		js, err := json.Marshal(map[string]interface{}{"vector_layers": md.VectorLayers})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, [2]string{"json", string(js)})
+	}
+	return res, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package tilefile
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendTiles returns a channel of tiles, which is closed once all of the
+// tiles have been read
+func sendTiles(tt []TileData) (<-chan TileData, <-chan bool) {
+	tiles, done := make(chan TileData), make(chan bool)
+	go func() {
+		for _, td := range tt {
+			tiles <- td
+		}
+		close(tiles)
+		close(done)
+	}()
+	return tiles, done
+}
+
+var testTiles = []TileData{
+	{0, 0, 0, []byte("world")},
+	{2, 1, 0, []byte("north")},
+	{2, 3, 2, []byte("south")},
+	{3, 5, 7, []byte("bottom")},
+}
+
+func TestMBTilesMetadata(t *testing.T) {
+	tr := makeTileRange()
+	md := Metadata{Name: "test", Format: "pbf", Description: "a test",
+		VectorLayers: []VectorLayer{{"water", "", 1, 3, map[string]string{"natural": "String"}}}}
+
+	mm, err := mbtilesMetadata(md, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 4 || mm[0] != [2]string{"name", "test"} || mm[1] != [2]string{"format", "pbf"} || mm[2] != [2]string{"description", "a test"} {
+		t.Errorf("metadata without tiles %v", mm)
+	}
+
+	for _, td := range []TileData{{3, 4, 3, nil}, {2, 3, 1, nil}, {3, 7, 4, nil}} {
+		tr.add(td)
+	}
+	mm, err = mbtilesMetadata(md, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals := map[string]string{}
+	for _, kv := range mm {
+		vals[kv[0]] = kv[1]
+	}
+	if vals["minzoom"] != "2" || vals["maxzoom"] != "3" {
+		t.Errorf("zooms %s to %s", vals["minzoom"], vals["maxzoom"])
+	}
+	// tiles 2/3/1 and 3/7/4 meet at the equator
+	bounds := strings.Split(vals["bounds"], ",")
+	if len(bounds) != 4 || bounds[0] != "0.0000000" || bounds[1] != "-40.9798981" || bounds[2] != "180.0000000" || bounds[3] != "66.5132604" {
+		t.Errorf("bounds %s", vals["bounds"])
+	}
+	if !strings.HasSuffix(vals["center"], ",2") || !strings.HasPrefix(vals["center"], "90.0000000,") {
+		t.Errorf("center %s", vals["center"])
+	}
+
+	var js struct {
+		VectorLayers []VectorLayer `json:"vector_layers"`
+	}
+	if err := json.Unmarshal([]byte(vals["json"]), &js); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.VectorLayers) != 1 || js.VectorLayers[0].Id != "water" || js.VectorLayers[0].MaxZoom != 3 {
+		t.Errorf("json %s", vals["json"])
+	}
+}
+
+func TestWriteMBTiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, gz := range []bool{false, true} {
+		fn := filepath.Join(dir, fmt.Sprintf("test%v.mbtiles", gz))
+		tiles, _ := sendTiles(testTiles)
+		md := Metadata{Name: "test", Format: "pbf", Gzip: gz}
+		nt, err := WriteMBTiles(fn, tiles, md)
+		if err != nil || nt != len(testTiles) {
+			t.Fatalf("wrote %d tiles: %v", nt, err)
+		}
+
+		db, err := sql.Open("sqlite3", fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles ORDER BY zoom_level, tile_column")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for rows.Next() {
+			var z, x, y int64
+			var data []byte
+			if err := rows.Scan(&z, &x, &y, &data); err != nil {
+				t.Fatal(err)
+			}
+			if gz {
+				data = gunzipData(t, data)
+			}
+			got = append(got, fmt.Sprintf("%d/%d/%d:%s", z, x, y, data))
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		// rows are counted from the bottom of each zoom
+		expected := []string{"0/0/0:world", "2/1/3:north", "2/3/1:south", "3/5/0:bottom"}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("gzip %v: tiles %v, expected %v", gz, got, expected)
+		}
+
+		var minZoom, maxZoom string
+		err = db.QueryRow("SELECT a.value, b.value FROM metadata a, metadata b WHERE a.name = 'minzoom' AND b.name = 'maxzoom'").Scan(&minZoom, &maxZoom)
+		if err != nil || minZoom != "0" || maxZoom != "3" {
+			t.Errorf("gzip %v: zooms %q to %q: %v", gz, minZoom, maxZoom, err)
+		}
+	}
+}
+
+func TestWriteTilesError(t *testing.T) {
+	// fn is in a directory which doesn't exist
+	fn := filepath.Join(t.TempDir(), "missing", "test")
+	for name, write := range map[string]func(string, <-chan TileData, Metadata) (int, error){
+		"mbtiles": WriteMBTiles, "pmtiles": WritePMTiles,
+	} {
+		tiles, done := sendTiles(testTiles)
+		if _, err := write(fn, tiles, Metadata{Name: "test", Format: "pbf"}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: tiles not read after error", name)
+		}
+	}
+}
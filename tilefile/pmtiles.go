@@ -0,0 +1,278 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package tilefile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	pmtilesHeaderLen  = 127
+	pmtilesRootMaxLen = 16384 - pmtilesHeaderLen
+
+	pmtilesCompressionNone = 1
+	pmtilesCompressionGzip = 2
+)
+
+var pmtilesTileTypes = map[string]uint8{"pbf": 1, "mvt": 1, "png": 2, "jpg": 3, "jpeg": 3, "webp": 4}
+
+// pmtilesTileId returns the position of tile z, x, y along the hilbert
+// curves of each zoom in turn.
+func pmtilesTileId(z, x, y int64) uint64 {
+	acc := ((uint64(1) << uint(2*z)) - 1) / 3
+	n := uint64(1) << uint(z)
+	tx, ty := uint64(x), uint64(y)
+	d := uint64(0)
+	for s := n / 2; s > 0; s /= 2 {
+		rx, ry := uint64(0), uint64(0)
+		if (tx & s) > 0 {
+			rx = 1
+		}
+		if (ty & s) > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				tx = n - 1 - tx
+				ty = n - 1 - ty
+			}
+			tx, ty = ty, tx
+		}
+	}
+	return acc + d
+}
+
+// pmtilesEntry is a directory entry: either runLength tiles starting at
+// tileId with the same content, or a leaf directory if runLength is zero.
+type pmtilesEntry struct {
+	tileId, offset, length uint64
+	runLength              uint64
+}
+
+type pmtilesEntrySlice []pmtilesEntry
+
+func (ps pmtilesEntrySlice) Len() int           { return len(ps) }
+func (ps pmtilesEntrySlice) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+func (ps pmtilesEntrySlice) Less(i, j int) bool { return ps[i].tileId < ps[j].tileId }
+
+// packPMTilesDirectory serializes entries as column of varints, which is
+// then compressed
+func packPMTilesDirectory(ee []pmtilesEntry) ([]byte, error) {
+	res := make([]byte, 0, 10+len(ee)*20)
+	buf := make([]byte, binary.MaxVarintLen64)
+	add := func(v uint64) {
+		res = append(res, buf[:binary.PutUvarint(buf, v)]...)
+	}
+	add(uint64(len(ee)))
+	last := uint64(0)
+	for _, e := range ee {
+		add(e.tileId - last)
+		last = e.tileId
+	}
+	for _, e := range ee {
+		add(e.runLength)
+	}
+	for _, e := range ee {
+		add(e.length)
+	}
+	for i, e := range ee {
+		if i > 0 && e.offset == ee[i-1].offset+ee[i-1].length {
+			add(0)
+		} else {
+			add(e.offset + 1)
+		}
+	}
+	return gzipData(res)
+}
+
+// pmtilesDirectories returns the root directory for ee, and the leaf
+// directories if ee doesn't fit into the root directory
+func pmtilesDirectories(ee []pmtilesEntry) ([]byte, []byte, error) {
+	root, err := packPMTilesDirectory(ee)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(root) <= pmtilesRootMaxLen {
+		return root, nil, nil
+	}
+	for leafSize := 4096; ; leafSize *= 2 {
+		leaves := []byte{}
+		rootEntries := []pmtilesEntry{}
+		for i := 0; i < len(ee); i += leafSize {
+			j := i + leafSize
+			if j > len(ee) {
+				j = len(ee)
+			}
+			lf, err := packPMTilesDirectory(ee[i:j])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, pmtilesEntry{ee[i].tileId, uint64(len(leaves)), uint64(len(lf)), 0})
+			leaves = append(leaves, lf...)
+		}
+		root, err = packPMTilesDirectory(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= pmtilesRootMaxLen {
+			return root, leaves, nil
+		}
+	}
+}
+
+// WritePMTiles writes tiles to a PMTiles (version 3) archive fn. Tiles
+// with the same content are only stored once, and runs of such tiles
+// (along the hilbert curve) share a directory entry. The tile data is
+// first written to a temporary file, in the same directory as fn. Returns
+// the number of tiles written. All of tiles is read, even on error.
+func WritePMTiles(fn string, tiles <-chan TileData, md Metadata) (int, error) {
+	defer drainTiles(tiles)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "osmquadtree.pmtiles.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	contents := map[[sha256.Size]byte]pmtilesEntry{}
+	entries := pmtilesEntrySlice{}
+	tr := makeTileRange()
+	tl := uint64(0)
+	nt := 0
+	for t := range tiles {
+		data := t.Data
+		if md.Gzip {
+			data, err = gzipData(data)
+			if err != nil {
+				return nt, err
+			}
+		}
+		h := sha256.Sum256(data)
+		e, ok := contents[h]
+		if !ok {
+			_, err = tmp.Write(data)
+			if err != nil {
+				return nt, err
+			}
+			e = pmtilesEntry{0, tl, uint64(len(data)), 1}
+			contents[h] = e
+			tl += uint64(len(data))
+		}
+		e.tileId = pmtilesTileId(t.Z, t.X, t.Y)
+		entries = append(entries, e)
+		tr.add(t)
+		nt++
+		if (nt % 10000) == 0 {
+			log.Printf("%s: %d tiles, %d unique\n", fn, nt, len(contents))
+		}
+	}
+
+	sort.Sort(entries)
+	runs := make([]pmtilesEntry, 0, len(entries))
+	for _, e := range entries {
+		if len(runs) > 0 {
+			l := &runs[len(runs)-1]
+			if e.tileId == l.tileId+l.runLength-1 {
+				return nt, errors.New(fmt.Sprintf("repeated tile %d", e.tileId))
+			}
+			if e.tileId == l.tileId+l.runLength && e.offset == l.offset {
+				l.runLength++
+				continue
+			}
+		}
+		runs = append(runs, e)
+	}
+
+	root, leaves, err := pmtilesDirectories(runs)
+	if err != nil {
+		return nt, err
+	}
+
+	mm := map[string]interface{}{"name": md.Name, "format": md.Format}
+	if md.Description != "" {
+		mm["description"] = md.Description
+	}
+	if md.Attribution != "" {
+		mm["attribution"] = md.Attribution
+	}
+	if len(md.VectorLayers) > 0 {
+		mm["vector_layers"] = md.VectorLayers
+	}
+	mj, err := json.Marshal(mm)
+	if err != nil {
+		return nt, err
+	}
+	meta, err := gzipData(mj)
+	if err != nil {
+		return nt, err
+	}
+
+	header := make([]byte, pmtilesHeaderLen)
+	copy(header, "PMTiles")
+	header[7] = 3
+	pos := uint64(pmtilesHeaderLen)
+	for i, v := range []uint64{
+		pos, uint64(len(root)),
+		pos + uint64(len(root)), uint64(len(meta)),
+		pos + uint64(len(root)+len(meta)), uint64(len(leaves)),
+		pos + uint64(len(root)+len(meta)+len(leaves)), tl,
+		uint64(nt), uint64(len(runs)), uint64(len(contents)),
+	} {
+		binary.LittleEndian.PutUint64(header[8+8*i:], v)
+	}
+	header[96] = 0 // tile data is in the order tiles were written
+	header[97] = pmtilesCompressionGzip
+	header[98] = pmtilesCompressionNone
+	if md.Gzip {
+		header[98] = pmtilesCompressionGzip
+	}
+	header[99] = pmtilesTileTypes[md.Format]
+	if tr.minZoom >= 0 {
+		header[100] = uint8(tr.minZoom)
+		header[101] = uint8(tr.maxZoom)
+		cx, cy := tr.center()
+		for i, v := range []int64{tr.bbox.Minx, tr.bbox.Miny, tr.bbox.Maxx, tr.bbox.Maxy} {
+			binary.LittleEndian.PutUint32(header[102+4*i:], uint32(int32(v)))
+		}
+		header[118] = uint8(tr.minZoom)
+		binary.LittleEndian.PutUint32(header[119:], uint32(int32(cx)))
+		binary.LittleEndian.PutUint32(header[123:], uint32(int32(cy)))
+	}
+
+	outf, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return nt, err
+	}
+	defer outf.Close()
+	for _, d := range [][]byte{header, root, meta, leaves} {
+		_, err = outf.Write(d)
+		if err != nil {
+			return nt, err
+		}
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return nt, err
+	}
+	_, err = io.Copy(outf, tmp)
+	if err != nil {
+		return nt, err
+	}
+	log.Printf("%s: %d tiles, %d unique, %d entries\n", fn, nt, len(contents), len(runs))
+	return nt, nil
+}
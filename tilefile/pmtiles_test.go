@@ -0,0 +1,204 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package tilefile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func gunzipData(t *testing.T, data []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// readPMTilesDirectory decodes a directory as written by
+// packPMTilesDirectory
+func readPMTilesDirectory(t *testing.T, data []byte) []pmtilesEntry {
+	data = gunzipData(t, data)
+	pos := 0
+	next := func() uint64 {
+		v, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			t.Fatalf("bad varint at %d", pos)
+		}
+		pos += n
+		return v
+	}
+	ee := make([]pmtilesEntry, next())
+	last := uint64(0)
+	for i := range ee {
+		last += next()
+		ee[i].tileId = last
+	}
+	for i := range ee {
+		ee[i].runLength = next()
+	}
+	for i := range ee {
+		ee[i].length = next()
+	}
+	for i := range ee {
+		o := next()
+		if o == 0 && i > 0 {
+			ee[i].offset = ee[i-1].offset + ee[i-1].length
+		} else {
+			ee[i].offset = o - 1
+		}
+	}
+	if pos != len(data) {
+		t.Errorf("directory has %d bytes, read %d", len(data), pos)
+	}
+	return ee
+}
+
+func TestPMTilesTileId(t *testing.T) {
+	for _, c := range []struct {
+		z, x, y int64
+		id      uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1}, {1, 0, 1, 2}, {1, 1, 1, 3}, {1, 1, 0, 4},
+		{2, 0, 0, 5}, {2, 1, 0, 6}, {2, 1, 1, 7}, {2, 0, 1, 8}, {2, 3, 0, 20},
+		{12, 3423, 1763, 19078479},
+	} {
+		if id := pmtilesTileId(c.z, c.x, c.y); id != c.id {
+			t.Errorf("%d/%d/%d: tile id %d, expected %d", c.z, c.x, c.y, id, c.id)
+		}
+	}
+	// each tile id is used once, and each zoom follows the last
+	seen := map[uint64]bool{}
+	for z := int64(0); z < 6; z++ {
+		n := int64(1) << uint(z)
+		for x := int64(0); x < n; x++ {
+			for y := int64(0); y < n; y++ {
+				id := pmtilesTileId(z, x, y)
+				if seen[id] || id >= uint64(n*n*4-1)/3 {
+					t.Fatalf("%d/%d/%d: unexpected tile id %d", z, x, y, id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+func TestWritePMTiles(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.pmtiles")
+	tiles := make(chan TileData)
+	go func() {
+		for _, td := range []TileData{
+			{2, 3, 0, []byte("sea")},
+			{1, 0, 0, []byte("land")},
+			{2, 0, 0, []byte("sea")},
+			{2, 1, 0, []byte("sea")},
+			{2, 1, 1, []byte("sea")},
+			{2, 2, 2, []byte("coast")},
+		} {
+			tiles <- td
+		}
+		close(tiles)
+	}()
+	md := Metadata{Name: "test", Format: "pbf", VectorLayers: []VectorLayer{{"water", "", 1, 2, map[string]string{"natural": "String"}}}}
+	nt, err := WritePMTiles(fn, tiles, md)
+	if err != nil || nt != 6 {
+		t.Fatalf("wrote %d tiles: %v", nt, err)
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:7]) != "PMTiles" || data[7] != 3 {
+		t.Fatalf("bad header %q", data[:8])
+	}
+	hv := make([]uint64, 11)
+	for i := range hv {
+		hv[i] = binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+	if hv[0] != pmtilesHeaderLen || hv[8] != 6 || hv[9] != 4 || hv[10] != 3 || hv[5] != 0 {
+		t.Errorf("header values %v", hv)
+	}
+	if hv[6]+hv[7] != uint64(len(data)) || hv[7] != uint64(len("sea")+len("land")+len("coast")) {
+		t.Errorf("tile data at %d, length %d, in file of %d bytes", hv[6], hv[7], len(data))
+	}
+	if data[99] != 1 || data[100] != 1 || data[101] != 2 || data[98] != pmtilesCompressionNone {
+		t.Errorf("header tile type %d, zooms %d to %d, compression %d", data[99], data[100], data[101], data[98])
+	}
+
+	got := []string{}
+	for _, e := range readPMTilesDirectory(t, data[hv[0]:hv[0]+hv[1]]) {
+		td := data[hv[6]+e.offset : hv[6]+e.offset+e.length]
+		got = append(got, fmt.Sprintf("%d+%d:%s", e.tileId, e.runLength, td))
+	}
+	// tiles 2/0/0, 2/1/0 and 2/1/1 are consecutive along the curve, 2/3/0
+	// is not
+	expected := []string{"1+1:land", "5+3:sea", "13+1:coast", "20+1:sea"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("entries %v, expected %v", got, expected)
+	}
+
+	var meta map[string]interface{}
+	if err := json.Unmarshal(gunzipData(t, data[hv[2]:hv[2]+hv[3]]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta["name"] != "test" || meta["format"] != "pbf" || len(meta["vector_layers"].([]interface{})) != 1 {
+		t.Errorf("metadata %v", meta)
+	}
+}
+
+func TestPMTilesLeafDirectories(t *testing.T) {
+	// random entries, so the directory doesn't compress into the root
+	rnd := rand.New(rand.NewSource(1))
+	ee := make([]pmtilesEntry, 100000)
+	id, offset := uint64(0), uint64(0)
+	for i := range ee {
+		ee[i] = pmtilesEntry{id, offset, uint64(1 + rnd.Intn(5000)), uint64(1 + rnd.Intn(3))}
+		id += ee[i].runLength + uint64(rnd.Intn(10))
+		offset += ee[i].length
+		if rnd.Intn(4) == 0 {
+			offset += uint64(rnd.Intn(1000))
+		}
+	}
+	root, leaves, err := pmtilesDirectories(ee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) > pmtilesRootMaxLen || len(leaves) == 0 {
+		t.Fatalf("root directory %d bytes, leaves %d bytes", len(root), len(leaves))
+	}
+	all := []pmtilesEntry{}
+	for _, r := range readPMTilesDirectory(t, root) {
+		if r.runLength != 0 {
+			t.Fatalf("root entry %v isn't a leaf directory", r)
+		}
+		lf := readPMTilesDirectory(t, leaves[r.offset:r.offset+r.length])
+		if len(lf) == 0 || lf[0].tileId != r.tileId {
+			t.Fatalf("leaf directory for %d starts with %v", r.tileId, lf[:1])
+		}
+		all = append(all, lf...)
+	}
+	if len(all) != len(ee) {
+		t.Fatalf("read %d entries, expected %d", len(all), len(ee))
+	}
+	for i, e := range all {
+		if e != ee[i] {
+			t.Fatalf("entry %d: %v, expected %v", i, e, ee[i])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+// Package tilefile writes tiles, such as those produced by package mvt, to
+// MBTiles and PMTiles archives.
+package tilefile
+
+import (
+	"github.com/jharris2268/osmquadtree/mvt"
+	"github.com/jharris2268/osmquadtree/quadtree"
+
+	"bytes"
+	"compress/gzip"
+)
+
+// TileData is an encoded tile at zoom Z, column X and row Y (with row 0 at
+// the top, as given by quadtree.Quadtree.Tuple).
+type TileData struct {
+	Z, X, Y int64
+	Data    []byte
+}
+
+// FromQuadtreeTiles converts the tiles produced by mvt.EncodeTiles into
+// TileData.
+func FromQuadtreeTiles(inc <-chan mvt.Tile) <-chan TileData {
+	res := make(chan TileData)
+	go func() {
+		for t := range inc {
+			x, y, z := t.Quadtree.Tuple()
+			res <- TileData{z, x, y, t.Data}
+		}
+		close(res)
+	}()
+	return res
+}
+
+// VectorLayer describes a layer of vector tiles, as given in the
+// vector_layers metadata of both MBTiles and PMTiles.
+type VectorLayer struct {
+	Id          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	MinZoom     int64             `json:"minzoom"`
+	MaxZoom     int64             `json:"maxzoom"`
+	Fields      map[string]string `json:"fields"`
+}
+
+// VectorLayers returns a VectorLayer for each of layers. The fields are
+// the Tags of each layer, described as String. Layers without a MaxZoom
+// are given maxZoom.
+func VectorLayers(layers []mvt.Layer, maxZoom int64) []VectorLayer {
+	res := make([]VectorLayer, len(layers))
+	for i, l := range layers {
+		res[i] = VectorLayer{l.Name, "", l.MinZoom, l.MaxZoom, map[string]string{}}
+		if l.MaxZoom == 0 {
+			res[i].MaxZoom = maxZoom
+		}
+		for _, t := range l.Tags {
+			res[i].Fields[t] = "String"
+		}
+	}
+	return res
+}
+
+// Metadata describes a tile archive. Format is the tile format (pbf for
+// vector tiles, or png, jpg or webp), and Gzip is set to compress each
+// tile (as expected for vector tiles). The bounds and zoom range are found
+// from the tiles written.
+type Metadata struct {
+	Name         string
+	Description  string
+	Attribution  string
+	Format       string
+	Gzip         bool
+	VectorLayers []VectorLayer
+}
+
+// tileRange collects the bounds and zoom range of the tiles written
+type tileRange struct {
+	bbox             *quadtree.Bbox
+	minZoom, maxZoom int64
+}
+
+func makeTileRange() *tileRange {
+	return &tileRange{quadtree.NullBbox(), -1, -1}
+}
+
+func (tr *tileRange) add(t TileData) {
+	if tr.minZoom < 0 || t.Z < tr.minZoom {
+		tr.minZoom = t.Z
+	}
+	if t.Z > tr.maxZoom {
+		tr.maxZoom = t.Z
+	}
+	qt, err := quadtree.FromTuple(t.X, t.Y, t.Z)
+	if err == nil {
+		tr.bbox.ExpandBox(qt.Bounds(0))
+	}
+}
+
+func (tr *tileRange) center() (int64, int64) {
+	return (tr.bbox.Minx + tr.bbox.Maxx) / 2, (tr.bbox.Miny + tr.bbox.Maxy) / 2
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drainTiles reads any tiles not yet written, so that the goroutine
+// sending them (e.g. mvt.EncodeTiles) isn't left blocked if writing fails.
+func drainTiles(tiles <-chan TileData) {
+	for range tiles {
+	}
+}
@@ -327,9 +327,10 @@ func findExistingObjs(ts locationscache.TilePairSet, nfs map[int64]srcBlock,
 }
 
 type srcBlock struct {
-	ts  elements.Timestamp
-	fn  string
-	idx read.BlockIdx
+	ts     elements.Timestamp
+	fn     string
+	idx    read.BlockIdx
+	params quadtree.Params
 }
 
 func newChangeEle(e elements.Element, ct elements.ChangeType, q quadtree.Quadtree) elements.Element {
@@ -387,6 +388,7 @@ func CalcUpdateTiles(prfx string, xmlfn string, enddate elements.Timestamp, newf
 			ss.fn = prfx + specs[i].Filename
 
 			ss.idx = hb.Index
+			ss.params = hb.QuadtreeParams
 			nfs[i] = ss
 		}
 
@@ -394,6 +396,8 @@ func CalcUpdateTiles(prfx string, xmlfn string, enddate elements.Timestamp, newf
 	if _, ok := nfs[0]; !ok {
 		panic("NO nfs[0]??")
 	}
+	// quadtree values must be calculated as for the original file
+	params := nfs[0].params
 	qts := make(quadtree.QuadtreeSlice, nfs[0].idx.Len())
 	for i, _ := range qts {
 		qts[i] = nfs[0].idx.Quadtree(i)
@@ -443,7 +447,7 @@ func CalcUpdateTiles(prfx string, xmlfn string, enddate elements.Timestamp, newf
                 }
 				bx.ExpandXY(n.lon, n.lat)
 			}
-			q, _ := quadtree.Calculate(*bx, 0.05, 18)
+			q, _ := params.Calculate(*bx)
 			if q < 0 {
 				log.Printf("?? way %s has null quadtree %s\n", o.String(), *bx)
 				q = 0
@@ -504,7 +508,7 @@ func CalcUpdateTiles(prfx string, xmlfn string, enddate elements.Timestamp, newf
 			if !ok {
 				a := nodelocs[o.Id()]
 
-				n, _ = quadtree.Calculate(quadtree.Bbox{a.lon, a.lat, a.lon + 1, a.lat + 1}, 0.05, 18)
+				n, _ = params.CalculatePoint(a.lon, a.lat)
 				oq, ok := objQts[o.Id()]
 				if ok {
 					n = n.Common(oq)
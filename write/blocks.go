@@ -75,7 +75,7 @@ func WriteExtendedBlock(block elements.ExtendedBlock, ischange bool, writeExtra
 	stm := map[string]int{"!!!ZZtrt": 0} //nonsense value stringtable starts at 1
 	//n.b. an empty string might be a real value
 
-	msgs, err := packBlock(block, stm, ischange, writeExtra,qttup)
+	msgs, err := packBlock(block, stm, packOptions{ischange: ischange, writeExtra: writeExtra, qttup: qttup})
 
 	if err != nil {
 		return nil, err
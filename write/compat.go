@@ -0,0 +1,73 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package write
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+)
+
+// dropInvisible removes deleted elements, which are not part of a standard
+// (non history) file. An element is deleted if its ChangeType is Delete, or
+// if it has Info which is not visible.
+func dropInvisible(bl elements.Block) elements.Block {
+	nb := make(elements.ByElementId, 0, bl.Len())
+	for i := 0; i < bl.Len(); i++ {
+		e := bl.Element(i)
+		if e == nil || e.ChangeType() == elements.Delete {
+			continue
+		}
+		if fe, ok := e.(elements.FullElement); ok && fe.Info() != nil && !fe.Info().Visible() {
+			continue
+		}
+		nb = append(nb, e)
+	}
+	return nb
+}
+
+//WriteBlockCompatible serializes the elements in block into a Pbf format
+//primitive block using only the fields of the standard format, as expected
+//by other applications (such as osmium, osm2pgsql and imposm). Nodes are
+//written as DenseNodes. No changetypes, quadtrees, block attributes or way
+//locations are written, and deleted elements are skipped. If noMetadata is
+//true element Info is omitted. Returns WrongTypeErr if the block contains
+//Geometry elements.
+func WriteBlockCompatible(block elements.Block, noMetadata bool) ([]byte, error) {
+	stm := map[string]int{"!!!ZZtrt": 0} //string zero is always written as ""
+
+	msgs, err := packBlock(dropInvisible(block), stm, packOptions{compatible: true, noMetadata: noMetadata})
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := packStringTable(stm)
+	if err != nil {
+		return nil, err
+	}
+	msgs = append(msgs, utils.PbfMsg{1, st, 0})
+
+	msgs.Sort()
+	return msgs.Pack(), nil
+}
+
+//WriteHeaderBlockCompatible serializes a header block with only the
+//standard required features (OsmSchema-V0.6 and DenseNodes) and the
+//writing program. bbox may be nil.
+func WriteHeaderBlockCompatible(bbox *quadtree.Bbox) ([]byte, error) {
+	msgs := make(utils.PbfMsgSlice, 0, 4)
+	if bbox != nil {
+		bb, err := packBbox(bbox)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, utils.PbfMsg{1, bb, 0})
+	}
+	msgs = append(msgs, utils.PbfMsg{4, []byte("OsmSchema-V0.6"), 0})
+	msgs = append(msgs, utils.PbfMsg{4, []byte("DenseNodes"), 0})
+	msgs = append(msgs, utils.PbfMsg{16, []byte("osmquadtree"), 0})
+	return msgs.Pack(), nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package write
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/read"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testElements returns nodes, ways and relations, some without info or
+// tags, and some deleted (with or without info). Dense nodes only have info if every node does,
+// so only ways and relations are given without info.
+func testElements() elements.ByElementId {
+	info := func(v int64, vis bool) elements.Info {
+		return elements.MakeInfo(v, elements.Timestamp(1500000000+v), elements.Ref(100+v), 7, "someone", vis)
+	}
+	tags := elements.MakeTags([]string{"highway", "name"}, []string{"primary", "High Street"})
+	return elements.ByElementId{
+		elements.MakeNode(1, info(1, true), tags, 515000000, -1200000, 5, elements.Normal),
+		elements.MakeNode(2, info(2, true), nil, 515000010, -1200010, 5, elements.Normal),
+		elements.MakeNode(3, info(3, true), nil, -515000000, 1200000, 5, elements.Modify),
+		elements.MakeNode(4, info(4, false), nil, 0, 0, 5, elements.Delete),
+		elements.MakeNode(5, info(5, true), elements.MakeTags([]string{"amenity"}, []string{"pub"}), 10, 20, 5, elements.Normal),
+		elements.MakeWay(10, info(2, true), tags, []elements.Ref{1, 2, 3}, 5, elements.Normal),
+		elements.MakeWay(11, nil, nil, []elements.Ref{3, 1}, 5, elements.Normal),
+		elements.MakeWay(12, info(5, false), nil, nil, 5, elements.Delete),
+		elements.MakeWay(13, nil, nil, nil, 5, elements.Delete),
+		elements.MakeWay(14, info(3, true), nil, []elements.Ref{1, 5}, 5, elements.Delete),
+		elements.MakeRelation(20, info(1, true), elements.MakeTags([]string{"type"}, []string{"route"}),
+			[]elements.ElementType{elements.Node, elements.Way, elements.Relation}, []elements.Ref{1, 10, 21}, []string{"stop", "", "sub"}, 5, elements.Normal),
+		elements.MakeRelation(21, nil, nil, nil, nil, nil, 5, elements.Normal),
+		elements.MakeRelation(22, nil, nil, nil, nil, nil, 5, elements.Delete),
+	}
+}
+
+// describe returns the contents of e written by WriteBlockCompatible
+func describe(e elements.Element, noMetadata bool) string {
+	fe := e.(elements.FullElement)
+	res := fmt.Sprintf("%s %d", e.Type(), e.Id())
+	if info := fe.Info(); info != nil && !noMetadata {
+		res += fmt.Sprintf(" [%d %d %d %d %s]", info.Version(), info.Timestamp(), info.Changeset(), info.Uid(), info.User())
+	}
+	if tags := fe.Tags(); tags != nil {
+		for i := 0; i < tags.Len(); i++ {
+			res += fmt.Sprintf(" %s=%s", tags.Key(i), tags.Value(i))
+		}
+	}
+	switch e.Type() {
+	case elements.Node:
+		ll := e.(elements.LonLat)
+		res += fmt.Sprintf(" %d %d", ll.Lon(), ll.Lat())
+	case elements.Way:
+		refs := e.(elements.Refs)
+		for i := 0; i < refs.Len(); i++ {
+			res += fmt.Sprintf(" %d", refs.Ref(i))
+		}
+	case elements.Relation:
+		mems := e.(elements.Members)
+		for i := 0; i < mems.Len(); i++ {
+			res += fmt.Sprintf(" %s:%d:%s", mems.MemberType(i), mems.Ref(i), mems.Role(i))
+		}
+	}
+	return res
+}
+
+func fieldNumbers(msgs utils.PbfMsgSlice) []int {
+	ff := map[int]bool{}
+	for _, m := range msgs {
+		ff[int(m.Tag)] = true
+	}
+	res := []int{}
+	for f := range ff {
+		res = append(res, f)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// checkFields checks that each field number of msgs is one of allowed
+func checkFields(t *testing.T, what string, msgs utils.PbfMsgSlice, allowed ...int) {
+	ok := map[int]bool{}
+	for _, f := range allowed {
+		ok[f] = true
+	}
+	for _, f := range fieldNumbers(msgs) {
+		if !ok[f] {
+			t.Errorf("%s has non standard field %d", what, f)
+		}
+	}
+}
+
+func TestWriteBlockCompatible(t *testing.T) {
+	block := testElements()
+	for _, noMetadata := range []bool{false, true} {
+		data, err := WriteBlockCompatible(block, noMetadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the fields of the standard format are written
+		nodes, groups := 0, 0
+		msgs := utils.ReadPbfTagSlice(data)
+		checkFields(t, "primitive block", msgs, 1, 2, 17, 18, 19, 20)
+		for _, m := range msgs {
+			switch m.Tag {
+			case 1:
+				st := utils.ReadPbfTagSlice(m.Data)
+				if len(st) == 0 || len(st[0].Data) != 0 {
+					t.Errorf("string table doesn't start with an empty string")
+				}
+			case 2:
+				groups++
+				gg := utils.ReadPbfTagSlice(m.Data)
+				checkFields(t, "primitive group", gg, 2, 3, 4)
+				for _, g := range gg {
+					obj := utils.ReadPbfTagSlice(g.Data)
+					switch g.Tag {
+					case 2:
+						checkFields(t, "dense nodes", obj, 1, 5, 8, 9, 10)
+						for _, o := range obj {
+							if o.Tag == 1 {
+								ids, _ := utils.ReadPackedList(o.Data)
+								nodes += len(ids)
+							}
+							if o.Tag == 5 {
+								if noMetadata {
+									t.Errorf("dense info written without metadata")
+								}
+								checkFields(t, "dense info", utils.ReadPbfTagSlice(o.Data), 1, 2, 3, 4, 5)
+							}
+						}
+					case 3:
+						checkFields(t, "way", obj, 1, 2, 3, 4, 8)
+					case 4:
+						checkFields(t, "relation", obj, 1, 2, 3, 4, 8, 9, 10)
+					}
+					for _, o := range obj {
+						if o.Tag == 4 && noMetadata {
+							t.Errorf("info written without metadata")
+						}
+					}
+				}
+			}
+		}
+		if nodes != 4 || groups != 3 {
+			t.Errorf("%d dense nodes in %d groups", nodes, groups)
+		}
+
+		// everything other than deleted elements is read back
+		bl, err := read.ReadExtendedBlock(0, data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := []string{}
+		for _, e := range block {
+			if info := e.(elements.FullElement).Info(); e.ChangeType() != elements.Delete && (info == nil || info.Visible()) {
+				exp = append(exp, describe(e, noMetadata))
+			}
+		}
+		got := []string{}
+		for i := 0; i < bl.Len(); i++ {
+			e := bl.Element(i)
+			if e.ChangeType() != elements.Normal {
+				t.Errorf("%s read with change type %s", e, e.ChangeType())
+			}
+			got = append(got, describe(e, false))
+		}
+		if len(got) != 8 {
+			t.Errorf("noMetadata=%t: read %d elements, expected 8", noMetadata, len(got))
+		}
+		if strings.Join(got, "\n") != strings.Join(exp, "\n") {
+			t.Errorf("noMetadata=%t: read\n%s\nexpected\n%s", noMetadata, strings.Join(got, "\n"), strings.Join(exp, "\n"))
+		}
+	}
+}
+
+func TestWriteBlockCompatibleGeometry(t *testing.T) {
+	block := append(testElements(), elements.MakeGeometry(30, nil, nil, []byte{}, 5, elements.Normal))
+	if _, err := WriteBlockCompatible(block, false); err != WrongTypeErr {
+		t.Errorf("expected WrongTypeErr, got %v", err)
+	}
+}
+
+func TestWriteHeaderBlockCompatible(t *testing.T) {
+	bbox := quadtree.Bbox{Minx: -1200000, Miny: 515000000, Maxx: 1200000, Maxy: 516000000}
+	for _, bb := range []*quadtree.Bbox{nil, &bbox} {
+		data, err := WriteHeaderBlockCompatible(bb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs := utils.ReadPbfTagSlice(data)
+		checkFields(t, "header", msgs, 1, 4, 16)
+		features := []string{}
+		for _, m := range msgs {
+			if m.Tag == 4 {
+				features = append(features, string(m.Data))
+			}
+		}
+		if strings.Join(features, ",") != "OsmSchema-V0.6,DenseNodes" {
+			t.Errorf("required features %v", features)
+		}
+
+		hb, err := read.ReadHeaderBlock(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bb != nil && (hb.Bbox == nil || *hb.Bbox != bbox) {
+			t.Errorf("bbox %v", hb.Bbox)
+		}
+	}
+}
@@ -76,14 +76,24 @@ func dropNils(bl elements.Block) elements.Block {
 	return bl
 }
 
-func packBlock(bl elements.Block, stm map[string]int, ischange bool, writeExtra bool, qttup bool) (utils.PbfMsgSlice, error) {
+// packOptions select which extensions to the standard pbf format are
+// written by packBlock
+type packOptions struct {
+	ischange   bool // write changetypes
+	writeExtra bool // write element quadtrees
+	qttup      bool // write quadtrees as x, y, z tuples
+	compatible bool // only write standard fields: fail on Geometry elements
+	noMetadata bool // don't write element Info
+}
+
+func packBlock(bl elements.Block, stm map[string]int, opts packOptions) (utils.PbfMsgSlice, error) {
 	bl2 := dropNils(bl)
 
-	ss := groupElements(bl2, ischange)
+	ss := groupElements(bl2, opts.ischange)
 	ans := make(utils.PbfMsgSlice, 0, len(ss)+10)
 
 	for i, s := range ss {
-		pg, err := packGroup(bl2, stm, s.f, s.t, s.ct, writeExtra, qttup)
+		pg, err := packGroup(bl2, stm, s.f, s.t, s.ct, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -105,7 +115,7 @@ func denseTags(tags elements.Tags, stm map[string]int, kvs []uint64) []uint64 {
 	return kvs
 }
 
-func packGroup(bl elements.Block, stm map[string]int, from int, to int, ct elements.ChangeType, writeExtra bool, qttup bool) ([]byte, error) {
+func packGroup(bl elements.Block, stm map[string]int, from int, to int, ct elements.ChangeType, opts packOptions) ([]byte, error) {
 	l := 1
 	if bl.Element(from).Type() != elements.Node {
 		l = bl.Len()
@@ -117,7 +127,7 @@ func packGroup(bl elements.Block, stm map[string]int, from int, to int, ct eleme
 	mm := make(utils.PbfMsgSlice, 0, l)
 
 	if bl.Element(from).Type() == elements.Node {
-		dd, err := packDense(bl, stm, from, to, writeExtra, qttup)
+		dd, err := packDense(bl, stm, from, to, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -125,7 +135,7 @@ func packGroup(bl elements.Block, stm map[string]int, from int, to int, ct eleme
 	} else {
 		for i := from; i < to; i++ {
 			e := bl.Element(i)
-			t, pp, err := packElement(e, stm, writeExtra, qttup)
+			t, pp, err := packElement(e, stm, opts)
 			if err != nil {
 				return nil, err
 			}
@@ -145,7 +155,8 @@ func getStringI(s string, stm map[string]int) int64 {
 	return int64(a)
 }
 
-func packDense(bl elements.Block, stm map[string]int, from int, to int, writeExtra bool, qttup bool) ([]byte, error) {
+func packDense(bl elements.Block, stm map[string]int, from int, to int, opts packOptions) ([]byte, error) {
+	writeExtra, qttup := opts.writeExtra, opts.qttup
 
 	mki := func() []int64 { return make([]int64, to-from) }
 	mku := func() []uint64 { return make([]uint64, to-from) }
@@ -159,6 +170,9 @@ func packDense(bl elements.Block, stm map[string]int, from int, to int, writeExt
 		qt = nil
         
 	}
+	if opts.noMetadata {
+		i_vs, i_ts, i_cs, i_ui, i_us, i_vv = nil, nil, nil, nil, nil, nil
+	}
 
 	for i, _ := range ii {
 		e := bl.Element(from + i)
@@ -191,12 +205,14 @@ func packDense(bl elements.Block, stm map[string]int, from int, to int, writeExt
 			}
 		}
 
-		if i == 0 || i_vs != nil {
+		if i == 0 || kvs != nil {
 			fe, ok := e.(interface {
 				Tags() elements.Tags
 			})
 			if ok && fe.Tags() != nil {
 				kvs = denseTags(fe.Tags(), stm, kvs)
+			} else if ok {
+				kvs = append(kvs, 0)
 			} else {
 				kvs = nil
 			}
@@ -290,7 +306,8 @@ func packDense(bl elements.Block, stm map[string]int, from int, to int, writeExt
 	return msgs.Pack(), nil
 }
 
-func packElement(e elements.Element, stm map[string]int, writeExtra bool, qttup bool) (uint64, []byte, error) {
+func packElement(e elements.Element, stm map[string]int, opts packOptions) (uint64, []byte, error) {
+	writeExtra, qttup := opts.writeExtra, opts.qttup
 
 	msgs := make(utils.PbfMsgSlice, 0, 8)
 	msgs = append(msgs, utils.PbfMsg{1, nil, uint64(e.Id())})
@@ -298,7 +315,7 @@ func packElement(e elements.Element, stm map[string]int, writeExtra bool, qttup
 	tt, ok := e.(interface {
 		Tags() elements.Tags
 	})
-	if ok {
+	if ok && tt.Tags() != nil {
 		kk, vv, err := packTags(tt.Tags(), stm)
 		if err != nil {
 			return 0, nil, err
@@ -311,7 +328,7 @@ func packElement(e elements.Element, stm map[string]int, writeExtra bool, qttup
 	ei, ok := e.(interface {
 		Info() elements.Info
 	})
-	if ok && ei.Info() != nil {
+	if ok && ei.Info() != nil && !opts.noMetadata {
 
 		ii := make(utils.PbfMsgSlice, 0, 6)
 		ii = append(ii, utils.PbfMsg{1, nil, uint64(ei.Info().Version())}) // NOT zigzag encoded
@@ -356,7 +373,7 @@ func packElement(e elements.Element, stm map[string]int, writeExtra bool, qttup
 			msgs = append(msgs, utils.PbfMsg{8, rrp, 0})
 		}
         wp,ok := e.(elements.WayPoints)
-        if ok {
+        if ok && !opts.compatible {
             lns,lts := packLonLats(wp)
             msgs = append(msgs, utils.PbfMsg{12, lns, 0}, utils.PbfMsg{13, lts, 0})
         }
@@ -375,6 +392,9 @@ func packElement(e elements.Element, stm map[string]int, writeExtra bool, qttup
 		msgs.Sort()
 		return 4, msgs.Pack(), nil
 	case elements.Geometry:
+		if opts.compatible {
+			return 0, nil, WrongTypeErr
+		}
 		gg, ok := e.(elements.PackedGeometry)
 		if ok {
 
@@ -8,6 +8,8 @@ package write
 import (
 	"github.com/jharris2268/osmquadtree/quadtree"
 	"github.com/jharris2268/osmquadtree/utils"
+
+	"math"
 )
 
 func packBbox(bbox *quadtree.Bbox) ([]byte, error) {
@@ -34,6 +36,14 @@ func packBlockIdx(bi BlockIdxWrite, i int) ([]byte, error) {
 	return msgs.Pack(), nil
 }
 
+// packQuadtreeParams stores the buffer in millionths
+func packQuadtreeParams(params quadtree.Params) []byte {
+	msgs := make(utils.PbfMsgSlice, 2)
+	msgs[0] = utils.PbfMsg{1, nil, uint64(math.Floor(params.Buffer*1000000 + 0.5))}
+	msgs[1] = utils.PbfMsg{2, nil, uint64(params.MaxLevel)}
+	return msgs.Pack()
+}
+
 type BlockIdxWrite interface {
 	Len() int
 	BlockLen(i int) int64
@@ -42,7 +52,13 @@ type BlockIdxWrite interface {
 }
 
 func WriteHeaderBlock(bbox *quadtree.Bbox, idx BlockIdxWrite) ([]byte, error) {
-	l := 3
+	return WriteHeaderBlockParams(bbox, idx, quadtree.DefaultParams)
+}
+
+// WriteHeaderBlockParams is WriteHeaderBlock, also recording the quadtree
+// parameters used to calculate the quadtree values of the file
+func WriteHeaderBlockParams(bbox *quadtree.Bbox, idx BlockIdxWrite, params quadtree.Params) ([]byte, error) {
+	l := 4
 	if bbox != nil {
 		l += 1
 	}
@@ -63,7 +79,8 @@ func WriteHeaderBlock(bbox *quadtree.Bbox, idx BlockIdxWrite) ([]byte, error) {
 	msgs[j] = utils.PbfMsg{4, []byte("OsmSchema-V0.6"), 0}
 	msgs[j+1] = utils.PbfMsg{4, []byte("DenseNodes"), 0}
 	msgs[j+2] = utils.PbfMsg{16, []byte("osmquadtree"), 0}
-	j += 3
+	msgs[j+3] = utils.PbfMsg{23, packQuadtreeParams(params), 0}
+	j += 4
 	if idx != nil {
 		for i := 0; i < idx.Len(); i++ {
 
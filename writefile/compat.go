@@ -0,0 +1,83 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package writefile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/pbffile"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/utils"
+	"github.com/jharris2268/osmquadtree/write"
+
+	"os"
+)
+
+// MaxCompatibleBlockLen is the largest number of elements written to each
+// primitive block by WritePbfFileCompatible, as recommended for the
+// standard format.
+const MaxCompatibleBlockLen = 8000
+
+func addCompatibleBlock(bl elements.ExtendedBlock, noMetadata bool) (utils.Idxer, error) {
+	res := []byte{}
+	for f := 0; f < bl.Len(); f += MaxCompatibleBlockLen {
+		t := f + MaxCompatibleBlockLen
+		if t > bl.Len() {
+			t = bl.Len()
+		}
+		sb := make(elements.ByElementId, 0, t-f)
+		for i := f; i < t; i++ {
+			sb = append(sb, bl.Element(i))
+		}
+		a, err := write.WriteBlockCompatible(sb, noMetadata)
+		if err != nil {
+			return nil, err
+		}
+		b, err := pbffile.PreparePbfFileBlock([]byte("OSMData"), a, true)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b...)
+	}
+	return &idxData{bl.Idx(), res, quadtree.Null}, nil
+}
+
+// WritePbfFileCompatible writes inc to outfn using only the standard pbf
+// format (see write.WriteBlockCompatible), so that the file can be read by
+// other applications. The header lists only the required features
+// OsmSchema-V0.6 and DenseNodes, with bbox if not nil. Blocks with more
+// than MaxCompatibleBlockLen elements are split. If noMetadata is true
+// element Info is not written. Note that some applications (such as
+// osm2pgsql) expect the elements to be sorted by type and id: use
+// blocksort.SortElementsById to convert data sorted by quadtree.
+func WritePbfFileCompatible(inc []chan elements.ExtendedBlock, outfn string, bbox *quadtree.Bbox, noMetadata bool) error {
+	outf, err := os.Create(outfn)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	header, err := write.WriteHeaderBlockCompatible(bbox)
+	if err != nil {
+		return err
+	}
+	dd, err := pbffile.PreparePbfFileBlock([]byte("OSMHeader"), header, true)
+	if err != nil {
+		return err
+	}
+	err = pbffile.WriteFileBlock(outf, dd)
+	if err != nil {
+		return err
+	}
+
+	addBl := func(bl elements.ExtendedBlock, i int) (utils.Idxer, error) {
+		return addCompatibleBlock(bl, noMetadata)
+	}
+	_, err = WriteBlocksOrdered(inc, outf, addBl, true)
+	if err != nil {
+		return err
+	}
+	return outf.Sync()
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package writefile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/pbffile"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/read"
+	"github.com/jharris2268/osmquadtree/readfile"
+	"github.com/jharris2268/osmquadtree/utils"
+
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// splitBlocks sends each of bls to one of nc channels in turn, as given by
+// readfile.ReadExtendedBlockMulti
+func splitBlocks(bls []elements.ExtendedBlock, nc int) []chan elements.ExtendedBlock {
+	res := make([]chan elements.ExtendedBlock, nc)
+	for i := range res {
+		res[i] = make(chan elements.ExtendedBlock)
+	}
+	go func() {
+		for i, bl := range bls {
+			res[i%nc] <- bl
+		}
+		for _, c := range res {
+			close(c)
+		}
+	}()
+	return res
+}
+
+func TestWritePbfFileCompatible(t *testing.T) {
+	info := elements.MakeInfo(1, 1500000000, 10, 7, "someone", true)
+	tags := elements.MakeTags([]string{"highway"}, []string{"primary"})
+
+	// the first block is split into two
+	nodes := make(elements.ByElementId, MaxCompatibleBlockLen+10)
+	for i := range nodes {
+		nodes[i] = elements.MakeNode(elements.Ref(i+1), info, nil, int64(i), int64(-i), 5, elements.Normal)
+	}
+	bls := []elements.ExtendedBlock{
+		elements.MakeExtendedBlock(0, nodes, 5, 0, 0, nil),
+		elements.MakeExtendedBlock(1, elements.ByElementId{
+			elements.MakeWay(1, info, tags, []elements.Ref{1, 2}, 5, elements.Normal),
+			elements.MakeWay(2, elements.MakeInfo(2, 1500000000, 11, 7, "someone", false), nil, nil, 5, elements.Delete),
+		}, 5, 0, 0, nil),
+		elements.MakeExtendedBlock(2, elements.ByElementId{
+			elements.MakeRelation(1, nil, nil, []elements.ElementType{elements.Way}, []elements.Ref{1}, []string{"outer"}, 5, elements.Normal),
+		}, 5, 0, 0, nil),
+	}
+	bbox := quadtree.Bbox{Minx: -10, Miny: -MaxCompatibleBlockLen - 10, Maxx: MaxCompatibleBlockLen + 10, Maxy: 0}
+
+	dir := t.TempDir()
+	for _, noMetadata := range []bool{false, true} {
+		fn := filepath.Join(dir, "test.pbf")
+		if err := WritePbfFileCompatible(splitBlocks(bls, 3), fn, &bbox, noMetadata); err != nil {
+			t.Fatal(err)
+		}
+
+		fl, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lens := []int{}
+		for fb := range pbffile.ReadPbfFileBlocks(fl) {
+			if len(lens) == 0 {
+				if string(fb.BlockType()) != "OSMHeader" {
+					t.Fatalf("first block is %s", fb.BlockType())
+				}
+				hb, err := read.ReadHeaderBlock(fb.BlockData(), 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hb.Bbox == nil || *hb.Bbox != bbox {
+					t.Errorf("header bbox %v", hb.Bbox)
+				}
+			} else {
+				bl, err := read.ReadExtendedBlock(0, fb.BlockData(), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bl.Len() > MaxCompatibleBlockLen {
+					t.Errorf("block with %d elements", bl.Len())
+				}
+			}
+			lens = append(lens, len(fb.BlockData()))
+		}
+		fl.Close()
+		if len(lens) != 5 {
+			t.Errorf("%d file blocks", len(lens))
+		}
+
+		// all but the deleted way are read back in order
+		inc, err := readfile.ReadExtendedBlockMultiSorted(fn, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		hasInfo := false
+		for bl := range inc {
+			for i := 0; i < bl.Len(); i++ {
+				e := bl.Element(i)
+				got = append(got, e.Type().String()+string(rune('0'+e.Id()%10)))
+				if e.(elements.FullElement).Info() != nil {
+					hasInfo = true
+				}
+			}
+		}
+		if len(got) != len(nodes)+2 || got[0] != "Node1" || got[len(nodes)] != "Way1" || got[len(nodes)+1] != "Relation1" {
+			t.Errorf("read %d elements: %v", len(got), got[len(nodes)-1:])
+		}
+		if hasInfo == noMetadata {
+			t.Errorf("noMetadata=%t: read info %t", noMetadata, hasInfo)
+		}
+	}
+}
+
+func TestWritePbfFileCompatibleGeometry(t *testing.T) {
+	bls := []elements.ExtendedBlock{
+		elements.MakeExtendedBlock(0, elements.ByElementId{elements.MakeGeometry(1, nil, nil, []byte{}, 5, elements.Normal)}, 5, 0, 0, nil),
+	}
+	if err := WritePbfFileCompatible(splitBlocks(bls, 2), filepath.Join(t.TempDir(), "test.pbf"), nil, false); err == nil {
+		t.Errorf("wrote geometry")
+	}
+}
+
+// failWriter fails after n bytes have been written
+type failWriter struct {
+	n int
+}
+
+func (fw *failWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		return 0, errors.New("write failed")
+	}
+	fw.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteBlocksOrdered(t *testing.T) {
+	const nb = 17
+	bls := make([]elements.ExtendedBlock, nb)
+	for i := range bls {
+		bls[i] = elements.MakeExtendedBlock(i, elements.ByElementId{}, quadtree.Quadtree(i<<5|5), 0, 0, nil)
+	}
+	addBlock := func(bad int) func(elements.ExtendedBlock, int) (utils.Idxer, error) {
+		return func(bl elements.ExtendedBlock, i int) (utils.Idxer, error) {
+			if bl.Idx() == bad {
+				return nil, errors.New("bad block")
+			}
+			var d []byte
+			if bl.Idx() != 3 {
+				d = []byte{byte(bl.Idx())}
+			}
+			return &idxData{bl.Idx(), d, bl.Quadtree()}, nil
+		}
+	}
+
+	for _, nc := range []int{1, 2, 3, 4, 5, 20} {
+		var buf bytes.Buffer
+		items, err := WriteBlocksOrdered(splitBlocks(bls, nc), &buf, addBlock(-1), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := []byte{}
+		for i := 0; i < nb; i++ {
+			if i != 3 {
+				exp = append(exp, byte(i))
+			}
+		}
+		if !bytes.Equal(buf.Bytes(), exp) {
+			t.Errorf("%d channels: wrote %v", nc, buf.Bytes())
+		}
+		if len(items) != nb {
+			t.Fatalf("%d channels: %d items", nc, len(items))
+		}
+		for i, it := range items {
+			ln := int64(1)
+			if i == 3 {
+				ln = 0
+			}
+			if it.Idx != i || it.Quadtree != bls[i].Quadtree() || it.Len != ln {
+				t.Errorf("%d channels: item %d is %v", nc, i, it)
+			}
+		}
+
+		// every channel is read to the end after an error, so this
+		// returns rather than blocking
+		if _, err := WriteBlocksOrdered(splitBlocks(bls, nc), &buf, addBlock(5), false); err == nil {
+			t.Errorf("%d channels: addBlock error not returned", nc)
+		}
+		if _, err := WriteBlocksOrdered(splitBlocks(bls, nc), &failWriter{4}, addBlock(-1), false); err == nil {
+			t.Errorf("%d channels: write error not returned", nc)
+		}
+	}
+}
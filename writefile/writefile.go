@@ -94,7 +94,7 @@ func addOrigBlock(bl elements.ExtendedBlock, bh []byte) (utils.Idxer, error) {
 	return &idxData{bl.Idx(), b, quadtree.Null}, err
 }
 
-func finishAndHeader(outf io.Writer, tf io.ReadWriter, ii []IdxItem, isc bool) (write.BlockIdxWrite, error) {
+func finishAndHeader(outf io.Writer, tf io.ReadWriter, ii []IdxItem, isc bool, params quadtree.Params) (write.BlockIdxWrite, error) {
 
 	tfs, ok := tf.(interface {
 		Sync() error
@@ -120,7 +120,7 @@ func finishAndHeader(outf io.Writer, tf io.ReadWriter, ii []IdxItem, isc bool) (
 		ii[i].Isc = isc
 	}
 
-	header, err := write.WriteHeaderBlock(quadtree.PlanetBbox(), blockIdx(ii))
+	header, err := write.WriteHeaderBlockParams(quadtree.PlanetBbox(), blockIdx(ii), params)
 	if err != nil {
 		return nil, err
 	}
@@ -152,7 +152,28 @@ func finishAndHeader(outf io.Writer, tf io.ReadWriter, ii []IdxItem, isc bool) (
 
 }
 
+// WritePbfFile writes the blocks from inc to outfn, with an index in the
+// header block. The header records quadtree.DefaultParams: when rewriting
+// an existing file use WritePbfFileFrom, so that the output keeps the
+// params of the input.
 func WritePbfFile(inc []chan elements.ExtendedBlock, outfn string, isc bool, qttup bool) (write.BlockIdxWrite, error) {
+	return WritePbfFileParams(inc, outfn, isc, qttup, quadtree.DefaultParams)
+}
+
+// WritePbfFileFrom is WritePbfFile for blocks read from infn: the
+// quadtree.Params recorded in the header of infn are copied to outfn.
+func WritePbfFileFrom(inc []chan elements.ExtendedBlock, outfn string, isc bool, qttup bool, infn string) (write.BlockIdxWrite, error) {
+	params, err := readfile.GetQuadtreeParams(infn)
+	if err != nil {
+		return nil, err
+	}
+	return WritePbfFileParams(inc, outfn, isc, qttup, params)
+}
+
+// WritePbfFileParams is WritePbfFile, recording params (the values used to
+// calculate the quadtrees of the elements) in the header block, in place of
+// those of the input
+func WritePbfFileParams(inc []chan elements.ExtendedBlock, outfn string, isc bool, qttup bool, params quadtree.Params) (write.BlockIdxWrite, error) {
 	outf, err := os.Create(outfn)
 	if err != nil {
 		return nil, err
@@ -168,10 +189,19 @@ func WritePbfFile(inc []chan elements.ExtendedBlock, outfn string, isc bool, qtt
 		tf.Close()
 		os.Remove(tf.Name())
 	}()
-	return WritePbfIndexed(inc, outf, tf, true, isc, false, qttup)
+	return WritePbfIndexedParams(inc, outf, tf, true, isc, false, qttup, params)
 }
 
+// WritePbfIndexed is WritePbfFile, writing to outf (using tf to hold the
+// blocks until the index is complete, if indexed is true). As with
+// WritePbfFile, the header records quadtree.DefaultParams: use
+// WritePbfIndexedParams with the params of the input file (see
+// readfile.GetQuadtreeParams) when rewriting a file.
 func WritePbfIndexed(inc []chan elements.ExtendedBlock, outf io.Writer, tf io.ReadWriter, indexed bool, ischange bool, plain bool, qttup bool) (write.BlockIdxWrite, error) {
+	return WritePbfIndexedParams(inc, outf, tf, indexed, ischange, plain, qttup, quadtree.DefaultParams)
+}
+
+func WritePbfIndexedParams(inc []chan elements.ExtendedBlock, outf io.Writer, tf io.ReadWriter, indexed bool, ischange bool, plain bool, qttup bool, params quadtree.Params) (write.BlockIdxWrite, error) {
 
 	addBl := func(bl elements.ExtendedBlock, i int) (utils.Idxer, error) {
 		return addFullBlock(bl, i, ischange, qttup, []byte("OSMData"))
@@ -201,7 +231,7 @@ func WritePbfIndexed(inc []chan elements.ExtendedBlock, outf io.Writer, tf io.Re
 		return nil, err
 	}
 
-	return finishAndHeader(outf, tf, ii, ischange)
+	return finishAndHeader(outf, tf, ii, ischange, params)
 }
 
 func checkprogress(cc chan IdxItem, ll int) {
@@ -234,15 +264,26 @@ func WriteQts(inc <-chan elements.ExtendedBlock, outfn string, qttup bool) error
 	return err
 }
 
+// orderedResult is a block prepared by the addBlock function passed to
+// WriteBlocksOrdered
+type orderedResult struct {
+	t   utils.Idxer
+	err error
+}
+
+// WriteBlocksOrdered converts each block of inchans with addBlock, in
+// parallel, and writes the results to outf in the order given by reading
+// from each channel in turn. Returns the first error from addBlock or
+// writing to outf, after reading all the remaining blocks.
 func WriteBlocksOrdered(
 	inchans []chan elements.ExtendedBlock,
 	outf io.Writer,
 	addBlock func(elements.ExtendedBlock, int) (utils.Idxer, error),
 	prog bool) ([]IdxItem, error) {
 
-	vv := make([]chan utils.Idxer, len(inchans))
+	vv := make([]chan orderedResult, len(inchans))
 	for j, _ := range inchans {
-		vv[j] = make(chan utils.Idxer, 5)
+		vv[j] = make(chan orderedResult, 5)
 	}
 
 	for i, _ := range inchans {
@@ -250,11 +291,7 @@ func WriteBlocksOrdered(
 		go func(i int) {
 			for bl := range inchans[i] {
 				t, err := addBlock(bl, 0)
-				if err != nil {
-					panic(err.Error())
-				}
-
-				vv[i] <- t
+				vv[i] <- orderedResult{t, err}
 			}
 			close(vv[i])
 		}(i)
@@ -262,7 +299,9 @@ func WriteBlocksOrdered(
 
 	st := time.Now()
 	items := make([]IdxItem, 0, 450000)
-	rem := 4
+	nc := len(inchans)
+	rem := nc
+	closed := make([]bool, nc)
 	j := 0
 
 	var progc chan IdxItem
@@ -271,17 +310,26 @@ func WriteBlocksOrdered(
 		go checkprogress(progc, 1371)
 	}
 
+	var resErr error
 	for rem > 0 {
-
-		p, ok := <-vv[j%4]
+		if closed[j%nc] {
+			j++
+			continue
+		}
+		r, ok := <-vv[j%nc]
 		if !ok {
+			closed[j%nc] = true
 			rem -= 1
-		} else {
-
+		} else if r.err != nil {
+			if resErr == nil {
+				resErr = r.err
+			}
+		} else if resErr == nil {
+			p := r.t
 			d := p.(DataQuadtreer)
 			if d.Data() != nil {
 
-				pbffile.WriteFileBlock(outf, d.Data())
+				resErr = pbffile.WriteFileBlock(outf, d.Data())
 				li := IdxItem{p.Idx(), d.Quadtree(), int64(len(d.Data())), false}
 				items = append(items, li)
 				if prog {
@@ -289,7 +337,7 @@ func WriteBlocksOrdered(
 				}
 
 			} else {
-				log.Printf("\n%8.1fs: NULL p.Idx()\n", time.Since(st).Seconds(), p.Idx())
+				log.Printf("\n%8.1fs: NULL %d\n", time.Since(st).Seconds(), p.Idx())
 
 				items = append(items, IdxItem{p.Idx(), d.Quadtree(), int64(0), false})
 			}
@@ -301,5 +349,5 @@ func WriteBlocksOrdered(
 		close(progc)
 	}
 
-	return items, nil
+	return items, resErr
 }
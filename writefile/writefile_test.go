@@ -0,0 +1,65 @@
+// Copyright 2015 James Harris. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version), both of which can be found in the
+// LICENSE file.
+
+package writefile
+
+import (
+	"github.com/jharris2268/osmquadtree/elements"
+	"github.com/jharris2268/osmquadtree/quadtree"
+	"github.com/jharris2268/osmquadtree/readfile"
+
+	"path/filepath"
+	"testing"
+)
+
+// testBlocks returns a channel of n blocks, each of one node
+func testBlocks(n int) chan elements.ExtendedBlock {
+	inc := make(chan elements.ExtendedBlock)
+	go func() {
+		for i := 0; i < n; i++ {
+			bl := elements.ByElementId{elements.MakeNode(elements.Ref(i+1), nil, elements.MakeTags(nil, nil), int64(i)*1000, int64(i)*1000, quadtree.Quadtree(i<<5|5), elements.Normal)}
+			inc <- elements.MakeExtendedBlock(i, bl, quadtree.Quadtree(i<<5|5), 0, 0, nil)
+		}
+		close(inc)
+	}()
+	return inc
+}
+
+func TestWritePbfFileParams(t *testing.T) {
+	dir := t.TempDir()
+	check := func(fn string, expected quadtree.Params) {
+		params, err := readfile.GetQuadtreeParams(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params != expected {
+			t.Errorf("%s: params %s, expected %s", filepath.Base(fn), params, expected)
+		}
+	}
+
+	deffn := filepath.Join(dir, "default.pbf")
+	if _, err := WritePbfFile(readfile.SplitExtendedBlockChans(testBlocks(3), 4), deffn, false, false); err != nil {
+		t.Fatal(err)
+	}
+	check(deffn, quadtree.DefaultParams)
+
+	other := quadtree.Params{Buffer: 0.1, MaxLevel: 16}
+	infn := filepath.Join(dir, "in.pbf")
+	if _, err := WritePbfFileParams(readfile.SplitExtendedBlockChans(testBlocks(3), 4), infn, false, false, other); err != nil {
+		t.Fatal(err)
+	}
+	check(infn, other)
+
+	// rewriting keeps the params of the input
+	outfn := filepath.Join(dir, "out.pbf")
+	if _, err := WritePbfFileFrom(readfile.SplitExtendedBlockChans(testBlocks(3), 4), outfn, false, false, infn); err != nil {
+		t.Fatal(err)
+	}
+	check(outfn, other)
+
+	if _, err := WritePbfFileFrom(readfile.SplitExtendedBlockChans(testBlocks(3), 4), outfn, false, false, filepath.Join(dir, "missing.pbf")); err == nil {
+		t.Errorf("expected error for missing input file")
+	}
+}